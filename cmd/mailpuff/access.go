@@ -0,0 +1,34 @@
+package main
+
+import (
+	"log"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+
+	"mailpuff/pkg/config"
+)
+
+// allowedUser проверяет белый список TELEGRAM_ALLOWED_USERS: через него проходит всё, что отправляет
+// письма от имени аккаунта или меняет почтовый ящик. Пустой список выключает такие действия
+// для всех. Если действие запрещено, возвращает текст ответа пользователю; what — название
+// действия для этого текста, op — для лога.
+func allowedUser(cfg config.Config, op, what string, userID, chatID int64) (string, bool) {
+	if len(cfg.TelegramAllowedUsers) == 0 {
+		return what + " is disabled: list your Telegram user id in TELEGRAM_ALLOWED_USERS", false
+	}
+	if !cfg.AllowedUser(userID) {
+		log.Printf("tg %s 403 reason=not_allowed user_id=%d chat_id=%d", op, userID, chatID)
+		return "You are not allowed to manage emails from this bot", false
+	}
+	return "", true
+}
+
+// callbackAllowed проверяет белый список TELEGRAM_ALLOWED_USERS для нажатия кнопки; отказ
+// показывается во всплывающем ответе на нажатие.
+func callbackAllowed(cfg config.Config, bot *tgbotapi.BotAPI, cq *tgbotapi.CallbackQuery, op, what string) bool {
+	notice, ok := allowedUser(cfg, op, what, cq.From.ID, cq.Message.Chat.ID)
+	if !ok {
+		_ = answerCallback(bot, cq.ID, notice)
+	}
+	return ok
+}
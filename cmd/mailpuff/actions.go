@@ -0,0 +1,460 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"html"
+	"log"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+
+	"mailpuff/pkg/config"
+	imapPkg "mailpuff/pkg/imap"
+	"mailpuff/pkg/state"
+	"mailpuff/pkg/telegram"
+	"mailpuff/pkg/viewer"
+)
+
+// actionCbMap сопоставляет ключ кнопок действий и флага -> страницу viewer (id/token), как markCbMap для "Mark as read".
+// Ключ отдельный: эти кнопки остаются и после того, как письмо прочитано.
+var actionCbMap sync.Map
+
+// pageToActionKey сопоставляет pageID -> ключ кнопок действий
+var pageToActionKey sync.Map
+
+// moveMenus сопоставляет ключ кнопок действий -> папки, показанные в меню «Move to…».
+// Кнопка папки ссылается на её номер: имя может не уместиться в 64 байта callback data.
+var moveMenus sync.Map
+
+// actionsRunning — ключи кнопок, нажатие которых ещё обрабатывается: кнопки обрабатываются
+// параллельно, и повторное нажатие не должно выполнить действие над письмом второй раз.
+var actionsRunning sync.Map
+
+// maxMoveTargets ограничивает длину меню «Move to…»
+const maxMoveTargets = 30
+
+var actionLabels = map[string]string{
+	config.ActionArchive: "📦 Archive",
+	config.ActionDelete:  "🗑 Delete",
+	config.ActionForward: "↪️ Forward",
+	config.ActionMove:    "📁 Move to…",
+	config.ActionSnooze:  "⏰ Snooze",
+	config.ActionSpam:    "🚫 Spam",
+}
+
+// Служебные значения action в callback data, помимо действий аккаунта.
+const (
+	actionFlag   = "flag"
+	actionUnflag = "unflag"
+	actionBack   = "back"
+)
+
+// errAlreadyThere — письмо уже лежит в папке назначения.
+var errAlreadyThere = errors.New("message is already in the destination mailbox")
+
+// buildActionCallbackData формирует callback data кнопки действия.
+// Формат: "act:<account>:<key>:<action>"; action — имя действия, "flag", "unflag", "back",
+// "m<номер папки>", "z<вариант Snooze>", "t<номер адреса>" или "t*" (меню «Forward»).
+func buildActionCallbackData(account, key, action string) string {
+	return "act:" + account + ":" + key + ":" + action
+}
+
+// registerActionKey заводит ключ кнопок действий и флага для новой страницы.
+func registerActionKey(pageID, token string) {
+	key := genCallbackKey(6)
+	actionCbMap.Store(key, markCallbackPayload{ID: pageID, Token: token})
+	pageToActionKey.Store(pageID, key)
+}
+
+// actionKey возвращает ключ кнопок действий страницы; пусто, если письмо уже перенесено или удалено.
+func actionKey(pageID string) string {
+	v, ok := pageToActionKey.Load(pageID)
+	if !ok {
+		return ""
+	}
+	key, _ := v.(string)
+	return key
+}
+
+// actionRows возвращает ряд кнопок действий страницы; nil, если действий нет или письмо уже перенесено.
+func actionRows(acc config.Account, pageID string) [][]telegram.Button {
+	key := actionKey(pageID)
+	if key == "" || len(acc.Actions) == 0 {
+		return nil
+	}
+	var row []telegram.Button
+	for _, a := range acc.Actions {
+		row = append(row, telegram.Button{Text: actionLabels[a], Data: buildActionCallbackData(acc.Name, key, a)})
+	}
+	return [][]telegram.Button{row}
+}
+
+// dropActionKey забывает ключ кнопок действий страницы и её меню «Move to…».
+func dropActionKey(pageID string) {
+	if v, ok := pageToActionKey.Load(pageID); ok {
+		if key, _ := v.(string); key != "" {
+			actionCbMap.Delete(key)
+			moveMenus.Delete(key)
+		}
+		pageToActionKey.Delete(pageID)
+	}
+}
+
+// messageKeyboard собирает клавиатуру уведомления: "Open html", "Mark as read" (если withMark
+// и кнопка ещё актуальна), кнопку флага по состоянию ref.flagged и действия аккаунта.
+func messageKeyboard(cfg config.Config, acc config.Account, ref tgMessageRef, withMark bool) telegram.Keyboard {
+	kb := telegram.Keyboard{
+		ViewURL: buildViewerURL(cfg.ViewerBaseURL, ref.id, ref.token),
+		Flagged: ref.flagged,
+		Rows:    actionRows(acc, ref.id),
+	}
+	if key := actionKey(ref.id); key != "" {
+		op := actionFlag
+		if ref.flagged {
+			op = actionUnflag
+		}
+		kb.FlagData = buildActionCallbackData(acc.Name, key, op)
+	}
+	if withMark {
+		if v, ok := pageToCbKey.Load(ref.id); ok {
+			if key, _ := v.(string); key != "" {
+				kb.MarkData = buildMarkCallbackData(acc.Name, key)
+			}
+		}
+	}
+	return kb
+}
+
+// handleActionCallback обрабатывает нажатие кнопки действия: переносит, откладывает или пересылает
+// письмо, ставит или снимает флаг, открывает/закрывает меню выбора папки, времени или адресата.
+// Всё, кроме «« Back», меняет почтовый ящик и доступно только пользователям из TELEGRAM_ALLOWED_USERS.
+func handleActionCallback(cfg config.Config, bot *tgbotapi.BotAPI, store *viewer.Store, st *state.Store, cq *tgbotapi.CallbackQuery) {
+	chatID, msgID := cq.Message.Chat.ID, cq.Message.MessageID
+	parts := strings.SplitN(cq.Data, ":", 4)
+	if len(parts) != 4 {
+		_ = answerCallback(bot, cq.ID, "Invalid data")
+		log.Printf("tg callback invalid_data chat_id=%d msg_id=%d data=%q", chatID, msgID, cq.Data)
+		return
+	}
+	accName, key, action := parts[1], parts[2], parts[3]
+	if _, busy := actionsRunning.LoadOrStore(key, struct{}{}); busy {
+		_ = answerCallback(bot, cq.ID, "Still working on the previous tap")
+		return
+	}
+	defer actionsRunning.Delete(key)
+	payloadV, ok := actionCbMap.Load(key)
+	if !ok {
+		_ = answerCallback(bot, cq.ID, "Link expired")
+		log.Printf("tg callback action 404 reason=cbkey_not_found chat_id=%d msg_id=%d key=%q", chatID, msgID, key)
+		return
+	}
+	payload := payloadV.(markCallbackPayload)
+	page, ok, reason := store.Authorize(payload.ID, payload.Token)
+	if !ok {
+		_ = answerCallback(bot, cq.ID, "Link expired or invalid")
+		log.Printf("tg callback action 404 reason=%s chat_id=%d msg_id=%d id=%s", reason, chatID, msgID, maskID(payload.ID))
+		return
+	}
+	acc, ok := cfg.Account(accName)
+	if !ok || page.Account != accName {
+		_ = answerCallback(bot, cq.ID, "Invalid data")
+		log.Printf("tg callback action 404 reason=account_mismatch account=%s chat_id=%d msg_id=%d id=%s", accName, chatID, msgID, maskID(payload.ID))
+		return
+	}
+	if page.IMAPUID <= 0 {
+		_ = answerCallback(bot, cq.ID, "IMAP UID missing")
+		log.Printf("tg callback action 404 reason=missing_imap_uid chat_id=%d msg_id=%d id=%s", chatID, msgID, maskID(payload.ID))
+		return
+	}
+
+	var dest string
+	switch {
+	case action == config.ActionMove:
+		if !callbackAllowed(cfg, bot, cq, "action", "Email actions") {
+			return
+		}
+		targets, err := moveTargets(acc, page.Mailbox)
+		if err != nil || len(targets) == 0 {
+			_ = answerCallback(bot, cq.ID, "No folders to move to")
+			log.Printf("tg callback move_menu error account=%s mailbox=%s err=%v", accName, page.Mailbox, err)
+			return
+		}
+		moveMenus.Store(key, targets)
+		kb := telegram.Keyboard{ViewURL: buildViewerURL(cfg.ViewerBaseURL, page.ID, page.Token)}
+		for i, name := range targets {
+			kb.Rows = append(kb.Rows, []telegram.Button{{Text: name, Data: buildActionCallbackData(accName, key, "m"+strconv.Itoa(i))}})
+		}
+		kb.Rows = append(kb.Rows, []telegram.Button{{Text: "« Back", Data: buildActionCallbackData(accName, key, actionBack)}})
+		_ = answerCallback(bot, cq.ID, "")
+		if err := telegram.EditKeyboard(bot, chatID, msgID, kb); err != nil {
+			log.Printf("tg callback move_menu edit_keyboard error chat_id=%d msg_id=%d err=%v", chatID, msgID, err)
+		}
+		return
+	case action == config.ActionSnooze:
+		if !callbackAllowed(cfg, bot, cq, "action", "Email actions") {
+			return
+		}
+		kb := telegram.Keyboard{ViewURL: buildViewerURL(cfg.ViewerBaseURL, page.ID, page.Token)}
+		for _, opt := range snoozeOptions(time.Now()) {
+			kb.Rows = append(kb.Rows, []telegram.Button{{Text: opt.label, Data: buildActionCallbackData(accName, key, "z"+opt.id)}})
+		}
+		kb.Rows = append(kb.Rows, []telegram.Button{{Text: "« Back", Data: buildActionCallbackData(accName, key, actionBack)}})
+		_ = answerCallback(bot, cq.ID, "")
+		if err := telegram.EditKeyboard(bot, chatID, msgID, kb); err != nil {
+			log.Printf("tg callback snooze_menu edit_keyboard error chat_id=%d msg_id=%d err=%v", chatID, msgID, err)
+		}
+		return
+	case strings.HasPrefix(action, "z"):
+		if !callbackAllowed(cfg, bot, cq, "action", "Email actions") {
+			return
+		}
+		until, ok := snoozeUntil(action[1:], time.Now())
+		if !ok {
+			_ = answerCallback(bot, cq.ID, "Menu expired")
+			return
+		}
+		snoozeMessage(cfg, bot, st, cq, acc, page, until)
+		return
+	case action == actionBack:
+		_ = answerCallback(bot, cq.ID, "")
+		kb := messageKeyboard(cfg, acc, pageRef(page), true)
+		if err := telegram.EditKeyboard(bot, chatID, msgID, kb); err != nil {
+			log.Printf("tg callback move_menu edit_keyboard error chat_id=%d msg_id=%d err=%v", chatID, msgID, err)
+		}
+		return
+	case action == actionFlag || action == actionUnflag:
+		if !callbackAllowed(cfg, bot, cq, "action", "Email actions") {
+			return
+		}
+		flagged := action == actionFlag
+		err := onPageMessage(acc, page, func(m *imapPkg.Conn) error {
+			return imapPkg.SetFlagged(m, page.IMAPUID, flagged)
+		})
+		if err != nil {
+			_ = answerCallback(bot, cq.ID, "Failed to update flag")
+			log.Printf("tg callback %s 500 account=%s mailbox=%s uid=%d id=%s err=%v", action, accName, page.Mailbox, page.IMAPUID, maskID(page.ID), err)
+			return
+		}
+		// Запоминаем состояние до правки сообщения, чтобы наблюдатель папки не правил его повторно
+		ref := pageRef(page)
+		ref.flagged = flagged
+		refKey := mailboxUID{account: page.Account, mailbox: page.Mailbox, uid: page.IMAPUID}
+		if _, ok := uidToMsg.Load(refKey); ok {
+			uidToMsg.Store(refKey, ref)
+		}
+		if flagged {
+			_ = answerCallback(bot, cq.ID, "Flagged")
+		} else {
+			_ = answerCallback(bot, cq.ID, "Unflagged")
+		}
+		if err := editNotification(bot, cfg, acc, ref, false); err != nil {
+			log.Printf("tg callback %s edit error chat_id=%d msg_id=%d err=%v", action, chatID, msgID, err)
+		}
+		log.Printf("tg callback %s ok account=%s mailbox=%s uid=%d chat_id=%d msg_id=%d id=%s", action, accName, page.Mailbox, page.IMAPUID, chatID, msgID, maskID(page.ID))
+		return
+	case action == config.ActionForward:
+		if !callbackAllowed(cfg, bot, cq, "forward_menu", "Forwarding emails") {
+			return
+		}
+		_ = answerCallback(bot, cq.ID, "")
+		if err := telegram.EditKeyboard(bot, chatID, msgID, forwardMenu(cfg, acc, page, key)); err != nil {
+			log.Printf("tg callback forward_menu edit_keyboard error chat_id=%d msg_id=%d err=%v", chatID, msgID, err)
+		}
+		return
+	case action == actionForwardOther:
+		if !callbackAllowed(cfg, bot, cq, "forward_menu", "Forwarding emails") {
+			return
+		}
+		askForwardAddress(cfg, bot, cq, acc, page)
+		return
+	case strings.HasPrefix(action, "t"):
+		i, err := strconv.Atoi(action[1:])
+		if err != nil {
+			_ = answerCallback(bot, cq.ID, "Menu expired")
+			return
+		}
+		if !callbackAllowed(cfg, bot, cq, "forward", "Forwarding emails") {
+			return
+		}
+		forwardFromMenu(cfg, bot, cq, acc, page, i)
+		return
+	case strings.HasPrefix(action, "m"):
+		if !callbackAllowed(cfg, bot, cq, "action", "Email actions") {
+			return
+		}
+		i, err := strconv.Atoi(action[1:])
+		v, ok := moveMenus.Load(key)
+		targets, _ := v.([]string)
+		if err != nil || !ok || i < 0 || i >= len(targets) {
+			_ = answerCallback(bot, cq.ID, "Menu expired")
+			return
+		}
+		action, dest = config.ActionMove, targets[i]
+	case acc.HasAction(action):
+		if !callbackAllowed(cfg, bot, cq, "action", "Email actions") {
+			return
+		}
+	default:
+		_ = answerCallback(bot, cq.ID, "Invalid data")
+		log.Printf("tg callback invalid_data chat_id=%d msg_id=%d data=%q", chatID, msgID, cq.Data)
+		return
+	}
+
+	// Пока письмо переносится, наблюдатель папки не должен принять его исчезновение за удаление
+	refKey := mailboxUID{account: page.Account, mailbox: page.Mailbox, uid: page.IMAPUID}
+	refV, hasRef := uidToMsg.LoadAndDelete(refKey)
+	note, err := runAction(acc, page, action, dest)
+	if err != nil {
+		if hasRef {
+			uidToMsg.Store(refKey, refV)
+		}
+		_ = answerCallback(bot, cq.ID, "Action failed")
+		log.Printf("tg callback action=%s 500 account=%s mailbox=%s uid=%d id=%s err=%v", action, accName, page.Mailbox, page.IMAPUID, maskID(page.ID), err)
+		return
+	}
+	_ = answerCallback(bot, cq.ID, note)
+
+	ref, _ := refV.(tgMessageRef)
+	if err := closeNotification(bot, cfg, chatID, msgID, page, ref, note); err != nil {
+		log.Printf("tg callback action=%s edit error chat_id=%d msg_id=%d err=%v", action, chatID, msgID, err)
+	}
+	log.Printf("tg callback action=%s ok account=%s mailbox=%s uid=%d chat_id=%d msg_id=%d id=%s", action, accName, page.Mailbox, page.IMAPUID, chatID, msgID, maskID(page.ID))
+}
+
+// closeNotification завершает уведомление о письме, которое ушло из папки: дописывает строку note
+// и оставляет только ссылку на страницу — она доступна до истечения TTL, остальные кнопки неприменимы.
+func closeNotification(bot *tgbotapi.BotAPI, cfg config.Config, chatID int64, msgID int, page *viewer.Page, ref tgMessageRef, note string) error {
+	dropCallbackKey(page.ID)
+	dropActionKey(page.ID)
+	kb := telegram.Keyboard{ViewURL: buildViewerURL(cfg.ViewerBaseURL, page.ID, page.Token)}
+	if ref.text == "" {
+		return telegram.EditKeyboard(bot, chatID, msgID, kb)
+	}
+	return telegram.EditMessage(bot, chatID, msgID, ref.text+"\n\n"+html.EscapeString(note), kb)
+}
+
+// runAction выполняет действие над письмом страницы и возвращает строку о результате для сообщения.
+// dest задаётся только для ActionMove; для остальных действий папка берётся из настроек или по SPECIAL-USE.
+// Удаление из самой корзины удаляет письмо безвозвратно. Если сервер без UIDPLUS оставил
+// письмо в папке с \Deleted, действие считается выполненным, а строка о результате говорит об этом.
+func runAction(acc config.Account, page *viewer.Page, action, dest string) (string, error) {
+	var note string
+	deleting := false
+	err := onPageMessage(acc, page, func(m *imapPkg.Conn) error {
+		if dest == "" {
+			var err error
+			if dest, err = actionMailbox(m, acc, action); err != nil {
+				return err
+			}
+		}
+		if dest == page.Mailbox {
+			if action == config.ActionDelete {
+				note, deleting = "🗑 Deleted", true
+				return imapPkg.DeleteMessage(m, page.IMAPUID)
+			}
+			return errAlreadyThere
+		}
+		switch action {
+		case config.ActionArchive:
+			note = "📦 Archived to " + dest
+		case config.ActionDelete:
+			note = "🗑 Moved to " + dest
+		case config.ActionSpam:
+			note = "🚫 Marked as spam"
+		default:
+			note = "📁 Moved to " + dest
+		}
+		return imapPkg.MoveMessage(m, page.IMAPUID, dest)
+	})
+	if errors.Is(err, imapPkg.ErrNotExpunged) {
+		if deleting {
+			return "🗑 Marked as deleted: the server has no UIDPLUS, the email is removed when the folder is expunged", nil
+		}
+		return note + "; the original stays marked as deleted: the server has no UIDPLUS", nil
+	}
+	return note, err
+}
+
+// onPageMessage выполняет fn на сессии пула с выбранной папкой письма страницы.
+// UID страницы действителен только при совпадении UIDVALIDITY, иначе fn не вызывается.
+func onPageMessage(acc config.Account, page *viewer.Page, fn func(m *imapPkg.Conn) error) error {
+	mgr, ok := imapManager(acc.Name)
+	if !ok {
+		return fmt.Errorf("no imap connection for account %q", acc.Name)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), imapActionTimeout)
+	defer cancel()
+	return mgr.Do(ctx, page.Mailbox, func(m *imapPkg.Conn, status imapPkg.MailboxStatus) error {
+		if status.UIDValidity != page.UIDValidity {
+			return fmt.Errorf("%w: page=%d mailbox=%d", imapPkg.ErrUIDValidityChanged, page.UIDValidity, status.UIDValidity)
+		}
+		return fn(m)
+	})
+}
+
+// actionMailbox возвращает папку назначения действия: из настроек аккаунта, а если она не задана —
+// папку с соответствующей ролью SPECIAL-USE (для архива подходит и «Вся почта» Gmail).
+func actionMailbox(m *imapPkg.Conn, acc config.Account, action string) (string, error) {
+	var configured, option string
+	var roles []string
+	switch action {
+	case config.ActionArchive:
+		configured, option, roles = acc.ArchiveMailbox, "archive_mailbox", []string{imapPkg.SpecialArchive, imapPkg.SpecialAll}
+	case config.ActionDelete:
+		configured, option, roles = acc.TrashMailbox, "trash_mailbox", []string{imapPkg.SpecialTrash}
+	case config.ActionSpam:
+		configured, option, roles = acc.SpamMailbox, "spam_mailbox", []string{imapPkg.SpecialJunk}
+	default:
+		return "", fmt.Errorf("unknown action %q", action)
+	}
+	if configured != "" {
+		return configured, nil
+	}
+	special, err := imapPkg.SpecialUseMailboxes(m)
+	if err != nil {
+		return "", err
+	}
+	for _, role := range roles {
+		if name := special[role]; name != "" {
+			return name, nil
+		}
+	}
+	return "", fmt.Errorf("server reports no %s mailbox, set actions.%s", strings.Join(roles, "/"), option)
+}
+
+// moveTargets возвращает папки для меню «Move to…» без текущей: из настроек аккаунта или через LIST.
+func moveTargets(acc config.Account, current string) ([]string, error) {
+	names := acc.MoveMailboxes
+	if len(names) == 0 {
+		mgr, ok := imapManager(acc.Name)
+		if !ok {
+			return nil, fmt.Errorf("no imap connection for account %q", acc.Name)
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), imapActionTimeout)
+		defer cancel()
+		err := mgr.Do(ctx, "", func(m *imapPkg.Conn, _ imapPkg.MailboxStatus) error {
+			var err error
+			names, err = imapPkg.ListMailboxes(m)
+			return err
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	var out []string
+	for _, name := range names {
+		if name == current {
+			continue
+		}
+		out = append(out, name)
+		if len(out) == maxMoveTargets {
+			break
+		}
+	}
+	return out, nil
+}
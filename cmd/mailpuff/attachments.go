@@ -0,0 +1,182 @@
+package main
+
+import (
+	"fmt"
+	"html"
+	"io"
+	"log"
+	"mime"
+	"net/url"
+	"strings"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+
+	"mailpuff/pkg/config"
+	imapPkg "mailpuff/pkg/imap"
+	"mailpuff/pkg/telegram"
+	"mailpuff/pkg/viewer"
+)
+
+// maxAttachmentDownload — вложения крупнее не отдаются и через viewer: файл целиком держится в памяти
+const maxAttachmentDownload = 100 << 20
+
+// buildAttachmentsURL формирует URL страницы со списком вложений на том же хосте, что и viewer base URL.
+func buildAttachmentsURL(base, id, token string) string {
+	u, err := url.Parse(base)
+	if err != nil {
+		return base
+	}
+	u.Path = "/attachments"
+	q := u.Query()
+	q.Set("id", id)
+	q.Set("token", token)
+	u.RawQuery = q.Encode()
+	return u.String()
+}
+
+// attachmentList отбирает вложения письма, которые настройки аккаунта разрешают отправлять и скачивать.
+func attachmentList(acc config.Account, em *imapPkg.Email) []viewer.Attachment {
+	var out []viewer.Attachment
+	for _, p := range em.Attachments() {
+		if !acc.AttachmentAllowed(p.MIMEType) {
+			continue
+		}
+		name := p.Filename
+		if name == "" {
+			name = "attachment-" + p.Path
+			if exts, _ := mime.ExtensionsByType(p.MIMEType); len(exts) > 0 {
+				name += exts[0]
+			}
+		}
+		out = append(out, viewer.Attachment{Part: p.Path, Filename: name, ContentType: p.MIMEType, Size: p.DecodedSize()})
+	}
+	return out
+}
+
+// fetchAttachment открывает вложение письма страницы для /attachment. Часть ищется заново
+// в BODYSTRUCTURE: кодировку знает только сервер, а письмо могло измениться. Вложение
+// декодируется при чтении, а сессия IMAP освобождается до того, как его начнут отдавать.
+func fetchAttachment(cfg config.Config) func(p *viewer.Page, a viewer.Attachment) (io.Reader, error) {
+	return func(p *viewer.Page, a viewer.Attachment) (io.Reader, error) {
+		acc, ok := cfg.Account(p.Account)
+		if !ok {
+			return nil, fmt.Errorf("unknown account %q", p.Account)
+		}
+		if p.IMAPUID <= 0 {
+			return nil, errOriginalGone
+		}
+		if a.Size > maxAttachmentDownload {
+			return nil, fmt.Errorf("attachment is too large (%d MB)", a.Size>>20)
+		}
+		var r io.Reader
+		err := onPageMessage(acc, p, func(m *imapPkg.Conn) error {
+			part, err := findAttachmentPart(m, p.IMAPUID, a.Part)
+			if err != nil {
+				return err
+			}
+			r, err = imapPkg.OpenPart(m, p.IMAPUID, part)
+			return err
+		})
+		return r, err
+	}
+}
+
+// fetchAttachmentPart загружает и декодирует часть path письма uid.
+func fetchAttachmentPart(m *imapPkg.Conn, uid int, path string) ([]byte, error) {
+	part, err := findAttachmentPart(m, uid, path)
+	if err != nil {
+		return nil, err
+	}
+	return imapPkg.FetchPart(m, uid, part)
+}
+
+// findAttachmentPart находит часть path письма uid в его BODYSTRUCTURE.
+func findAttachmentPart(m *imapPkg.Conn, uid int, path string) (imapPkg.Part, error) {
+	headers, err := imapPkg.FetchHeaders(m, []int{uid})
+	if err != nil {
+		return imapPkg.Part{}, err
+	}
+	em := headers[uid]
+	if em == nil {
+		return imapPkg.Part{}, errOriginalGone
+	}
+	for _, p := range em.Parts {
+		if p.Path == path {
+			return p, nil
+		}
+	}
+	return imapPkg.Part{}, fmt.Errorf("part %s not found", path)
+}
+
+// sendAttachments отправляет разрешённые вложения письма ответом на уведомление msgID: файлы
+// не больше AttachmentMaxSize — документами (альбомами до 10 файлов и до 50 МБ), а для остальных —
+// сообщение с кнопкой «Download attachments», ведущей на страницу вложений в viewer.
+func sendAttachments(cfg config.Config, bot *tgbotapi.BotAPI, store *viewer.Store, acc config.Account, page *viewer.Page, em *imapPkg.Email, chatID int64, msgID int) {
+	atts := attachmentList(acc, em)
+	if len(atts) == 0 {
+		return
+	}
+	store.SetAttachments(page.ID, atts)
+	var small, large []viewer.Attachment
+	for _, a := range atts {
+		if a.Size <= acc.AttachmentMaxSize {
+			small = append(small, a)
+		} else {
+			large = append(large, a)
+		}
+	}
+
+	sent := 0
+	var album []telegram.Document
+	albumSize := 0
+	flush := func() {
+		if len(album) == 0 {
+			return
+		}
+		if err := telegram.SendDocuments(bot, chatID, msgID, album); err != nil {
+			log.Printf("tg attachments send error account=%s mailbox=%s uid=%d files=%d err=%v", acc.Name, page.Mailbox, page.IMAPUID, len(album), err)
+		} else {
+			sent += len(album)
+		}
+		album, albumSize = nil, 0
+	}
+	for _, a := range small {
+		var data []byte
+		err := onPageMessage(acc, page, func(m *imapPkg.Conn) error {
+			var err error
+			data, err = fetchAttachmentPart(m, page.IMAPUID, a.Part)
+			return err
+		})
+		if err != nil {
+			log.Printf("imap fetch_attachment error account=%s mailbox=%s uid=%d part=%s: %v", acc.Name, page.Mailbox, page.IMAPUID, a.Part, err)
+			continue
+		}
+		// Размер из BODYSTRUCTURE — оценка: точный известен только после декодирования
+		if len(data) > acc.AttachmentMaxSize {
+			large = append(large, a)
+			continue
+		}
+		if len(album) == telegram.MaxAlbumSize || albumSize+len(data) > config.TelegramMaxFileSize {
+			flush()
+		}
+		album = append(album, telegram.Document{Name: a.Filename, Data: data})
+		albumSize += len(data)
+	}
+	flush()
+
+	if len(large) > 0 {
+		var b strings.Builder
+		fmt.Fprintf(&b, "📎 Larger than %.0f MB, download from the viewer:", float64(acc.AttachmentMaxSize)/(1<<20))
+		for _, a := range large {
+			fmt.Fprintf(&b, "\n• %s (%.1f MB)", html.EscapeString(a.Filename), float64(a.Size)/(1<<20))
+			if a.Size > maxAttachmentDownload {
+				b.WriteString(" — too large, open it in your mail client")
+			}
+		}
+		link := buildAttachmentsURL(cfg.ViewerBaseURL, page.ID, page.Token)
+		if err := telegram.SendLink(bot, chatID, msgID, b.String(), "📎 Download attachments", link); err != nil {
+			log.Printf("tg attachments link error account=%s mailbox=%s uid=%d err=%v", acc.Name, page.Mailbox, page.IMAPUID, err)
+		}
+	}
+	log.Printf("tg attachments ok account=%s mailbox=%s uid=%d sent=%d large=%d skipped=%d", acc.Name, page.Mailbox, page.IMAPUID, sent, len(large), len(em.Attachments())-len(atts))
+}
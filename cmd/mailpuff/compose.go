@@ -0,0 +1,462 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"html"
+	"log"
+	"net/mail"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+
+	"mailpuff/pkg/config"
+	"mailpuff/pkg/email"
+	"mailpuff/pkg/smtp"
+	"mailpuff/pkg/state"
+	"mailpuff/pkg/telegram"
+)
+
+const (
+	// composeSessionTTL — черновик /compose без действий пользователя дольше этого забывается
+	composeSessionTTL = 30 * time.Minute
+	// maxComposeFileSize — Bot API отдаёт ботам файлы не больше 20 МБ
+	maxComposeFileSize = 20 << 20
+	// maxComposeSize — общий размер вложений: после base64 письмо укладывается в типичные 25 МБ SMTP
+	maxComposeSize = 18 << 20
+	// composePreviewText — сколько символов текста письма показывать в предпросмотре
+	composePreviewText = 3000
+	// composeQueueSize — сколько сообщений черновика может ждать обработки
+	composeQueueSize = 16
+)
+
+// Этапы диалога /compose.
+const (
+	composeTo = iota
+	composeSubject
+	composeBody
+	composeReview
+	composeSending
+)
+
+// composeSessions — черновики /compose: composeKey -> *composeSession.
+// Черновики живут в памяти: после рестарта диалог начинается заново.
+var composeSessions sync.Map
+
+// composeKey — черновик принадлежит пользователю в конкретном чате.
+type composeKey struct {
+	chatID int64
+	userID int64
+}
+
+type composeSession struct {
+	mu sync.Mutex
+	// id — ключ черновика в callback data кнопок предпросмотра
+	id        string
+	account   string
+	stage     int
+	to        []*mail.Address
+	subject   string
+	text      string
+	files     []email.Attachment
+	size      int
+	previewID int
+	// botMsgs (id сообщения -> struct{}) — сообщения бота в диалоге: ответы на них тоже относятся
+	// к черновику. botMsgs и updated читаются циклом обновлений без mu, пока черновик занят отправкой
+	botMsgs sync.Map
+	// updated — время последнего действия, UnixNano
+	updated atomic.Int64
+	// queue — сообщения пользователя по порядку: их обрабатывает одна горутина run, иначе
+	// тема, пришедшая сразу за адресами, или текст во время загрузки файла могли бы обогнать их
+	queue chan *tgbotapi.Message
+}
+
+// handleComposeMessage забирает сообщения диалога /compose: команды /compose и /cancel и сообщения
+// пользователя с открытым черновиком. false — сообщение к /compose не относится.
+func handleComposeMessage(cfg config.Config, bot *tgbotapi.BotAPI, msg *tgbotapi.Message) bool {
+	if msg.From == nil {
+		return false
+	}
+	key := composeKey{chatID: msg.Chat.ID, userID: msg.From.ID}
+	switch msg.Command() {
+	case "compose":
+		go startCompose(cfg, bot, key, msg)
+		return true
+	case "cancel":
+		s, ok := loadComposeSession(key)
+		if !ok {
+			return false
+		}
+		go cancelCompose(cfg, bot, key, s, msg.MessageID)
+		return true
+	case "":
+	default:
+		return false
+	}
+	s, ok := loadComposeSession(key)
+	if !ok {
+		return false
+	}
+	if r := msg.ReplyToMessage; r != nil {
+		// Ответ на уведомление — это ответ на письмо, а не часть черновика
+		if _, own := s.botMsgs.Load(r.MessageID); !own {
+			return false
+		}
+	}
+	// Загрузка файлов и SMTP не задерживают обработку остальных обновлений
+	select {
+	case s.queue <- msg:
+	default:
+		log.Printf("tg compose queue_full account=%s user_id=%d chat_id=%d msg_id=%d", s.account, key.userID, key.chatID, msg.MessageID)
+		go func() {
+			if err := telegram.SendReply(bot, key.chatID, msg.MessageID, "Too many messages at once, send this one again"); err != nil {
+				log.Printf("tg compose notice error chat_id=%d msg_id=%d err=%v", key.chatID, msg.MessageID, err)
+			}
+		}()
+	}
+	return true
+}
+
+// run обрабатывает сообщения черновика по одному в порядке поступления, пока черновик открыт.
+func (s *composeSession) run(cfg config.Config, bot *tgbotapi.BotAPI, key composeKey) {
+	ticker := time.NewTicker(time.Minute)
+	defer ticker.Stop()
+	for {
+		select {
+		case msg := <-s.queue:
+			s.handle(cfg, bot, key, msg)
+		case <-ticker.C:
+		}
+		// Отправленный, отменённый, заменённый или просроченный черновик больше не принимает сообщений
+		if cur, ok := loadComposeSession(key); !ok || cur != s {
+			return
+		}
+	}
+}
+
+// loadComposeSession возвращает открытый черновик; просроченный удаляется.
+func loadComposeSession(key composeKey) (*composeSession, bool) {
+	v, ok := composeSessions.Load(key)
+	if !ok {
+		return nil, false
+	}
+	s := v.(*composeSession)
+	if time.Since(time.Unix(0, s.updated.Load())) > composeSessionTTL {
+		composeSessions.CompareAndDelete(key, s)
+		return nil, false
+	}
+	return s, true
+}
+
+// startCompose проверяет белый список и аккаунт и начинает новый черновик.
+func startCompose(cfg config.Config, bot *tgbotapi.BotAPI, key composeKey, msg *tgbotapi.Message) {
+	notify := func(text string) {
+		if err := telegram.SendReply(bot, key.chatID, msg.MessageID, text); err != nil {
+			log.Printf("tg compose notice error chat_id=%d msg_id=%d err=%v", key.chatID, msg.MessageID, err)
+		}
+	}
+	if notice, ok := allowedUser(cfg, "compose", "Composing emails", key.userID, key.chatID); !ok {
+		notify(notice)
+		return
+	}
+	acc, err := composeAccount(cfg, strings.TrimSpace(msg.CommandArguments()))
+	if err != nil {
+		notify(err.Error())
+		return
+	}
+	s := &composeSession{
+		id:      genCallbackKey(6),
+		account: acc.Name,
+		stage:   composeTo,
+		queue:   make(chan *tgbotapi.Message, composeQueueSize),
+	}
+	s.updated.Store(time.Now().UnixNano())
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if old, ok := composeSessions.Swap(key, s); ok {
+		old := old.(*composeSession)
+		old.mu.Lock()
+		old.closePreview(bot, key, old.previewText(cfg)+"\n\n❌ Replaced by a new draft")
+		old.mu.Unlock()
+	}
+	s.prompt(bot, key, msg.MessageID, fmt.Sprintf("✏️ New email from %s. Who is it to?", acc.SMTPFrom), "name@example.com, other@example.com")
+	go s.run(cfg, bot, key)
+	log.Printf("tg compose start account=%s user_id=%d chat_id=%d", acc.Name, key.userID, key.chatID)
+}
+
+// composeAccount выбирает аккаунт отправителя: по имени из аргумента команды или единственный с SMTP.
+func composeAccount(cfg config.Config, name string) (config.Account, error) {
+	var names []string
+	for _, acc := range cfg.Accounts {
+		if acc.CanReply() {
+			names = append(names, acc.Name)
+		}
+	}
+	if name != "" {
+		acc, ok := cfg.Account(name)
+		if !ok || !acc.CanReply() {
+			return config.Account{}, fmt.Errorf("No account %q with SMTP configured. Available: %s", name, strings.Join(names, ", "))
+		}
+		return acc, nil
+	}
+	switch len(names) {
+	case 0:
+		return config.Account{}, errors.New("No account has SMTP configured (smtp.host)")
+	case 1:
+		acc, _ := cfg.Account(names[0])
+		return acc, nil
+	}
+	return config.Account{}, fmt.Errorf("Choose the account to send from: /compose <name>. Available: %s", strings.Join(names, ", "))
+}
+
+// cancelCompose отменяет черновик командой /cancel.
+func cancelCompose(cfg config.Config, bot *tgbotapi.BotAPI, key composeKey, s *composeSession, replyTo int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.stage == composeSending || !composeSessions.CompareAndDelete(key, s) {
+		return
+	}
+	s.closePreview(bot, key, s.previewText(cfg)+"\n\n❌ Cancelled")
+	if err := telegram.SendReply(bot, key.chatID, replyTo, "Draft discarded"); err != nil {
+		log.Printf("tg compose notice error chat_id=%d msg_id=%d err=%v", key.chatID, replyTo, err)
+	}
+	log.Printf("tg compose cancel account=%s user_id=%d chat_id=%d", s.account, key.userID, key.chatID)
+}
+
+// handle продвигает черновик по этапам: адреса, тема, текст, предпросмотр. Файлы и фото
+// прикладываются на любом этапе; новый текст на этапе предпросмотра заменяет текст письма.
+func (s *composeSession) handle(cfg config.Config, bot *tgbotapi.BotAPI, key composeKey, msg *tgbotapi.Message) {
+	s.updated.Store(time.Now().UnixNano())
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	reply := func(text string) {
+		if err := telegram.SendReply(bot, key.chatID, msg.MessageID, text); err != nil {
+			log.Printf("tg compose notice error chat_id=%d msg_id=%d err=%v", key.chatID, msg.MessageID, err)
+		}
+	}
+	if s.stage == composeSending {
+		reply("The email is being sent")
+		return
+	}
+	if msg.Document != nil || len(msg.Photo) > 0 {
+		if err := s.attach(bot, msg); err != nil {
+			reply("❌ Not attached: " + err.Error())
+			log.Printf("tg compose attach error account=%s chat_id=%d msg_id=%d err=%v", s.account, key.chatID, msg.MessageID, err)
+			return
+		}
+		if s.stage == composeReview {
+			s.preview(cfg, bot, key)
+			return
+		}
+		reply(fmt.Sprintf("📎 Attached (%d files, %s)", len(s.files), email.FormatSize(s.size)))
+		return
+	}
+	text := strings.TrimSpace(msg.Text)
+	if text == "" {
+		reply("Only text, files and photos can be used in an email")
+		return
+	}
+	switch s.stage {
+	case composeTo:
+		to, err := mail.ParseAddressList(text)
+		if err != nil {
+			s.prompt(bot, key, msg.MessageID, "Not a valid address list, try again", "name@example.com")
+			return
+		}
+		s.to = to
+		s.stage = composeSubject
+		s.prompt(bot, key, msg.MessageID, "Subject?", "Subject")
+	case composeSubject:
+		s.subject = text
+		s.stage = composeBody
+		s.prompt(bot, key, msg.MessageID, "Now send the text of the email. Files and photos sent to me before it are attached", "Text")
+	case composeBody, composeReview:
+		s.text = msg.Text
+		s.stage = composeReview
+		s.preview(cfg, bot, key)
+	}
+}
+
+// attach загружает документ или фото сообщения и добавляет его к вложениям черновика.
+func (s *composeSession) attach(bot *tgbotapi.BotAPI, msg *tgbotapi.Message) error {
+	var a email.Attachment
+	var fileID string
+	var size int
+	if d := msg.Document; d != nil {
+		fileID, size = d.FileID, d.FileSize
+		a.Filename, a.ContentType = d.FileName, d.MimeType
+	} else {
+		// Telegram присылает фото в нескольких размерах, последний — самый крупный
+		p := msg.Photo[len(msg.Photo)-1]
+		fileID, size = p.FileID, p.FileSize
+		a.Filename, a.ContentType = fmt.Sprintf("photo_%d.jpg", len(s.files)+1), "image/jpeg"
+	}
+	if a.Filename == "" {
+		a.Filename = fmt.Sprintf("file_%d", len(s.files)+1)
+	}
+	tooLarge := fmt.Errorf("attachments may not exceed %s in total and %s per file", email.FormatSize(maxComposeSize), email.FormatSize(maxComposeFileSize))
+	limit := min(maxComposeFileSize, maxComposeSize-s.size)
+	if size > limit {
+		return tooLarge
+	}
+	data, err := telegram.DownloadFile(bot, fileID, int64(limit))
+	if errors.Is(err, telegram.ErrFileTooLarge) {
+		return tooLarge
+	}
+	if err != nil {
+		return err
+	}
+	a.Data = data
+	s.files = append(s.files, a)
+	s.size += len(data)
+	return nil
+}
+
+// prompt задаёт вопрос диалога ответом на сообщение пользователя.
+func (s *composeSession) prompt(bot *tgbotapi.BotAPI, key composeKey, replyTo int, text, placeholder string) {
+	id, err := telegram.SendPrompt(bot, key.chatID, replyTo, text, placeholder)
+	if err != nil {
+		log.Printf("tg compose prompt error chat_id=%d msg_id=%d err=%v", key.chatID, replyTo, err)
+		return
+	}
+	s.botMsgs.Store(id, struct{}{})
+}
+
+// preview показывает письмо целиком с кнопками «Send» и «Cancel»; прежний предпросмотр удаляется.
+func (s *composeSession) preview(cfg config.Config, bot *tgbotapi.BotAPI, key composeKey) {
+	if s.previewID != 0 {
+		_ = telegram.DeleteMessage(bot, key.chatID, s.previewID)
+		s.previewID = 0
+	}
+	rows := [][]telegram.Button{{
+		{Text: "✅ Send", Data: "cmp:" + s.id + ":send"},
+		{Text: "❌ Cancel", Data: "cmp:" + s.id + ":cancel"},
+	}}
+	id, err := telegram.SendButtons(bot, key.chatID, s.previewText(cfg)+"\n\n<i>Send another text to replace it, or a file to attach.</i>", rows)
+	if err != nil {
+		log.Printf("tg compose preview error chat_id=%d err=%v", key.chatID, err)
+		return
+	}
+	s.previewID = id
+	s.botMsgs.Store(id, struct{}{})
+}
+
+// previewText — письмо для предпросмотра (HTML): заголовки, вложения и начало текста.
+func (s *composeSession) previewText(cfg config.Config) string {
+	var b strings.Builder
+	from := s.account
+	if acc, ok := cfg.Account(s.account); ok {
+		from = acc.SMTPFrom
+	}
+	fmt.Fprintf(&b, "📝 <b>New email</b>\nFrom: %s\nTo: %s\nSubject: %s\n", html.EscapeString(from), html.EscapeString(joinMailAddresses(s.to)), html.EscapeString(s.subject))
+	for _, f := range s.files {
+		fmt.Fprintf(&b, "📎 %s (%s)\n", html.EscapeString(f.Filename), email.FormatSize(len(f.Data)))
+	}
+	text := s.text
+	if r := []rune(text); len(r) > composePreviewText {
+		text = string(r[:composePreviewText]) + "…"
+	}
+	b.WriteString("\n" + html.EscapeString(text))
+	return b.String()
+}
+
+// closePreview убирает кнопки предпросмотра, дописывая итог черновика.
+func (s *composeSession) closePreview(bot *tgbotapi.BotAPI, key composeKey, status string) {
+	if s.previewID == 0 {
+		return
+	}
+	if err := telegram.EditText(bot, key.chatID, s.previewID, status); err != nil {
+		log.Printf("tg compose edit_preview error chat_id=%d msg_id=%d err=%v", key.chatID, s.previewID, err)
+	}
+}
+
+// handleComposeCallback обрабатывает кнопки предпросмотра: "cmp:<id>:send" и "cmp:<id>:cancel".
+func handleComposeCallback(cfg config.Config, bot *tgbotapi.BotAPI, cq *tgbotapi.CallbackQuery) {
+	parts := strings.Split(cq.Data, ":")
+	if len(parts) != 3 || cq.Message == nil {
+		_ = answerCallback(bot, cq.ID, "Invalid data")
+		return
+	}
+	key := composeKey{chatID: cq.Message.Chat.ID, userID: cq.From.ID}
+	s, ok := loadComposeSession(key)
+	if !ok || s.id != parts[1] {
+		// Чужой черновик или устаревший предпросмотр
+		_ = answerCallback(bot, cq.ID, "Draft expired")
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.stage != composeReview {
+		_ = answerCallback(bot, cq.ID, "")
+		return
+	}
+	switch parts[2] {
+	case "cancel":
+		composeSessions.CompareAndDelete(key, s)
+		_ = answerCallback(bot, cq.ID, "Draft discarded")
+		s.closePreview(bot, key, s.previewText(cfg)+"\n\n❌ Cancelled")
+		log.Printf("tg compose cancel account=%s user_id=%d chat_id=%d", s.account, key.userID, key.chatID)
+	case "send":
+		_ = answerCallback(bot, cq.ID, "Sending…")
+		s.send(cfg, bot, key)
+	default:
+		_ = answerCallback(bot, cq.ID, "Invalid data")
+	}
+}
+
+// send отправляет черновик через SMTP аккаунта и кладёт копию в отправленные.
+// При ошибке черновик остаётся: отправку можно повторить.
+func (s *composeSession) send(cfg config.Config, bot *tgbotapi.BotAPI, key composeKey) {
+	s.stage = composeSending
+	acc, ok := cfg.Account(s.account)
+	var out email.Outgoing
+	err := fmt.Errorf("account %q is gone", s.account)
+	if ok {
+		out, err = sendComposed(acc, s)
+	}
+	if err != nil {
+		s.stage = composeReview
+		if err := telegram.SendReply(bot, key.chatID, s.previewID, "❌ Not sent: "+err.Error()); err != nil {
+			log.Printf("tg compose notice error chat_id=%d msg_id=%d err=%v", key.chatID, s.previewID, err)
+		}
+		log.Printf("tg compose 500 account=%s user_id=%d chat_id=%d err=%v", s.account, key.userID, key.chatID, err)
+		return
+	}
+	composeSessions.CompareAndDelete(key, s)
+	s.closePreview(bot, key, s.previewText(cfg)+"\n\n✅ Sent")
+	log.Printf("tg compose ok account=%s to=%s attachments=%d user_id=%d chat_id=%d", acc.Name, strings.Join(out.To, ","), len(s.files), key.userID, key.chatID)
+	go saveSent(acc, state.Key{}, out, "", nil)
+}
+
+// sendComposed собирает письмо из черновика и отправляет его через SMTP аккаунта.
+func sendComposed(acc config.Account, s *composeSession) (email.Outgoing, error) {
+	from, err := mail.ParseAddress(acc.SMTPFrom)
+	if err != nil {
+		return email.Outgoing{}, err
+	}
+	out, err := email.BuildMessage(email.ComposeOptions{
+		From:        from,
+		To:          s.to,
+		Subject:     s.subject,
+		Text:        s.text,
+		Attachments: s.files,
+	})
+	if err != nil {
+		return email.Outgoing{}, err
+	}
+	if err := smtp.Send(accountSMTPConfig(acc), from.Address, out.To, out.Raw); err != nil {
+		return email.Outgoing{}, err
+	}
+	return out, nil
+}
+
+func joinMailAddresses(list []*mail.Address) string {
+	s := make([]string, len(list))
+	for i, a := range list {
+		s[i] = a.String()
+	}
+	return strings.Join(s, ", ")
+}
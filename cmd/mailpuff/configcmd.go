@@ -0,0 +1,46 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+
+	"mailpuff/pkg/config"
+)
+
+// runConfigCommand обрабатывает `mailpuff config validate [-config path]`: загружает
+// конфигурацию так же, как при запуске, и печатает все найденные ошибки.
+// Возвращает код завершения процесса.
+func runConfigCommand(args []string) int {
+	if len(args) == 0 || args[0] != "validate" {
+		fmt.Fprintln(os.Stderr, "usage: mailpuff config validate [-config path]")
+		return 2
+	}
+	fs := flag.NewFlagSet("config validate", flag.ContinueOnError)
+	path := fs.String("config", os.Getenv(config.EnvConfigPath), "path to YAML/TOML config file (env "+config.EnvConfigPath+")")
+	if err := fs.Parse(args[1:]); err != nil {
+		return 2
+	}
+	cfg, err := config.Load(*path)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	source := "environment"
+	if *path != "" {
+		source = *path + " + environment"
+	}
+	fmt.Printf("config ok: source=%s accounts=%d\n", source, len(cfg.Accounts))
+	for _, acc := range cfg.Accounts {
+		names := make([]string, 0, len(acc.Mailboxes))
+		for _, mb := range acc.Mailboxes {
+			names = append(names, mb.Name)
+		}
+		fmt.Printf("  account=%s host=%s:%d security=%s user=%s mailboxes=%s chat_id=%d\n", acc.Name, acc.IMAPHost, acc.IMAPPort, acc.IMAPSecurity, acc.IMAPUsername, strings.Join(names, ","), acc.TelegramChatID)
+		if acc.CanReply() {
+			fmt.Printf("    smtp=%s:%d security=%s from=%q\n", acc.SMTPHost, acc.SMTPPort, acc.SMTPSecurity, acc.SMTPFrom)
+		}
+	}
+	return 0
+}
@@ -0,0 +1,200 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/mail"
+	"strconv"
+	"strings"
+	"sync"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+
+	"mailpuff/pkg/config"
+	"mailpuff/pkg/email"
+	imapPkg "mailpuff/pkg/imap"
+	"mailpuff/pkg/smtp"
+	"mailpuff/pkg/state"
+	"mailpuff/pkg/telegram"
+	"mailpuff/pkg/viewer"
+)
+
+// maxForwardSize — письма крупнее не пересылаются: типичный предел размера письма у SMTP-серверов
+const maxForwardSize = 25 << 20
+
+// actionForwardOther — кнопка «Other address…» меню «Forward»; адреса книги — "t<номер>".
+const actionForwardOther = "t*"
+
+// forwardPrompts сопоставляет вопрос «кому переслать» (чат и сообщение) -> письмо страницы.
+// Вопросы живут в памяти: после рестарта ответ на старый вопрос игнорируется.
+var forwardPrompts sync.Map
+
+type promptKey struct {
+	chatID int64
+	msgID  int
+}
+
+type forwardPrompt struct {
+	account string
+	pageID  string
+	token   string
+	// userID — кто нажал кнопку: в группе адрес принимается только от него
+	userID int64
+}
+
+// forwardMenu собирает меню «Forward»: адреса из адресной книги аккаунта и ввод другого адреса.
+func forwardMenu(cfg config.Config, acc config.Account, page *viewer.Page, key string) telegram.Keyboard {
+	kb := telegram.Keyboard{ViewURL: buildViewerURL(cfg.ViewerBaseURL, page.ID, page.Token)}
+	for i, s := range acc.ForwardAddresses {
+		label := s
+		if a, err := mail.ParseAddress(s); err == nil && a.Name != "" {
+			label = a.Name
+		}
+		kb.Rows = append(kb.Rows, []telegram.Button{{Text: label, Data: buildActionCallbackData(acc.Name, key, "t"+strconv.Itoa(i))}})
+	}
+	kb.Rows = append(kb.Rows,
+		[]telegram.Button{{Text: "✏️ Other address…", Data: buildActionCallbackData(acc.Name, key, actionForwardOther)}},
+		[]telegram.Button{{Text: "« Back", Data: buildActionCallbackData(acc.Name, key, actionBack)}},
+	)
+	return kb
+}
+
+// askForwardAddress просит ответить на вопрос адресом получателя и возвращает обычные кнопки уведомления.
+func askForwardAddress(cfg config.Config, bot *tgbotapi.BotAPI, cq *tgbotapi.CallbackQuery, acc config.Account, page *viewer.Page) {
+	chatID, msgID := cq.Message.Chat.ID, cq.Message.MessageID
+	_ = answerCallback(bot, cq.ID, "")
+	promptID, err := telegram.SendPrompt(bot, chatID, msgID, "↪️ Reply with the address to forward this email to", "name@example.com")
+	if err != nil {
+		log.Printf("tg callback forward_prompt error chat_id=%d msg_id=%d err=%v", chatID, msgID, err)
+		return
+	}
+	forwardPrompts.Store(promptKey{chatID: chatID, msgID: promptID}, forwardPrompt{account: acc.Name, pageID: page.ID, token: page.Token, userID: cq.From.ID})
+	if err := telegram.EditKeyboard(bot, chatID, msgID, messageKeyboard(cfg, acc, pageRef(page), true)); err != nil {
+		log.Printf("tg callback forward_menu edit_keyboard error chat_id=%d msg_id=%d err=%v", chatID, msgID, err)
+	}
+}
+
+// forwardFromMenu пересылает письмо страницы на адрес номер i из адресной книги аккаунта.
+// Загрузка письма и SMTP идут в фоне, результат приходит ответом на уведомление.
+func forwardFromMenu(cfg config.Config, bot *tgbotapi.BotAPI, cq *tgbotapi.CallbackQuery, acc config.Account, page *viewer.Page, i int) {
+	chatID, msgID := cq.Message.Chat.ID, cq.Message.MessageID
+	if i < 0 || i >= len(acc.ForwardAddresses) {
+		_ = answerCallback(bot, cq.ID, "Menu expired")
+		return
+	}
+	to, err := mail.ParseAddress(acc.ForwardAddresses[i])
+	if err != nil {
+		_ = answerCallback(bot, cq.ID, "Failed to forward")
+		log.Printf("tg callback forward 500 account=%s mailbox=%s uid=%d id=%s err=%v", acc.Name, page.Mailbox, page.IMAPUID, maskID(page.ID), err)
+		return
+	}
+	_ = answerCallback(bot, cq.ID, "Forwarding to "+to.Address+"…")
+	if err := telegram.EditKeyboard(bot, chatID, msgID, messageKeyboard(cfg, acc, pageRef(page), true)); err != nil {
+		log.Printf("tg callback forward edit_keyboard error chat_id=%d msg_id=%d err=%v", chatID, msgID, err)
+	}
+	go func() {
+		notify := func(text string) {
+			if err := telegram.SendReply(bot, chatID, msgID, text); err != nil {
+				log.Printf("tg callback forward notice error chat_id=%d msg_id=%d err=%v", chatID, msgID, err)
+			}
+		}
+		if err := forwardPage(cfg, acc, page, to); err != nil {
+			notify("❌ Not forwarded to " + to.Address + ": " + err.Error())
+			log.Printf("tg callback forward 500 account=%s mailbox=%s uid=%d id=%s err=%v", acc.Name, page.Mailbox, page.IMAPUID, maskID(page.ID), err)
+			return
+		}
+		notify("↪️ Forwarded to " + to.Address)
+		log.Printf("tg callback forward ok account=%s mailbox=%s uid=%d to=%s chat_id=%d msg_id=%d id=%s", acc.Name, page.Mailbox, page.IMAPUID, to.Address, chatID, msgID, maskID(page.ID))
+	}()
+}
+
+// handleForwardPrompt обрабатывает ответ на вопрос «кому переслать»; false — msg отвечает не на такой вопрос.
+func handleForwardPrompt(cfg config.Config, bot *tgbotapi.BotAPI, store *viewer.Store, msg *tgbotapi.Message) bool {
+	chatID := msg.Chat.ID
+	pk := promptKey{chatID: chatID, msgID: msg.ReplyToMessage.MessageID}
+	v, ok := forwardPrompts.Load(pk)
+	if !ok {
+		return false
+	}
+	prompt := v.(forwardPrompt)
+	if msg.From == nil || msg.From.ID != prompt.userID {
+		return true
+	}
+	notify := func(text string) {
+		if err := telegram.SendReply(bot, chatID, msg.MessageID, text); err != nil {
+			log.Printf("tg forward notice error chat_id=%d msg_id=%d err=%v", chatID, msg.MessageID, err)
+		}
+	}
+	// Белый список мог измениться с момента вопроса: проверяется перед отправкой ещё раз
+	if notice, ok := allowedUser(cfg, "forward", "Forwarding emails", msg.From.ID, chatID); !ok {
+		forwardPrompts.Delete(pk)
+		notify(notice)
+		return true
+	}
+	to, err := mail.ParseAddress(strings.TrimSpace(msg.Text))
+	if err != nil {
+		// Вопрос остаётся в силе: можно ответить на него ещё раз
+		notify("Not an email address, reply to the question again")
+		return true
+	}
+	forwardPrompts.Delete(pk)
+	page, ok, reason := store.Authorize(prompt.pageID, prompt.token)
+	acc, accOK := cfg.Account(prompt.account)
+	if !ok || !accOK || page.IMAPUID <= 0 {
+		notify("Link expired, the email can no longer be forwarded")
+		log.Printf("tg forward 404 reason=%s account=%s chat_id=%d id=%s", reason, prompt.account, chatID, maskID(prompt.pageID))
+		return true
+	}
+	if err := forwardPage(cfg, acc, page, to); err != nil {
+		notify("❌ Not forwarded: " + err.Error())
+		log.Printf("tg forward 500 account=%s mailbox=%s uid=%d id=%s err=%v", acc.Name, page.Mailbox, page.IMAPUID, maskID(page.ID), err)
+		return true
+	}
+	notify("↪️ Forwarded to " + to.Address)
+	log.Printf("tg forward ok account=%s mailbox=%s uid=%d to=%s chat_id=%d id=%s", acc.Name, page.Mailbox, page.IMAPUID, to.Address, chatID, maskID(page.ID))
+	return true
+}
+
+// forwardPage пересылает письмо страницы вложением через SMTP аккаунта, затем сохраняет
+// копию в отправленных и помечает исходное письмо $Forwarded.
+func forwardPage(cfg config.Config, acc config.Account, page *viewer.Page, to *mail.Address) error {
+	from, err := mail.ParseAddress(acc.SMTPFrom)
+	if err != nil {
+		return err
+	}
+	var orig *imapPkg.Email
+	var raw []byte
+	err = onPageMessage(acc, page, func(m *imapPkg.Conn) error {
+		headers, err := imapPkg.FetchHeaders(m, []int{page.IMAPUID})
+		if err != nil {
+			return err
+		}
+		if orig = headers[page.IMAPUID]; orig == nil {
+			return errOriginalGone
+		}
+		if orig.Size > maxForwardSize {
+			return fmt.Errorf("email is too large to forward (%d MB)", orig.Size>>20)
+		}
+		raw, err = imapPkg.FetchRaw(m, page.IMAPUID)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	out, err := email.BuildForward(email.ForwardOptions{
+		From:     from,
+		To:       []*mail.Address{to},
+		Original: orig,
+		Raw:      raw,
+	})
+	if err != nil {
+		return err
+	}
+	if err := smtp.Send(accountSMTPConfig(acc), from.Address, out.To, out.Raw); err != nil {
+		return err
+	}
+	key := state.Key{Account: acc.StateID(), Mailbox: page.Mailbox, UIDValidity: page.UIDValidity, UID: page.IMAPUID}
+	// Копия и $Forwarded не задерживают ответ пользователю: их сбой только пишется в лог
+	go saveSent(acc, key, out, "mark_forwarded", imapPkg.MarkForwarded)
+	return nil
+}
@@ -0,0 +1,371 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+
+	"mailpuff/pkg/config"
+	"mailpuff/pkg/email"
+	"mailpuff/pkg/telegram"
+	"mailpuff/pkg/viewer"
+)
+
+// maxIngestMessage — письма крупнее в архиве пропускаются: файл целиком держится в памяти
+const maxIngestMessage = 100 << 20
+
+// errNoBody — в письме нет текста, который можно показать на странице viewer.
+var errNoBody = errors.New("message has no text or HTML body")
+
+// runIngestCommand обрабатывает `mailpuff ingest [flags] path...`: пропускает локальные письма
+// (.eml, mbox, Maildir) через тот же путь, что и письма из IMAP — Summarize, страница viewer,
+// уведомление в Telegram, — а затем обслуживает страницы, пока они не истекут.
+// С -dry-run только печатает разбор писем (email.Outline) и не требует конфигурации.
+// Возвращает код завершения процесса.
+func runIngestCommand(args []string) int {
+	fs := flag.NewFlagSet("ingest", flag.ContinueOnError)
+	path := fs.String("config", os.Getenv(config.EnvConfigPath), "path to YAML/TOML config file (env "+config.EnvConfigPath+")")
+	accName := fs.String("account", "", "account whose chat, page TTL and addresses to use (default: global settings)")
+	chatID := fs.Int64("chat", 0, "Telegram chat to notify (default: account or TELEGRAM_CHAT_ID)")
+	label := fs.String("label", "", "folder line of the notifications (default: source file name)")
+	delay := fs.Duration("delay", time.Second, "pause between notifications (Telegram rate limits)")
+	dryRun := fs.Bool("dry-run", false, "print how each message is parsed instead of sending it")
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "usage: mailpuff ingest [flags] file.eml|archive.mbox|maildir...")
+		fs.PrintDefaults()
+	}
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+	if fs.NArg() == 0 {
+		fs.Usage()
+		return 2
+	}
+
+	if *dryRun {
+		failed := 0
+		err := walkIngestSources(fs.Args(), func(name string, raw []byte) {
+			m, err := email.ParseMessage(raw)
+			var out []byte
+			if err == nil {
+				out, err = email.Outline(m)
+			}
+			if err != nil {
+				failed++
+				fmt.Fprintf(os.Stderr, "%s: %v\n", name, err)
+				return
+			}
+			_, _ = os.Stdout.Write(out)
+		})
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+		if failed > 0 {
+			return 1
+		}
+		return 0
+	}
+
+	cfg, err := config.LoadOffline(*path)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	in := ingester{cfg: cfg, chatID: cfg.TelegramChatID, label: *label, ttl: cfg.ViewerPageTTL, maxViews: cfg.ViewerPageMaxViews}
+	if *accName != "" {
+		acc, ok := cfg.Account(*accName)
+		if !ok {
+			fmt.Fprintf(os.Stderr, "unknown account %q\n", *accName)
+			return 2
+		}
+		in.chatID, in.ttl, in.maxViews, in.self = acc.TelegramChatID, acc.ViewerPageTTL, acc.ViewerPageMaxViews, acc.OwnAddresses()
+	}
+	if *chatID != 0 {
+		in.chatID = *chatID
+	}
+	if in.chatID == 0 {
+		fmt.Fprintln(os.Stderr, "no Telegram chat: set -chat, -account or TELEGRAM_CHAT_ID")
+		return 2
+	}
+	if in.bot, err = tgbotapi.NewBotAPI(cfg.TelegramToken); err != nil {
+		fmt.Fprintf(os.Stderr, "telegram init error: %v\n", err)
+		return 1
+	}
+
+	// Страницы живут в памяти этого процесса: ссылки работают, пока он обслуживает viewer
+	in.store = viewer.NewStore(in.ttl, in.maxViews)
+	done := make(chan struct{}, 1)
+	in.store.SetOnDelete(func(p *viewer.Page, reason string) {
+		if in.live.Add(-1) == 0 && in.finished.Load() {
+			done <- struct{}{}
+		}
+	})
+	serveErr := make(chan error, 1)
+	go func() { serveErr <- viewer.StartHTTPServer(cfg.HTTPAddr, in.store, nil, nil, nil) }()
+
+	sent, failed := 0, 0
+	err = walkIngestSources(fs.Args(), func(name string, raw []byte) {
+		if sent+failed > 0 && *delay > 0 {
+			time.Sleep(*delay)
+		}
+		if err := in.ingest(name, raw); err != nil {
+			failed++
+			log.Printf("ingest error source=%s err=%v", name, err)
+			return
+		}
+		sent++
+	})
+	if err != nil {
+		log.Printf("ingest error: %v", err)
+	}
+	log.Printf("ingest done sent=%d failed=%d", sent, failed)
+	code := 0
+	if err != nil || failed > 0 {
+		code = 1
+	}
+	if sent == 0 {
+		return code
+	}
+
+	in.finished.Store(true)
+	if in.live.Load() == 0 {
+		return code
+	}
+	log.Printf("ingest serving pages=%d http=%s until they expire (ttl=%s), interrupt to stop", in.live.Load(), cfg.HTTPAddr, in.ttl)
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, os.Interrupt, syscall.SIGTERM)
+	select {
+	case <-done:
+	case <-sig:
+	case err := <-serveErr:
+		log.Printf("http server error: %v", err)
+		code = 1
+	}
+	return code
+}
+
+// ingester отправляет уведомления о локальных письмах.
+type ingester struct {
+	cfg      config.Config
+	bot      *tgbotapi.BotAPI
+	store    *viewer.Store
+	chatID   int64
+	label    string
+	ttl      time.Duration
+	maxViews int
+	// self — адреса владельца аккаунта для строки «👥 To»
+	self []string
+	// live — сколько страниц ещё открываются; finished — все письма отправлены
+	live     atomic.Int64
+	finished atomic.Bool
+}
+
+// ingest проводит одно письмо через Summarize, viewer и Telegram, как watcher.notify письмо из IMAP.
+func (in *ingester) ingest(name string, raw []byte) error {
+	m, err := email.ParseMessage(raw)
+	if err != nil {
+		return err
+	}
+	sum := email.Summarize(m)
+	if len(sum.Problems) > 0 {
+		log.Printf("email decode_problems source=%s problems=%q", name, sum.Problems)
+	}
+	if sum.HTMLBody == "" {
+		return errNoBody
+	}
+	in.live.Add(1)
+	id, token, err := in.store.CreatePage(sum.HTMLBody, in.ttl, in.maxViews)
+	if err != nil {
+		in.live.Add(-1)
+		return err
+	}
+	label := in.label
+	if label == "" {
+		label = sourceLabel(name)
+	}
+	msgID, err := telegram.SendMessage(in.bot, in.chatID, messageText(in.cfg, label, sum, in.self), telegram.Keyboard{ViewURL: buildViewerURL(in.cfg.ViewerBaseURL, id, token)})
+	if err != nil {
+		in.store.Delete(id)
+		return err
+	}
+	in.store.SetMessageRef(id, in.chatID, msgID)
+	log.Printf("ingest ok source=%s chat_id=%d msg_id=%d id=%s", name, in.chatID, msgID, maskID(id))
+	return nil
+}
+
+// sourceLabel — подпись уведомления по умолчанию: имя файла или папки Maildir без номера письма.
+func sourceLabel(name string) string {
+	name, _, _ = strings.Cut(name, "#")
+	dir := filepath.Dir(name)
+	if base := filepath.Base(dir); base == "cur" || base == "new" {
+		return filepath.Base(filepath.Dir(dir))
+	}
+	return filepath.Base(name)
+}
+
+// walkIngestSources передаёт fn каждое письмо из paths по порядку: каталог с cur/ и new/ —
+// Maildir, другой каталог — его файлы *.eml, файл, начинающийся со строки "From ", — mbox,
+// остальные файлы — одно письмо. name — источник письма для логов ("archive.mbox#3").
+func walkIngestSources(paths []string, fn func(name string, raw []byte)) error {
+	for _, p := range paths {
+		info, err := os.Stat(p)
+		if err != nil {
+			return err
+		}
+		if info.IsDir() {
+			files, err := mailDirFiles(p)
+			if err != nil {
+				return err
+			}
+			for _, f := range files {
+				if err := readMessageFile(f, fn); err != nil {
+					return err
+				}
+			}
+			continue
+		}
+		mbox, err := isMbox(p)
+		if err != nil {
+			return err
+		}
+		if mbox {
+			err = readMbox(p, fn)
+		} else {
+			err = readMessageFile(p, fn)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// mailDirFiles возвращает письма каталога: для Maildir — файлы cur/ и new/ по порядку имён
+// (имя начинается с времени доставки), иначе — файлы *.eml.
+func mailDirFiles(dir string) ([]string, error) {
+	var files []string
+	maildir := false
+	for _, sub := range []string{"cur", "new"} {
+		entries, err := os.ReadDir(filepath.Join(dir, sub))
+		if errors.Is(err, os.ErrNotExist) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		maildir = true
+		for _, e := range entries {
+			if e.Type().IsRegular() && !strings.HasPrefix(e.Name(), ".") {
+				files = append(files, filepath.Join(dir, sub, e.Name()))
+			}
+		}
+	}
+	if maildir {
+		sort.Slice(files, func(i, j int) bool { return filepath.Base(files[i]) < filepath.Base(files[j]) })
+		return files, nil
+	}
+	files, err := filepath.Glob(filepath.Join(dir, "*.eml"))
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(files)
+	if len(files) == 0 {
+		return nil, fmt.Errorf("%s: no .eml files and not a Maildir (cur/, new/)", dir)
+	}
+	return files, nil
+}
+
+func readMessageFile(path string, fn func(name string, raw []byte)) error {
+	info, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+	if info.Size() > maxIngestMessage {
+		log.Printf("ingest skip source=%s reason=too_large size=%d", path, info.Size())
+		return nil
+	}
+	raw, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	fn(path, raw)
+	return nil
+}
+
+func isMbox(path string) (bool, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return false, err
+	}
+	defer f.Close()
+	head := make([]byte, 5)
+	n, err := io.ReadFull(f, head)
+	if err != nil && !errors.Is(err, io.ErrUnexpectedEOF) && !errors.Is(err, io.EOF) {
+		return false, err
+	}
+	return string(head[:n]) == "From ", nil
+}
+
+// readMbox делит архив mbox на письма по строкам "From " после пустой строки (или в начале файла)
+// и снимает экранирование ">From " (mboxrd).
+func readMbox(path string, fn func(name string, raw []byte)) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	r := bufio.NewReaderSize(f, 64<<10)
+	var msg []byte
+	n := 0
+	tooLarge := false
+	flush := func() {
+		if n > 0 && tooLarge {
+			log.Printf("ingest skip source=%s#%d reason=too_large", path, n)
+		} else if n > 0 {
+			fn(fmt.Sprintf("%s#%d", path, n), msg)
+		}
+		msg, tooLarge = nil, false
+	}
+	prevBlank := true
+	for {
+		line, err := r.ReadBytes('\n')
+		if len(line) > 0 {
+			if prevBlank && bytes.HasPrefix(line, []byte("From ")) {
+				flush()
+				n++
+			} else if !tooLarge {
+				if unquoted := bytes.TrimLeft(line, ">"); len(unquoted) < len(line) && bytes.HasPrefix(unquoted, []byte("From ")) {
+					line = line[1:]
+				}
+				msg = append(msg, line...)
+				if len(msg) > maxIngestMessage {
+					msg, tooLarge = nil, true
+				}
+			}
+			prevBlank = len(bytes.TrimRight(line, "\r\n")) == 0
+		}
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return err
+		}
+	}
+	flush()
+	return nil
+}
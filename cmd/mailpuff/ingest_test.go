@@ -0,0 +1,135 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestWalkIngestSources(t *testing.T) {
+	const mbox = "From alice@example.org Mon Mar  4 10:00:00 2024\n" +
+		"Subject: one\n" +
+		"\n" +
+		"first\n" +
+		">From the archive\n" +
+		"From inside a paragraph\n" +
+		"\n" +
+		"From bob@example.org Mon Mar  4 11:00:00 2024\n" +
+		"Subject: two\n" +
+		"\n" +
+		"second\n"
+	tests := []struct {
+		name string
+		// files — дерево каталога теста: путь -> содержимое
+		files map[string]string
+		paths []string
+		// want — источники писем (относительно каталога теста) и их содержимое без концевых переводов строк
+		want    [][2]string
+		wantErr bool
+	}{
+		{
+			name:  "mbox",
+			files: map[string]string{"archive.mbox": mbox},
+			paths: []string{"archive.mbox"},
+			want: [][2]string{
+				{"archive.mbox#1", "Subject: one\n\nfirst\nFrom the archive\nFrom inside a paragraph"},
+				{"archive.mbox#2", "Subject: two\n\nsecond"},
+			},
+		},
+		{
+			name: "maildir",
+			files: map[string]string{
+				"Mail/new/1700000002.M2.host":     "Subject: b\n\nb\n",
+				"Mail/cur/1700000001.M1.host:2,S": "Subject: a\n\na\n",
+				"Mail/cur/.hidden":                "ignored",
+				"Mail/tmp/1700000003.M3.host":     "Subject: in delivery\n\nc\n",
+			},
+			paths: []string{"Mail"},
+			want: [][2]string{
+				{"Mail/cur/1700000001.M1.host:2,S", "Subject: a\n\na"},
+				{"Mail/new/1700000002.M2.host", "Subject: b\n\nb"},
+			},
+		},
+		{
+			name: "eml directory and single file",
+			files: map[string]string{
+				"eml/b.eml":     "Subject: b\n",
+				"eml/a.eml":     "Subject: a\n",
+				"eml/notes.txt": "not mail",
+				"single.eml":    "Subject: single\n",
+			},
+			paths: []string{"eml", "single.eml"},
+			want: [][2]string{
+				{"eml/a.eml", "Subject: a"},
+				{"eml/b.eml", "Subject: b"},
+				{"single.eml", "Subject: single"},
+			},
+		},
+		{
+			name:    "directory without mail",
+			files:   map[string]string{"empty/readme.txt": "x"},
+			paths:   []string{"empty"},
+			wantErr: true,
+		},
+		{
+			name:    "missing path",
+			paths:   []string{"nope.mbox"},
+			wantErr: true,
+		},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			dir := t.TempDir()
+			for name, data := range tc.files {
+				path := filepath.Join(dir, filepath.FromSlash(name))
+				if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+					t.Fatal(err)
+				}
+				if err := os.WriteFile(path, []byte(data), 0o644); err != nil {
+					t.Fatal(err)
+				}
+			}
+			var paths []string
+			for _, p := range tc.paths {
+				paths = append(paths, filepath.Join(dir, p))
+			}
+			var got [][2]string
+			err := walkIngestSources(paths, func(name string, raw []byte) {
+				rel, _ := filepath.Rel(dir, name)
+				got = append(got, [2]string{filepath.ToSlash(rel), strings.TrimRight(string(raw), "\n")})
+			})
+			if tc.wantErr {
+				if err == nil {
+					t.Fatalf("walkIngestSources: want an error, got %q", got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(got) != len(tc.want) {
+				t.Fatalf("got %d messages, want %d: %q", len(got), len(tc.want), got)
+			}
+			for i := range got {
+				if got[i] != tc.want[i] {
+					t.Errorf("message %d = %q, want %q", i, got[i], tc.want[i])
+				}
+			}
+		})
+	}
+}
+
+func TestSourceLabel(t *testing.T) {
+	tests := []struct{ name, want string }{
+		{"/var/mail/archive.mbox#12", "archive.mbox"},
+		{"/home/me/Maildir/.Lists/cur/1700000001.M1.host:2,S", ".Lists"},
+		{"/home/me/Maildir/new/1700000002.M2.host", "Maildir"},
+		{"export/message.eml", "message.eml"},
+	}
+	for _, tc := range tests {
+		if got := sourceLabel(tc.name); got != tc.want {
+			t.Errorf("sourceLabel(%q) = %q, want %q", tc.name, got, tc.want)
+		}
+	}
+}
@@ -1,19 +1,22 @@
 package main
 
 import (
+    "context"
     "crypto/rand"
     "encoding/base64"
+    "flag"
+    "fmt"
     "log"
     "net/url"
-    "time"
+    "os"
     "strings"
     "sync"
 
     tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
 
     "mailpuff/pkg/config"
-    "mailpuff/pkg/email"
     imapPkg "mailpuff/pkg/imap"
+    "mailpuff/pkg/state"
     "mailpuff/pkg/telegram"
     "mailpuff/pkg/viewer"
 )
@@ -57,9 +60,10 @@ func buildMarkURL(base, id, token string) string {
 }
 
 // buildMarkCallbackData формирует callback data для кнопки "Mark as read".
-// Формат: "mark:<key>" (ключ хранится локально в памяти и маппится на id/token)
-func buildMarkCallbackData(key string) string {
-    return "mark:" + key
+// Формат: "mark:<account>:<key>" (ключ хранится локально в памяти и маппится на id/token;
+// имя аккаунта сверяется со страницей, чтобы кнопка не тронула письмо чужого ящика)
+func buildMarkCallbackData(account, key string) string {
+    return "mark:" + account + ":" + key
 }
 
 // genCallbackKey генерирует короткий URL-safe ключ для callback data
@@ -79,34 +83,114 @@ type markCallbackPayload struct {
 
 var markCbMap sync.Map
 
-// tgMessageRef хранит сведения, необходимые для редактирования клавиатуры сообщения
-// при автоматическом скрытии кнопки "Mark as read".
+// tgMessageRef хранит сведения, необходимые для редактирования сообщения, когда
+// письмо на сервере прочитано, помечено флагом или удалено.
 type tgMessageRef struct {
     chatID    int64
     messageID int
     id        string
     token     string
+    // emailMessageID — Message-ID письма для повторной привязки после смены UIDVALIDITY
+    emailMessageID string
+    // text — исходный текст уведомления, к которому дописывается состояние письма
+    text string
+    // seen, flagged — последнее известное состояние флагов \Seen и \Flagged
+    seen    bool
+    flagged bool
 }
 
-// uidToMsg сопоставляет IMAP UID -> ссылку на Telegram-сообщение и страницу viewer
+// uidToMsg сопоставляет (аккаунт, папка, IMAP UID) -> ссылку на Telegram-сообщение и страницу viewer
 var uidToMsg sync.Map
 
+// markRefSeen запоминает, что письмо прочитано и кнопка "Mark as read" уже скрыта.
+// Запись остаётся, чтобы сообщение можно было обновить при удалении письма или смене флага.
+func markRefSeen(key mailboxUID) {
+    if v, ok := uidToMsg.Load(key); ok {
+        if ref, ok := v.(tgMessageRef); ok {
+            ref.seen = true
+            uidToMsg.Store(key, ref)
+        }
+    }
+}
+
 // pageToCbKey сопоставляет pageID -> callback key, чтобы можно было
 // удалить key из локального кэша после скрытия кнопки
 var pageToCbKey sync.Map
 
-// hideMarkButton обновляет клавиатуру сообщения, оставляя только кнопку "Open html".
-func hideMarkButton(bot *tgbotapi.BotAPI, chatID int64, messageID int, viewerURL string) error {
-    btnView := tgbotapi.NewInlineKeyboardButtonURL("Open html", viewerURL)
-    newMarkup := tgbotapi.NewInlineKeyboardMarkup(tgbotapi.NewInlineKeyboardRow(btnView))
-    edit := tgbotapi.NewEditMessageReplyMarkup(chatID, messageID, newMarkup)
-    _, err := bot.Request(edit)
-    return err
+// pageRef возвращает ссылку на уведомление страницы из uidToMsg, а если её там нет — собирает из полей страницы.
+func pageRef(p *viewer.Page) tgMessageRef {
+    if v, ok := uidToMsg.Load(mailboxUID{account: p.Account, mailbox: p.Mailbox, uid: p.IMAPUID}); ok {
+        if ref, ok := v.(tgMessageRef); ok && ref.id == p.ID {
+            return ref
+        }
+    }
+    return tgMessageRef{chatID: p.ChatID, messageID: p.MessageID, id: p.ID, token: p.Token}
+}
+
+// hideMarkButton обновляет клавиатуру сообщения, убирая кнопку "Mark as read": остаются "Open html", флаг и действия аккаунта.
+func hideMarkButton(bot *tgbotapi.BotAPI, cfg config.Config, acc config.Account, ref tgMessageRef) error {
+    return telegram.EditKeyboard(bot, ref.chatID, ref.messageID, messageKeyboard(cfg, acc, ref, false))
 }
 
 func main() {
-	cfg := config.Load()
-    log.Printf("starting mailpuff poll=%s mailbox=%s http=%s ttl=%s maxViews=%d", cfg.PollInterval, cfg.Mailbox, cfg.HTTPAddr, cfg.ViewerPageTTL, cfg.ViewerPageMaxViews)
+    if len(os.Args) > 1 {
+        switch os.Args[1] {
+        case "config":
+            os.Exit(runConfigCommand(os.Args[2:]))
+        case "secrets":
+            os.Exit(runSecretsCommand(os.Args[2:]))
+        case "oauth":
+            os.Exit(runOAuthCommand(os.Args[2:]))
+        case "ingest":
+            os.Exit(runIngestCommand(os.Args[2:]))
+        }
+    }
+    configPath := flag.String("config", os.Getenv(config.EnvConfigPath), "path to YAML/TOML config file (env "+config.EnvConfigPath+")")
+    flag.Parse()
+    cfg, err := config.Load(*configPath)
+    if err != nil {
+        log.Fatalf("config error: %v", err)
+    }
+    log.Printf("starting mailpuff poll=%s accounts=%d http=%s ttl=%s maxViews=%d", cfg.PollInterval, len(cfg.Accounts), cfg.HTTPAddr, cfg.ViewerPageTTL, cfg.ViewerPageMaxViews)
+    for _, acc := range cfg.Accounts {
+        mailboxNames := make([]string, 0, len(acc.Mailboxes))
+        for _, mb := range acc.Mailboxes {
+            mailboxNames = append(mailboxNames, mb.Name)
+        }
+        log.Printf("account name=%s host=%s security=%s user=%s mailboxes=%s chat_id=%d", acc.Name, acc.IMAPHost, acc.IMAPSecurity, acc.IMAPUsername, strings.Join(mailboxNames, ","), acc.TelegramChatID)
+        if acc.IMAPSecurity == config.SecurityPlain && !isLocalHost(acc.IMAPHost) {
+            log.Printf("warning: account=%s host=%s uses plaintext IMAP, credentials and mail are sent unencrypted", acc.Name, acc.IMAPHost)
+        }
+        if acc.CanReply() {
+            log.Printf("account name=%s smtp host=%s port=%d security=%s from=%q", acc.Name, acc.SMTPHost, acc.SMTPPort, acc.SMTPSecurity, acc.SMTPFrom)
+            if acc.SMTPSecurity == config.SecurityPlain && !isLocalHost(acc.SMTPHost) {
+                log.Printf("warning: account=%s host=%s uses plaintext SMTP, credentials and replies are sent unencrypted", acc.Name, acc.SMTPHost)
+            }
+        }
+    }
+
+    // Состояние (обработанные письма) хранится на диске, чтобы рестарт не дублировал уведомления
+    st, err := state.Open(cfg.DataDir)
+    if err != nil {
+        log.Fatalf("state init error: %v", err)
+    }
+    defer func() { _ = st.Close() }()
+
+    // OAuth2: один источник токенов на аккаунт, чтобы все соединения делили access token
+    for _, acc := range cfg.Accounts {
+        if !acc.UsesOAuth() {
+            continue
+        }
+        ts, err := newAccountTokenSource(acc, st)
+        if err != nil {
+            log.Fatalf("oauth init error account=%s: %v", acc.Name, err)
+        }
+        accountTokens.Store(acc.Name, ts)
+    }
+    // Соединения аккаунта: пул сессий для действий и общий backoff переподключения
+    for _, acc := range cfg.Accounts {
+        accountIMAP.Store(acc.Name, newIMAPManager(cfg, acc))
+    }
 
 	bot, err := tgbotapi.NewBotAPI(cfg.TelegramToken)
 	if err != nil {
@@ -120,43 +204,39 @@ func main() {
             // Маскируем id
             masked := maskID(p.ID)
             log.Printf("cleanup: page id=%s reason=%s kept_telegram_message chat_id=%d msg_id=%d", masked, reason, p.ChatID, p.MessageID)
+            // Без страницы сообщение больше не обновляем
+            key := mailboxUID{account: p.Account, mailbox: p.Mailbox, uid: p.IMAPUID}
+            if v, ok := uidToMsg.Load(key); ok {
+                if ref, _ := v.(tgMessageRef); ref.id == p.ID {
+                    uidToMsg.Delete(key)
+                }
+            }
+            dropActionKey(p.ID)
         }
     })
+    markSeen := func(p *viewer.Page) error { return markPageSeen(cfg, p) }
+
 	// При первом открытии страницы — опционально помечаем письмо прочитанным в IMAP
     store.SetOnFirstView(func(p *viewer.Page) {
-		if p == nil {
-			return
-		}
-		if !cfg.MarkSeen {
-			return
-		}
-		if p.IMAPUID <= 0 {
-			return
-		}
-        imapCfg := imapPkg.Config{
-			Host:     cfg.IMAPHost,
-			Port:     cfg.IMAPPort,
-			Username: cfg.IMAPUsername,
-			Password: cfg.IMAPPassword,
-			UseTLS:   cfg.IMAPUseTLS,
-			Mailbox:  cfg.Mailbox,
-		}
-		m, err := imapPkg.ConnectAndSelect(imapCfg)
-        if err != nil {
-            log.Printf("imap connect error during first-view mark-seen: %v", err)
-			return
-		}
-		defer func() { _ = m.Close() }()
-        if err := imapPkg.MarkSeen(m, p.IMAPUID); err != nil {
-            log.Printf("imap mark_seen error uid=%d: %v", p.IMAPUID, err)
-			return
-		}
-        log.Printf("imap mark_seen ok uid=%d on first HTML view", p.IMAPUID)
+        if p == nil {
+            return
+        }
+        acc, ok := cfg.Account(p.Account)
+        if !ok || !markSeenOnView(acc, p.Mailbox) {
+            return
+        }
+        if p.IMAPUID <= 0 {
+            return
+        }
+        if err := markSeen(p); err != nil {
+            log.Printf("imap mark_seen error account=%s mailbox=%s uid=%d on first HTML view: %v", p.Account, p.Mailbox, p.IMAPUID, err)
+            return
+        }
+        log.Printf("imap mark_seen ok account=%s mailbox=%s uid=%d on first HTML view", p.Account, p.Mailbox, p.IMAPUID)
 
         // После успешной отметки как прочитанного — скрываем кнопку в Telegram-сообщении
         if p.ChatID != 0 && p.MessageID != 0 && p.ID != "" && p.Token != "" {
-            viewerURL := buildViewerURL(cfg.ViewerBaseURL, p.ID, p.Token)
-            if err := hideMarkButton(bot, p.ChatID, p.MessageID, viewerURL); err != nil {
+            if err := hideMarkButton(bot, cfg, acc, pageRef(p)); err != nil {
                 log.Printf("tg edit keyboard on first-view uid=%d chat_id=%d msg_id=%d err=%v", p.IMAPUID, p.ChatID, p.MessageID, err)
             }
         }
@@ -170,208 +250,151 @@ func main() {
             }
         }
         if p.IMAPUID > 0 {
-            uidToMsg.Delete(p.IMAPUID)
-        }
-	})
-    // Обработчик для пометки прочитанным через IMAP (переиспользуется HTTP и Telegram callback)
-    markSeen := func(uid int) error {
-        imapCfg := imapPkg.Config{
-            Host:     cfg.IMAPHost,
-            Port:     cfg.IMAPPort,
-            Username: cfg.IMAPUsername,
-            Password: cfg.IMAPPassword,
-            UseTLS:   cfg.IMAPUseTLS,
-            Mailbox:  cfg.Mailbox,
+            markRefSeen(mailboxUID{account: p.Account, mailbox: p.Mailbox, uid: p.IMAPUID})
         }
-        m, err := imapPkg.ConnectAndSelect(imapCfg)
-        if err != nil {
-            return err
-        }
-        defer func() { _ = m.Close() }()
-        return imapPkg.MarkSeen(m, uid)
-    }
+    })
 
-    // HTTP сервер: поддержка /view и /mark_read
+    // HTTP сервер: поддержка /view, /mark_read и скачивания вложений
     go func() {
-        if err := viewer.StartHTTPServer(cfg.HTTPAddr, store, markSeen); err != nil {
+        if err := viewer.StartHTTPServer(cfg.HTTPAddr, store, markSeen, fetchAttachment(cfg), imapHealth(cfg)); err != nil {
             log.Fatalf("http server error: %v", err)
         }
     }()
 
-    // Telegram updates: обработка нажатий на кнопку Mark as read (callback)
+    // Telegram updates: обработка нажатий на кнопки Mark as read и действий (callback)
+    // и ответов на уведомления (ответ на письмо и адрес для пересылки — через SMTP),
+    // диалог /compose для новых писем
     go func() {
         u := tgbotapi.NewUpdate(0)
         u.Timeout = 60
         updates := bot.GetUpdatesChan(u)
         for upd := range updates {
-            if upd.CallbackQuery == nil {
+            if upd.Message != nil && handleComposeMessage(cfg, bot, upd.Message) {
                 continue
             }
-            data := upd.CallbackQuery.Data
-            if !strings.HasPrefix(data, "mark:") {
+            if upd.Message != nil && upd.Message.ReplyToMessage != nil {
+                // SMTP может отвечать долго — не задерживаем обработку кнопок
+                go handleReply(cfg, bot, store, st, upd.Message)
                 continue
             }
-
-            // Ожидаем формат: mark:<key>
-            parts := strings.SplitN(data, ":", 2)
-            if len(parts) != 2 {
-                _ = answerCallback(bot, upd.CallbackQuery.ID, "Invalid data")
-                log.Printf("tg callback invalid_data chat_id=%d msg_id=%d data=%q", upd.CallbackQuery.Message.Chat.ID, upd.CallbackQuery.Message.MessageID, data)
+            if upd.CallbackQuery == nil {
                 continue
             }
-            key := parts[1]
-            payloadV, ok := markCbMap.Load(key)
-            if !ok {
-                _ = answerCallback(bot, upd.CallbackQuery.ID, "Link expired")
-                log.Printf("tg callback mark_read 404 reason=cbkey_not_found chat_id=%d msg_id=%d key=%q", upd.CallbackQuery.Message.Chat.ID, upd.CallbackQuery.Message.MessageID, key)
+            data := upd.CallbackQuery.Data
+            if strings.HasPrefix(data, "cmp:") {
+                go handleComposeCallback(cfg, bot, upd.CallbackQuery)
                 continue
             }
-            payload := payloadV.(markCallbackPayload)
-            id := payload.ID
-            tok := payload.Token
-
-            page, ok, reason := store.Authorize(id, tok)
-            if !ok {
-                _ = answerCallback(bot, upd.CallbackQuery.ID, "Link expired or invalid")
-                log.Printf("tg callback mark_read 404 reason=%s chat_id=%d msg_id=%d id=%s", reason, upd.CallbackQuery.Message.Chat.ID, upd.CallbackQuery.Message.MessageID, maskID(id))
+            if strings.HasPrefix(data, "act:") {
+                // IMAP-операции не задерживают обработку остальных обновлений
+                go handleActionCallback(cfg, bot, store, st, upd.CallbackQuery)
                 continue
             }
-            if page.IMAPUID <= 0 {
-                _ = answerCallback(bot, upd.CallbackQuery.ID, "IMAP UID missing")
-                log.Printf("tg callback mark_read 404 reason=missing_imap_uid chat_id=%d msg_id=%d id=%s", upd.CallbackQuery.Message.Chat.ID, upd.CallbackQuery.Message.MessageID, maskID(id))
-                continue
-            }
-            if err := markSeen(page.IMAPUID); err != nil {
-                _ = answerCallback(bot, upd.CallbackQuery.ID, "Failed to mark as read")
-                log.Printf("tg callback mark_read 500 uid=%d id=%s err=%v", page.IMAPUID, maskID(id), err)
-                continue
+            if strings.HasPrefix(data, "mark:") {
+                // Как и кнопки действий: медленный или переподключающийся аккаунт не задерживает остальные обновления
+                go handleMarkCallback(cfg, bot, store, upd.CallbackQuery)
             }
+        }
+    }()
 
-            // Успех: отвечаем всплывашкой и обновляем клавиатуру (убираем Mark as read)
-            _ = answerCallback(bot, upd.CallbackQuery.ID, "Marked as read")
-            markCbMap.Delete(key)
+    // Каждый аккаунт обслуживается независимо: свой супервизор папок и свои соединения
+    for _, acc := range cfg.Accounts {
+        acc := acc
+        mgr, _ := imapManager(acc.Name)
+        go superviseMailboxes(cfg, acc, mgr, func(mb config.Mailbox) *mailboxWatcher {
+            return newMailboxWatcher(cfg, acc, mb, bot, store, st, mgr)
+        })
+    }
+    // Отложенные письма возвращаются по расписанию, переживающему рестарты
+    go runSnoozes(cfg, bot, store, st)
+    select {}
+}
 
-            viewerURL := buildViewerURL(cfg.ViewerBaseURL, id, tok)
-            if err := hideMarkButton(bot, upd.CallbackQuery.Message.Chat.ID, upd.CallbackQuery.Message.MessageID, viewerURL); err != nil {
-                log.Printf("tg callback mark_read edit_keyboard error chat_id=%d msg_id=%d err=%v", upd.CallbackQuery.Message.Chat.ID, upd.CallbackQuery.Message.MessageID, err)
-            }
+// markPageSeen помечает письмо страницы прочитанным через IMAP (HTTP, Telegram callback и первый просмотр).
+// UID страницы действителен только при совпадении UIDVALIDITY папки, иначе можно пометить чужое письмо.
+func markPageSeen(cfg config.Config, p *viewer.Page) error {
+    acc, ok := cfg.Account(p.Account)
+    if !ok {
+        return fmt.Errorf("unknown account %q", p.Account)
+    }
+    mgr, ok := imapManager(acc.Name)
+    if !ok {
+        return fmt.Errorf("no imap connection for account %q", acc.Name)
+    }
+    ctx, cancel := context.WithTimeout(context.Background(), imapActionTimeout)
+    defer cancel()
+    return mgr.Do(ctx, p.Mailbox, func(m *imapPkg.Conn, status imapPkg.MailboxStatus) error {
+        if status.UIDValidity != p.UIDValidity {
+            return fmt.Errorf("%w: page=%d mailbox=%d", imapPkg.ErrUIDValidityChanged, p.UIDValidity, status.UIDValidity)
+        }
+        return imapPkg.MarkSeen(m, p.IMAPUID)
+    })
+}
 
-            // Очистка привязок для предотвращения повторной обработки
-            uidToMsg.Delete(page.IMAPUID)
-            pageToCbKey.Delete(id)
+// handleMarkCallback обрабатывает нажатие «Mark as read»: помечает письмо страницы прочитанным
+// и убирает кнопку из уведомления.
+func handleMarkCallback(cfg config.Config, bot *tgbotapi.BotAPI, store *viewer.Store, cq *tgbotapi.CallbackQuery) {
+    data := cq.Data
+    // Ожидаем формат: mark:<account>:<key>. Кнопки старого формата mark:<key>
+    // ссылаются на страницы до перезапуска и обрабатываются как устаревшие.
+    parts := strings.SplitN(data, ":", 3)
+    if len(parts) == 2 {
+        _ = answerCallback(bot, cq.ID, "Link expired")
+        log.Printf("tg callback mark_read 404 reason=legacy_data chat_id=%d msg_id=%d", cq.Message.Chat.ID, cq.Message.MessageID)
+        return
+    }
+    if len(parts) != 3 {
+        _ = answerCallback(bot, cq.ID, "Invalid data")
+        log.Printf("tg callback invalid_data chat_id=%d msg_id=%d data=%q", cq.Message.Chat.ID, cq.Message.MessageID, data)
+        return
+    }
+    accName, key := parts[1], parts[2]
+    payloadV, ok := markCbMap.Load(key)
+    if !ok {
+        _ = answerCallback(bot, cq.ID, "Link expired")
+        log.Printf("tg callback mark_read 404 reason=cbkey_not_found chat_id=%d msg_id=%d key=%q", cq.Message.Chat.ID, cq.Message.MessageID, key)
+        return
+    }
+    payload := payloadV.(markCallbackPayload)
+    id := payload.ID
+    tok := payload.Token
 
-            log.Printf("tg callback mark_read ok uid=%d chat_id=%d msg_id=%d id=%s", page.IMAPUID, upd.CallbackQuery.Message.Chat.ID, upd.CallbackQuery.Message.MessageID, maskID(id))
-        }
-    }()
+    page, ok, reason := store.Authorize(id, tok)
+    if !ok {
+        _ = answerCallback(bot, cq.ID, "Link expired or invalid")
+        log.Printf("tg callback mark_read 404 reason=%s chat_id=%d msg_id=%d id=%s", reason, cq.Message.Chat.ID, cq.Message.MessageID, maskID(id))
+        return
+    }
+    if page.Account != accName {
+        _ = answerCallback(bot, cq.ID, "Invalid data")
+        log.Printf("tg callback mark_read 404 reason=account_mismatch account=%s chat_id=%d msg_id=%d id=%s", accName, cq.Message.Chat.ID, cq.Message.MessageID, maskID(id))
+        return
+    }
+    if page.IMAPUID <= 0 {
+        _ = answerCallback(bot, cq.ID, "IMAP UID missing")
+        log.Printf("tg callback mark_read 404 reason=missing_imap_uid chat_id=%d msg_id=%d id=%s", cq.Message.Chat.ID, cq.Message.MessageID, maskID(id))
+        return
+    }
+    if err := markPageSeen(cfg, page); err != nil {
+        _ = answerCallback(bot, cq.ID, "Failed to mark as read")
+        log.Printf("tg callback mark_read 500 account=%s uid=%d id=%s err=%v", accName, page.IMAPUID, maskID(id), err)
+        return
+    }
 
-    processed := make(map[int]struct{})
-
-	for {
-		imapCfg := imapPkg.Config{
-			Host:     cfg.IMAPHost,
-			Port:     cfg.IMAPPort,
-			Username: cfg.IMAPUsername,
-			Password: cfg.IMAPPassword,
-			UseTLS:   cfg.IMAPUseTLS,
-			Mailbox:  cfg.Mailbox,
-		}
-        c, err := imapPkg.ConnectAndSelect(imapCfg)
-        if err != nil {
-            log.Printf("imap connect error host=%s port=%d mailbox=%s: %v", imapCfg.Host, imapCfg.Port, imapCfg.Mailbox, err)
-			time.Sleep(cfg.PollInterval)
-			continue
-		}
-		func() {
-			defer func() {
-                _ = c.Close()
-			}()
-            uids, err := imapPkg.SearchUnseen(c)
-            if err != nil {
-                log.Printf("imap search_unseen error: %v", err)
-				return
-			}
-            // Авто-скрытие кнопки для писем, которые стали прочитанными в почтовом клиенте
-            unseenSet := make(map[int]struct{}, len(uids))
-            for _, u := range uids {
-                unseenSet[u] = struct{}{}
-            }
-            uidToMsg.Range(func(k, v any) bool {
-                uid, ok := k.(int)
-                if !ok {
-                    return true
-                }
-                if _, stillUnseen := unseenSet[uid]; stillUnseen {
-                    return true
-                }
-                // Письмо больше не в UNSEEN => считаем прочитанным, скрываем кнопку
-                ref, ok := v.(tgMessageRef)
-                if !ok {
-                    return true
-                }
-                viewerURL := buildViewerURL(cfg.ViewerBaseURL, ref.id, ref.token)
-                if err := hideMarkButton(bot, ref.chatID, ref.messageID, viewerURL); err != nil {
-                    log.Printf("imap auto-hide button failed uid=%d chat_id=%d msg_id=%d err=%v", uid, ref.chatID, ref.messageID, err)
-                    // Оставляем запись, попробуем на следующей итерации
-                    return true
-                }
-                // После успешного скрытия чистим callback-key и карту соответствий
-                if vKey, okKey := pageToCbKey.Load(ref.id); okKey {
-                    if cbKey, _ := vKey.(string); cbKey != "" {
-                        markCbMap.Delete(cbKey)
-                    }
-                    pageToCbKey.Delete(ref.id)
-                }
-                uidToMsg.Delete(uid)
-                log.Printf("imap auto-hide button ok uid=%d chat_id=%d msg_id=%d id=%s", uid, ref.chatID, ref.messageID, maskID(ref.id))
-                return true
-            })
-            emailsMap, err := imapPkg.FetchEmails(c, uids)
-            if err != nil {
-                log.Printf("imap fetch_emails error uids=%v: %v", uids, err)
-				return
-			}
-            for uid, em := range emailsMap {
-                if uid == 0 {
-                    continue
-                }
-                if _, seen := processed[uid]; seen {
-                    continue
-                }
-                sum := email.Summarize(em)
-                if sum.HTMLBody == "" {
-                    log.Printf("email skip uid=%d reason=no_body", uid)
-                    processed[uid] = struct{}{}
-					continue
-				}
-                // Создаём страницу в хранилище
-                id, token, err := store.CreatePage(sum.HTMLBody, cfg.ViewerPageTTL, cfg.ViewerPageMaxViews)
-                if err != nil {
-                    log.Printf("viewer create_page error uid=%d: %v", uid, err)
-                    processed[uid] = struct{}{}
-                    continue
-                }
-                viewerURL := buildViewerURL(cfg.ViewerBaseURL, id, token)
-                cbKey := genCallbackKey(6)
-                markCbMap.Store(cbKey, markCallbackPayload{ID: id, Token: token})
-                pageToCbKey.Store(id, cbKey)
-                markCB := buildMarkCallbackData(cbKey)
-                msgID, err := telegram.SendMessage(bot, cfg.TelegramChatID, sum.Subject, sum.FromName, sum.FromAddress, viewerURL, markCB)
-                if err != nil {
-                    log.Printf("telegram send error uid=%d: %v", uid, err)
-                    processed[uid] = struct{}{}
-					continue
-				}
-                store.SetMessageRef(id, cfg.TelegramChatID, msgID)
-				_ = store.SetIMAPUID(id, uid)
-                // Сохраняем соответствие UID -> Telegram сообщение/страница для дальнейшего авто-скрытия кнопки
-                uidToMsg.Store(uid, tgMessageRef{chatID: cfg.TelegramChatID, messageID: msgID, id: id, token: token})
-                log.Printf("sent telegram message msg_id=%d uid=%d page_id=%s", msgID, uid, maskID(id))
-                processed[uid] = struct{}{}
-
-			}
-		}()
-		time.Sleep(cfg.PollInterval)
-	}
+    // Успех: отвечаем всплывашкой и обновляем клавиатуру (убираем Mark as read)
+    _ = answerCallback(bot, cq.ID, "Marked as read")
+    markCbMap.Delete(key)
+
+    acc, _ := cfg.Account(accName)
+    if err := hideMarkButton(bot, cfg, acc, pageRef(page)); err != nil {
+        log.Printf("tg callback mark_read edit_keyboard error chat_id=%d msg_id=%d err=%v", cq.Message.Chat.ID, cq.Message.MessageID, err)
+    }
+
+    // Очистка привязок для предотвращения повторной обработки
+    markRefSeen(mailboxUID{account: page.Account, mailbox: page.Mailbox, uid: page.IMAPUID})
+    pageToCbKey.Delete(id)
+
+    log.Printf("tg callback mark_read ok account=%s uid=%d chat_id=%d msg_id=%d id=%s", accName, page.IMAPUID, cq.Message.Chat.ID, cq.Message.MessageID, maskID(id))
 }
 
 // maskID скрывает чувствительные идентификаторы (UUID) в логах, оставляя только часть.
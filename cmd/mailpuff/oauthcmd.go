@@ -0,0 +1,93 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"time"
+
+	"mailpuff/pkg/config"
+	"mailpuff/pkg/oauth"
+	"mailpuff/pkg/state"
+)
+
+// newAccountTokenSource создаёт источник OAuth2-токенов аккаунта; ротированные
+// refresh token сохраняются в state под StateID аккаунта.
+func newAccountTokenSource(acc config.Account, st *state.Store) (*oauth.TokenSource, error) {
+	return oauth.NewTokenSource(oauth.Config{
+		TokenURL:     acc.OAuth.TokenURL,
+		ClientID:     acc.OAuth.ClientID,
+		ClientSecret: acc.OAuth.ClientSecret,
+		RefreshToken: acc.OAuth.RefreshToken,
+		Scopes:       acc.OAuth.Scopes,
+	}, acc.StateID(), st, nil)
+}
+
+// oauthRefreshNote — ротированный refresh token сохраняется в базе состояния, а её монопольно
+// держит запущенный сервис, поэтому команда работает только при остановленном сервисе.
+const oauthRefreshNote = `The rotated refresh token is saved to the state database, which the running
+mailpuff service holds exclusively: stop the service first (docker compose stop app).
+A running service refreshes tokens by itself.`
+
+// runOAuthCommand обрабатывает `mailpuff oauth refresh [-config path] [-account name]`:
+// выполняет refresh-token flow для OAuth2-аккаунтов и сохраняет ротированный refresh token.
+// Токены не печатаются. Возвращает код завершения процесса.
+func runOAuthCommand(args []string) int {
+	usage := func() {
+		fmt.Fprintln(os.Stderr, "usage: mailpuff oauth refresh [-config path] [-account name]")
+		fmt.Fprintln(os.Stderr, oauthRefreshNote)
+	}
+	if len(args) == 0 || args[0] != "refresh" {
+		usage()
+		return 2
+	}
+	fs := flag.NewFlagSet("oauth refresh", flag.ContinueOnError)
+	path := fs.String("config", os.Getenv(config.EnvConfigPath), "path to YAML/TOML config file (env "+config.EnvConfigPath+")")
+	name := fs.String("account", "", "account name (default: all OAuth2 accounts)")
+	fs.Usage = func() {
+		usage()
+		fs.PrintDefaults()
+	}
+	if err := fs.Parse(args[1:]); err != nil {
+		return 2
+	}
+	cfg, err := config.Load(*path)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	st, err := state.Open(cfg.DataDir)
+	if errors.Is(err, state.ErrLocked) {
+		fmt.Fprintf(os.Stderr, "%v\nIs mailpuff running? %s\n", err, oauthRefreshNote)
+		return 1
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	defer func() { _ = st.Close() }()
+
+	code, found := 0, false
+	for _, acc := range cfg.Accounts {
+		if !acc.UsesOAuth() || (*name != "" && acc.Name != *name) {
+			continue
+		}
+		found = true
+		ts, err := newAccountTokenSource(acc, st)
+		if err == nil {
+			_, err = ts.Token()
+		}
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "account=%s: %v\n", acc.Name, err)
+			code = 1
+			continue
+		}
+		fmt.Printf("account=%s auth=%s token ok, expires in %s\n", acc.Name, acc.IMAPAuth, time.Until(ts.Expiry()).Round(time.Second))
+	}
+	if !found {
+		fmt.Fprintln(os.Stderr, "no matching OAuth2 accounts")
+		return 1
+	}
+	return code
+}
@@ -0,0 +1,215 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/mail"
+	"strings"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+
+	"mailpuff/pkg/config"
+	"mailpuff/pkg/email"
+	imapPkg "mailpuff/pkg/imap"
+	"mailpuff/pkg/oauth"
+	"mailpuff/pkg/smtp"
+	"mailpuff/pkg/state"
+	"mailpuff/pkg/telegram"
+	"mailpuff/pkg/viewer"
+)
+
+// errOriginalGone — письма, на которое отвечают, больше нет в папке уведомления.
+var errOriginalGone = errors.New("original message not found")
+
+// accountSMTPConfig собирает параметры SMTP аккаунта; OAuth2 использует тот же источник токенов, что и IMAP.
+func accountSMTPConfig(acc config.Account) smtp.Config {
+	cfg := smtp.Config{
+		Host:     acc.SMTPHost,
+		Port:     acc.SMTPPort,
+		Username: acc.SMTPUsername,
+		Password: acc.SMTPPassword,
+		Security: acc.SMTPSecurity,
+		TLS: imapPkg.TLSOptions{
+			CAFile:      acc.SMTPTLSCAFile,
+			Fingerprint: acc.SMTPTLSFingerprint,
+			SkipVerify:  acc.SMTPTLSSkipVerify,
+		},
+		Auth: acc.SMTPAuth,
+	}
+	if v, ok := accountTokens.Load(acc.Name); ok {
+		cfg.Tokens = v.(*oauth.TokenSource)
+	}
+	return cfg
+}
+
+// handleReply отправляет ответ на письмо: текст сообщения, которым пользователь ответил
+// в Telegram на уведомление. Отвечать могут только пользователи из TELEGRAM_ALLOWED_USERS. Ответ на вопрос «кому переслать» передаётся в handleForwardPrompt,
+// остальные сообщения игнорируются.
+func handleReply(cfg config.Config, bot *tgbotapi.BotAPI, store *viewer.Store, st *state.Store, msg *tgbotapi.Message) {
+	if handleForwardPrompt(cfg, bot, store, msg) {
+		return
+	}
+	chatID, notifID := msg.Chat.ID, msg.ReplyToMessage.MessageID
+	key, _, found, err := st.FindNotification(chatID, notifID)
+	if err != nil {
+		log.Printf("state find_notification error chat_id=%d msg_id=%d: %v", chatID, notifID, err)
+		return
+	}
+	if !found {
+		return
+	}
+	acc, ok := accountByStateID(cfg, key.Account)
+	if !ok {
+		return
+	}
+	notify := func(text string) {
+		if err := telegram.SendReply(bot, chatID, msg.MessageID, text); err != nil {
+			log.Printf("tg reply notice error chat_id=%d msg_id=%d err=%v", chatID, msg.MessageID, err)
+		}
+	}
+	if msg.From == nil {
+		return
+	}
+	if notice, ok := allowedUser(cfg, "reply", "Replying to emails", msg.From.ID, chatID); !ok {
+		notify(notice)
+		return
+	}
+	if !acc.CanReply() {
+		notify("Replies are not configured for account " + acc.Name + " (smtp.host)")
+		return
+	}
+	text := strings.TrimSpace(msg.Text)
+	if text == "" {
+		notify("Only text replies can be sent")
+		return
+	}
+
+	reply, err := sendReply(cfg, acc, key, text)
+	if err != nil {
+		notify("❌ Reply not sent: " + err.Error())
+		log.Printf("tg reply 500 account=%s mailbox=%s uid=%d chat_id=%d msg_id=%d err=%v", acc.Name, key.Mailbox, key.UID, chatID, notifID, err)
+		return
+	}
+	notify("✉️ Reply sent to " + strings.Join(reply.To, ", "))
+	log.Printf("tg reply ok account=%s mailbox=%s uid=%d to=%s chat_id=%d msg_id=%d", acc.Name, key.Mailbox, key.UID, strings.Join(reply.To, ","), chatID, notifID)
+	// Копия в «Отправленных» и \Answered — после отправки: их сбой не отменяет ответ
+	saveSent(acc, key, reply, "mark_answered", imapPkg.MarkAnswered)
+}
+
+// sendReply загружает исходное письмо, собирает ответ и отправляет его через SMTP аккаунта.
+func sendReply(cfg config.Config, acc config.Account, key state.Key, text string) (email.Outgoing, error) {
+	from, err := mail.ParseAddress(acc.SMTPFrom)
+	if err != nil {
+		return email.Outgoing{}, err
+	}
+	mgr, ok := imapManager(acc.Name)
+	if !ok {
+		return email.Outgoing{}, fmt.Errorf("no imap connection for account %q", acc.Name)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), imapActionTimeout)
+	defer cancel()
+	var orig *imapPkg.Email
+	var refs []string
+	err = mgr.Do(ctx, key.Mailbox, func(m *imapPkg.Conn, status imapPkg.MailboxStatus) error {
+		if status.UIDValidity != key.UIDValidity {
+			return fmt.Errorf("%w: state=%d mailbox=%d", imapPkg.ErrUIDValidityChanged, key.UIDValidity, status.UIDValidity)
+		}
+		headers, err := imapPkg.FetchHeaders(m, []int{key.UID})
+		if err != nil {
+			return err
+		}
+		if orig = headers[key.UID]; orig == nil {
+			return errOriginalGone
+		}
+		if refs, err = imapPkg.FetchReferences(m, key.UID); err != nil {
+			return err
+		}
+		if !acc.ReplyQuote {
+			return nil
+		}
+		return imapPkg.FetchBodies(m, []*imapPkg.Email{orig}, imapPkg.FetchOptions{MaxBodySize: cfg.MaxBodySize, Decoder: email.DecodeText})
+	})
+	if err != nil {
+		return email.Outgoing{}, err
+	}
+	reply, err := email.BuildReply(email.ReplyOptions{
+		From:       from,
+		Original:   orig,
+		References: refs,
+		Text:       text,
+		Quote:      acc.ReplyQuote,
+	})
+	if err != nil {
+		return email.Outgoing{}, err
+	}
+	if err := smtp.Send(accountSMTPConfig(acc), from.Address, reply.To, reply.Raw); err != nil {
+		return email.Outgoing{}, err
+	}
+	return reply, nil
+}
+
+// saveSent кладёт копию отправленного письма в папку отправленных (если это не отключено)
+// и отмечает исходное письмо функцией mark (\Answered, $Forwarded); op — её имя для лога.
+// У нового письма (/compose) исходного нет: mark — nil.
+func saveSent(acc config.Account, key state.Key, out email.Outgoing, op string, mark func(m *imapPkg.Conn, uid int) error) {
+	mgr, ok := imapManager(acc.Name)
+	if !ok {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), imapActionTimeout)
+	defer cancel()
+	if acc.SentMailbox != config.SentMailboxNone {
+		var sent string
+		err := mgr.Do(ctx, "", func(m *imapPkg.Conn, _ imapPkg.MailboxStatus) error {
+			var err error
+			if sent, err = sentMailbox(m, acc); err != nil {
+				return err
+			}
+			return imapPkg.AppendMessage(m, sent, out.Raw)
+		})
+		if err != nil {
+			log.Printf("imap append_sent error account=%s mailbox=%q message_id=%s: %v", acc.Name, sent, out.MessageID, err)
+		} else {
+			log.Printf("imap append_sent ok account=%s mailbox=%q message_id=%s", acc.Name, sent, out.MessageID)
+		}
+	}
+	if mark == nil {
+		return
+	}
+	err := mgr.Do(ctx, key.Mailbox, func(m *imapPkg.Conn, status imapPkg.MailboxStatus) error {
+		if status.UIDValidity != key.UIDValidity {
+			return imapPkg.ErrUIDValidityChanged
+		}
+		return mark(m, key.UID)
+	})
+	if err != nil {
+		log.Printf("imap %s error account=%s mailbox=%s uid=%d: %v", op, acc.Name, key.Mailbox, key.UID, err)
+	}
+}
+
+// sentMailbox возвращает папку для копий ответов: из настроек аккаунта или с ролью \Sent из LIST.
+func sentMailbox(m *imapPkg.Conn, acc config.Account) (string, error) {
+	if acc.SentMailbox != "" {
+		return acc.SentMailbox, nil
+	}
+	special, err := imapPkg.SpecialUseMailboxes(m)
+	if err != nil {
+		return "", err
+	}
+	if name := special[imapPkg.SpecialSent]; name != "" {
+		return name, nil
+	}
+	return "", fmt.Errorf("server reports no %s mailbox, set smtp.sent_mailbox", imapPkg.SpecialSent)
+}
+
+// accountByStateID находит аккаунт по идентификатору из ключей состояния.
+func accountByStateID(cfg config.Config, id string) (config.Account, bool) {
+	for _, acc := range cfg.Accounts {
+		if acc.StateID() == id {
+			return acc, true
+		}
+	}
+	return config.Account{}, false
+}
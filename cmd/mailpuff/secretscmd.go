@@ -0,0 +1,67 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"os"
+
+	"mailpuff/pkg/secrets"
+)
+
+// runSecretsCommand обрабатывает `mailpuff secrets encrypt|decrypt [-in path] [-out path]`.
+// Ключ берётся из SECRETS_KEY или SECRETS_KEY_FILE; по умолчанию читается stdin и пишется stdout.
+// Возвращает код завершения процесса.
+func runSecretsCommand(args []string) int {
+	usage := "usage: mailpuff secrets encrypt|decrypt [-in path] [-out path]"
+	if len(args) == 0 || (args[0] != "encrypt" && args[0] != "decrypt") {
+		fmt.Fprintln(os.Stderr, usage)
+		return 2
+	}
+	fs := flag.NewFlagSet("secrets "+args[0], flag.ContinueOnError)
+	in := fs.String("in", "", "input file (default stdin)")
+	out := fs.String("out", "", "output file (default stdout)")
+	if err := fs.Parse(args[1:]); err != nil {
+		return 2
+	}
+	key, err := secrets.KeyFromEnv()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	var data []byte
+	if *in == "" {
+		data, err = io.ReadAll(os.Stdin)
+	} else {
+		data, err = os.ReadFile(*in)
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	var result []byte
+	if args[0] == "encrypt" {
+		// проверяем формат заранее, чтобы не зашифровать файл, который потом не прочитается
+		if _, err := secrets.ParseEnv(data); err != nil {
+			fmt.Fprintf(os.Stderr, "invalid secrets: %v\n", err)
+			return 1
+		}
+		result, err = secrets.Encrypt(data, key)
+	} else {
+		result, err = secrets.Decrypt(data, key)
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	if *out == "" {
+		_, err = os.Stdout.Write(result)
+	} else {
+		err = os.WriteFile(*out, result, 0o600)
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	return 0
+}
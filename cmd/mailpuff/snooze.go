@@ -0,0 +1,305 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+
+	"mailpuff/pkg/config"
+	"mailpuff/pkg/email"
+	imapPkg "mailpuff/pkg/imap"
+	"mailpuff/pkg/state"
+	"mailpuff/pkg/viewer"
+)
+
+// snoozeCheckInterval — как часто проверять, не пора ли вернуть отложенные письма
+const snoozeCheckInterval = 30 * time.Second
+
+// Часы возвращения для вариантов «вечером», «завтра» и «на следующей неделе» (местное время, TZ).
+const (
+	snoozeEveningHour = 19
+	snoozeMorningHour = 8
+)
+
+// snoozedMarker — строка над текстом уведомления о вернувшемся письме
+const snoozedMarker = "⏰ <b>Snoozed</b>"
+
+// errSnoozeGone — отложенное письмо больше не найти: его удалили или перенесли вручную.
+var errSnoozeGone = errors.New("snoozed message not found")
+
+// errSnoozeNoAccount — аккаунта отложенного письма нет в конфигурации. Запись остаётся:
+// аккаунт могли временно убрать, а письмо может лежать в папке для отложенных.
+var errSnoozeNoAccount = errors.New("snoozed message account is not configured")
+
+// snoozeOrphans — ID записей, о которых уже написано в лог, что их аккаунт не настроен
+var snoozeOrphans sync.Map
+
+type snoozeOption struct {
+	id    string
+	label string
+}
+
+// snoozeOptions возвращает варианты меню «Snooze»; «Tonight» предлагается, пока до вечера больше часа.
+func snoozeOptions(now time.Time) []snoozeOption {
+	opts := []snoozeOption{{id: "1h", label: "In 1 hour"}}
+	if t, ok := snoozeUntil("tonight", now); ok {
+		opts = append(opts, snoozeOption{id: "tonight", label: "Tonight " + t.Format("15:04")})
+	}
+	tomorrow, _ := snoozeUntil("tomorrow", now)
+	week, _ := snoozeUntil("week", now)
+	return append(opts,
+		snoozeOption{id: "tomorrow", label: "Tomorrow " + tomorrow.Format("15:04")},
+		snoozeOption{id: "week", label: "Next week " + week.Format("Mon 15:04")},
+	)
+}
+
+// snoozeUntil возвращает время возвращения письма для варианта id; false — вариант неизвестен или уже неприменим.
+func snoozeUntil(id string, now time.Time) (time.Time, bool) {
+	day := func(offset, hour int) time.Time {
+		return time.Date(now.Year(), now.Month(), now.Day()+offset, hour, 0, 0, 0, now.Location())
+	}
+	switch id {
+	case "1h":
+		return now.Add(time.Hour), true
+	case "tonight":
+		t := day(0, snoozeEveningHour)
+		return t, t.Sub(now) > time.Hour
+	case "tomorrow":
+		return day(1, snoozeMorningHour), true
+	case "week":
+		// Ближайший понедельник после сегодняшнего дня
+		offset := (8 - int(now.Weekday())) % 7
+		if offset == 0 {
+			offset = 7
+		}
+		return day(offset, snoozeMorningHour), true
+	}
+	return time.Time{}, false
+}
+
+// snoozeMessage откладывает письмо страницы до until: помечает его прочитанным и, если у аккаунта
+// задана папка для отложенных, переносит туда. Запись сохраняется до изменений на сервере,
+// чтобы письмо не потерялось в той папке при сбое. Запись привязана к StateID аккаунта:
+// переименование аккаунта в конфигурации её не теряет.
+func snoozeMessage(cfg config.Config, bot *tgbotapi.BotAPI, st *state.Store, cq *tgbotapi.CallbackQuery, acc config.Account, page *viewer.Page, until time.Time) {
+	chatID, msgID := cq.Message.Chat.ID, cq.Message.MessageID
+	ref := pageRef(page)
+	sn := state.Snooze{
+		Account:        acc.StateID(),
+		Mailbox:        page.Mailbox,
+		UIDValidity:    page.UIDValidity,
+		UID:            page.IMAPUID,
+		EmailMessageID: ref.emailMessageID,
+		Until:          until,
+	}
+	if sn.EmailMessageID == "" {
+		rec, _, _ := st.Processed(state.Key{Account: acc.StateID(), Mailbox: page.Mailbox, UIDValidity: page.UIDValidity, UID: page.IMAPUID})
+		sn.EmailMessageID = rec.EmailMessageID
+	}
+	// В другой папке письмо находится по Message-ID; без него откладываем на месте
+	if acc.SnoozeMailbox != "" && acc.SnoozeMailbox != page.Mailbox && sn.EmailMessageID != "" {
+		sn.Parked = acc.SnoozeMailbox
+	}
+	id, err := st.SaveSnooze(sn)
+	if err != nil {
+		_ = answerCallback(bot, cq.ID, "Failed to snooze")
+		log.Printf("tg callback snooze 500 account=%s mailbox=%s uid=%d id=%s err=%v", acc.Name, page.Mailbox, page.IMAPUID, maskID(page.ID), err)
+		return
+	}
+
+	refKey := mailboxUID{account: page.Account, mailbox: page.Mailbox, uid: page.IMAPUID}
+	refV, hasRef := uidToMsg.LoadAndDelete(refKey)
+	err = onPageMessage(acc, page, func(m *imapPkg.Conn) error {
+		if sn.Parked != "" {
+			// Сначала перенос: если он не удался, письмо остаётся на месте непрочитанным
+			return parkedMove(m, page.IMAPUID, sn.Parked)
+		}
+		return imapPkg.MarkSeen(m, page.IMAPUID)
+	})
+	if err != nil {
+		if hasRef {
+			uidToMsg.Store(refKey, refV)
+		}
+		if derr := st.DeleteSnooze(id); derr != nil {
+			log.Printf("state delete_snooze error account=%s mailbox=%s uid=%d: %v", acc.Name, page.Mailbox, page.IMAPUID, derr)
+		}
+		_ = answerCallback(bot, cq.ID, "Failed to snooze")
+		log.Printf("tg callback snooze 500 account=%s mailbox=%s uid=%d id=%s err=%v", acc.Name, page.Mailbox, page.IMAPUID, maskID(page.ID), err)
+		return
+	}
+	if sn.Parked != "" {
+		// Письмо уже отложено: сбой здесь оставляет его непрочитанным в папке для отложенных
+		if err := markParkedSeen(acc, sn); err != nil {
+			log.Printf("imap mark_seen error account=%s mailbox=%q message_id=%q: %v", acc.Name, sn.Parked, sn.EmailMessageID, err)
+		}
+	}
+	when := until.Format("Mon 02 Jan 15:04")
+	_ = answerCallback(bot, cq.ID, "Snoozed until "+when)
+	if err := closeNotification(bot, cfg, chatID, msgID, page, ref, "⏰ Snoozed until "+when); err != nil {
+		log.Printf("tg callback snooze edit error chat_id=%d msg_id=%d err=%v", chatID, msgID, err)
+	}
+	log.Printf("tg callback snooze ok account=%s mailbox=%s uid=%d parked=%q until=%s chat_id=%d msg_id=%d id=%s", acc.Name, page.Mailbox, page.IMAPUID, sn.Parked, until.Format(time.RFC3339), chatID, msgID, maskID(page.ID))
+}
+
+// parkedMove переносит отложенное письмо. Без UIDPLUS копия в dest создана, а исходное письмо
+// осталось с \Deleted: для отложенного письма этого достаточно — SearchMessageID его пропускает.
+func parkedMove(m *imapPkg.Conn, uid int, dest string) error {
+	err := imapPkg.MoveMessage(m, uid, dest)
+	if errors.Is(err, imapPkg.ErrNotExpunged) {
+		log.Printf("imap move uid=%d dest=%q: %v", uid, dest, err)
+		return nil
+	}
+	return err
+}
+
+// markParkedSeen помечает прочитанным письмо, перенесённое в папку для отложенных; там у него новый UID.
+func markParkedSeen(acc config.Account, sn state.Snooze) error {
+	mgr, ok := imapManager(acc.Name)
+	if !ok {
+		return fmt.Errorf("no imap connection for account %q", acc.Name)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), imapActionTimeout)
+	defer cancel()
+	return mgr.Do(ctx, sn.Parked, func(m *imapPkg.Conn, _ imapPkg.MailboxStatus) error {
+		uids, err := imapPkg.SearchMessageID(m, sn.EmailMessageID)
+		if err != nil {
+			return err
+		}
+		if len(uids) == 0 {
+			return errSnoozeGone
+		}
+		return imapPkg.MarkSeen(m, uids[len(uids)-1])
+	})
+}
+
+// runSnoozes раз в snoozeCheckInterval возвращает письма, время которых пришло. Неудачная попытка
+// повторяется на следующей проверке; забываются только письма, которых больше нет на сервере.
+func runSnoozes(cfg config.Config, bot *tgbotapi.BotAPI, store *viewer.Store, st *state.Store) {
+	for {
+		snoozes, err := st.Snoozes()
+		if err != nil {
+			log.Printf("state snoozes error: %v", err)
+		}
+		now := time.Now()
+		for _, sn := range snoozes {
+			if sn.Until.After(now) {
+				continue
+			}
+			err := wakeSnooze(cfg, bot, store, st, sn)
+			if errors.Is(err, errSnoozeNoAccount) {
+				if _, logged := snoozeOrphans.LoadOrStore(sn.ID, true); !logged {
+					log.Printf("snooze kept account=%s mailbox=%s parked=%q until=%s: %v", sn.Account, sn.Mailbox, sn.Parked, sn.Until.Format(time.RFC3339), err)
+				}
+				continue
+			}
+			snoozeOrphans.Delete(sn.ID)
+			if err != nil && !errors.Is(err, errSnoozeGone) {
+				log.Printf("snooze wake error account=%s mailbox=%s uid=%d parked=%q: %v", sn.Account, sn.Mailbox, sn.UID, sn.Parked, err)
+				continue
+			}
+			if derr := st.DeleteSnooze(sn.ID); derr != nil {
+				log.Printf("state delete_snooze error account=%s mailbox=%s uid=%d: %v", sn.Account, sn.Mailbox, sn.UID, derr)
+			}
+			if err != nil {
+				log.Printf("snooze dropped account=%s mailbox=%s uid=%d parked=%q: %v", sn.Account, sn.Mailbox, sn.UID, sn.Parked, err)
+				continue
+			}
+			log.Printf("snooze wake ok account=%s mailbox=%s message_id=%q", sn.Account, sn.Mailbox, sn.EmailMessageID)
+		}
+		time.Sleep(snoozeCheckInterval)
+	}
+}
+
+// wakeSnooze возвращает отложенное письмо в исходную папку, снимает \Seen и отправляет о нём
+// новое уведомление со своей страницей viewer: прежняя к этому времени может быть уже удалена.
+func wakeSnooze(cfg config.Config, bot *tgbotapi.BotAPI, store *viewer.Store, st *state.Store, sn state.Snooze) error {
+	acc, ok := snoozeAccount(cfg, sn.Account)
+	if !ok {
+		return fmt.Errorf("%w: %q", errSnoozeNoAccount, sn.Account)
+	}
+	mgr, ok := imapManager(acc.Name)
+	if !ok {
+		return fmt.Errorf("no imap connection for account %q", acc.Name)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), imapActionTimeout)
+	defer cancel()
+	if sn.Parked != "" {
+		err := mgr.Do(ctx, sn.Parked, func(m *imapPkg.Conn, _ imapPkg.MailboxStatus) error {
+			uids, err := imapPkg.SearchMessageID(m, sn.EmailMessageID)
+			if err != nil {
+				return err
+			}
+			if len(uids) == 0 {
+				return errSnoozeGone
+			}
+			return parkedMove(m, uids[len(uids)-1], sn.Mailbox)
+		})
+		if err != nil {
+			return err
+		}
+		// Письмо уже в исходной папке под новым UID: повторная попытка должна искать его там
+		sn.Parked, sn.UID = "", 0
+		if _, err := st.SaveSnooze(sn); err != nil {
+			return err
+		}
+	}
+
+	var em *imapPkg.Email
+	var uidValidity uint32
+	err := mgr.Do(ctx, sn.Mailbox, func(m *imapPkg.Conn, status imapPkg.MailboxStatus) error {
+		uid := sn.UID
+		if uid == 0 || status.UIDValidity != sn.UIDValidity {
+			if sn.EmailMessageID == "" {
+				return errSnoozeGone
+			}
+			uids, err := imapPkg.SearchMessageID(m, sn.EmailMessageID)
+			if err != nil {
+				return err
+			}
+			if len(uids) == 0 {
+				return errSnoozeGone
+			}
+			uid = uids[len(uids)-1]
+		}
+		// Отмечаем письмо обработанным до снятия \Seen: иначе наблюдатель папки
+		// сам отправит о нём обычное уведомление
+		key := state.Key{Account: acc.StateID(), Mailbox: sn.Mailbox, UIDValidity: status.UIDValidity, UID: uid}
+		if err := st.MarkProcessed(key, state.Record{EmailMessageID: sn.EmailMessageID}); err != nil {
+			return err
+		}
+		if err := imapPkg.MarkUnseen(m, uid); err != nil {
+			return err
+		}
+		headers, err := imapPkg.FetchHeaders(m, []int{uid})
+		if err != nil {
+			return err
+		}
+		if em = headers[uid]; em == nil {
+			return errSnoozeGone
+		}
+		uidValidity = status.UIDValidity
+		return imapPkg.FetchBodies(m, []*imapPkg.Email{em}, imapPkg.FetchOptions{MaxBodySize: cfg.MaxBodySize, MaxInlineSize: cfg.MaxInlineSize, Decoder: email.DecodeText})
+	})
+	if err != nil {
+		return err
+	}
+	mb, ok := mailboxSettings(acc.Name, sn.Mailbox)
+	if !ok {
+		mb = config.Mailbox{Name: sn.Mailbox}
+	}
+	newMailboxWatcher(cfg, acc, mb, bot, store, st, mgr).notify(em, uidValidity, snoozedMarker)
+	return nil
+}
+
+// snoozeAccount находит аккаунт отложенного письма по StateID; записи прежних версий хранят имя аккаунта.
+func snoozeAccount(cfg config.Config, id string) (config.Account, bool) {
+	if acc, ok := accountByStateID(cfg, id); ok {
+		return acc, true
+	}
+	return cfg.Account(id)
+}
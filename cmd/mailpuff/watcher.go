@@ -0,0 +1,715 @@
+package main
+
+import (
+	"context"
+	"log"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+
+	"mailpuff/pkg/config"
+	"mailpuff/pkg/email"
+	imapPkg "mailpuff/pkg/imap"
+	"mailpuff/pkg/oauth"
+	"mailpuff/pkg/state"
+	"mailpuff/pkg/telegram"
+	"mailpuff/pkg/viewer"
+)
+
+const (
+	// stateRetention — сколько хранятся записи о прочитанных и удалённых письмах: по ним отвечают
+	// на уведомления. Записи непрочитанных писем хранятся, пока письмо не прочитано.
+	stateRetention = 30 * 24 * time.Hour
+	// statePruneInterval — как часто наблюдатель папки чистит её записи
+	statePruneInterval = 24 * time.Hour
+)
+
+// mailboxUID — UID письма имеет смысл только внутри своей папки своего аккаунта.
+type mailboxUID struct {
+	account string
+	mailbox string
+	uid     int
+}
+
+// accountMailbox — папка конкретного аккаунта.
+type accountMailbox struct {
+	account string
+	mailbox string
+}
+
+// watchedMailboxes сопоставляет (аккаунт, папка) -> настройки папки (config.Mailbox)
+var watchedMailboxes sync.Map
+
+// mailboxSettings возвращает настройки отслеживаемой папки аккаунта.
+func mailboxSettings(account, name string) (config.Mailbox, bool) {
+	v, ok := watchedMailboxes.Load(accountMailbox{account: account, mailbox: name})
+	if !ok {
+		return config.Mailbox{}, false
+	}
+	mb, ok := v.(config.Mailbox)
+	return mb, ok
+}
+
+// markSeenOnView сообщает, нужно ли помечать письмо из папки прочитанным при первом просмотре.
+func markSeenOnView(acc config.Account, mailbox string) bool {
+	if mb, ok := mailboxSettings(acc.Name, mailbox); ok && mb.MarkSeen != nil {
+		return *mb.MarkSeen
+	}
+	return acc.MarkSeen
+}
+
+// accountTokens сопоставляет имя аккаунта с OAuth2 -> *oauth.TokenSource (общий для всех его соединений)
+var accountTokens sync.Map
+
+// accountIMAP сопоставляет имя аккаунта -> *imapPkg.Manager (пул сессий и backoff аккаунта)
+var accountIMAP sync.Map
+
+// imapActionTimeout ограничивает разовое действие через пул: ожидание сессии, подключение и команды
+const imapActionTimeout = time.Minute
+
+// imapManager возвращает менеджер соединений аккаунта.
+func imapManager(account string) (*imapPkg.Manager, bool) {
+	v, ok := accountIMAP.Load(account)
+	if !ok {
+		return nil, false
+	}
+	mgr, ok := v.(*imapPkg.Manager)
+	return mgr, ok
+}
+
+// newIMAPManager создаёт менеджер соединений аккаунта по общим настройкам переподключения.
+func newIMAPManager(cfg config.Config, acc config.Account) *imapPkg.Manager {
+	return imapPkg.NewManager(accountIMAPConfig(acc), imapPkg.ManagerOptions{
+		Name:       acc.Name,
+		PoolSize:   cfg.IMAPPoolSize,
+		BackoffMin: cfg.ReconnectMin,
+		BackoffMax: cfg.ReconnectMax,
+	})
+}
+
+// imapHealth возвращает отчёт для /healthz: сколько аккаунтов в каждом состоянии подключения.
+// /healthz доступен без авторизации на адресе viewer, поэтому имён аккаунтов, серверов и текстов
+// ошибок в отчёте нет — подробности пишутся в лог. Сервис здоров, когда все аккаунты подключены.
+func imapHealth(cfg config.Config) func() (bool, any) {
+	return func() (bool, any) {
+		counts := map[string]int{imapPkg.HealthOK: 0, imapPkg.HealthConnecting: 0, imapPkg.HealthDown: 0}
+		for _, acc := range cfg.Accounts {
+			mgr, ok := imapManager(acc.Name)
+			if !ok {
+				continue
+			}
+			counts[mgr.Health().State]++
+		}
+		healthy := counts[imapPkg.HealthConnecting] == 0 && counts[imapPkg.HealthDown] == 0
+		return healthy, map[string]any{"healthy": healthy, "accounts": len(cfg.Accounts), "states": counts}
+	}
+}
+
+// accountIMAPConfig собирает параметры подключения аккаунта.
+func accountIMAPConfig(acc config.Account) imapPkg.Config {
+	cfg := imapPkg.Config{
+		Host:     acc.IMAPHost,
+		Port:     acc.IMAPPort,
+		Username: acc.IMAPUsername,
+		Password: acc.IMAPPassword,
+		Security: acc.IMAPSecurity,
+		TLS: imapPkg.TLSOptions{
+			CAFile:      acc.IMAPTLSCAFile,
+			Fingerprint: acc.IMAPTLSFingerprint,
+			SkipVerify:  acc.IMAPTLSSkipVerify,
+		},
+		Auth: acc.IMAPAuth,
+	}
+	if v, ok := accountTokens.Load(acc.Name); ok {
+		cfg.Tokens = v.(*oauth.TokenSource)
+	}
+	return cfg
+}
+
+// isLocalHost сообщает, что host — локальный адрес (мост вроде ProtonMail Bridge на той же машине).
+func isLocalHost(host string) bool {
+	if strings.EqualFold(host, "localhost") {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
+
+// sleepCtx ждёт d либо отмены ctx; возвращает false, если ctx отменён.
+func sleepCtx(ctx context.Context, d time.Duration) bool {
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+// mailboxWatcher следит за одной папкой: держит к ней соединение (IDLE или опрос),
+// отправляет уведомления о новых письмах и обновляет уже отправленные, когда письмо
+// прочитано в другом клиенте, помечено флагом или удалено.
+type mailboxWatcher struct {
+	cfg     config.Config
+	account config.Account
+	mailbox config.Mailbox
+	bot     *tgbotapi.BotAPI
+	store   *viewer.Store
+	st      *state.Store
+	// imap — соединения аккаунта, общие для всех его папок
+	imap *imapPkg.Manager
+	// label — подпись папки в уведомлении; пустая, если отслеживается единственная папка
+	label string
+	// resyncRefs — привязки Telegram-сообщений прежнего поколения UID по Message-ID.
+	// Заполняется при смене UIDVALIDITY и разбирается по мере нахождения писем под новыми UID.
+	resyncRefs map[string]tgMessageRef
+	// modSeq — MODSEQ, с которого запрашивать изменения уведомлённых писем (CONDSTORE);
+	// 0 — полная сверка. Переживает переподключения, пока не сменился UIDVALIDITY.
+	modSeq uint64
+	// unseenFrom — с какого UID искать новые непрочитанные; 0 — весь UNSEEN папки
+	unseenFrom int
+	// prunedAt — когда записи папки последний раз чистились (pruneState)
+	prunedAt time.Time
+}
+
+// newMailboxWatcher создаёт наблюдатель папки mb аккаунта acc.
+func newMailboxWatcher(cfg config.Config, acc config.Account, mb config.Mailbox, bot *tgbotapi.BotAPI, store *viewer.Store, st *state.Store, mgr *imapPkg.Manager) *mailboxWatcher {
+	// Подпись папки в уведомлениях нужна, только если папок может быть больше одной
+	multiMailbox := len(acc.Mailboxes) > 1 || acc.Mailboxes[0].IsPattern()
+	label := mb.Label
+	if label == "" && multiMailbox {
+		label = mb.Name
+	}
+	if len(cfg.Accounts) > 1 {
+		if label == "" {
+			label = mb.Name
+		}
+		label = acc.Name + " / " + label
+	}
+	return &mailboxWatcher{
+		cfg:        cfg,
+		account:    acc,
+		mailbox:    mb,
+		bot:        bot,
+		store:      store,
+		st:         st,
+		imap:       mgr,
+		label:      label,
+		resyncRefs: make(map[string]tgMessageRef),
+	}
+}
+
+func (w *mailboxWatcher) chatID() int64 {
+	if w.mailbox.ChatID != 0 {
+		return w.mailbox.ChatID
+	}
+	return w.account.TelegramChatID
+}
+
+// run держит одно долгоживущее соединение с папкой до отмены ctx: при поддержке IDLE
+// ждёт push-уведомлений и переподаёт IDLE каждые ForceReconnect; без IDLE опрашивает
+// каждые PollInterval и переподключается раз в ForceReconnect. После ошибок пауза
+// растёт экспоненциально (ReconnectMin..ReconnectMax) и сбрасывается после успешного прохода.
+func (w *mailboxWatcher) run(ctx context.Context) {
+	accName := w.account.Name
+	mailbox := w.mailbox.Name
+	retry := imapPkg.Backoff{Min: w.cfg.ReconnectMin, Max: w.cfg.ReconnectMax}
+	for ctx.Err() == nil {
+		c, status, err := w.imap.Open(ctx, mailbox)
+		if err != nil {
+			if ctx.Err() != nil {
+				break
+			}
+			delay := retry.Next()
+			log.Printf("imap connect error account=%s host=%s port=%d mailbox=%s retry_in=%s: %v", accName, w.account.IMAPHost, w.account.IMAPPort, mailbox, delay.Round(10*time.Millisecond), err)
+			sleepCtx(ctx, delay)
+			continue
+		}
+		uidValidity := status.UIDValidity
+		prev, changed, err := w.st.CheckUIDValidity(w.account.StateID(), status.Name, uidValidity)
+		if err != nil {
+			log.Printf("state uidvalidity check error account=%s mailbox=%s: %v", accName, status.Name, err)
+			_ = c.Close()
+			sleepCtx(ctx, retry.Next())
+			continue
+		}
+		if changed {
+			// Сервер пересоздал папку: все UID прежнего поколения недействительны.
+			// Уже уведомлённые письма будут опознаны по Message-ID и не придут повторно.
+			log.Printf("imap uidvalidity changed account=%s mailbox=%s old=%d new=%d: resyncing by Message-ID", accName, status.Name, prev, uidValidity)
+			w.invalidateUIDs()
+		}
+		if changed || status.HighestModSeq == 0 {
+			w.modSeq = 0
+		}
+		// Первый проход по соединению читает весь UNSEEN: письма могли прийти, пока его не было
+		w.unseenFrom = 0
+		idle := imapPkg.SupportsIdle(c)
+		connectedAt := time.Now()
+		mode := "poll"
+		if idle {
+			mode = "idle"
+		}
+		log.Printf("imap connected account=%s host=%s mailbox=%s mode=%s condstore=%t", accName, w.account.IMAPHost, mailbox, mode, status.HighestModSeq != 0)
+		failed := false
+		for ctx.Err() == nil {
+			if err := w.process(c, status); err != nil {
+				failed = true
+				break
+			}
+			retry.Reset()
+			w.pruneState(c)
+			if !idle {
+				if time.Since(connectedAt)+w.cfg.PollInterval > w.cfg.ForceReconnect {
+					break
+				}
+				sleepCtx(ctx, w.cfg.PollInterval)
+				continue
+			}
+			changed, err := imapPkg.WaitForChange(ctx, c, w.cfg.ForceReconnect)
+			if err != nil {
+				log.Printf("imap idle error account=%s mailbox=%s: %v", accName, mailbox, err)
+				failed = true
+				break
+			}
+			if changed {
+				log.Printf("imap idle wakeup account=%s mailbox=%s", accName, mailbox)
+			}
+		}
+		_ = c.Close()
+		switch {
+		case failed:
+			sleepCtx(ctx, retry.Next())
+		case !idle:
+			sleepCtx(ctx, w.cfg.PollInterval)
+		}
+	}
+	log.Printf("imap watcher stopped account=%s mailbox=%s", accName, mailbox)
+}
+
+// pruneState раз в statePruneInterval удаляет записи папки старше stateRetention, кроме записей
+// непрочитанных писем: иначе они пришли бы повторно. Ошибки только логируются — чистка
+// повторится на следующем проходе.
+func (w *mailboxWatcher) pruneState(c *imapPkg.Conn) {
+	if time.Since(w.prunedAt) < statePruneInterval {
+		return
+	}
+	unseen, err := imapPkg.SearchUnseenFrom(c, 0)
+	if err != nil {
+		log.Printf("state prune error account=%s mailbox=%s: %v", w.account.Name, w.mailbox.Name, err)
+		return
+	}
+	n, err := w.st.PruneProcessed(w.account.StateID(), w.mailbox.Name, time.Now().Add(-stateRetention), unseen)
+	if err != nil {
+		log.Printf("state prune error account=%s mailbox=%s: %v", w.account.Name, w.mailbox.Name, err)
+		return
+	}
+	w.prunedAt = time.Now()
+	if n > 0 {
+		log.Printf("state prune ok account=%s mailbox=%s records=%d", w.account.Name, w.mailbox.Name, n)
+	}
+}
+
+// markProcessed фиксирует письмо как обработанное; ошибку записи только логируем
+func (w *mailboxWatcher) markProcessed(key state.Key, rec state.Record) {
+	if err := w.st.MarkProcessed(key, rec); err != nil {
+		log.Printf("state mark_processed error account=%s mailbox=%s uid=%d: %v", w.account.Name, key.Mailbox, key.UID, err)
+	}
+}
+
+// invalidateUIDs сбрасывает всё, что в памяти было привязано к UID прежнего поколения
+// этой папки, чтобы авто-скрытие не тронуло кнопки чужих писем.
+func (w *mailboxWatcher) invalidateUIDs() {
+	uidToMsg.Range(func(k, v any) bool {
+		key, ok := k.(mailboxUID)
+		if !ok || key.account != w.account.Name || key.mailbox != w.mailbox.Name {
+			return true
+		}
+		if ref, ok := v.(tgMessageRef); ok && ref.emailMessageID != "" {
+			w.resyncRefs[ref.emailMessageID] = ref
+		}
+		uidToMsg.Delete(k)
+		return true
+	})
+}
+
+// resyncByMessageID переносит запись о письме, уже уведомлённом до смены UIDVALIDITY, на новый UID.
+// Возвращает true, если письмо найдено и повторное уведомление не нужно.
+func (w *mailboxWatcher) resyncByMessageID(key state.Key, emailMessageID string) bool {
+	rec, found, err := w.st.TakeResync(key.Account, key.Mailbox, emailMessageID)
+	if err != nil {
+		log.Printf("state resync lookup error account=%s mailbox=%s uid=%d: %v", w.account.Name, key.Mailbox, key.UID, err)
+		return false
+	}
+	if !found {
+		return false
+	}
+	w.markProcessed(key, rec)
+	if ref, ok := w.resyncRefs[emailMessageID]; ok {
+		delete(w.resyncRefs, emailMessageID)
+		if w.store.SetIMAPRef(ref.id, w.account.Name, key.Mailbox, key.UIDValidity, key.UID) {
+			uidToMsg.Store(mailboxUID{account: w.account.Name, mailbox: key.Mailbox, uid: key.UID}, ref)
+		}
+	}
+	log.Printf("imap resync account=%s mailbox=%s uid=%d uidvalidity=%d chat_id=%d msg_id=%d reason=message_id_match", w.account.Name, key.Mailbox, key.UID, key.UIDValidity, rec.ChatID, rec.MessageID)
+	return true
+}
+
+// process обновляет уведомления об уже известных письмах (trackChanges) и отправляет
+// уведомления о новых непрочитанных. Ошибка означает проблему с соединением — его нужно переоткрыть.
+func (w *mailboxWatcher) process(c *imapPkg.Conn, status imapPkg.MailboxStatus) error {
+	mailbox := w.mailbox.Name
+	accName := w.account.Name
+	uidValidity := status.UIDValidity
+	if err := w.trackChanges(c, status); err != nil {
+		return err
+	}
+	uids, err := imapPkg.SearchUnseenFrom(c, w.unseenFrom)
+	if err != nil {
+		log.Printf("imap search_unseen error account=%s mailbox=%s: %v", accName, mailbox, err)
+		return err
+	}
+	if w.unseenFrom == 0 {
+		// Дальше достаточно писем, пришедших после SELECT; при ошибке соединение
+		// переоткрывается и UNSEEN снова читается целиком
+		w.unseenFrom = status.UIDNext
+	}
+	// Заголовки и структура — только для писем, которые ещё не обрабатывались
+	fresh := make([]int, 0, len(uids))
+	for _, uid := range uids {
+		key := state.Key{Account: w.account.StateID(), Mailbox: mailbox, UIDValidity: uidValidity, UID: uid}
+		if _, seen, err := w.st.Processed(key); err != nil {
+			log.Printf("state lookup error account=%s mailbox=%s uid=%d: %v", accName, mailbox, uid, err)
+			continue
+		} else if seen {
+			continue
+		}
+		fresh = append(fresh, uid)
+	}
+	if len(fresh) == 0 {
+		return nil
+	}
+	headers, err := imapPkg.FetchHeaders(c, fresh)
+	if err != nil {
+		log.Printf("imap fetch_headers error account=%s mailbox=%s uids=%v: %v", accName, mailbox, fresh, err)
+		return err
+	}
+	// Тела (только текстовые части) — для писем, о которых действительно нужно уведомить
+	var toLoad []*imapPkg.Email
+	for _, uid := range fresh {
+		em, ok := headers[uid]
+		if !ok {
+			continue
+		}
+		key := state.Key{Account: w.account.StateID(), Mailbox: mailbox, UIDValidity: uidValidity, UID: uid}
+		if w.resyncByMessageID(key, em.MessageID) {
+			continue
+		}
+		toLoad = append(toLoad, em)
+	}
+	if err := imapPkg.FetchBodies(c, toLoad, imapPkg.FetchOptions{MaxBodySize: w.cfg.MaxBodySize, MaxInlineSize: w.cfg.MaxInlineSize, Decoder: email.DecodeText}); err != nil {
+		log.Printf("imap fetch_bodies error account=%s mailbox=%s: %v", accName, mailbox, err)
+		return err
+	}
+	for _, em := range toLoad {
+		w.notify(em, uidValidity, "")
+	}
+	return nil
+}
+
+// notify создаёт страницу viewer и отправляет уведомление о письме; marker — строка над текстом
+// уведомления (например, об отложенном письме). Письмо отмечается обработанным и при ошибке,
+// чтобы не повторять её на каждой проверке.
+func (w *mailboxWatcher) notify(em *imapPkg.Email, uidValidity uint32, marker string) {
+	accName := w.account.Name
+	mailbox := w.mailbox.Name
+	chatID := w.chatID()
+	uid := em.UID
+	key := state.Key{Account: w.account.StateID(), Mailbox: mailbox, UIDValidity: uidValidity, UID: uid}
+	if em.Truncated {
+		log.Printf("imap body truncated account=%s mailbox=%s uid=%d size=%d limit=%d", accName, mailbox, uid, em.Size, w.cfg.MaxBodySize)
+	}
+	sum := email.Summarize(email.FromIMAP(em))
+	if len(sum.Problems) > 0 {
+		log.Printf("email decode_problems account=%s mailbox=%s uid=%d problems=%q", accName, mailbox, uid, sum.Problems)
+	}
+	if sum.HTMLBody == "" {
+		log.Printf("email skip account=%s mailbox=%s uid=%d reason=no_body", accName, mailbox, uid)
+		w.markProcessed(key, state.Record{EmailMessageID: em.MessageID})
+		return
+	}
+	// Создаём страницу в хранилище
+	id, token, err := w.store.CreatePage(sum.HTMLBody, w.account.ViewerPageTTL, w.account.ViewerPageMaxViews)
+	if err != nil {
+		log.Printf("viewer create_page error account=%s mailbox=%s uid=%d: %v", accName, mailbox, uid, err)
+		w.markProcessed(key, state.Record{EmailMessageID: em.MessageID})
+		return
+	}
+	cbKey := genCallbackKey(6)
+	markCbMap.Store(cbKey, markCallbackPayload{ID: id, Token: token})
+	pageToCbKey.Store(id, cbKey)
+	registerActionKey(id, token)
+	ref := tgMessageRef{
+		chatID:         chatID,
+		id:             id,
+		token:          token,
+		emailMessageID: em.MessageID,
+		text:           messageText(w.cfg, w.label, sum, w.account.OwnAddresses()),
+		flagged:        em.Flagged,
+	}
+	if marker != "" {
+		ref.text = marker + "\n" + ref.text
+	}
+	msgID, err := telegram.SendMessage(w.bot, chatID, notificationText(ref, false), messageKeyboard(w.cfg, w.account, ref, true))
+	if err != nil {
+		log.Printf("telegram send error account=%s mailbox=%s uid=%d: %v", accName, mailbox, uid, err)
+		w.markProcessed(key, state.Record{EmailMessageID: em.MessageID})
+		return
+	}
+	w.store.SetMessageRef(id, chatID, msgID)
+	_ = w.store.SetIMAPRef(id, accName, mailbox, uidValidity, uid)
+	// Сохраняем соответствие UID -> Telegram сообщение/страница для обновления при изменениях письма
+	ref.messageID = msgID
+	uidToMsg.Store(mailboxUID{account: accName, mailbox: mailbox, uid: uid}, ref)
+	log.Printf("sent telegram message msg_id=%d account=%s mailbox=%s uid=%d page_id=%s", msgID, accName, mailbox, uid, maskID(id))
+	// Вложения — ответом на уведомление; при повторном уведомлении об отложенном письме не дублируются
+	if w.account.SendAttachments && marker == "" {
+		if page, ok, _ := w.store.Authorize(id, token); ok {
+			go sendAttachments(w.cfg, w.bot, w.store, w.account, page, em, chatID, msgID)
+		}
+	}
+	w.markProcessed(key, state.Record{ChatID: chatID, MessageID: msgID, EmailMessageID: em.MessageID})
+}
+
+// trackChanges сверяет с сервером письма папки, о которых уже отправлены уведомления:
+// у прочитанных в другом клиенте скрывает кнопку "Mark as read", помеченные флагом
+// отмечает звёздочкой, а об удалённых (или перенесённых в другую папку) пишет в сообщении.
+// С CONDSTORE сервер присылает только изменившиеся письма, поэтому проверка не зависит от размера папки.
+func (w *mailboxWatcher) trackChanges(c *imapPkg.Conn, status imapPkg.MailboxStatus) error {
+	accName := w.account.Name
+	mailbox := w.mailbox.Name
+	tracked := make(map[int]tgMessageRef)
+	var uids []int
+	uidToMsg.Range(func(k, v any) bool {
+		key, ok := k.(mailboxUID)
+		if !ok || key.account != accName || key.mailbox != mailbox {
+			return true
+		}
+		if ref, ok := v.(tgMessageRef); ok {
+			tracked[key.uid] = ref
+			uids = append(uids, key.uid)
+		}
+		return true
+	})
+	since := w.modSeq
+	changes, err := imapPkg.TrackChanges(c, uids, since)
+	if err != nil {
+		log.Printf("imap track_changes error account=%s mailbox=%s uids=%d since=%d: %v", accName, mailbox, len(uids), since, err)
+		return err
+	}
+	for uid, flags := range changes.Flags {
+		ref, ok := tracked[uid]
+		if !ok {
+			continue
+		}
+		w.applyFlags(uid, ref, imapPkg.HasFlag(flags, imapPkg.FlagSeen), imapPkg.HasFlag(flags, imapPkg.FlagFlagged))
+	}
+	for _, uid := range changes.Vanished {
+		ref, ok := tracked[uid]
+		if !ok {
+			continue
+		}
+		key := mailboxUID{account: accName, mailbox: mailbox, uid: uid}
+		if err := w.editMessage(ref, true); err != nil {
+			log.Printf("tg edit on vanished failed account=%s mailbox=%s uid=%d chat_id=%d msg_id=%d err=%v", accName, mailbox, uid, ref.chatID, ref.messageID, err)
+			continue
+		}
+		dropCallbackKey(ref.id)
+		dropActionKey(ref.id)
+		uidToMsg.Delete(key)
+		log.Printf("imap vanished account=%s mailbox=%s uid=%d chat_id=%d msg_id=%d id=%s", accName, mailbox, uid, ref.chatID, ref.messageID, maskID(ref.id))
+	}
+	if since == 0 {
+		w.modSeq = status.HighestModSeq
+	}
+	if changes.ModSeq > w.modSeq {
+		w.modSeq = changes.ModSeq
+	}
+	return nil
+}
+
+// applyFlags обновляет сообщение по текущим флагам письма. Снятие \Seen кнопку не возвращает.
+func (w *mailboxWatcher) applyFlags(uid int, ref tgMessageRef, seen, flagged bool) {
+	accName := w.account.Name
+	mailbox := w.mailbox.Name
+	key := mailboxUID{account: accName, mailbox: mailbox, uid: uid}
+	readNow := seen && !ref.seen
+	switch {
+	case flagged != ref.flagged:
+		ref.flagged = flagged
+		ref.seen = ref.seen || seen
+		if err := w.editMessage(ref, false); err != nil {
+			log.Printf("tg edit on flag change failed account=%s mailbox=%s uid=%d chat_id=%d msg_id=%d err=%v", accName, mailbox, uid, ref.chatID, ref.messageID, err)
+			// Оставляем прежнее состояние, попробуем при следующей сверке
+			return
+		}
+		log.Printf("imap flag change account=%s mailbox=%s uid=%d flagged=%t seen=%t chat_id=%d msg_id=%d", accName, mailbox, uid, flagged, ref.seen, ref.chatID, ref.messageID)
+	case readNow:
+		// Письмо прочитано в почтовом клиенте — скрываем кнопку
+		if err := hideMarkButton(w.bot, w.cfg, w.account, ref); err != nil {
+			log.Printf("imap auto-hide button failed account=%s mailbox=%s uid=%d chat_id=%d msg_id=%d err=%v", accName, mailbox, uid, ref.chatID, ref.messageID, err)
+			return
+		}
+		ref.seen = true
+		log.Printf("imap auto-hide button ok account=%s mailbox=%s uid=%d chat_id=%d msg_id=%d id=%s", accName, mailbox, uid, ref.chatID, ref.messageID, maskID(ref.id))
+	default:
+		return
+	}
+	if readNow {
+		dropCallbackKey(ref.id)
+	}
+	uidToMsg.Store(key, ref)
+}
+
+// editMessage перерисовывает уведомление по состоянию письма (см. editNotification).
+func (w *mailboxWatcher) editMessage(ref tgMessageRef, vanished bool) error {
+	return editNotification(w.bot, w.cfg, w.account, ref, vanished)
+}
+
+// editNotification перерисовывает уведомление: исходный текст, строка о состоянии письма
+// и кнопки — "Mark as read", флаг и действия только у письма, которое ещё в папке.
+// Без исходного текста (ссылка собрана из страницы) обновляются только кнопки.
+func editNotification(bot *tgbotapi.BotAPI, cfg config.Config, acc config.Account, ref tgMessageRef, vanished bool) error {
+	kb := messageKeyboard(cfg, acc, ref, !ref.seen && !vanished)
+	if vanished {
+		kb = telegram.Keyboard{ViewURL: kb.ViewURL}
+	}
+	if ref.text == "" {
+		return telegram.EditKeyboard(bot, ref.chatID, ref.messageID, kb)
+	}
+	return telegram.EditMessage(bot, ref.chatID, ref.messageID, notificationText(ref, vanished), kb)
+}
+
+// messageText — текст нового уведомления о письме по шаблону из конфигурации, с анонсом текста.
+// self — адреса владельца аккаунта для строки получателей.
+func messageText(cfg config.Config, folder string, sum email.Summary, self []string) string {
+	return telegram.MessageText(cfg.MessageTemplate, telegram.Notification{
+		Folder:      folder,
+		Subject:     sum.Subject,
+		FromName:    sum.FromName,
+		FromAddress: sum.FromAddress,
+		Recipients:  sum.Addresses.RecipientSummary(self),
+		Preview:     email.PreviewText(sum.Text, cfg.PreviewLength),
+		Date:        sum.Date,
+	})
+}
+
+// notificationText — текст уведомления со строкой о состоянии письма.
+func notificationText(ref tgMessageRef, vanished bool) string {
+	text := ref.text
+	if vanished {
+		return text + "\n\n🗑 Removed from the mailbox (deleted or moved to another folder)"
+	}
+	if ref.flagged {
+		text += "\n\n⭐ Flagged"
+	}
+	return text
+}
+
+// dropCallbackKey забывает callback key кнопки "Mark as read" страницы.
+func dropCallbackKey(pageID string) {
+	if v, ok := pageToCbKey.Load(pageID); ok {
+		if cbKey, _ := v.(string); cbKey != "" {
+			markCbMap.Delete(cbKey)
+		}
+		pageToCbKey.Delete(pageID)
+	}
+}
+
+// resolveMailboxes раскрывает шаблоны из конфигурации в конкретные папки через LIST.
+// Первое совпадение выигрывает: явно перечисленная папка и шаблон не дают дублей.
+func resolveMailboxes(mgr *imapPkg.Manager, acc config.Account) ([]config.Mailbox, error) {
+	hasPattern := false
+	for _, mb := range acc.Mailboxes {
+		if mb.IsPattern() {
+			hasPattern = true
+			break
+		}
+	}
+	if !hasPattern {
+		return acc.Mailboxes, nil
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), imapActionTimeout)
+	defer cancel()
+	var names []string
+	err := mgr.Do(ctx, "", func(c *imapPkg.Conn, _ imapPkg.MailboxStatus) error {
+		var err error
+		names, err = imapPkg.ListMailboxes(c)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	var out []config.Mailbox
+	seen := make(map[string]bool)
+	for _, mb := range acc.Mailboxes {
+		if !mb.IsPattern() {
+			if !seen[mb.Name] {
+				seen[mb.Name] = true
+				out = append(out, mb)
+			}
+			continue
+		}
+		for _, name := range names {
+			if seen[name] || !imapPkg.MatchMailbox(mb.Name, name) {
+				continue
+			}
+			seen[name] = true
+			resolved := mb
+			resolved.Name = name
+			out = append(out, resolved)
+		}
+	}
+	return out, nil
+}
+
+// superviseMailboxes запускает по наблюдателю на каждую отслеживаемую папку аккаунта. Если в
+// конфигурации есть шаблоны, список папок перечитывается раз в ForceReconnect: для новых
+// папок запускаются наблюдатели, наблюдатели исчезнувших папок останавливаются.
+// Каждый аккаунт обслуживается своим супервизором, ошибки одного аккаунта не задерживают другие.
+func superviseMailboxes(cfg config.Config, acc config.Account, mgr *imapPkg.Manager, newWatcher func(mb config.Mailbox) *mailboxWatcher) {
+	running := make(map[string]context.CancelFunc)
+	for {
+		mailboxes, err := resolveMailboxes(mgr, acc)
+		if err != nil {
+			log.Printf("imap list mailboxes error account=%s host=%s: %v", acc.Name, acc.IMAPHost, err)
+			time.Sleep(cfg.PollInterval)
+			continue
+		}
+		wanted := make(map[string]bool, len(mailboxes))
+		for _, mb := range mailboxes {
+			wanted[mb.Name] = true
+			watchedMailboxes.Store(accountMailbox{account: acc.Name, mailbox: mb.Name}, mb)
+			if _, ok := running[mb.Name]; ok {
+				continue
+			}
+			ctx, cancel := context.WithCancel(context.Background())
+			running[mb.Name] = cancel
+			log.Printf("imap watch start account=%s mailbox=%s", acc.Name, mb.Name)
+			go newWatcher(mb).run(ctx)
+		}
+		for name, cancel := range running {
+			if !wanted[name] {
+				log.Printf("imap watch stop account=%s mailbox=%s reason=no_longer_matched", acc.Name, name)
+				cancel()
+				delete(running, name)
+				watchedMailboxes.Delete(accountMailbox{account: acc.Name, mailbox: name})
+			}
+		}
+		time.Sleep(cfg.ForceReconnect)
+	}
+}
@@ -1,111 +1,820 @@
 package config
 
 import (
-	"log"
-	"os"
+	"fmt"
+	"net/mail"
+	"net/url"
+	"regexp"
 	"strconv"
 	"strings"
 	"time"
+
+	"mailpuff/pkg/imap"
+	"mailpuff/pkg/telegram"
 )
 
+// EnvConfigPath — переменная окружения с путём к файлу конфигурации (альтернатива флагу -config).
+const EnvConfigPath = "MAILPUFF_CONFIG"
+
 type Config struct {
-	IMAPHost       string
-	IMAPPort       int
-	IMAPUsername   string
-	IMAPPassword   string
-	IMAPUseTLS     bool
-	Mailbox        string
+	Accounts       []Account
 	PollInterval   time.Duration
 	ForceReconnect time.Duration
-	TelegramToken  string
-	TelegramChatID int64
-	ViewerBaseURL  string
-	MarkSeen       bool
-	HTTPAddr       string
-	ViewerPageTTL  time.Duration
+	// ReconnectMin, ReconnectMax — пределы задержки между неудачными подключениями к IMAP
+	ReconnectMin time.Duration
+	ReconnectMax time.Duration
+	// IMAPPoolSize — сессий на аккаунт для разовых команд
+	IMAPPoolSize int
+	// MaxBodySize — лимит загрузки текстовой части письма в байтах; вложения не загружаются
+	MaxBodySize        int
+	TelegramToken      string
+	TelegramChatID     int64
+	ViewerBaseURL      string
+	MarkSeen           bool
+	HTTPAddr           string
+	ViewerPageTTL      time.Duration
+	ViewerPageMaxViews int
+	DataDir            string
+	// TelegramAllowedUsers — id пользователей Telegram, которым доступны ответы на письма, пересылка,
+	// команда /compose и кнопки действий с письмом, включая флаг.
+	TelegramAllowedUsers []int64
+	// MaxInlineSize — общий размер картинок cid: одного письма, встраиваемых в страницу viewer; 0 — не встраивать.
+	MaxInlineSize int
+	// MessageTemplate — шаблон уведомления о письме; nil — telegram.DefaultTemplate.
+	MessageTemplate *telegram.Template
+	// PreviewLength — длина анонса текста письма в уведомлении; 0 — без анонса.
+	PreviewLength int
+}
+
+// Account — одна IMAP-учётная запись со своими папками, чатом и параметрами viewer.
+// Поля без префиксного значения в окружении наследуют общие настройки.
+type Account struct {
+	// Name — короткое имя аккаунта ([a-z0-9_-]), попадает в callback data и логи.
+	Name         string
+	IMAPHost     string
+	IMAPPort     int
+	IMAPUsername string
+	IMAPPassword string
+	// IMAPSecurity — режим соединения: SecurityTLS, SecurityStartTLS или SecurityPlain.
+	IMAPSecurity string
+	// IMAPTLSCAFile — PEM с корневыми сертификатами вместо системных.
+	IMAPTLSCAFile string
+	// IMAPTLSFingerprint — закреплённый SHA-256 отпечаток сертификата сервера.
+	IMAPTLSFingerprint string
+	// IMAPTLSSkipVerify отключает проверку сертификата.
+	IMAPTLSSkipVerify bool
+	// IMAPAuth — способ аутентификации: AuthLogin, AuthXOAuth2 или AuthOAuthBearer.
+	IMAPAuth string
+	// OAuth — параметры refresh-token flow для IMAPAuth = xoauth2/oauthbearer.
+	OAuth     OAuth
+	Mailboxes []Mailbox
+	// TelegramChatID — чат по умолчанию для уведомлений аккаунта.
+	TelegramChatID     int64
+	MarkSeen           bool
+	ViewerPageTTL      time.Duration
 	ViewerPageMaxViews int
+	// Actions — кнопки действий под уведомлением (ActionArchive, ...) в порядке показа.
+	Actions []string
+	// ArchiveMailbox, TrashMailbox, SpamMailbox — папки для действий; пусто — папка
+	// с ролью \Archive (или \All), \Trash, \Junk из LIST (RFC 6154).
+	ArchiveMailbox string
+	TrashMailbox   string
+	SpamMailbox    string
+	// MoveMailboxes — папки в меню «Move to…»; пусто — все папки аккаунта.
+	MoveMailboxes []string
+	// ForwardAddresses — адресная книга меню «Forward»: "Имя <адрес>" или адрес.
+	ForwardAddresses []string
+	// SnoozeMailbox — куда переносить отложенные письма до их возвращения; пусто — письмо
+	// остаётся в папке и помечается прочитанным.
+	SnoozeMailbox string
+	// SMTPHost — сервер для ответов на письма из Telegram; пусто — ответы выключены.
+	SMTPHost string
+	SMTPPort int
+	// SMTPUsername, SMTPPassword, SMTPAuth — по умолчанию те же, что у IMAP (включая OAuth2).
+	SMTPUsername       string
+	SMTPPassword       string
+	SMTPAuth           string
+	SMTPSecurity       string
+	SMTPTLSCAFile      string
+	SMTPTLSFingerprint string
+	SMTPTLSSkipVerify  bool
+	// SMTPFrom — отправитель ответов в виде "Имя <адрес>" или просто адрес.
+	SMTPFrom string
+	// SentMailbox — папка для копий ответов; пусто — папка с ролью \Sent из LIST,
+	// SentMailboxNone — копии не сохраняются (Gmail кладёт отправленное в «Отправленные» сам).
+	SentMailbox string
+	// ReplyQuote — цитировать исходное письмо под ответом.
+	ReplyQuote bool
+	// SendAttachments — отправлять вложения писем в чат документами в ответ на уведомление.
+	SendAttachments bool
+	// AttachmentMaxSize — вложения крупнее (в байтах) не отправляются в чат,
+	// их можно скачать через viewer; не больше TelegramMaxFileSize.
+	AttachmentMaxSize int
+	// AttachmentAllow, AttachmentDeny — MIME-типы вложений ("application/pdf", "image/*").
+	// Пустой AttachmentAllow разрешает все типы, кроме перечисленных в AttachmentDeny.
+	AttachmentAllow []string
+	AttachmentDeny  []string
+}
+
+// SentMailboxNone — значение SentMailbox, отключающее сохранение копий ответов.
+const SentMailboxNone = "-"
+
+// maxPreviewLength — самый длинный анонс письма: с заголовками уведомления он укладывается в лимит Telegram.
+const maxPreviewLength = 3000
+
+// TelegramMaxFileSize — предел Bot API для файлов, отправляемых ботом.
+const TelegramMaxFileSize = 50 << 20
+
+// DefaultAttachmentDeny — MIME-типы исполняемых файлов и скриптов, которые по умолчанию
+// не отправляются в чат и не отдаются viewer.
+var DefaultAttachmentDeny = []string{
+	"application/x-msdownload",
+	"application/x-msdos-program",
+	"application/x-ms-installer",
+	"application/x-msi",
+	"application/vnd.microsoft.portable-executable",
+	"application/x-executable",
+	"application/x-sh",
+	"application/x-bat",
+	"application/java-archive",
+	"application/javascript",
+	"application/x-javascript",
+	"text/javascript",
+}
+
+// CanReply сообщает, настроена ли у аккаунта отправка ответов через SMTP.
+func (a Account) CanReply() bool {
+	return a.SMTPHost != ""
 }
 
-func getenv(key, def string) string {
-	if v := os.Getenv(key); v != "" {
-		return v
+// OwnAddresses возвращает адреса владельца аккаунта: логин IMAP, если это адрес, и отправитель ответов.
+// По ним уведомление отличает письма «вам» от писем, где вы в копии или не указаны вовсе.
+func (a Account) OwnAddresses() []string {
+	var out []string
+	if strings.Contains(a.IMAPUsername, "@") {
+		out = append(out, a.IMAPUsername)
+	}
+	if from, err := mail.ParseAddress(a.SMTPFrom); err == nil {
+		out = append(out, from.Address)
 	}
-	return def
+	return out
 }
 
-func mustGetenv(key string) string {
-	v := os.Getenv(key)
-	if v == "" {
-		log.Fatalf("required env %s is not set", key)
+// Кнопки действий с письмом в Telegram.
+const (
+	ActionArchive = "archive"
+	ActionDelete  = "delete"
+	ActionForward = "forward"
+	ActionMove    = "move"
+	ActionSnooze  = "snooze"
+	ActionSpam    = "spam"
+)
+
+// AllowedUser сообщает, есть ли пользователь Telegram userID в TelegramAllowedUsers: только такие
+// пользователи отвечают на письма, пересылают их, пишут новые и нажимают кнопки действий.
+func (c Config) AllowedUser(userID int64) bool {
+	for _, id := range c.TelegramAllowedUsers {
+		if id == userID {
+			return true
+		}
 	}
-	return v
+	return false
 }
 
-func parseBoolEnv(key string, def bool) bool {
-	v := strings.ToLower(strings.TrimSpace(os.Getenv(key)))
-	if v == "" {
-		return def
+// HasAction сообщает, включена ли у аккаунта кнопка действия.
+func (a Account) HasAction(action string) bool {
+	for _, x := range a.Actions {
+		if x == action {
+			return true
+		}
 	}
-	if v == "1" || v == "true" || v == "yes" || v == "y" {
+	return false
+}
+
+// AttachmentAllowed сообщает, можно ли отправлять в чат и отдавать через viewer вложение типа mimeType.
+func (a Account) AttachmentAllowed(mimeType string) bool {
+	mimeType = strings.ToLower(mimeType)
+	for _, p := range a.AttachmentDeny {
+		if matchMIME(p, mimeType) {
+			return false
+		}
+	}
+	if len(a.AttachmentAllow) == 0 {
 		return true
 	}
-	if v == "0" || v == "false" || v == "no" || v == "n" {
-		return false
+	for _, p := range a.AttachmentAllow {
+		if matchMIME(p, mimeType) {
+			return true
+		}
 	}
-	return def
+	return false
 }
 
-func parseIntEnv(key string, def int) int {
-	if s := strings.TrimSpace(os.Getenv(key)); s != "" {
-		if n, err := strconv.Atoi(s); err == nil {
-			return n
-		}
+// matchMIME сравнивает MIME-тип с шаблоном: "type/subtype", "type/*" или "*/*".
+func matchMIME(pattern, mimeType string) bool {
+	if pattern == "*/*" || pattern == mimeType {
+		return true
 	}
-	return def
+	prefix, ok := strings.CutSuffix(pattern, "/*")
+	return ok && strings.HasPrefix(mimeType, prefix+"/")
+}
+
+var mimePatternRe = regexp.MustCompile(`^([a-z0-9][a-z0-9!#$&^_.+-]*|\*)/([a-z0-9][a-z0-9!#$&^_.+-]*|\*)$`)
+
+// StateID — идентификатор аккаунта в ключах постоянного состояния. Привязан к серверу
+// и логину, а не к Name, чтобы переименование аккаунта не вызывало повторных уведомлений.
+func (a Account) StateID() string {
+	return a.IMAPUsername + "@" + a.IMAPHost
+}
+
+// Способы аутентификации IMAP.
+const (
+	AuthLogin       = "login"
+	AuthXOAuth2     = "xoauth2"
+	AuthOAuthBearer = "oauthbearer"
+)
+
+// Режимы защиты IMAP-соединения.
+const (
+	SecurityTLS      = "tls"
+	SecurityStartTLS = "starttls"
+	SecurityPlain    = "plain"
+)
+
+// UsesOAuth сообщает, что аккаунт входит по OAuth2 access token, а не по паролю.
+func (a Account) UsesOAuth() bool {
+	return a.IMAPAuth == AuthXOAuth2 || a.IMAPAuth == AuthOAuthBearer
 }
 
-func parseInt64Env(key string, def int64) int64 {
-	if s := strings.TrimSpace(os.Getenv(key)); s != "" {
-		if n, err := strconv.ParseInt(s, 10, 64); err == nil {
-			return n
+// OAuth — клиент OAuth2 и refresh token, выданный пользователем.
+type OAuth struct {
+	TokenURL     string
+	ClientID     string
+	ClientSecret string
+	RefreshToken string
+	Scopes       []string
+}
+
+// oauthProviders — адреса token endpoint и scope по умолчанию для известных провайдеров.
+var oauthProviders = map[string]struct {
+	tokenURL string
+	scopes   []string
+}{
+	"google":    {"https://oauth2.googleapis.com/token", []string{"https://mail.google.com/"}},
+	"microsoft": {"https://login.microsoftonline.com/common/oauth2/v2.0/token", []string{"https://outlook.office.com/IMAP.AccessAsUser.All", "offline_access"}},
+}
+
+// Account возвращает аккаунт по имени.
+func (c Config) Account(name string) (Account, bool) {
+	for _, a := range c.Accounts {
+		if a.Name == name {
+			return a, true
 		}
 	}
-	return def
+	return Account{}, false
+}
+
+// DefaultAccountName — имя единственного аккаунта, заданного переменными без префикса.
+const DefaultAccountName = "default"
+
+var accountNameRe = regexp.MustCompile(`^[a-z0-9_-]{1,32}$`)
+
+// Mailbox — настройки отслеживаемой папки или шаблона папок.
+type Mailbox struct {
+	// Name — имя папки либо шаблон в духе IMAP LIST: '*' — любые символы,
+	// '%' — любые символы в пределах одного уровня иерархии (например, "Projects/*").
+	Name string `yaml:"name" toml:"name"`
+	// Label — подпись папки в уведомлении; по умолчанию имя папки.
+	Label string `yaml:"label" toml:"label"`
+	// ChatID — чат для уведомлений из этой папки; 0 — чат аккаунта.
+	ChatID int64 `yaml:"chat_id" toml:"chat_id"`
+	// MarkSeen переопределяет IMAP_MARK_SEEN для папки; nil — общее значение.
+	MarkSeen *bool `yaml:"mark_seen" toml:"mark_seen"`
+}
+
+// IsPattern сообщает, является ли Name шаблоном, который нужно раскрыть через LIST.
+func (m Mailbox) IsPattern() bool {
+	return strings.ContainsAny(m.Name, "*%")
 }
 
-func parseDurationEnv(key string, def time.Duration) time.Duration {
-	if s := strings.TrimSpace(os.Getenv(key)); s != "" {
-		if d, err := time.ParseDuration(s); err == nil {
-			return d
+// parseMailboxes разбирает IMAP_MAILBOXES: папки через запятую, настройки папки —
+// в формате query-строки после '?', например:
+//
+//	INBOX,Alerts?label=🚨 Alerts&chat_id=-1001234567890,Billing?mark_seen=true,Projects/*
+func parseMailboxes(s string) ([]Mailbox, error) {
+	var out []Mailbox
+	for _, item := range strings.Split(s, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
 		}
-		// allow seconds as integer
-		if n, err := strconv.Atoi(s); err == nil {
-			return time.Duration(n) * time.Second
+		name, query, _ := strings.Cut(item, "?")
+		mb := Mailbox{Name: strings.TrimSpace(name)}
+		if mb.Name == "" {
+			return nil, fmt.Errorf("empty mailbox name in %q", item)
 		}
+		opts, err := url.ParseQuery(query)
+		if err != nil {
+			return nil, fmt.Errorf("mailbox %q: %w", mb.Name, err)
+		}
+		for k, v := range opts {
+			val := strings.TrimSpace(v[len(v)-1])
+			switch k {
+			case "label":
+				mb.Label = val
+			case "chat_id":
+				n, err := strconv.ParseInt(val, 10, 64)
+				if err != nil {
+					return nil, fmt.Errorf("mailbox %q: invalid chat_id %q", mb.Name, val)
+				}
+				mb.ChatID = n
+			case "mark_seen":
+				b, err := strconv.ParseBool(val)
+				if err != nil {
+					return nil, fmt.Errorf("mailbox %q: invalid mark_seen %q", mb.Name, val)
+				}
+				mb.MarkSeen = &b
+			default:
+				return nil, fmt.Errorf("mailbox %q: unknown option %q", mb.Name, k)
+			}
+		}
+		out = append(out, mb)
+	}
+	if len(out) == 0 {
+		return nil, fmt.Errorf("no mailboxes listed")
+	}
+	return out, nil
+}
+
+// ValidationError перечисляет все ошибки конфигурации, найденные за один проход.
+type ValidationError struct {
+	Problems []string
+}
+
+func (e *ValidationError) Error() string {
+	return "invalid configuration:\n  - " + strings.Join(e.Problems, "\n  - ")
+}
+
+// Load собирает конфигурацию: значения из файла path (YAML или TOML, если path не пуст),
+// поверх них — переменные окружения (каждую можно передать файлом через <ИМЯ>_FILE
+// или зашифрованным файлом секретов SECRETS_FILE). Без аккаунтов в файле они читаются из окружения:
+// без ACCOUNTS используется единственный аккаунт из переменных IMAP_*; с ACCOUNTS=work,home
+// каждый аккаунт описывается переменными с префиксом ACCOUNT_<ИМЯ>_ (ACCOUNT_WORK_IMAP_HOST, ...).
+// Все найденные ошибки возвращаются разом в *ValidationError.
+func Load(path string) (Config, error) {
+	return load(&loader{}, path)
+}
+
+// LoadOffline загружает конфигурацию для команд, которым не нужен IMAP (mailpuff ingest):
+// аккаунты не обязательны, а аккаунт по умолчанию без IMAP_HOST пропускается. Аккаунты,
+// заданные явно, проверяются как обычно.
+func LoadOffline(path string) (Config, error) {
+	return load(&loader{offline: true}, path)
+}
+
+func load(l *loader, path string) (Config, error) {
+	raw := defaultFile()
+	if path != "" {
+		if err := l.decodeFile(path, &raw); err != nil {
+			return Config{}, err
+		}
+	}
+	l.loadSecrets(&raw)
+	l.resolveSecretFiles(&raw)
+	l.applyEnv(&raw)
+	cfg := l.build(raw)
+	if len(l.problems) > 0 {
+		return cfg, &ValidationError{Problems: l.problems}
 	}
-	return def
+	return cfg, nil
 }
 
-func Load() Config {
+// build переносит разобранные значения в Config, подставляя наследуемые настройки
+// аккаунтов, и проверяет результат целиком.
+func (l *loader) build(raw fileConfig) Config {
 	cfg := Config{
-		IMAPHost:       mustGetenv("IMAP_HOST"),
-		IMAPPort:       parseIntEnv("IMAP_PORT", 993),
-		IMAPUsername:   mustGetenv("IMAP_USERNAME"),
-		IMAPPassword:   mustGetenv("IMAP_PASSWORD"),
-		IMAPUseTLS:     parseBoolEnv("IMAP_TLS", true),
-		Mailbox:        getenv("IMAP_MAILBOX", "INBOX"),
-		PollInterval:   parseDurationEnv("IMAP_POLL_INTERVAL", 60*time.Second),
-		ForceReconnect: parseDurationEnv("IMAP_FORCE_RECONNECT", 60*time.Second),
-		TelegramToken:  mustGetenv("TELEGRAM_TOKEN"),
-		TelegramChatID: parseInt64Env("TELEGRAM_CHAT_ID", 0),
-		ViewerBaseURL:  mustGetenv("VIEWER_URL_BASE"),
-		MarkSeen:       parseBoolEnv("IMAP_MARK_SEEN", false),
-        HTTPAddr:       getenv("HTTP_ADDR", ":8080"),
-        ViewerPageTTL:  parseDurationEnv("VIEWER_PAGE_TTL", 48*time.Hour),
-        ViewerPageMaxViews: parseIntEnv("VIEWER_PAGE_MAX_VIEWS", 3),
-	}
-	if cfg.TelegramChatID == 0 {
-		log.Fatalf("TELEGRAM_CHAT_ID must be a valid int64")
+		PollInterval:         time.Duration(raw.PollInterval),
+		ForceReconnect:       time.Duration(raw.ForceReconnect),
+		ReconnectMin:         time.Duration(raw.ReconnectMin),
+		ReconnectMax:         time.Duration(raw.ReconnectMax),
+		IMAPPoolSize:         raw.PoolSize,
+		MaxBodySize:          raw.MaxBodySize,
+		MaxInlineSize:        raw.MaxInline,
+		TelegramToken:        raw.Telegram.Token,
+		TelegramChatID:       raw.Telegram.ChatID,
+		TelegramAllowedUsers: raw.Telegram.AllowedUsers,
+		ViewerBaseURL:        raw.Viewer.URLBase,
+		MarkSeen:             raw.MarkSeen,
+		HTTPAddr:             raw.HTTPAddr,
+		ViewerPageTTL:        time.Duration(raw.Viewer.PageTTL),
+		ViewerPageMaxViews:   raw.Viewer.PageMaxViews,
+		DataDir:              raw.DataDir,
+		PreviewLength:        raw.Telegram.PreviewLength,
+	}
+	if cfg.PollInterval <= 0 {
+		l.problemf("poll_interval (IMAP_POLL_INTERVAL) must be positive")
+	}
+	if cfg.ForceReconnect <= 0 {
+		l.problemf("force_reconnect (IMAP_FORCE_RECONNECT) must be positive")
+	}
+	if cfg.ReconnectMin <= 0 {
+		l.problemf("reconnect_min (IMAP_RECONNECT_MIN) must be positive")
+	} else if cfg.ReconnectMax < cfg.ReconnectMin {
+		l.problemf("reconnect_max (IMAP_RECONNECT_MAX) must not be less than reconnect_min, got %s < %s", cfg.ReconnectMax, cfg.ReconnectMin)
+	}
+	if cfg.IMAPPoolSize < 1 || cfg.IMAPPoolSize > 10 {
+		l.problemf("pool_size (IMAP_POOL_SIZE) must be within 1..10, got %d", cfg.IMAPPoolSize)
+	}
+	if cfg.MaxBodySize < 1024 {
+		l.problemf("max_body_size (IMAP_MAX_BODY_SIZE) must be at least 1024 bytes, got %d", cfg.MaxBodySize)
+	}
+	if cfg.MaxInlineSize < 0 {
+		l.problemf("max_inline_size (IMAP_MAX_INLINE_SIZE) must not be negative, got %d", cfg.MaxInlineSize)
+	}
+	if cfg.TelegramToken == "" {
+		l.problemf("telegram.token (TELEGRAM_TOKEN) is required")
+	}
+	for _, id := range cfg.TelegramAllowedUsers {
+		if id <= 0 {
+			l.problemf("telegram.allowed_users (TELEGRAM_ALLOWED_USERS) must list positive user ids, got %d", id)
+		}
+	}
+	if raw.Telegram.MessageTemplate != "" {
+		t, err := telegram.ParseTemplate(raw.Telegram.MessageTemplate)
+		if err != nil {
+			l.problemf("telegram.message_template (TELEGRAM_MESSAGE_TEMPLATE): %v", err)
+		}
+		cfg.MessageTemplate = t
+	}
+	if cfg.PreviewLength < 0 || cfg.PreviewLength > maxPreviewLength {
+		l.problemf("telegram.preview_length (TELEGRAM_PREVIEW_LENGTH) must be within 0..%d, got %d", maxPreviewLength, cfg.PreviewLength)
+	}
+	if cfg.ViewerBaseURL == "" {
+		l.problemf("viewer.url_base (VIEWER_URL_BASE) is required")
+	} else if u, err := url.Parse(cfg.ViewerBaseURL); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		l.problemf("viewer.url_base (VIEWER_URL_BASE) must be an absolute http(s) URL, got %q", cfg.ViewerBaseURL)
+	}
+	if cfg.HTTPAddr == "" {
+		l.problemf("http_addr (HTTP_ADDR) must not be empty")
+	}
+	if cfg.ViewerPageTTL <= 0 {
+		l.problemf("viewer.page_ttl (VIEWER_PAGE_TTL) must be positive")
+	}
+	if cfg.DataDir == "" {
+		l.problemf("data_dir (DATA_DIR) must not be empty")
+	}
+
+	if len(raw.Accounts) == 0 && !l.offline {
+		l.problemf("no accounts configured")
+	}
+	names := make(map[string]bool)
+	stateIDs := make(map[string]string)
+	for _, fa := range raw.Accounts {
+		acc := l.buildAccount(fa, cfg)
+		if acc.Name != "" {
+			if names[acc.Name] {
+				l.problemf("account %q is defined more than once", acc.Name)
+			}
+			names[acc.Name] = true
+		}
+		if acc.IMAPHost != "" && acc.IMAPUsername != "" {
+			if other, ok := stateIDs[acc.StateID()]; ok {
+				l.problemf("account %q duplicates login %s of account %q", acc.Name, acc.StateID(), other)
+			}
+			stateIDs[acc.StateID()] = acc.Name
+		}
+		cfg.Accounts = append(cfg.Accounts, acc)
 	}
 	return cfg
-}
\ No newline at end of file
+}
+
+// buildAccount собирает аккаунт, наследуя незаданные поля из общих настроек cfg.
+func (l *loader) buildAccount(fa fileAccount, cfg Config) Account {
+	acc := Account{
+		Name:               fa.Name,
+		IMAPHost:           fa.IMAP.Host,
+		IMAPPort:           fa.IMAP.Port,
+		IMAPUsername:       fa.IMAP.Username,
+		IMAPPassword:       fa.IMAP.Password,
+		IMAPSecurity:       strings.ToLower(fa.IMAP.Security),
+		IMAPAuth:           strings.ToLower(fa.IMAP.Auth),
+		IMAPTLSCAFile:      fa.IMAP.TLSCA,
+		IMAPTLSFingerprint: fa.IMAP.TLSFingerprint,
+		OAuth: OAuth{
+			TokenURL:     fa.IMAP.OAuth.TokenURL,
+			ClientID:     fa.IMAP.OAuth.ClientID,
+			ClientSecret: fa.IMAP.OAuth.ClientSecret,
+			RefreshToken: fa.IMAP.OAuth.RefreshToken,
+			Scopes:       fa.IMAP.OAuth.Scopes,
+		},
+		Mailboxes:          fa.Mailboxes,
+		TelegramChatID:     fa.TelegramChatID,
+		MarkSeen:           cfg.MarkSeen,
+		ViewerPageTTL:      cfg.ViewerPageTTL,
+		ViewerPageMaxViews: cfg.ViewerPageMaxViews,
+		ArchiveMailbox:     fa.Actions.ArchiveMailbox,
+		TrashMailbox:       fa.Actions.TrashMailbox,
+		SpamMailbox:        fa.Actions.SpamMailbox,
+		MoveMailboxes:      fa.Actions.MoveTo,
+		ForwardAddresses:   fa.Actions.ForwardTo,
+		SnoozeMailbox:      fa.Actions.SnoozeMailbox,
+		SMTPHost:           fa.SMTP.Host,
+		SMTPPort:           fa.SMTP.Port,
+		SMTPUsername:       fa.SMTP.Username,
+		SMTPPassword:       fa.SMTP.Password,
+		SMTPSecurity:       strings.ToLower(fa.SMTP.Security),
+		SMTPTLSCAFile:      fa.SMTP.TLSCA,
+		SMTPTLSFingerprint: fa.SMTP.TLSFingerprint,
+		SMTPFrom:           fa.SMTP.From,
+		SentMailbox:        fa.SMTP.SentMailbox,
+		ReplyQuote:         true,
+		SendAttachments:    fa.Attachments.Send,
+		AttachmentMaxSize:  fa.Attachments.MaxSize,
+		AttachmentDeny:     DefaultAttachmentDeny,
+	}
+	for _, t := range fa.Attachments.Allow {
+		acc.AttachmentAllow = append(acc.AttachmentAllow, strings.ToLower(strings.TrimSpace(t)))
+	}
+	if fa.Attachments.Deny != nil {
+		acc.AttachmentDeny = nil
+		for _, t := range fa.Attachments.Deny {
+			acc.AttachmentDeny = append(acc.AttachmentDeny, strings.ToLower(strings.TrimSpace(t)))
+		}
+	}
+	if acc.AttachmentMaxSize == 0 {
+		acc.AttachmentMaxSize = TelegramMaxFileSize
+	}
+	for _, a := range fa.Actions.Buttons {
+		acc.Actions = append(acc.Actions, strings.ToLower(strings.TrimSpace(a)))
+	}
+	if fa.IMAP.TLSSkipVerify != nil {
+		acc.IMAPTLSSkipVerify = *fa.IMAP.TLSSkipVerify
+	}
+	if acc.IMAPSecurity == "" {
+		acc.IMAPSecurity = SecurityTLS
+		// Прежний смысл tls=false: TLS без проверки сертификата
+		if fa.IMAP.TLS != nil && !*fa.IMAP.TLS {
+			acc.IMAPTLSSkipVerify = true
+		}
+	}
+	if acc.IMAPPort == 0 {
+		acc.IMAPPort = 993
+		if acc.IMAPSecurity != SecurityTLS {
+			acc.IMAPPort = 143
+		}
+	}
+	if acc.IMAPAuth == "" {
+		acc.IMAPAuth = AuthLogin
+	}
+	if acc.TelegramChatID == 0 {
+		acc.TelegramChatID = cfg.TelegramChatID
+	}
+	if fa.MarkSeen != nil {
+		acc.MarkSeen = *fa.MarkSeen
+	}
+	if fa.Viewer.PageTTL != 0 {
+		acc.ViewerPageTTL = time.Duration(fa.Viewer.PageTTL)
+	}
+	if fa.Viewer.PageMaxViews != nil {
+		acc.ViewerPageMaxViews = *fa.Viewer.PageMaxViews
+	}
+	if len(acc.Mailboxes) == 0 {
+		acc.Mailboxes = []Mailbox{{Name: "INBOX"}}
+	}
+
+	where := fmt.Sprintf("account %q", fa.Name)
+	env := func(key string) string { return fa.envPrefix + key }
+	if !accountNameRe.MatchString(fa.Name) {
+		l.problemf("%s: invalid name (allowed: a-z, 0-9, '_', '-', up to 32 chars)", where)
+	}
+	if acc.IMAPHost == "" {
+		l.problemf("%s: imap.host (%s) is required", where, env("IMAP_HOST"))
+	}
+	if acc.IMAPPort < 1 || acc.IMAPPort > 65535 {
+		l.problemf("%s: imap.port (%s) must be within 1..65535, got %d", where, env("IMAP_PORT"), acc.IMAPPort)
+	}
+	if acc.IMAPUsername == "" {
+		l.problemf("%s: imap.username (%s) is required", where, env("IMAP_USERNAME"))
+	}
+	l.checkSecurity(acc, fa, where, env)
+	switch acc.IMAPAuth {
+	case AuthLogin:
+		if acc.IMAPPassword == "" {
+			l.problemf("%s: imap.password (%s) is required", where, env("IMAP_PASSWORD"))
+		}
+	case AuthXOAuth2, AuthOAuthBearer:
+		l.buildOAuth(&acc, fa, where, env)
+	default:
+		l.problemf("%s: imap.auth (%s) must be one of login, xoauth2, oauthbearer, got %q", where, env("IMAP_AUTH"), acc.IMAPAuth)
+	}
+	if acc.TelegramChatID == 0 {
+		if fa.envPrefix == "" {
+			l.problemf("%s: telegram_chat_id (TELEGRAM_CHAT_ID) is required", where)
+		} else {
+			l.problemf("%s: telegram_chat_id (%s or TELEGRAM_CHAT_ID) is required", where, env("TELEGRAM_CHAT_ID"))
+		}
+	}
+	if acc.ViewerPageTTL <= 0 {
+		l.problemf("%s: viewer.page_ttl (%s) must be positive", where, env("VIEWER_PAGE_TTL"))
+	}
+	buttons := make(map[string]bool)
+	for _, a := range acc.Actions {
+		switch a {
+		case ActionArchive, ActionDelete, ActionForward, ActionMove, ActionSnooze, ActionSpam:
+		default:
+			l.problemf("%s: actions.buttons (%s) must list archive, delete, forward, move, snooze, spam, got %q", where, env("IMAP_ACTIONS"), a)
+		}
+		if buttons[a] {
+			l.problemf("%s: actions.buttons (%s) lists %q more than once", where, env("IMAP_ACTIONS"), a)
+		}
+		buttons[a] = true
+	}
+	if buttons[ActionForward] && !acc.CanReply() {
+		l.problemf("%s: actions.buttons (%s) lists forward, which requires smtp.host (%s)", where, env("IMAP_ACTIONS"), env("SMTP_HOST"))
+	}
+	for _, a := range acc.ForwardAddresses {
+		if _, err := mail.ParseAddress(a); err != nil {
+			l.problemf("%s: actions.forward_to (%s): invalid address %q", where, env("IMAP_FORWARD_TO"), a)
+		}
+	}
+	if acc.CanReply() {
+		l.buildSMTP(&acc, fa, where, env)
+	}
+	if acc.AttachmentMaxSize < 0 || acc.AttachmentMaxSize > TelegramMaxFileSize {
+		l.problemf("%s: attachments.max_size (%s) must be within 1..%d (Telegram bot limit), got %d", where, env("ATTACHMENTS_MAX_SIZE"), TelegramMaxFileSize, acc.AttachmentMaxSize)
+	}
+	for _, t := range acc.AttachmentAllow {
+		if !mimePatternRe.MatchString(t) {
+			l.problemf("%s: attachments.allow (%s): invalid MIME type %q", where, env("ATTACHMENTS_ALLOW"), t)
+		}
+	}
+	for _, t := range acc.AttachmentDeny {
+		if !mimePatternRe.MatchString(t) {
+			l.problemf("%s: attachments.deny (%s): invalid MIME type %q", where, env("ATTACHMENTS_DENY"), t)
+		}
+	}
+	seen := make(map[string]bool)
+	for i, mb := range acc.Mailboxes {
+		if strings.TrimSpace(mb.Name) == "" {
+			l.problemf("%s: mailboxes[%d]: name is required", where, i)
+			continue
+		}
+		if seen[mb.Name] {
+			l.problemf("%s: mailbox %q is listed more than once", where, mb.Name)
+		}
+		seen[mb.Name] = true
+	}
+	return acc
+}
+
+// checkSecurity проверяет режим соединения и параметры TLS аккаунта.
+func (l *loader) checkSecurity(acc Account, fa fileAccount, where string, env func(string) string) {
+	switch acc.IMAPSecurity {
+	case SecurityTLS, SecurityStartTLS:
+	case SecurityPlain:
+		if acc.IMAPTLSCAFile != "" || acc.IMAPTLSFingerprint != "" || acc.IMAPTLSSkipVerify {
+			l.problemf("%s: imap.tls_ca, imap.tls_fingerprint and imap.tls_skip_verify have no effect with imap.security (%s) = plain", where, env("IMAP_SECURITY"))
+		}
+		return
+	default:
+		l.problemf("%s: imap.security (%s) must be one of tls, starttls, plain, got %q", where, env("IMAP_SECURITY"), acc.IMAPSecurity)
+		return
+	}
+	if fa.IMAP.Security != "" && fa.IMAP.TLS != nil && !*fa.IMAP.TLS {
+		l.problemf("%s: imap.tls (%s) is deprecated and conflicts with imap.security; use imap.tls_skip_verify", where, env("IMAP_TLS"))
+	}
+	if acc.IMAPTLSCAFile != "" {
+		if _, err := imap.LoadCAFile(acc.IMAPTLSCAFile); err != nil {
+			l.problemf("%s: imap.tls_ca (%s): %v", where, env("IMAP_TLS_CA"), err)
+		}
+	}
+	if acc.IMAPTLSFingerprint != "" {
+		if _, err := imap.ParseFingerprint(acc.IMAPTLSFingerprint); err != nil {
+			l.problemf("%s: imap.tls_fingerprint (%s): %v", where, env("IMAP_TLS_FINGERPRINT"), err)
+		}
+		if acc.IMAPTLSSkipVerify {
+			l.problemf("%s: imap.tls_fingerprint (%s) and imap.tls_skip_verify are mutually exclusive", where, env("IMAP_TLS_FINGERPRINT"))
+		}
+	}
+}
+
+// buildSMTP подставляет умолчания SMTP (порт по режиму защиты, вход и адрес как у IMAP)
+// и проверяет их.
+func (l *loader) buildSMTP(acc *Account, fa fileAccount, where string, env func(string) string) {
+	if fa.SMTP.TLSSkipVerify != nil {
+		acc.SMTPTLSSkipVerify = *fa.SMTP.TLSSkipVerify
+	}
+	if fa.SMTP.Quote != nil {
+		acc.ReplyQuote = *fa.SMTP.Quote
+	}
+	if acc.SMTPSecurity == "" {
+		acc.SMTPSecurity = SecurityTLS
+	}
+	if acc.SMTPPort == 0 {
+		acc.SMTPPort = 465
+		if acc.SMTPSecurity != SecurityTLS {
+			acc.SMTPPort = 587
+		}
+	}
+	if acc.SMTPUsername == "" {
+		if acc.SMTPPassword != "" {
+			l.problemf("%s: smtp.password (%s) requires smtp.username (%s)", where, env("SMTP_PASSWORD"), env("SMTP_USERNAME"))
+		}
+		acc.SMTPUsername, acc.SMTPPassword, acc.SMTPAuth = acc.IMAPUsername, acc.IMAPPassword, acc.IMAPAuth
+	} else {
+		acc.SMTPAuth = AuthLogin
+		if acc.SMTPPassword == "" {
+			l.problemf("%s: smtp.password (%s) is required with smtp.username", where, env("SMTP_PASSWORD"))
+		}
+	}
+	if acc.SMTPFrom == "" && strings.Contains(acc.IMAPUsername, "@") {
+		acc.SMTPFrom = acc.IMAPUsername
+	}
+
+	if acc.SMTPPort < 1 || acc.SMTPPort > 65535 {
+		l.problemf("%s: smtp.port (%s) must be within 1..65535, got %d", where, env("SMTP_PORT"), acc.SMTPPort)
+	}
+	if acc.SMTPFrom == "" {
+		l.problemf("%s: smtp.from (%s) is required when imap.username is not an email address", where, env("SMTP_FROM"))
+	} else if _, err := mail.ParseAddress(acc.SMTPFrom); err != nil {
+		l.problemf("%s: smtp.from (%s) must be an email address, got %q", where, env("SMTP_FROM"), acc.SMTPFrom)
+	}
+	switch acc.SMTPSecurity {
+	case SecurityTLS, SecurityStartTLS:
+	case SecurityPlain:
+		if acc.SMTPTLSCAFile != "" || acc.SMTPTLSFingerprint != "" || acc.SMTPTLSSkipVerify {
+			l.problemf("%s: smtp.tls_ca, smtp.tls_fingerprint and smtp.tls_skip_verify have no effect with smtp.security (%s) = plain", where, env("SMTP_SECURITY"))
+		}
+		return
+	default:
+		l.problemf("%s: smtp.security (%s) must be one of tls, starttls, plain, got %q", where, env("SMTP_SECURITY"), acc.SMTPSecurity)
+		return
+	}
+	if acc.SMTPTLSCAFile != "" {
+		if _, err := imap.LoadCAFile(acc.SMTPTLSCAFile); err != nil {
+			l.problemf("%s: smtp.tls_ca (%s): %v", where, env("SMTP_TLS_CA"), err)
+		}
+	}
+	if acc.SMTPTLSFingerprint != "" {
+		if _, err := imap.ParseFingerprint(acc.SMTPTLSFingerprint); err != nil {
+			l.problemf("%s: smtp.tls_fingerprint (%s): %v", where, env("SMTP_TLS_FINGERPRINT"), err)
+		}
+		if acc.SMTPTLSSkipVerify {
+			l.problemf("%s: smtp.tls_fingerprint (%s) and smtp.tls_skip_verify are mutually exclusive", where, env("SMTP_TLS_FINGERPRINT"))
+		}
+	}
+}
+
+// buildOAuth подставляет адреса провайдера и проверяет параметры OAuth2 аккаунта.
+func (l *loader) buildOAuth(acc *Account, fa fileAccount, where string, env func(string) string) {
+	o := &acc.OAuth
+	if p := strings.ToLower(fa.IMAP.OAuth.Provider); p != "" {
+		preset, ok := oauthProviders[p]
+		if !ok {
+			l.problemf("%s: imap.oauth.provider (%s) must be google or microsoft, got %q", where, env("IMAP_OAUTH_PROVIDER"), p)
+		} else {
+			if o.TokenURL == "" {
+				o.TokenURL = preset.tokenURL
+			}
+			if len(o.Scopes) == 0 {
+				o.Scopes = preset.scopes
+			}
+		}
+	}
+	if o.TokenURL == "" {
+		l.problemf("%s: imap.oauth.token_url (%s) or imap.oauth.provider is required for %s", where, env("IMAP_OAUTH_TOKEN_URL"), acc.IMAPAuth)
+	} else if u, err := url.Parse(o.TokenURL); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		l.problemf("%s: imap.oauth.token_url (%s) must be an absolute http(s) URL, got %q", where, env("IMAP_OAUTH_TOKEN_URL"), o.TokenURL)
+	}
+	if o.ClientID == "" {
+		l.problemf("%s: imap.oauth.client_id (%s) is required for %s", where, env("IMAP_OAUTH_CLIENT_ID"), acc.IMAPAuth)
+	}
+	if o.RefreshToken == "" {
+		l.problemf("%s: imap.oauth.refresh_token (%s) is required for %s", where, env("IMAP_OAUTH_REFRESH_TOKEN"), acc.IMAPAuth)
+	}
+}
+
+// loader накапливает ошибки разбора и проверки, чтобы сообщить обо всех сразу.
+type loader struct {
+	problems []string
+	// secrets — значения из расшифрованного файла секретов (см. loadSecrets)
+	secrets map[string]string
+	// offline — аккаунты не обязательны (LoadOffline)
+	offline bool
+}
+
+func (l *loader) problemf(format string, args ...any) {
+	msg := fmt.Sprintf(format, args...)
+	// одна и та же переменная может читаться и как общая настройка, и как настройка аккаунта
+	for _, p := range l.problems {
+		if p == msg {
+			return
+		}
+	}
+	l.problems = append(l.problems, msg)
+}
+
+// accountEnvPrefix возвращает префикс переменных окружения аккаунта: "ACCOUNT_WORK_" для "work".
+func accountEnvPrefix(name string) string {
+	return "ACCOUNT_" + strings.ToUpper(strings.ReplaceAll(name, "-", "_")) + "_"
+}
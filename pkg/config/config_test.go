@@ -0,0 +1,272 @@
+package config
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// envPrefixes — переменные, которые читает Load; тесты начинают с чистого окружения.
+var envPrefixes = []string{"IMAP_", "SMTP_", "TELEGRAM_", "VIEWER_", "ACCOUNT", "ATTACHMENTS_", "HTTP_ADDR", "DATA_DIR", "SECRETS_", "MAILPUFF_"}
+
+// setEnv очищает окружение конфигурации и задаёт env на время теста.
+func setEnv(t *testing.T, env map[string]string) {
+	t.Helper()
+	for _, kv := range os.Environ() {
+		key, _, _ := strings.Cut(kv, "=")
+		for _, p := range envPrefixes {
+			if strings.HasPrefix(key, p) {
+				t.Setenv(key, "")
+			}
+		}
+	}
+	for k, v := range env {
+		t.Setenv(k, v)
+	}
+}
+
+// baseEnv — минимальная рабочая конфигурация единственного аккаунта из окружения.
+func baseEnv() map[string]string {
+	return map[string]string{
+		"TELEGRAM_TOKEN":   "123:abc",
+		"TELEGRAM_CHAT_ID": "-100",
+		"VIEWER_URL_BASE":  "https://mail.example.com",
+		"IMAP_HOST":        "imap.example.com",
+		"IMAP_USERNAME":    "user@example.com",
+		"IMAP_PASSWORD":    "secret",
+	}
+}
+
+// writeFile создаёт файл name с содержимым data во временном каталоге теста.
+func writeFile(t *testing.T, name, data string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), name)
+	if err := os.WriteFile(path, []byte(data), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestLoadValidation(t *testing.T) {
+	tests := []struct {
+		name string
+		// env накладывается на baseEnv; пустое значение снимает переменную
+		env  map[string]string
+		want []string
+	}{
+		{
+			name: "valid",
+		},
+		{
+			name: "required settings",
+			env:  map[string]string{"TELEGRAM_TOKEN": "", "VIEWER_URL_BASE": "", "IMAP_HOST": "", "IMAP_PASSWORD": ""},
+			want: []string{
+				"telegram.token (TELEGRAM_TOKEN) is required",
+				"viewer.url_base (VIEWER_URL_BASE) is required",
+				`account "default": imap.host (IMAP_HOST) is required`,
+				`account "default": imap.password (IMAP_PASSWORD) is required`,
+			},
+		},
+		{
+			name: "invalid values",
+			env: map[string]string{
+				"IMAP_POOL_SIZE":         "0",
+				"IMAP_PORT":              "70000",
+				"IMAP_SECURITY":          "ssl",
+				"VIEWER_URL_BASE":        "mail.example.com",
+				"TELEGRAM_ALLOWED_USERS": "42,-1",
+			},
+			want: []string{
+				"pool_size (IMAP_POOL_SIZE) must be within 1..10, got 0",
+				`viewer.url_base (VIEWER_URL_BASE) must be an absolute http(s) URL, got "mail.example.com"`,
+				"telegram.allowed_users (TELEGRAM_ALLOWED_USERS) must list positive user ids, got -1",
+				`account "default": imap.port (IMAP_PORT) must be within 1..65535, got 70000`,
+				`account "default": imap.security (IMAP_SECURITY) must be one of tls, starttls, plain, got "ssl"`,
+			},
+		},
+		{
+			name: "unparsable values",
+			env:  map[string]string{"IMAP_POLL_INTERVAL": "soon", "IMAP_MAX_BODY_SIZE": "2MB", "IMAP_MARK_SEEN": "maybe"},
+			want: []string{
+				"IMAP_POLL_INTERVAL:",
+				`IMAP_MAX_BODY_SIZE: invalid integer "2MB"`,
+				`IMAP_MARK_SEEN: invalid boolean "maybe"`,
+			},
+		},
+		{
+			name: "reconnect bounds",
+			env:  map[string]string{"IMAP_RECONNECT_MIN": "1m", "IMAP_RECONNECT_MAX": "10s"},
+			want: []string{"reconnect_max (IMAP_RECONNECT_MAX) must not be less than reconnect_min, got 10s < 1m0s"},
+		},
+		{
+			name: "actions",
+			env:  map[string]string{"IMAP_ACTIONS": "archive,burn,archive,forward"},
+			want: []string{
+				`account "default": actions.buttons (IMAP_ACTIONS) must list archive, delete, forward, move, snooze, spam, got "burn"`,
+				`account "default": actions.buttons (IMAP_ACTIONS) lists "archive" more than once`,
+				`account "default": actions.buttons (IMAP_ACTIONS) lists forward, which requires smtp.host (SMTP_HOST)`,
+			},
+		},
+		{
+			name: "prefixed accounts",
+			env: map[string]string{
+				"ACCOUNTS":                   "work,home",
+				"ACCOUNT_WORK_IMAP_HOST":     "imap.work.example.com",
+				"ACCOUNT_WORK_IMAP_USERNAME": "me@work.example.com",
+				"ACCOUNT_WORK_IMAP_PASSWORD": "w",
+				"ACCOUNT_HOME_IMAP_HOST":     "imap.home.example.com",
+				"ACCOUNT_HOME_IMAP_PASSWORD": "h",
+			},
+			want: []string{`account "home": imap.username (ACCOUNT_HOME_IMAP_USERNAME) is required`},
+		},
+		{
+			name: "duplicate login",
+			env: map[string]string{
+				"ACCOUNTS":                "a,b",
+				"ACCOUNT_A_IMAP_HOST":     "imap.example.com",
+				"ACCOUNT_A_IMAP_USERNAME": "me@example.com",
+				"ACCOUNT_A_IMAP_PASSWORD": "x",
+				"ACCOUNT_B_IMAP_HOST":     "imap.example.com",
+				"ACCOUNT_B_IMAP_USERNAME": "me@example.com",
+				"ACCOUNT_B_IMAP_PASSWORD": "y",
+			},
+			want: []string{`account "b" duplicates login me@example.com@imap.example.com of account "a"`},
+		},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			env := baseEnv()
+			for k, v := range tc.env {
+				env[k] = v
+			}
+			setEnv(t, env)
+			_, err := Load("")
+			if len(tc.want) == 0 {
+				if err != nil {
+					t.Fatalf("Load: %v", err)
+				}
+				return
+			}
+			var verr *ValidationError
+			if !errors.As(err, &verr) {
+				t.Fatalf("Load: err = %v, want *ValidationError", err)
+			}
+			// Все ошибки перечисляются за один проход, каждая — один раз
+			if len(verr.Problems) != len(tc.want) {
+				t.Errorf("got %d problems, want %d:\n%s", len(verr.Problems), len(tc.want), verr)
+			}
+			for _, w := range tc.want {
+				found := false
+				for _, p := range verr.Problems {
+					if strings.HasPrefix(p, w) {
+						found = true
+						break
+					}
+				}
+				if !found {
+					t.Errorf("missing problem %q in:\n%s", w, verr)
+				}
+			}
+		})
+	}
+}
+
+func TestLoadEnvOverridesFile(t *testing.T) {
+	path := writeFile(t, "mailpuff.yaml", `
+poll_interval: 30s
+telegram:
+  token: file-token
+  chat_id: -1
+  allowed_users: [1, 2]
+viewer:
+  url_base: https://file.example.com
+  page_max_views: 5
+accounts:
+  - name: work
+    imap:
+      host: imap.work.example.com
+      username: me@work.example.com
+      password: file-password
+    mailboxes:
+      - name: INBOX
+    viewer:
+      page_max_views: 1
+  - name: home
+    imap:
+      host: imap.home.example.com
+      username: me@home.example.com
+      password: home-password
+      security: starttls
+`)
+	setEnv(t, map[string]string{
+		"IMAP_POLL_INTERVAL":            "2m",
+		"TELEGRAM_ALLOWED_USERS":        "7, 8",
+		"VIEWER_PAGE_MAX_VIEWS":         "9",
+		"ACCOUNT_WORK_IMAP_PASSWORD":    "env-password",
+		"ACCOUNT_WORK_IMAP_MAILBOXES":   "INBOX, Lists/*?chat_id=-5",
+		"ACCOUNT_HOME_TELEGRAM_CHAT_ID": "-2",
+	})
+	cfg, err := Load(path)
+	if err != nil {
+		t.Fatalf("Load: %v", err)
+	}
+	if cfg.PollInterval != 2*time.Minute {
+		t.Errorf("PollInterval = %s, want the env value 2m", cfg.PollInterval)
+	}
+	if cfg.TelegramToken != "file-token" {
+		t.Errorf("TelegramToken = %q, want the file value", cfg.TelegramToken)
+	}
+	if got := cfg.TelegramAllowedUsers; len(got) != 2 || got[0] != 7 || got[1] != 8 {
+		t.Errorf("TelegramAllowedUsers = %v, want [7 8]", got)
+	}
+	work, ok := cfg.Account("work")
+	if !ok {
+		t.Fatal("account work is missing")
+	}
+	home, _ := cfg.Account("home")
+	for _, tc := range []struct {
+		name      string
+		got, want any
+	}{
+		{"work password", work.IMAPPassword, "env-password"},
+		{"work mailboxes", len(work.Mailboxes), 2},
+		{"work pattern", work.Mailboxes[len(work.Mailboxes)-1].Name, "Lists/*"},
+		{"work pattern chat", work.Mailboxes[len(work.Mailboxes)-1].ChatID, int64(-5)},
+		{"work chat", work.TelegramChatID, int64(-1)},
+		{"work max views", work.ViewerPageMaxViews, 1},
+		{"home chat", home.TelegramChatID, int64(-2)},
+		{"home max views", home.ViewerPageMaxViews, 9},
+		{"home port", home.IMAPPort, 143},
+		{"home mailboxes", home.Mailboxes[0].Name, "INBOX"},
+	} {
+		if tc.got != tc.want {
+			t.Errorf("%s = %v, want %v", tc.name, tc.got, tc.want)
+		}
+	}
+}
+
+func TestLoadFileProblems(t *testing.T) {
+	tests := []struct {
+		name, file, data string
+		accounts         string
+		want             string
+	}{
+		{name: "unknown yaml key", file: "c.yaml", data: "telegram:\n  tokne: x\n", want: `unknown key "tokne"`},
+		{name: "unknown toml key", file: "c.toml", data: "[telegram]\ntokne = \"x\"\n", want: `unknown key "telegram.tokne"`},
+		{name: "accounts with ACCOUNTS", file: "c.yaml", data: "accounts:\n  - name: work\n", accounts: "home", want: "ACCOUNTS cannot be combined with accounts defined in the config file"},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			env := baseEnv()
+			env["ACCOUNTS"] = tc.accounts
+			setEnv(t, env)
+			_, err := Load(writeFile(t, tc.file, tc.data))
+			if err == nil || !strings.Contains(err.Error(), tc.want) {
+				t.Fatalf("Load: err = %v, want it to mention %q", err, tc.want)
+			}
+		})
+	}
+}
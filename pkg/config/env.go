@@ -0,0 +1,272 @@
+package config
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+
+	"mailpuff/pkg/secrets"
+)
+
+// applyEnv накладывает переменные окружения поверх значений из файла.
+// Без аккаунтов в файле аккаунты целиком описываются окружением.
+func (l *loader) applyEnv(raw *fileConfig) {
+	l.envDuration("IMAP_POLL_INTERVAL", &raw.PollInterval)
+	l.envDuration("IMAP_FORCE_RECONNECT", &raw.ForceReconnect)
+	l.envDuration("IMAP_RECONNECT_MIN", &raw.ReconnectMin)
+	l.envDuration("IMAP_RECONNECT_MAX", &raw.ReconnectMax)
+	l.envInt("IMAP_POOL_SIZE", &raw.PoolSize)
+	l.envInt("IMAP_MAX_BODY_SIZE", &raw.MaxBodySize)
+	l.envInt("IMAP_MAX_INLINE_SIZE", &raw.MaxInline)
+	l.envString("TELEGRAM_TOKEN", &raw.Telegram.Token)
+	l.envInt64("TELEGRAM_CHAT_ID", &raw.Telegram.ChatID)
+	l.envInt64List("TELEGRAM_ALLOWED_USERS", &raw.Telegram.AllowedUsers)
+	l.envString("TELEGRAM_MESSAGE_TEMPLATE", &raw.Telegram.MessageTemplate)
+	l.envInt("TELEGRAM_PREVIEW_LENGTH", &raw.Telegram.PreviewLength)
+	l.envString("VIEWER_URL_BASE", &raw.Viewer.URLBase)
+	l.envBool("IMAP_MARK_SEEN", &raw.MarkSeen)
+	l.envString("HTTP_ADDR", &raw.HTTPAddr)
+	l.envDuration("VIEWER_PAGE_TTL", &raw.Viewer.PageTTL)
+	l.envInt("VIEWER_PAGE_MAX_VIEWS", &raw.Viewer.PageMaxViews)
+	l.envString("DATA_DIR", &raw.DataDir)
+
+	names, hasNames := l.getenv("ACCOUNTS")
+	if len(raw.Accounts) > 0 {
+		if hasNames {
+			l.problemf("ACCOUNTS cannot be combined with accounts defined in the config file")
+		}
+		for i := range raw.Accounts {
+			raw.Accounts[i].envPrefix = accountEnvPrefix(raw.Accounts[i].Name)
+			l.applyAccountEnv(&raw.Accounts[i])
+		}
+		return
+	}
+	if !hasNames {
+		fa := fileAccount{Name: DefaultAccountName}
+		l.applyAccountEnv(&fa)
+		if l.offline && fa.IMAP.Host == "" {
+			return
+		}
+		raw.Accounts = append(raw.Accounts, fa)
+		return
+	}
+	for _, name := range strings.Split(names, ",") {
+		name = strings.ToLower(strings.TrimSpace(name))
+		if name == "" {
+			continue
+		}
+		fa := fileAccount{Name: name, envPrefix: accountEnvPrefix(name)}
+		l.applyAccountEnv(&fa)
+		raw.Accounts = append(raw.Accounts, fa)
+	}
+	if len(raw.Accounts) == 0 {
+		l.problemf("ACCOUNTS is set but lists no accounts")
+	}
+}
+
+// applyAccountEnv читает переопределения аккаунта из переменных с его префиксом.
+func (l *loader) applyAccountEnv(fa *fileAccount) {
+	p := fa.envPrefix
+	l.envString(p+"IMAP_HOST", &fa.IMAP.Host)
+	l.envInt(p+"IMAP_PORT", &fa.IMAP.Port)
+	l.envString(p+"IMAP_USERNAME", &fa.IMAP.Username)
+	l.envString(p+"IMAP_PASSWORD", &fa.IMAP.Password)
+	l.envBoolPtr(p+"IMAP_TLS", &fa.IMAP.TLS)
+	l.envString(p+"IMAP_SECURITY", &fa.IMAP.Security)
+	l.envString(p+"IMAP_TLS_CA", &fa.IMAP.TLSCA)
+	l.envString(p+"IMAP_TLS_FINGERPRINT", &fa.IMAP.TLSFingerprint)
+	l.envBoolPtr(p+"IMAP_TLS_SKIP_VERIFY", &fa.IMAP.TLSSkipVerify)
+	l.envString(p+"IMAP_AUTH", &fa.IMAP.Auth)
+	l.envString(p+"IMAP_OAUTH_PROVIDER", &fa.IMAP.OAuth.Provider)
+	l.envString(p+"IMAP_OAUTH_TOKEN_URL", &fa.IMAP.OAuth.TokenURL)
+	l.envString(p+"IMAP_OAUTH_CLIENT_ID", &fa.IMAP.OAuth.ClientID)
+	l.envString(p+"IMAP_OAUTH_CLIENT_SECRET", &fa.IMAP.OAuth.ClientSecret)
+	l.envString(p+"IMAP_OAUTH_REFRESH_TOKEN", &fa.IMAP.OAuth.RefreshToken)
+	if s, ok := l.getenv(p + "IMAP_OAUTH_SCOPES"); ok {
+		fa.IMAP.OAuth.Scopes = strings.FieldsFunc(s, func(r rune) bool { return r == ',' || r == ' ' })
+	}
+	l.envInt64(p+"TELEGRAM_CHAT_ID", &fa.TelegramChatID)
+	l.envBoolPtr(p+"IMAP_MARK_SEEN", &fa.MarkSeen)
+	l.envDuration(p+"VIEWER_PAGE_TTL", &fa.Viewer.PageTTL)
+	l.envIntPtr(p+"VIEWER_PAGE_MAX_VIEWS", &fa.Viewer.PageMaxViews)
+	l.envList(p+"IMAP_ACTIONS", &fa.Actions.Buttons)
+	l.envString(p+"IMAP_ARCHIVE_MAILBOX", &fa.Actions.ArchiveMailbox)
+	l.envString(p+"IMAP_TRASH_MAILBOX", &fa.Actions.TrashMailbox)
+	l.envString(p+"IMAP_SPAM_MAILBOX", &fa.Actions.SpamMailbox)
+	l.envList(p+"IMAP_MOVE_MAILBOXES", &fa.Actions.MoveTo)
+	l.envList(p+"IMAP_FORWARD_TO", &fa.Actions.ForwardTo)
+	l.envString(p+"IMAP_SNOOZE_MAILBOX", &fa.Actions.SnoozeMailbox)
+	l.envString(p+"SMTP_HOST", &fa.SMTP.Host)
+	l.envInt(p+"SMTP_PORT", &fa.SMTP.Port)
+	l.envString(p+"SMTP_USERNAME", &fa.SMTP.Username)
+	l.envString(p+"SMTP_PASSWORD", &fa.SMTP.Password)
+	l.envString(p+"SMTP_SECURITY", &fa.SMTP.Security)
+	l.envString(p+"SMTP_TLS_CA", &fa.SMTP.TLSCA)
+	l.envString(p+"SMTP_TLS_FINGERPRINT", &fa.SMTP.TLSFingerprint)
+	l.envBoolPtr(p+"SMTP_TLS_SKIP_VERIFY", &fa.SMTP.TLSSkipVerify)
+	l.envString(p+"SMTP_FROM", &fa.SMTP.From)
+	l.envString(p+"SMTP_SENT_MAILBOX", &fa.SMTP.SentMailbox)
+	l.envBoolPtr(p+"SMTP_QUOTE", &fa.SMTP.Quote)
+	l.envBool(p+"ATTACHMENTS_SEND", &fa.Attachments.Send)
+	l.envInt(p+"ATTACHMENTS_MAX_SIZE", &fa.Attachments.MaxSize)
+	l.envList(p+"ATTACHMENTS_ALLOW", &fa.Attachments.Allow)
+	l.envList(p+"ATTACHMENTS_DENY", &fa.Attachments.Deny)
+	// IMAP_MAILBOXES (список с настройками) имеет приоритет над одиночной IMAP_MAILBOX
+	if s, ok := l.getenv(p + "IMAP_MAILBOXES"); ok {
+		mbs, err := parseMailboxes(s)
+		if err != nil {
+			l.problemf("%sIMAP_MAILBOXES: %v", p, err)
+			return
+		}
+		fa.Mailboxes = mbs
+	} else if s, ok := l.getenv(p + "IMAP_MAILBOX"); ok {
+		fa.Mailboxes = []Mailbox{{Name: s}}
+	}
+}
+
+// getenv возвращает значение переменной key: из окружения, из файла по пути в <key>_FILE
+// (соглашение Docker/Kubernetes secrets) либо из файла секретов — именно в таком порядке.
+func (l *loader) getenv(key string) (string, bool) {
+	v := strings.TrimSpace(os.Getenv(key))
+	path := strings.TrimSpace(os.Getenv(key + "_FILE"))
+	switch {
+	case v != "" && path != "":
+		l.problemf("%s and %s_FILE are mutually exclusive", key, key)
+		return v, true
+	case v != "":
+		return v, true
+	case path != "":
+		s, err := secrets.ReadFile(path)
+		if err != nil {
+			l.problemf("%s_FILE: %v", key, err)
+			return "", false
+		}
+		return s, s != ""
+	}
+	v = l.secrets[key]
+	return v, v != ""
+}
+
+func (l *loader) envString(key string, dst *string) {
+	if v, ok := l.getenv(key); ok {
+		*dst = v
+	}
+}
+
+// envList читает список через запятую; пустые элементы отбрасываются.
+func (l *loader) envList(key string, dst *[]string) {
+	v, ok := l.getenv(key)
+	if !ok {
+		return
+	}
+	var out []string
+	for _, item := range strings.Split(v, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			out = append(out, item)
+		}
+	}
+	*dst = out
+}
+
+func (l *loader) envInt(key string, dst *int) {
+	v, ok := l.getenv(key)
+	if !ok {
+		return
+	}
+	n, err := strconv.Atoi(v)
+	if err != nil {
+		l.problemf("%s: invalid integer %q", key, v)
+		return
+	}
+	*dst = n
+}
+
+func (l *loader) envIntPtr(key string, dst **int) {
+	var n int
+	if _, ok := l.getenv(key); !ok {
+		return
+	}
+	before := len(l.problems)
+	l.envInt(key, &n)
+	if len(l.problems) == before {
+		*dst = &n
+	}
+}
+
+func (l *loader) envInt64(key string, dst *int64) {
+	v, ok := l.getenv(key)
+	if !ok {
+		return
+	}
+	n, err := strconv.ParseInt(v, 10, 64)
+	if err != nil {
+		l.problemf("%s: invalid int64 %q", key, v)
+		return
+	}
+	*dst = n
+}
+
+// envInt64List читает список целых чисел через запятую.
+func (l *loader) envInt64List(key string, dst *[]int64) {
+	var items []string
+	l.envList(key, &items)
+	if items == nil {
+		return
+	}
+	out := make([]int64, 0, len(items))
+	for _, item := range items {
+		n, err := strconv.ParseInt(item, 10, 64)
+		if err != nil {
+			l.problemf("%s: invalid int64 %q", key, item)
+			return
+		}
+		out = append(out, n)
+	}
+	*dst = out
+}
+
+func (l *loader) envBool(key string, dst *bool) {
+	v, ok := l.getenv(key)
+	if !ok {
+		return
+	}
+	b, err := parseBool(v)
+	if err != nil {
+		l.problemf("%s: %v", key, err)
+		return
+	}
+	*dst = b
+}
+
+func (l *loader) envBoolPtr(key string, dst **bool) {
+	var b bool
+	if _, ok := l.getenv(key); !ok {
+		return
+	}
+	before := len(l.problems)
+	l.envBool(key, &b)
+	if len(l.problems) == before {
+		*dst = &b
+	}
+}
+
+func (l *loader) envDuration(key string, dst *Duration) {
+	v, ok := l.getenv(key)
+	if !ok {
+		return
+	}
+	if err := dst.UnmarshalText([]byte(v)); err != nil {
+		l.problemf("%s: %v", key, err)
+	}
+}
+
+func parseBool(s string) (bool, error) {
+	switch strings.ToLower(s) {
+	case "1", "true", "yes", "y":
+		return true, nil
+	case "0", "false", "no", "n":
+		return false, nil
+	}
+	return false, fmt.Errorf("invalid boolean %q", s)
+}
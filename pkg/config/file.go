@@ -0,0 +1,247 @@
+package config
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/BurntSushi/toml"
+	"gopkg.in/yaml.v3"
+)
+
+// Duration — длительность в файле конфигурации: "90s", "25m", "48h" или целое число секунд.
+type Duration time.Duration
+
+func (d *Duration) UnmarshalText(b []byte) error {
+	s := strings.TrimSpace(string(b))
+	if v, err := time.ParseDuration(s); err == nil {
+		*d = Duration(v)
+		return nil
+	}
+	// целое число трактуем как секунды, как и в переменных окружения
+	if n, err := strconv.Atoi(s); err == nil {
+		*d = Duration(time.Duration(n) * time.Second)
+		return nil
+	}
+	return fmt.Errorf("invalid duration %q", s)
+}
+
+// UnmarshalYAML сообщает об ошибке как *yaml.TypeError, чтобы декодер продолжил разбор
+// и остальные ошибки файла попали в тот же отчёт.
+func (d *Duration) UnmarshalYAML(n *yaml.Node) error {
+	if err := d.UnmarshalText([]byte(n.Value)); err != nil {
+		return &yaml.TypeError{Errors: []string{fmt.Sprintf("line %d: %v", n.Line, err)}}
+	}
+	return nil
+}
+
+// fileConfig — схема файла конфигурации (см. config.example.yaml). Имена ключей
+// совпадают в YAML и TOML.
+type fileConfig struct {
+	PollInterval   Duration `yaml:"poll_interval" toml:"poll_interval"`
+	ForceReconnect Duration `yaml:"force_reconnect" toml:"force_reconnect"`
+	// ReconnectMin, ReconnectMax — пределы экспоненциальной задержки переподключения
+	ReconnectMin Duration `yaml:"reconnect_min" toml:"reconnect_min"`
+	ReconnectMax Duration `yaml:"reconnect_max" toml:"reconnect_max"`
+	// PoolSize — сессий на аккаунт для действий (пометка прочитанным, LIST)
+	PoolSize int `yaml:"pool_size" toml:"pool_size"`
+	// MaxBodySize — сколько байт текстовой части письма загружать для просмотра
+	MaxBodySize int    `yaml:"max_body_size" toml:"max_body_size"`
+	MarkSeen    bool   `yaml:"mark_seen" toml:"mark_seen"`
+	HTTPAddr    string `yaml:"http_addr" toml:"http_addr"`
+	DataDir     string `yaml:"data_dir" toml:"data_dir"`
+	// MaxInline — сколько байт картинок cid: письма встраивать в страницу viewer; 0 — не встраивать
+	MaxInline int `yaml:"max_inline_size" toml:"max_inline_size"`
+	// SecretsFile — зашифрованный файл секретов в формате .env (см. pkg/secrets)
+	SecretsFile string        `yaml:"secrets_file" toml:"secrets_file"`
+	Telegram    fileTelegram  `yaml:"telegram" toml:"telegram"`
+	Viewer      fileViewer    `yaml:"viewer" toml:"viewer"`
+	Accounts    []fileAccount `yaml:"accounts" toml:"accounts"`
+}
+
+type fileTelegram struct {
+	Token string `yaml:"token" toml:"token"`
+	// TokenFile — путь к файлу с токеном вместо token
+	TokenFile string `yaml:"token_file" toml:"token_file"`
+	// ChatID — чат по умолчанию для аккаунтов без собственного telegram_chat_id
+	ChatID int64 `yaml:"chat_id" toml:"chat_id"`
+	// AllowedUsers — id пользователей, которым доступны ответы, пересылка, /compose и действия с письмами
+	AllowedUsers []int64 `yaml:"allowed_users" toml:"allowed_users"`
+	// MessageTemplate — шаблон уведомления (Go html/template, поля telegram.Notification)
+	MessageTemplate string `yaml:"message_template" toml:"message_template"`
+	// PreviewLength — сколько символов текста письма показывать в уведомлении; 0 — не показывать
+	PreviewLength int `yaml:"preview_length" toml:"preview_length"`
+}
+
+type fileViewer struct {
+	URLBase      string   `yaml:"url_base" toml:"url_base"`
+	PageTTL      Duration `yaml:"page_ttl" toml:"page_ttl"`
+	PageMaxViews int      `yaml:"page_max_views" toml:"page_max_views"`
+}
+
+// fileAccount — аккаунт в файле. Указатели и нулевые значения означают «наследовать общее».
+type fileAccount struct {
+	Name           string            `yaml:"name" toml:"name"`
+	IMAP           fileIMAP          `yaml:"imap" toml:"imap"`
+	Mailboxes      []Mailbox         `yaml:"mailboxes" toml:"mailboxes"`
+	TelegramChatID int64             `yaml:"telegram_chat_id" toml:"telegram_chat_id"`
+	MarkSeen       *bool             `yaml:"mark_seen" toml:"mark_seen"`
+	Viewer         fileAccountViewer `yaml:"viewer" toml:"viewer"`
+	Actions        fileActions       `yaml:"actions" toml:"actions"`
+	SMTP           fileSMTP          `yaml:"smtp" toml:"smtp"`
+	Attachments    fileAttachments   `yaml:"attachments" toml:"attachments"`
+
+	// envPrefix — префикс переменных окружения, переопределяющих поля аккаунта
+	envPrefix string
+}
+
+type fileIMAP struct {
+	Host     string `yaml:"host" toml:"host"`
+	Port     int    `yaml:"port" toml:"port"`
+	Username string `yaml:"username" toml:"username"`
+	Password string `yaml:"password" toml:"password"`
+	// PasswordFile — путь к файлу с паролем вместо password
+	PasswordFile string `yaml:"password_file" toml:"password_file"`
+	// Auth — login (по умолчанию), xoauth2 или oauthbearer
+	Auth  string    `yaml:"auth" toml:"auth"`
+	OAuth fileOAuth `yaml:"oauth" toml:"oauth"`
+	// Security — tls (по умолчанию), starttls или plain
+	Security string `yaml:"security" toml:"security"`
+	// TLSCA — путь к PEM с корневыми сертификатами
+	TLSCA          string `yaml:"tls_ca" toml:"tls_ca"`
+	TLSFingerprint string `yaml:"tls_fingerprint" toml:"tls_fingerprint"`
+	TLSSkipVerify  *bool  `yaml:"tls_skip_verify" toml:"tls_skip_verify"`
+	// TLS устарело: false означает TLS без проверки сертификата (tls_skip_verify)
+	TLS *bool `yaml:"tls" toml:"tls"`
+}
+
+type fileOAuth struct {
+	// Provider — google или microsoft: подставляет token_url и scopes по умолчанию
+	Provider         string   `yaml:"provider" toml:"provider"`
+	TokenURL         string   `yaml:"token_url" toml:"token_url"`
+	ClientID         string   `yaml:"client_id" toml:"client_id"`
+	ClientSecret     string   `yaml:"client_secret" toml:"client_secret"`
+	ClientSecretFile string   `yaml:"client_secret_file" toml:"client_secret_file"`
+	RefreshToken     string   `yaml:"refresh_token" toml:"refresh_token"`
+	RefreshTokenFile string   `yaml:"refresh_token_file" toml:"refresh_token_file"`
+	Scopes           []string `yaml:"scopes" toml:"scopes"`
+}
+
+// fileActions — кнопки действий под уведомлением и папки, в которые они переносят письмо.
+type fileActions struct {
+	// Buttons — archive, delete, forward, move, snooze, spam в порядке показа
+	Buttons []string `yaml:"buttons" toml:"buttons"`
+	// ArchiveMailbox, TrashMailbox, SpamMailbox — пусто: папка с ролью из LIST (SPECIAL-USE)
+	ArchiveMailbox string `yaml:"archive_mailbox" toml:"archive_mailbox"`
+	TrashMailbox   string `yaml:"trash_mailbox" toml:"trash_mailbox"`
+	SpamMailbox    string `yaml:"spam_mailbox" toml:"spam_mailbox"`
+	// MoveTo — папки в меню «Move to…»; пусто — все папки аккаунта
+	MoveTo []string `yaml:"move_to" toml:"move_to"`
+	// ForwardTo — адресная книга меню «Forward»: "Имя <адрес>" или адрес
+	ForwardTo []string `yaml:"forward_to" toml:"forward_to"`
+	// SnoozeMailbox — папка для отложенных писем; пусто — письмо остаётся на месте прочитанным
+	SnoozeMailbox string `yaml:"snooze_mailbox" toml:"snooze_mailbox"`
+}
+
+// fileSMTP — сервер для ответов на письма из Telegram. Без host ответы выключены.
+type fileSMTP struct {
+	Host string `yaml:"host" toml:"host"`
+	Port int    `yaml:"port" toml:"port"`
+	// Username, Password — пусто: вход как в IMAP (те же логин, пароль или OAuth2)
+	Username     string `yaml:"username" toml:"username"`
+	Password     string `yaml:"password" toml:"password"`
+	PasswordFile string `yaml:"password_file" toml:"password_file"`
+	// Security — tls (по умолчанию, порт 465), starttls (порт 587) или plain
+	Security       string `yaml:"security" toml:"security"`
+	TLSCA          string `yaml:"tls_ca" toml:"tls_ca"`
+	TLSFingerprint string `yaml:"tls_fingerprint" toml:"tls_fingerprint"`
+	TLSSkipVerify  *bool  `yaml:"tls_skip_verify" toml:"tls_skip_verify"`
+	// From — отправитель ответов ("Имя <адрес>"); по умолчанию imap.username
+	From string `yaml:"from" toml:"from"`
+	// SentMailbox — папка для копий ответов; пусто — папка с ролью \Sent, "-" — не сохранять
+	SentMailbox string `yaml:"sent_mailbox" toml:"sent_mailbox"`
+	// Quote — цитировать исходное письмо под ответом (по умолчанию true)
+	Quote *bool `yaml:"quote" toml:"quote"`
+}
+
+// fileAttachments — отправка вложений писем в чат Telegram.
+type fileAttachments struct {
+	// Send — отправлять вложения документами в ответ на уведомление (по умолчанию false)
+	Send bool `yaml:"send" toml:"send"`
+	// MaxSize — байт; вложения крупнее отдаются только через viewer (по умолчанию и не больше 50 МБ)
+	MaxSize int `yaml:"max_size" toml:"max_size"`
+	// Allow — разрешённые MIME-типы ("application/pdf", "image/*"); пусто — все
+	Allow []string `yaml:"allow" toml:"allow"`
+	// Deny — запрещённые MIME-типы; не задано — исполняемые файлы и скрипты (DefaultAttachmentDeny)
+	Deny []string `yaml:"deny" toml:"deny"`
+}
+
+type fileAccountViewer struct {
+	PageTTL      Duration `yaml:"page_ttl" toml:"page_ttl"`
+	PageMaxViews *int     `yaml:"page_max_views" toml:"page_max_views"`
+}
+
+// yamlUnknownFieldRe переписывает сообщение yaml.v3 о лишнем ключе в читаемый вид.
+var yamlUnknownFieldRe = regexp.MustCompile(`field (\S+) not found in type \S+`)
+
+// defaultFile возвращает значения по умолчанию, поверх которых читаются файл и окружение.
+func defaultFile() fileConfig {
+	var raw fileConfig
+	raw.PollInterval = Duration(60 * time.Second)
+	raw.ForceReconnect = Duration(25 * time.Minute)
+	raw.ReconnectMin = Duration(2 * time.Second)
+	raw.ReconnectMax = Duration(5 * time.Minute)
+	raw.PoolSize = 2
+	raw.MaxBodySize = 2 << 20
+	raw.MaxInline = 5 << 20
+	raw.HTTPAddr = ":8080"
+	raw.DataDir = "data"
+	raw.Viewer.PageTTL = Duration(48 * time.Hour)
+	raw.Viewer.PageMaxViews = 3
+	raw.Telegram.PreviewLength = 300
+	return raw
+}
+
+// decodeFile читает файл конфигурации; формат определяется расширением
+// (.toml — TOML, иначе YAML). Синтаксические ошибки и неизвестные ключи
+// попадают в общий список проблем, ошибка возвращается, только если файл не прочитать.
+func (l *loader) decodeFile(path string, raw *fileConfig) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("read config file: %w", err)
+	}
+	if strings.EqualFold(filepath.Ext(path), ".toml") {
+		md, err := toml.Decode(string(data), raw)
+		if err != nil {
+			l.problemf("%s: %v", path, err)
+			return nil
+		}
+		for _, key := range md.Undecoded() {
+			l.problemf("%s: unknown key %q", path, key.String())
+		}
+		return nil
+	}
+	dec := yaml.NewDecoder(bytes.NewReader(data))
+	dec.KnownFields(true)
+	if err := dec.Decode(raw); err != nil {
+		var typeErr *yaml.TypeError
+		switch {
+		case errors.As(err, &typeErr):
+			for _, e := range typeErr.Errors {
+				l.problemf("%s: %s", path, yamlUnknownFieldRe.ReplaceAllString(e, "unknown key \"$1\""))
+			}
+		case errors.Is(err, io.EOF):
+			// пустой файл — все значения берутся из окружения
+		default:
+			l.problemf("%s: %v", path, err)
+		}
+	}
+	return nil
+}
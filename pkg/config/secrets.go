@@ -0,0 +1,59 @@
+package config
+
+import (
+	"fmt"
+
+	"mailpuff/pkg/secrets"
+)
+
+// loadSecrets расшифровывает файл секретов (SECRETS_FILE или secrets_file из файла
+// конфигурации). Его значения используются как переменные окружения с наименьшим приоритетом.
+func (l *loader) loadSecrets(raw *fileConfig) {
+	path := raw.SecretsFile
+	if v, ok := l.getenv("SECRETS_FILE"); ok {
+		path = v
+	}
+	if path == "" {
+		return
+	}
+	key, err := secrets.KeyFromEnv()
+	if err != nil {
+		l.problemf("secrets_file (SECRETS_FILE): %v", err)
+		return
+	}
+	m, err := secrets.Load(path, key)
+	if err != nil {
+		l.problemf("secrets_file (SECRETS_FILE) %s: %v", path, err)
+		return
+	}
+	l.secrets = m
+}
+
+// resolveSecretFiles подставляет секреты, заданные в файле конфигурации путями *_file.
+func (l *loader) resolveSecretFiles(raw *fileConfig) {
+	l.readSecretFile("", "telegram.token", raw.Telegram.TokenFile, &raw.Telegram.Token)
+	for i := range raw.Accounts {
+		a := &raw.Accounts[i]
+		where := fmt.Sprintf("account %q: ", a.Name)
+		l.readSecretFile(where, "imap.password", a.IMAP.PasswordFile, &a.IMAP.Password)
+		l.readSecretFile(where, "imap.oauth.client_secret", a.IMAP.OAuth.ClientSecretFile, &a.IMAP.OAuth.ClientSecret)
+		l.readSecretFile(where, "imap.oauth.refresh_token", a.IMAP.OAuth.RefreshTokenFile, &a.IMAP.OAuth.RefreshToken)
+		l.readSecretFile(where, "smtp.password", a.SMTP.PasswordFile, &a.SMTP.Password)
+	}
+}
+
+func (l *loader) readSecretFile(where, field, path string, dst *string) {
+	if path == "" {
+		return
+	}
+	if *dst != "" {
+		l.problemf("%s%s and %s_file are mutually exclusive", where, field, field)
+		return
+	}
+	v, err := secrets.ReadFile(path)
+	if err != nil {
+		l.problemf("%s%s_file: %v", where, field, err)
+		return
+	}
+	*dst = v
+}
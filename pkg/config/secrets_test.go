@@ -0,0 +1,109 @@
+package config
+
+import (
+	"strings"
+	"testing"
+
+	"mailpuff/pkg/secrets"
+)
+
+func TestLoadSecretSources(t *testing.T) {
+	enc, err := secrets.Encrypt([]byte("IMAP_PASSWORD=from-secrets\nTELEGRAM_TOKEN=\"secret:token\"\n"), "k3y")
+	if err != nil {
+		t.Fatal(err)
+	}
+	secretsFile := writeFile(t, "secrets.enc", string(enc))
+	passwordFile := writeFile(t, "imap_password", "from-file\n")
+
+	tests := []struct {
+		name string
+		// env накладывается на baseEnv; пустое значение снимает переменную
+		env          map[string]string
+		file         string
+		wantPassword string
+		wantToken    string
+		wantErr      string
+	}{
+		{
+			name:         "_FILE",
+			env:          map[string]string{"IMAP_PASSWORD": "", "IMAP_PASSWORD_FILE": passwordFile},
+			wantPassword: "from-file",
+			wantToken:    "123:abc",
+		},
+		{
+			name:    "value and _FILE",
+			env:     map[string]string{"IMAP_PASSWORD_FILE": passwordFile},
+			wantErr: "IMAP_PASSWORD and IMAP_PASSWORD_FILE are mutually exclusive",
+		},
+		{
+			name:    "missing _FILE",
+			env:     map[string]string{"IMAP_PASSWORD": "", "IMAP_PASSWORD_FILE": passwordFile + ".missing"},
+			wantErr: "IMAP_PASSWORD_FILE:",
+		},
+		{
+			name:         "encrypted secrets",
+			env:          map[string]string{"IMAP_PASSWORD": "", "TELEGRAM_TOKEN": "", "SECRETS_FILE": secretsFile, "SECRETS_KEY": "k3y"},
+			wantPassword: "from-secrets",
+			wantToken:    "secret:token",
+		},
+		{
+			// Файл секретов — наименьший приоритет: окружение и _FILE его перекрывают
+			name:         "env over secrets",
+			env:          map[string]string{"IMAP_PASSWORD": "", "IMAP_PASSWORD_FILE": passwordFile, "SECRETS_FILE": secretsFile, "SECRETS_KEY": "k3y"},
+			wantPassword: "from-file",
+			wantToken:    "123:abc",
+		},
+		{
+			name:    "wrong key",
+			env:     map[string]string{"SECRETS_FILE": secretsFile, "SECRETS_KEY": "nope"},
+			wantErr: "wrong key or corrupted file",
+		},
+		{
+			name:    "no key",
+			env:     map[string]string{"SECRETS_FILE": secretsFile},
+			wantErr: "SECRETS_KEY or SECRETS_KEY_FILE is required",
+		},
+		{
+			name:         "password_file in config file",
+			env:          map[string]string{"IMAP_HOST": "", "IMAP_USERNAME": "", "IMAP_PASSWORD": ""},
+			file:         "accounts:\n  - name: work\n    imap:\n      host: imap.example.com\n      username: me@example.com\n      password_file: " + passwordFile + "\n",
+			wantPassword: "from-file",
+			wantToken:    "123:abc",
+		},
+		{
+			name:    "password and password_file in config file",
+			env:     map[string]string{"IMAP_HOST": "", "IMAP_USERNAME": "", "IMAP_PASSWORD": ""},
+			file:    "accounts:\n  - name: work\n    imap:\n      host: imap.example.com\n      username: me@example.com\n      password: x\n      password_file: " + passwordFile + "\n",
+			wantErr: `account "work": imap.password and imap.password_file are mutually exclusive`,
+		},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			env := baseEnv()
+			for k, v := range tc.env {
+				env[k] = v
+			}
+			setEnv(t, env)
+			path := ""
+			if tc.file != "" {
+				path = writeFile(t, "mailpuff.yaml", tc.file)
+			}
+			cfg, err := Load(path)
+			if tc.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tc.wantErr) {
+					t.Fatalf("Load: err = %v, want it to mention %q", err, tc.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Load: %v", err)
+			}
+			if got := cfg.Accounts[0].IMAPPassword; got != tc.wantPassword {
+				t.Errorf("IMAPPassword = %q, want %q", got, tc.wantPassword)
+			}
+			if cfg.TelegramToken != tc.wantToken {
+				t.Errorf("TelegramToken = %q, want %q", cfg.TelegramToken, tc.wantToken)
+			}
+		})
+	}
+}
@@ -0,0 +1,310 @@
+package email
+
+import (
+	"fmt"
+	"mime"
+	"net/mail"
+	"strings"
+
+	"github.com/emersion/go-message/charset"
+	"golang.org/x/net/idna"
+
+	"mailpuff/pkg/imap"
+)
+
+// Address — адрес письма по RFC 5322: имя уже декодировано из RFC 2047,
+// адрес — в нижнем регистре, домен — как в письме (ASCII или punycode).
+type Address struct {
+	Name string
+	Addr string
+	// Group — имя группы ("Team: a@x, b@y;"), в которую входит адрес; пустое — адрес вне группы
+	Group string
+}
+
+// Display возвращает адрес для показа: IDN-домен в punycode переводится в Unicode.
+func (a Address) Display() string {
+	local, domain, ok := strings.Cut(a.Addr, "@")
+	if !ok {
+		return a.Addr
+	}
+	if u, err := idna.Display.ToUnicode(domain); err == nil {
+		domain = u
+	}
+	return local + "@" + domain
+}
+
+// ASCII возвращает адрес с доменом в punycode — в таком виде его принимает SMTP без SMTPUTF8.
+func (a Address) ASCII() string {
+	local, domain, ok := strings.Cut(a.Addr, "@")
+	if !ok {
+		return a.Addr
+	}
+	if s, err := idna.Lookup.ToASCII(domain); err == nil {
+		domain = s
+	}
+	return local + "@" + domain
+}
+
+// String возвращает "Имя <адрес>" или просто адрес для показа.
+func (a Address) String() string {
+	if a.Name == "" {
+		return a.Display()
+	}
+	return a.Name + " <" + a.Display() + ">"
+}
+
+// Mail возвращает адрес для заголовков исходящего письма.
+func (a Address) Mail() *mail.Address {
+	return &mail.Address{Name: a.Name, Address: a.ASCII()}
+}
+
+// Is сообщает, что a — тот же почтовый ящик, что addr: без учёта регистра,
+// имени и формы записи IDN-домена.
+func (a Address) Is(addr string) bool {
+	if p, err := mail.ParseAddress(addr); err == nil {
+		addr = p.Address
+	}
+	return normalizeAddr(a.Addr) == normalizeAddr(addr)
+}
+
+func normalizeAddr(addr string) string {
+	addr = strings.ToLower(strings.TrimSpace(addr))
+	local, domain, ok := strings.Cut(addr, "@")
+	if !ok {
+		return addr
+	}
+	if s, err := idna.Lookup.ToASCII(domain); err == nil {
+		domain = s
+	}
+	return local + "@" + domain
+}
+
+// Addresses — все адреса заголовков письма.
+type Addresses struct {
+	From []Address
+	// Sender — фактический отправитель, если он отличается от From (RFC 5322 3.6.2)
+	Sender  []Address
+	ReplyTo []Address
+	To      []Address
+	Cc      []Address
+}
+
+// EnvelopeAddresses собирает адреса из ENVELOPE письма, загруженного pkg/imap.
+func EnvelopeAddresses(e *imap.Email) Addresses {
+	conv := func(list []imap.Address) []Address {
+		if len(list) == 0 {
+			return nil
+		}
+		out := make([]Address, len(list))
+		for i, a := range list {
+			out[i] = Address{Name: decodeName(a.Name), Addr: a.Addr, Group: a.Group}
+		}
+		return out
+	}
+	return Addresses{
+		From:    conv(e.From),
+		Sender:  conv(e.Sender),
+		ReplyTo: conv(e.ReplyTo),
+		To:      conv(e.To),
+		Cc:      conv(e.Cc),
+	}
+}
+
+// Recipients возвращает получателей из To и Cc без повторов.
+func (as Addresses) Recipients() []Address {
+	var out []Address
+	seen := map[string]bool{}
+	for _, a := range append(append([]Address(nil), as.To...), as.Cc...) {
+		k := normalizeAddr(a.Addr)
+		if seen[k] {
+			continue
+		}
+		seen[k] = true
+		out = append(out, a)
+	}
+	return out
+}
+
+// ReplyTargets возвращает, кому отвечать: Reply-To, а без него — From.
+func (as Addresses) ReplyTargets() []Address {
+	if len(as.ReplyTo) > 0 {
+		return as.ReplyTo
+	}
+	return as.From
+}
+
+// HasRecipient сообщает, что addr есть среди получателей To или Cc.
+func (as Addresses) HasRecipient(addr string) bool {
+	for _, a := range as.Recipients() {
+		if a.Is(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// RecipientSummary описывает получателей для уведомления: "you", "you + 4 others",
+// "Team (3)" или "Alice + 2 others"; self — собственные адреса аккаунта.
+// Пустая строка — письмо адресовано только владельцу аккаунта или получателей нет.
+func (as Addresses) RecipientSummary(self []string) string {
+	rcpts := as.Recipients()
+	if len(rcpts) == 0 {
+		return ""
+	}
+	mine := -1
+	for i, a := range rcpts {
+		for _, s := range self {
+			if a.Is(s) {
+				mine = i
+				break
+			}
+		}
+		if mine >= 0 {
+			break
+		}
+	}
+	if mine >= 0 && len(rcpts) == 1 {
+		return ""
+	}
+	// Письмо только членам одной группы показываем её именем
+	if g := rcpts[0].Group; g != "" && mine < 0 {
+		same := true
+		for _, a := range rcpts[1:] {
+			same = same && a.Group == g
+		}
+		if same {
+			return fmt.Sprintf("%s (%d)", g, len(rcpts))
+		}
+	}
+	first := "you"
+	if mine < 0 {
+		first = rcpts[0].Name
+		if first == "" {
+			first = rcpts[0].Display()
+		}
+	}
+	switch n := len(rcpts) - 1; n {
+	case 0:
+		return first
+	case 1:
+		return first + " + 1 other"
+	default:
+		return fmt.Sprintf("%s + %d others", first, n)
+	}
+}
+
+// ParseAddressList разбирает значение заголовка со списком адресов (To, Cc, Reply-To):
+// имена в RFC 2047, группы "Team: a@x, b@y;" и кавычки. Элементы, которые net/mail
+// не принимает, разбираются мягко — «адрес <...>» или голый адрес; нераспознанные пропускаются.
+func ParseAddressList(s string) []Address {
+	parser := mail.AddressParser{WordDecoder: wordDecoder}
+	var out []Address
+	for _, item := range splitAddressList(s) {
+		if strings.TrimSpace(item.text) == "" {
+			continue
+		}
+		list, err := parser.ParseList(item.text)
+		if err != nil {
+			if a, ok := parseAddressLenient(item.text); ok {
+				list = []*mail.Address{a}
+			}
+		}
+		for _, a := range list {
+			if a.Address == "" {
+				continue
+			}
+			out = append(out, Address{Name: decodeName(a.Name), Addr: strings.ToLower(a.Address), Group: item.group})
+		}
+	}
+	return out
+}
+
+type addressItem struct {
+	text  string
+	group string
+}
+
+// splitAddressList делит список на адреса и группы: запятые, ":" и ";" учитываются
+// только вне кавычек, комментариев и угловых скобок.
+func splitAddressList(s string) []addressItem {
+	var out []addressItem
+	var cur strings.Builder
+	group := ""
+	quoted, escaped, angle, comment := false, false, false, 0
+	flush := func() {
+		out = append(out, addressItem{text: cur.String(), group: group})
+		cur.Reset()
+	}
+	// Разделители — ASCII, поэтому идём по байтам: «сырые» 8-битные имена остаются нетронутыми
+	for i := 0; i < len(s); i++ {
+		r := s[i]
+		switch {
+		case escaped:
+			escaped = false
+		case r == '\\' && (quoted || comment > 0):
+			escaped = true
+		case quoted:
+			quoted = r != '"'
+		case comment > 0:
+			if r == '(' {
+				comment++
+			} else if r == ')' {
+				comment--
+			}
+		case r == '"':
+			quoted = true
+		case r == '(':
+			comment++
+		case r == '<':
+			angle = true
+		case r == '>':
+			angle = false
+		case angle:
+		case r == ':' && group == "":
+			group = decodeName(strings.Trim(strings.TrimSpace(cur.String()), `"`))
+			cur.Reset()
+			continue
+		case r == ';' && group != "":
+			flush()
+			group = ""
+			continue
+		case r == ',':
+			flush()
+			continue
+		}
+		cur.WriteByte(r)
+	}
+	flush()
+	return out
+}
+
+// parseAddressLenient извлекает адрес из «Имя <адрес>» или голого адреса, которые
+// не прошли строгий разбор (например, точка в имени без кавычек).
+func parseAddressLenient(s string) (*mail.Address, bool) {
+	s = strings.TrimSpace(s)
+	if i := strings.LastIndex(s, "<"); i >= 0 {
+		j := strings.Index(s[i:], ">")
+		if j < 0 {
+			return nil, false
+		}
+		addr := strings.TrimSpace(s[i+1 : i+j])
+		if !strings.Contains(addr, "@") {
+			return nil, false
+		}
+		name := strings.Trim(strings.TrimSpace(s[:i]), `"`)
+		return &mail.Address{Name: name, Address: addr}, true
+	}
+	if strings.Count(s, "@") == 1 && !strings.ContainsAny(s, " \t<>\",") {
+		return &mail.Address{Address: s}, true
+	}
+	return nil, false
+}
+
+var wordDecoder = &mime.WordDecoder{CharsetReader: charset.Reader}
+
+// decodeName декодирует слова RFC 2047, которые остались в имени (net/mail не декодирует
+// их внутри кавычек, а часть серверов отдаёт имя в ENVELOPE как есть), и «сырые» 8-битные байты.
+func decodeName(name string) string {
+	s, _ := DecodeHeader(name, "")
+	return s
+}
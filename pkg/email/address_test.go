@@ -0,0 +1,104 @@
+package email
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseAddressList(t *testing.T) {
+	tests := []struct {
+		name string
+		in   string
+		want []Address
+	}{
+		{
+			name: "plain",
+			in:   "Alice <Alice@Example.org>, bob@example.org",
+			want: []Address{{Name: "Alice", Addr: "alice@example.org"}, {Addr: "bob@example.org"}},
+		},
+		{
+			name: "quoted name with comma",
+			in:   `"Doe, John" <john@example.org>, "Smith; Ann" <ann@example.org>`,
+			want: []Address{{Name: "Doe, John", Addr: "john@example.org"}, {Name: "Smith; Ann", Addr: "ann@example.org"}},
+		},
+		{
+			name: "rfc 2047 name",
+			in:   "=?UTF-8?B?0JDQvdC90LA=?= <anna@example.ru>, \"=?utf-8?q?J=C3=B6rg?=\" <joerg@example.de>",
+			want: []Address{{Name: "Анна", Addr: "anna@example.ru"}, {Name: "Jörg", Addr: "joerg@example.de"}},
+		},
+		{
+			name: "group",
+			in:   "Team: a@example.org, B <b@example.org>;, c@example.org",
+			want: []Address{
+				{Addr: "a@example.org", Group: "Team"},
+				{Name: "B", Addr: "b@example.org", Group: "Team"},
+				{Addr: "c@example.org"},
+			},
+		},
+		{
+			name: "empty group",
+			in:   "undisclosed-recipients:;",
+			want: nil,
+		},
+		{
+			name: "comment",
+			in:   "carol@example.org (Carol, Sales), dave@example.org",
+			want: []Address{{Name: "Carol, Sales", Addr: "carol@example.org"}, {Addr: "dave@example.org"}},
+		},
+		{
+			name: "lenient",
+			in:   "J.R. Smith <jr@example.org>, broken <no-at-sign>, eve@example.org",
+			want: []Address{{Name: "J.R. Smith", Addr: "jr@example.org"}, {Addr: "eve@example.org"}},
+		},
+		{
+			name: "empty",
+			in:   " , ",
+			want: nil,
+		},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			got := ParseAddressList(tc.in)
+			if !reflect.DeepEqual(got, tc.want) {
+				t.Errorf("ParseAddressList(%q)\n got %+v\nwant %+v", tc.in, got, tc.want)
+			}
+		})
+	}
+}
+
+func TestRecipientSummary(t *testing.T) {
+	self := []string{"me@example.org"}
+	tests := []struct {
+		name   string
+		header string
+		want   string
+	}{
+		{"only me", "Me <ME@example.org>", ""},
+		{"me and others", "me@example.org, a@example.org, b@example.org", "you + 2 others"},
+		{"someone else", "Alice <alice@example.org>, bob@example.org", "Alice + 1 other"},
+		{"bare address", "bob@example.org", "bob@example.org"},
+		{"group", "Team: a@example.org, b@example.org, c@example.org;", "Team (3)"},
+		{"duplicates", "a@example.org, A@example.org", "a@example.org"},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			as := Addresses{To: ParseAddressList(tc.header)}
+			if got := as.RecipientSummary(self); got != tc.want {
+				t.Errorf("RecipientSummary(%q) = %q, want %q", tc.header, got, tc.want)
+			}
+		})
+	}
+}
+
+func TestAddressIDN(t *testing.T) {
+	a := Address{Name: "Пётр", Addr: "petr@xn--e1afmkfd.xn--p1ai"}
+	if got, want := a.Display(), "petr@пример.рф"; got != want {
+		t.Errorf("Display = %q, want %q", got, want)
+	}
+	if got := (Address{Addr: "petr@пример.рф"}).ASCII(); got != "petr@xn--e1afmkfd.xn--p1ai" {
+		t.Errorf("ASCII = %q", got)
+	}
+	if !a.Is("PETR@пример.рф") {
+		t.Error("Is does not match the Unicode form of the same mailbox")
+	}
+}
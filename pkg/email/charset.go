@@ -0,0 +1,357 @@
+package email
+
+import (
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"regexp"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/gogs/chardet"
+	"golang.org/x/text/encoding"
+	"golang.org/x/text/encoding/htmlindex"
+	"golang.org/x/text/encoding/ianaindex"
+
+	"mailpuff/pkg/imap"
+)
+
+// charsetAliases — написания кодировок из старых почтовых программ, которых нет в реестрах IANA и WHATWG.
+var charsetAliases = map[string]string{
+	"cp1251":         "windows-1251",
+	"win-1251":       "windows-1251",
+	"win1251":        "windows-1251",
+	"x-cp1251":       "windows-1251",
+	"cp1252":         "windows-1252",
+	"koi8r":          "koi8-r",
+	"koi8":           "koi8-r",
+	"cp866":          "ibm866",
+	"x-sjis":         "shift_jis",
+	"sjis":           "shift_jis",
+	"x-euc-jp":       "euc-jp",
+	"iso2022jp":      "iso-2022-jp",
+	"utf8":           "utf-8",
+	"x-unknown":      "",
+	"unknown":        "",
+	"default":        "",
+	"x-user-defined": "",
+}
+
+// lookupCharset находит кодировку по имени из заголовка; nil — UTF-8 или ASCII (перекодировать не нужно).
+// ok — false для неизвестных имён.
+func lookupCharset(label string) (enc encoding.Encoding, name string, ok bool) {
+	name = strings.ToLower(strings.Trim(strings.TrimSpace(label), `"'`))
+	if alias, found := charsetAliases[name]; found {
+		name = alias
+	}
+	switch name {
+	case "":
+		return nil, "", false
+	case "utf-8", "us-ascii", "ascii":
+		return nil, name, true
+	}
+	if e, err := htmlindex.Get(name); err == nil {
+		if e == encoding.Nop {
+			return nil, name, true
+		}
+		return e, name, true
+	}
+	if e, err := ianaindex.MIME.Encoding(name); err == nil && e != nil {
+		return e, name, true
+	}
+	return nil, name, false
+}
+
+// DecodeCharset переводит текст в кодировке declared в UTF-8. Если кодировка не указана,
+// неизвестна или явно не подходит (например, «utf-8» с байтами KOI8-R), она определяется
+// по содержимому. problems описывает, что пришлось угадать или заменить; результат — всегда
+// корректный UTF-8.
+func DecodeCharset(data []byte, declared string) (text string, problems []string) {
+	enc, name, known := lookupCharset(declared)
+	jp := isISO2022JP(data)
+	switch {
+	case known && enc == nil:
+		if utf8.Valid(data) && !jp {
+			return string(data), nil
+		}
+	case known:
+		// Письмо в UTF-8 с устаревшей меткой — частая ошибка почтовых программ
+		if hasHighBytes(data) && utf8.Valid(data) && !isMultiByte(name) {
+			return string(data), []string{fmt.Sprintf("declared charset %s, but the text is UTF-8", name)}
+		}
+		out, bad := convert(data, enc)
+		if bad == 0 {
+			return out, nil
+		}
+		// Байты, которых нет в кодировке, — признак неверной метки: пробуем угадать
+		if s, guessed, ok := sniffCharset(data); ok && guessed != name {
+			return s, []string{fmt.Sprintf("declared charset %s does not match the text, detected %s", name, guessed)}
+		}
+		return out, []string{fmt.Sprintf("%d bytes are not valid %s", bad, name)}
+	case utf8.Valid(data) && !jp:
+		return string(data), nil
+	}
+
+	var problem string
+	switch {
+	case declared == "":
+		problem = "charset not declared"
+	case !known:
+		problem = fmt.Sprintf("unknown charset %q", declared)
+	default:
+		problem = fmt.Sprintf("declared charset %s does not match the text", name)
+	}
+	if s, guessed, ok := sniffCharset(data); ok {
+		return s, []string{problem + ", detected " + guessed}
+	}
+	return strings.ToValidUTF8(string(data), "�"), []string{problem + ", invalid bytes replaced"}
+}
+
+// sniffCharset определяет кодировку текста по содержимому (статистика chardet) и перекодирует его.
+func sniffCharset(data []byte) (string, string, bool) {
+	if isISO2022JP(data) {
+		if s, bad := convert(data, mustCharset("iso-2022-jp")); bad == 0 {
+			return s, "iso-2022-jp", true
+		}
+	}
+	results, err := chardet.NewTextDetector().DetectAll(data)
+	if err != nil {
+		return "", "", false
+	}
+	for _, r := range results {
+		name := strings.ToLower(r.Charset)
+		if strings.HasPrefix(name, "utf-16") || strings.HasPrefix(name, "utf-32") || name == "utf-8" {
+			continue
+		}
+		enc, _, ok := lookupCharset(name)
+		if !ok || enc == nil {
+			continue
+		}
+		if s, bad := convert(data, enc); bad == 0 {
+			return s, name, true
+		}
+	}
+	return "", "", false
+}
+
+func mustCharset(name string) encoding.Encoding {
+	enc, _, _ := lookupCharset(name)
+	return enc
+}
+
+// convert перекодирует data в UTF-8; bad — сколько символов пришлось заменить на U+FFFD.
+func convert(data []byte, enc encoding.Encoding) (string, int) {
+	out, err := enc.NewDecoder().Bytes(data)
+	if err != nil {
+		return strings.ToValidUTF8(string(data), "�"), len(data)
+	}
+	bad := bytes.Count(out, []byte("�")) - bytes.Count(data, []byte("�"))
+	return string(out), max(bad, 0)
+}
+
+func hasHighBytes(data []byte) bool {
+	for _, b := range data {
+		if b >= 0x80 {
+			return true
+		}
+	}
+	return false
+}
+
+// isISO2022JP ищет escape-последовательности JIS X 0208 — 7-битный текст ISO-2022-JP выглядит как ASCII.
+func isISO2022JP(data []byte) bool {
+	return bytes.Contains(data, []byte("\x1b$B")) || bytes.Contains(data, []byte("\x1b$@"))
+}
+
+// isMultiByte — многобайтовые кодировки, где корректный UTF-8 возможен и в правильно размеченном тексте.
+func isMultiByte(name string) bool {
+	switch name {
+	case "shift_jis", "euc-jp", "euc-kr", "gbk", "gb2312", "gb18030", "big5":
+		return true
+	}
+	return false
+}
+
+// DecodeTransfer снимает Content-Transfer-Encoding. Ошибки кодирования не обрывают текст:
+// битые последовательности quoted-printable остаются как есть, посторонние символы base64
+// пропускаются. Обрезанное по лимиту тело (неполная последняя группа base64) проблемой не считается.
+func DecodeTransfer(raw []byte, enc string) (data []byte, problems []string) {
+	switch strings.ToLower(strings.TrimSpace(enc)) {
+	case "base64":
+		return decodeBase64(raw)
+	case "quoted-printable":
+		return decodeQuotedPrintable(raw)
+	}
+	return raw, nil
+}
+
+func decodeBase64(raw []byte) ([]byte, []string) {
+	var problems []string
+	junk := 0
+	var out, quad []byte
+	flush := func() {
+		if len(quad) >= 2 {
+			b, _ := base64.RawStdEncoding.DecodeString(string(quad))
+			out = append(out, b...)
+		}
+		quad = quad[:0]
+	}
+	for _, c := range raw {
+		switch {
+		case c >= 'A' && c <= 'Z', c >= 'a' && c <= 'z', c >= '0' && c <= '9', c == '+', c == '/':
+			quad = append(quad, c)
+			if len(quad) == 4 {
+				flush()
+			}
+		case c == '=':
+			// Паддинг завершает группу; за ним может начаться следующий склеенный фрагмент
+			flush()
+		case c == '\r' || c == '\n' || c == ' ' || c == '\t':
+		default:
+			junk++
+		}
+	}
+	flush()
+	if junk > 0 {
+		problems = append(problems, fmt.Sprintf("base64: skipped %d invalid characters", junk))
+	}
+	return out, problems
+}
+
+func decodeQuotedPrintable(raw []byte) ([]byte, []string) {
+	out := make([]byte, 0, len(raw))
+	bad := 0
+	for i := 0; i < len(raw); i++ {
+		c := raw[i]
+		if c != '=' {
+			out = append(out, c)
+			continue
+		}
+		rest := raw[i+1:]
+		if len(rest) >= 2 && isHex(rest[0]) && isHex(rest[1]) {
+			out = append(out, unhex(rest[0])<<4|unhex(rest[1]))
+			i += 2
+			continue
+		}
+		// Мягкий перенос: "=" в конце строки, в том числе с пробелами после него
+		j := 0
+		for j < len(rest) && (rest[j] == ' ' || rest[j] == '\t') {
+			j++
+		}
+		if j == len(rest) {
+			i += j
+			continue
+		}
+		if rest[j] == '\n' {
+			i += j + 1
+			continue
+		}
+		if rest[j] == '\r' && j+1 < len(rest) && rest[j+1] == '\n' {
+			i += j + 2
+			continue
+		}
+		bad++
+		out = append(out, c)
+	}
+	var problems []string
+	if bad > 0 {
+		problems = append(problems, fmt.Sprintf("quoted-printable: %d invalid escape sequences kept as is", bad))
+	}
+	return out, problems
+}
+
+func isHex(c byte) bool {
+	return c >= '0' && c <= '9' || c >= 'A' && c <= 'F' || c >= 'a' && c <= 'f'
+}
+
+func unhex(c byte) byte {
+	switch {
+	case c >= 'a':
+		return c - 'a' + 10
+	case c >= 'A':
+		return c - 'A' + 10
+	}
+	return c - '0'
+}
+
+// DecodeText — imap.TextDecoder: снимает Content-Transfer-Encoding с загруженной текстовой
+// части и переводит её в UTF-8; проблемы подписываются номером и типом части.
+func DecodeText(raw []byte, p imap.Part) (string, []string) {
+	data, problems := DecodeTransfer(raw, p.Encoding)
+	text, more := DecodeCharset(data, p.Charset)
+	problems = append(problems, more...)
+	for i, s := range problems {
+		problems[i] = fmt.Sprintf("part %s (%s): %s", p.Path, p.MIMEType, s)
+	}
+	return text, problems
+}
+
+// encodedWordRe — слово RFC 2047: =?charset?B|Q?текст?= (язык после "*" в charset отбрасывается)
+var encodedWordRe = regexp.MustCompile(`=\?([^?\s*]+)(?:\*[^?\s]*)?\?([bBqQ])\?([^?\s]*)\?=`)
+
+// DecodeHeader переводит значение заголовка в UTF-8: декодирует слова RFC 2047 (соседние слова
+// в одной кодировке склеиваются до перекодирования — так не рвутся многобайтовые символы),
+// а «сырые» 8-битные байты перекодирует из hint (обычно кодировка текста письма) или угаданной кодировки.
+func DecodeHeader(s, hint string) (string, []string) {
+	if !strings.Contains(s, "=?") && utf8.ValidString(s) {
+		return s, nil
+	}
+	var b strings.Builder
+	var problems []string
+	var pending []byte
+	pendingCharset := ""
+	flushWords := func() {
+		if pendingCharset == "" && pending == nil {
+			return
+		}
+		text, p := DecodeCharset(pending, pendingCharset)
+		b.WriteString(text)
+		problems = append(problems, p...)
+		pending, pendingCharset = nil, ""
+	}
+	literal := func(seg string) {
+		if seg == "" {
+			return
+		}
+		flushWords()
+		if utf8.ValidString(seg) {
+			b.WriteString(seg)
+			return
+		}
+		text, p := DecodeCharset([]byte(seg), hint)
+		if len(p) == 0 {
+			p = []string{"unencoded 8-bit text decoded as " + strings.ToLower(hint)}
+		}
+		b.WriteString(text)
+		problems = append(problems, p...)
+	}
+	last := 0
+	for _, m := range encodedWordRe.FindAllStringSubmatchIndex(s, -1) {
+		gap := s[last:m[0]]
+		// Пробелы между соседними закодированными словами не входят в текст (RFC 2047 6.2)
+		if !(pending != nil && strings.TrimSpace(gap) == "") {
+			literal(gap)
+		}
+		cs, kind, payload := s[m[2]:m[3]], s[m[4]:m[5]], s[m[6]:m[7]]
+		var data []byte
+		var p []string
+		if kind == "b" || kind == "B" {
+			data, p = decodeBase64([]byte(payload))
+		} else {
+			data, p = decodeQuotedPrintable([]byte(strings.ReplaceAll(payload, "_", " ")))
+		}
+		problems = append(problems, p...)
+		if pending != nil && !strings.EqualFold(cs, pendingCharset) {
+			flushWords()
+		}
+		if pending == nil {
+			pending = []byte{}
+		}
+		pending = append(pending, data...)
+		pendingCharset = cs
+		last = m[1]
+	}
+	literal(s[last:])
+	flushWords()
+	return b.String(), problems
+}
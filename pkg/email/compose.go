@@ -0,0 +1,100 @@
+package email
+
+import (
+	"bytes"
+	"errors"
+	"strings"
+	"time"
+
+	"github.com/emersion/go-message/mail"
+)
+
+// Attachment — файл, прикладываемый к новому письму.
+type Attachment struct {
+	Filename string
+	// ContentType — MIME-тип файла; пустой — application/octet-stream
+	ContentType string
+	Data        []byte
+}
+
+// ComposeOptions — исходные данные нового письма.
+type ComposeOptions struct {
+	From    *mail.Address
+	To      []*mail.Address
+	Subject string
+	Text    string
+	// Attachments — вложения; без них письмо состоит из одной текстовой части
+	Attachments []Attachment
+	// Date — время отправки; нулевое — текущее
+	Date time.Time
+}
+
+// BuildMessage собирает новое письмо: текст text/plain и, если есть, вложения в multipart/mixed.
+func BuildMessage(opts ComposeOptions) (Outgoing, error) {
+	if opts.From == nil || len(opts.To) == 0 {
+		return Outgoing{}, errors.New("email: message needs a sender and recipients")
+	}
+	h, out, err := newHeader(opts.From, opts.To, strings.TrimSpace(opts.Subject), opts.Date)
+	if err != nil {
+		return Outgoing{}, err
+	}
+	body := []byte(strings.TrimRight(opts.Text, "\r\n ") + "\n")
+
+	var buf bytes.Buffer
+	if len(opts.Attachments) == 0 {
+		h.Set("Content-Type", "text/plain; charset=utf-8")
+		w, err := mail.CreateSingleInlineWriter(&buf, h)
+		if err != nil {
+			return Outgoing{}, err
+		}
+		if _, err := w.Write(body); err != nil {
+			return Outgoing{}, err
+		}
+		if err := w.Close(); err != nil {
+			return Outgoing{}, err
+		}
+		out.Raw = buf.Bytes()
+		return out, nil
+	}
+
+	w, err := mail.CreateWriter(&buf, h)
+	if err != nil {
+		return Outgoing{}, err
+	}
+	var th mail.InlineHeader
+	th.Set("Content-Type", "text/plain; charset=utf-8")
+	tw, err := w.CreateSingleInline(th)
+	if err != nil {
+		return Outgoing{}, err
+	}
+	if _, err := tw.Write(body); err != nil {
+		return Outgoing{}, err
+	}
+	if err := tw.Close(); err != nil {
+		return Outgoing{}, err
+	}
+	for _, a := range opts.Attachments {
+		ct := a.ContentType
+		if ct == "" {
+			ct = "application/octet-stream"
+		}
+		var ah mail.AttachmentHeader
+		ah.Set("Content-Type", ct)
+		ah.SetFilename(attachmentName(a.Filename))
+		aw, err := w.CreateAttachment(ah)
+		if err != nil {
+			return Outgoing{}, err
+		}
+		if _, err := aw.Write(a.Data); err != nil {
+			return Outgoing{}, err
+		}
+		if err := aw.Close(); err != nil {
+			return Outgoing{}, err
+		}
+	}
+	if err := w.Close(); err != nil {
+		return Outgoing{}, err
+	}
+	out.Raw = buf.Bytes()
+	return out, nil
+}
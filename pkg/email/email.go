@@ -1,12 +1,14 @@
 package email
 
 import (
+	"encoding/base64"
 	"fmt"
 	"html"
+	"net/url"
+	"regexp"
 	"strings"
 	"time"
-
-	bimap "github.com/BrianLeishman/go-imap"
+	"unicode/utf8"
 )
 
 type Summary struct {
@@ -16,47 +18,122 @@ type Summary struct {
 	ToAddress   string
 	Date        time.Time
 	HTMLBody    string
+	// Addresses — все адреса заголовков: получатели из To и Cc, Reply-To, Sender
+	Addresses Addresses
+	// Problems — проблемы декодирования заголовков и текста (кодировка угадана, битый base64 и т.п.)
+	Problems []string
+	// Text — текст письма без разметки (text/plain или HTMLToText) для анонса в уведомлении
+	Text string
 }
 
-// Summarize constructs Summary из структуры письма библиотеки BrianLeishman.
+// Summarize constructs Summary из письма: разобранного ParseMessage или загруженного pkg/imap (FromIMAP).
 // Берём HTML, иначе разворачиваем text/plain в безопасный <pre>.
-func Summarize(e *bimap.Email) Summary {
+func Summarize(m *Message) Summary {
     var sum Summary
-    sum.Subject = e.Subject
-    sum.Date = e.Sent
-    // Разобрать From и To в адрес/имя по простым паттернам
-    parseAddr := func(s string) (addr, name string) {
-        s = strings.TrimSpace(s)
-        if s == "" {
-            return "", ""
+    sum.Problems = append(sum.Problems, m.Problems...)
+    sum.Subject = m.Subject
+    sum.Date = m.Date
+    // Для краткой подписи берём первого отправителя и получателя
+    sum.Addresses = m.Addresses
+    if from := sum.Addresses.From; len(from) > 0 {
+        sum.FromAddress, sum.FromName = from[0].Display(), from[0].Name
+    }
+    if rcpts := sum.Addresses.Recipients(); len(rcpts) > 0 {
+        sum.ToAddress = rcpts[0].Display()
+    }
+
+    var htmlBody string
+    textPart, htmlPart := m.Body()
+    if htmlPart != nil {
+        htmlBody = htmlPart.Text
+    }
+    if htmlBody == "" && textPart != nil && textPart.Text != "" {
+        htmlBody = "<pre style=\"white-space:pre-wrap;word-wrap:break-word;\">" + html.EscapeString(textPart.Text) + "</pre>"
+    }
+    // Декодер мог не проверять текст (FetchOptions.Decoder не задан): мусор дальше не передаём
+    if !utf8.ValidString(htmlBody) {
+        htmlBody = strings.ToValidUTF8(htmlBody, "�")
+        sum.Problems = append(sum.Problems, "body: invalid UTF-8 replaced")
+    }
+    // Анонс строится по text/plain, а без него — по тексту HTML
+    if textPart != nil && textPart.Text != "" {
+        sum.Text = textPart.Text
+    } else if htmlPart != nil {
+        sum.Text = HTMLToText(htmlPart.Text)
+    }
+    sum.Text = strings.ToValidUTF8(sum.Text, "�")
+    if htmlBody != "" {
+        htmlBody = embedInlineImages(htmlBody, m.InlineImages()) + bodyFooter(m, sum.Problems)
+    }
+    sum.HTMLBody = htmlBody
+    return sum
+}
+
+// cidRe находит ссылки cid: в атрибутах и стилях HTML (RFC 2392)
+var cidRe = regexp.MustCompile(`(?i)cid:([^"'\s)>]+)`)
+
+// embedInlineImages заменяет ссылки cid: на загруженные картинки письма в виде data: URI,
+// чтобы страница viewer выглядела как в почтовом клиенте и не требовала отдельных запросов.
+func embedInlineImages(htmlBody string, images []*Part) string {
+    if len(images) == 0 {
+        return htmlBody
+    }
+    byID := make(map[string]*Part, len(images))
+    for _, img := range images {
+        byID[strings.ToLower(img.ContentID)] = img
+    }
+    return cidRe.ReplaceAllStringFunc(htmlBody, func(ref string) string {
+        id := ref[len("cid:"):]
+        if s, err := url.PathUnescape(id); err == nil {
+            id = s
         }
-        if i := strings.Index(s, "<"); i >= 0 && strings.Contains(s, ">") {
-            name = strings.TrimSpace(strings.TrimSpace(s[:i]))
-            j := strings.Index(s[i:], ">")
-            if j >= 0 {
-                addr = strings.TrimSpace(s[i+1 : i+j])
-            }
-            return addr, name
+        img, ok := byID[strings.ToLower(id)]
+        if !ok {
+            return ref
+        }
+        return "data:" + img.MIMEType + ";base64," + base64.StdEncoding.EncodeToString(img.Body)
+    })
+}
+
+// bodyFooter сообщает под текстом письма об обрезке и проблемах декодирования и перечисляет
+// вложения: они не загружаются вместе с письмом.
+func bodyFooter(m *Message, problems []string) string {
+    var b strings.Builder
+    if m.Truncated {
+        b.WriteString("<hr><p><i>Message truncated: only the beginning of the body was loaded.</i></p>")
+    }
+    if len(problems) > 0 {
+        b.WriteString("<hr><p><i>⚠️ The message was not decoded cleanly, some characters may be wrong:</i></p><ul>")
+        for _, p := range problems {
+            fmt.Fprintf(&b, "<li><i>%s</i></li>", html.EscapeString(p))
         }
-        if i := strings.Index(s, ":"); i > 0 {
-            // format: addr:name
-            addr = strings.TrimSpace(s[:i])
-            name = strings.TrimSpace(s[i+1:])
-            return addr, name
+        b.WriteString("</ul>")
+    }
+    atts := m.Attachments()
+    if len(atts) == 0 {
+        return b.String()
+    }
+    b.WriteString("<hr><p>📎 Attachments:</p><ul>")
+    for _, a := range atts {
+        name := a.Filename
+        if name == "" {
+            name = "unnamed " + a.MIMEType
         }
-        return s, ""
+        fmt.Fprintf(&b, "<li>%s (%s)</li>", html.EscapeString(name), FormatSize(a.Size))
     }
-    // Поля адресов в библиотеке — тип EmailAddresses с методом String()
-    sum.FromAddress, sum.FromName = parseAddr(e.From.String())
-    toAddr, _ := parseAddr(e.To.String())
-    sum.ToAddress = toAddr
+    b.WriteString("</ul>")
+    return b.String()
+}
 
-    htmlBody := e.HTML
-    if htmlBody == "" && e.Text != "" {
-        htmlBody = "<pre style=\"white-space:pre-wrap;word-wrap:break-word;\">" + html.EscapeString(e.Text) + "</pre>"
+// FormatSize печатает размер в байтах, КБ или МБ.
+func FormatSize(n int) string {
+    switch {
+    case n >= 1<<20:
+        return fmt.Sprintf("%.1f MB", float64(n)/(1<<20))
+    case n >= 1<<10:
+        return fmt.Sprintf("%d KB", n>>10)
     }
-    sum.HTMLBody = htmlBody
-    return sum
+    return fmt.Sprintf("%d B", n)
 }
 
 func FormatGistDescription(sum Summary) string {
@@ -0,0 +1,148 @@
+package email
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/emersion/go-message/mail"
+
+	"mailpuff/pkg/imap"
+)
+
+// ForwardOptions — исходные данные пересылки письма.
+type ForwardOptions struct {
+	From *mail.Address
+	To   []*mail.Address
+	// Original — заголовки пересылаемого письма (imap.FetchHeaders)
+	Original *imap.Email
+	// Raw — пересылаемое письмо целиком, как на сервере (imap.FetchRaw)
+	Raw []byte
+	// Date — время отправки; нулевое — текущее
+	Date time.Time
+}
+
+// BuildForward собирает пересылку: короткая справка об исходном письме и само письмо
+// вложением message/rfc822 (RFC 2046 5.2.1) — со всеми его частями и вложениями без изменений.
+func BuildForward(opts ForwardOptions) (Outgoing, error) {
+	orig := opts.Original
+	if opts.From == nil || orig == nil || len(opts.To) == 0 {
+		return Outgoing{}, errors.New("email: forward needs a sender, recipients and the original message")
+	}
+	if len(opts.Raw) == 0 {
+		return Outgoing{}, errors.New("email: original message content is empty")
+	}
+	h, out, err := newHeader(opts.From, opts.To, forwardSubject(orig.Subject), opts.Date)
+	if err != nil {
+		return Outgoing{}, err
+	}
+
+	var buf bytes.Buffer
+	w, err := mail.CreateWriter(&buf, h)
+	if err != nil {
+		return Outgoing{}, err
+	}
+	var th mail.InlineHeader
+	th.Set("Content-Type", "text/plain; charset=utf-8")
+	tw, err := w.CreateSingleInline(th)
+	if err != nil {
+		return Outgoing{}, err
+	}
+	if _, err := tw.Write([]byte(forwardSummary(orig))); err != nil {
+		return Outgoing{}, err
+	}
+	if err := tw.Close(); err != nil {
+		return Outgoing{}, err
+	}
+
+	var ah mail.AttachmentHeader
+	ah.Set("Content-Type", "message/rfc822")
+	ah.SetFilename(attachmentName(orig.Subject) + ".eml")
+	// Вложенное письмо не перекодируется (RFC 2046 5.2.1): 7bit, а с 8-битными байтами — 8bit
+	ah.Set("Content-Transfer-Encoding", "7bit")
+	if !isASCII(opts.Raw) {
+		ah.Set("Content-Transfer-Encoding", "8bit")
+	}
+	aw, err := w.CreateAttachment(ah)
+	if err != nil {
+		return Outgoing{}, err
+	}
+	if _, err := aw.Write(opts.Raw); err != nil {
+		return Outgoing{}, err
+	}
+	if err := aw.Close(); err != nil {
+		return Outgoing{}, err
+	}
+	if err := w.Close(); err != nil {
+		return Outgoing{}, err
+	}
+	out.Raw = buf.Bytes()
+	return out, nil
+}
+
+// forwardSubject добавляет «Fwd: », если тема ещё не начинается с него.
+func forwardSubject(subject string) string {
+	s := strings.TrimSpace(subject)
+	lower := strings.ToLower(s)
+	if strings.HasPrefix(lower, "fwd:") || strings.HasPrefix(lower, "fw:") {
+		return s
+	}
+	return "Fwd: " + s
+}
+
+// forwardSummary — текст над вложенным письмом в духе почтовых клиентов.
+func forwardSummary(e *imap.Email) string {
+	var b strings.Builder
+	b.WriteString("---------- Forwarded message ----------\n")
+	if len(e.From) > 0 {
+		fmt.Fprintf(&b, "From: %s\n", joinAddresses(e.From))
+	}
+	if !e.Sent.IsZero() {
+		fmt.Fprintf(&b, "Date: %s\n", e.Sent.Format("Mon, 02 Jan 2006 15:04"))
+	}
+	fmt.Fprintf(&b, "Subject: %s\n", e.Subject)
+	if len(e.To) > 0 {
+		fmt.Fprintf(&b, "To: %s\n", joinAddresses(e.To))
+	}
+	b.WriteString("\nThe original message is attached.\n")
+	return b.String()
+}
+
+func joinAddresses(list []imap.Address) string {
+	s := make([]string, len(list))
+	for i, a := range list {
+		s[i] = a.String()
+	}
+	return strings.Join(s, ", ")
+}
+
+// attachmentName делает из темы имя файла: без разделителей путей и управляющих символов.
+func attachmentName(subject string) string {
+	name := strings.Map(func(r rune) rune {
+		switch {
+		case r < 0x20, r == 0x7f:
+			return -1
+		case strings.ContainsRune(`/\:*?"<>|`, r):
+			return '_'
+		}
+		return r
+	}, strings.TrimSpace(subject))
+	if r := []rune(name); len(r) > 80 {
+		name = string(r[:80])
+	}
+	if name == "" {
+		name = "message"
+	}
+	return name
+}
+
+func isASCII(b []byte) bool {
+	for _, c := range b {
+		if c >= 0x80 {
+			return false
+		}
+	}
+	return true
+}
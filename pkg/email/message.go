@@ -0,0 +1,667 @@
+package email
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"mime"
+	"net/mail"
+	"strings"
+	"time"
+
+	"mailpuff/pkg/imap"
+)
+
+// Пределы разбора: письмо из чужого источника не должно раздувать дерево частей без конца.
+const (
+	maxPartDepth = 20
+	maxPartCount = 1000
+)
+
+// HeaderField — поле заголовка: имя как в письме, значение без переносов строк (RFC 5322 2.2.3),
+// ещё не декодированное из RFC 2047.
+type HeaderField struct {
+	Key   string
+	Value string
+}
+
+// Header — поля заголовка в порядке следования.
+type Header []HeaderField
+
+// Get возвращает значение первого поля key (без учёта регистра) или пустую строку.
+func (h Header) Get(key string) string {
+	for _, f := range h {
+		if strings.EqualFold(f.Key, key) {
+			return f.Value
+		}
+	}
+	return ""
+}
+
+// Values возвращает значения всех полей key.
+func (h Header) Values(key string) []string {
+	var out []string
+	for _, f := range h {
+		if strings.EqualFold(f.Key, key) {
+			out = append(out, f.Value)
+		}
+	}
+	return out
+}
+
+// Part — часть MIME-дерева письма.
+type Part struct {
+	// Path — номер части, как у BODY[<path>] в IMAP: "1", "2.1"; у корня не-multipart письма — "1"
+	Path   string
+	Header Header
+	// MIMEType — тип в нижнем регистре, например "text/html"
+	MIMEType    string
+	Charset     string
+	Encoding    string
+	Disposition string
+	Filename    string
+	// ContentID — Content-ID без угловых скобок (для ссылок cid:)
+	ContentID string
+	// Children — вложенные части multipart/*; у листовых частей пусто
+	Children []*Part
+	// Body — содержимое листовой части без Content-Transfer-Encoding; nil — не загружено
+	Body []byte
+	// Size — размер содержимого после декодирования (для незагруженных частей — оценка)
+	Size int
+	// Text — текстовая часть в UTF-8 (только для text/plain и text/html письма)
+	Text string
+}
+
+// IsAttachment сообщает, что часть — вложение, а не текст письма.
+func (p *Part) IsAttachment() bool {
+	if p.Disposition == "attachment" {
+		return true
+	}
+	if p.MIMEType != "text/plain" && p.MIMEType != "text/html" {
+		return true
+	}
+	return p.Filename != "" && p.Disposition != "inline"
+}
+
+// Message — письмо в модели pkg/email: из исходного RFC 5322 (ParseMessage) или из
+// письма, загруженного pkg/imap (FromIMAP).
+type Message struct {
+	// Header — заголовок письма; пусто у писем из IMAP (там заголовки берутся из ENVELOPE)
+	Header    Header
+	MessageID string
+	// Subject — тема, уже декодированная в UTF-8
+	Subject   string
+	Date      time.Time
+	Addresses Addresses
+	// Root — корень MIME-дерева
+	Root *Part
+	// Size — размер исходного письма
+	Size int
+	// Truncated — текст письма загружен не полностью
+	Truncated bool
+	// Problems — проблемы разбора и декодирования: письмо всё равно показывается, но может быть искажено
+	Problems []string
+}
+
+// Parts возвращает листовые части письма в порядке следования; пустые multipart пропускаются.
+func (m *Message) Parts() []*Part {
+	var out []*Part
+	var walk func(p *Part)
+	walk = func(p *Part) {
+		if len(p.Children) == 0 {
+			if !strings.HasPrefix(p.MIMEType, "multipart/") {
+				out = append(out, p)
+			}
+			return
+		}
+		for _, c := range p.Children {
+			walk(c)
+		}
+	}
+	if m.Root != nil {
+		walk(m.Root)
+	}
+	return out
+}
+
+// Body выбирает части для просмотра: первую text/plain и первую text/html, не являющиеся вложениями.
+func (m *Message) Body() (text, html *Part) {
+	for _, p := range m.Parts() {
+		if p.IsAttachment() {
+			continue
+		}
+		switch p.MIMEType {
+		case "text/plain":
+			if text == nil {
+				text = p
+			}
+		case "text/html":
+			if html == nil {
+				html = p
+			}
+		}
+	}
+	return text, html
+}
+
+// Attachments возвращает части письма, не являющиеся его текстом, кроме картинок,
+// на которые ссылается HTML письма (cid:).
+func (m *Message) Attachments() []*Part {
+	_, html := m.Body()
+	var out []*Part
+	for _, p := range m.Parts() {
+		if p.IsAttachment() && !references(html, p.ContentID) {
+			out = append(out, p)
+		}
+	}
+	return out
+}
+
+// InlineImages возвращает загруженные картинки, на которые ссылается HTML письма (cid:).
+func (m *Message) InlineImages() []*Part {
+	_, html := m.Body()
+	var out []*Part
+	for _, p := range m.Parts() {
+		if p.Body != nil && inlineImageTypes[p.MIMEType] && references(html, p.ContentID) {
+			out = append(out, p)
+		}
+	}
+	return out
+}
+
+// inlineImageTypes — форматы картинок, которые viewer показывает как data: URI
+var inlineImageTypes = map[string]bool{
+	"image/gif":     true,
+	"image/jpeg":    true,
+	"image/png":     true,
+	"image/webp":    true,
+	"image/svg+xml": true,
+}
+
+func references(html *Part, id string) bool {
+	if html == nil || id == "" {
+		return false
+	}
+	return strings.Contains(strings.ToLower(html.Text), "cid:"+strings.ToLower(id))
+}
+
+// FromIMAP переводит письмо, загруженное pkg/imap (FetchHeaders и FetchBodies), в Message.
+// BODYSTRUCTURE в imap.Email уже плоская, поэтому её листья становятся детьми одного корня.
+func FromIMAP(e *imap.Email) *Message {
+	m := &Message{
+		MessageID: e.MessageID,
+		Date:      e.Sent,
+		Addresses: EnvelopeAddresses(e),
+		Size:      e.Size,
+		Truncated: e.Truncated,
+		Problems:  append([]string(nil), e.Problems...),
+	}
+	inline := make(map[string][]byte, len(e.Inline))
+	for _, img := range e.Inline {
+		inline[strings.ToLower(img.ContentID)] = img.Data
+	}
+	textPart, htmlPart := imap.BodyParts(e.Parts)
+	root := &Part{MIMEType: "multipart/mixed"}
+	for i := range e.Parts {
+		ip := &e.Parts[i]
+		p := &Part{
+			Path:        ip.Path,
+			MIMEType:    ip.MIMEType,
+			Charset:     ip.Charset,
+			Encoding:    ip.Encoding,
+			Disposition: ip.Disposition,
+			Filename:    ip.Filename,
+			ContentID:   ip.ContentID,
+			Size:        ip.DecodedSize(),
+		}
+		switch ip {
+		case textPart:
+			p.Text = e.Text
+		case htmlPart:
+			p.Text = e.HTML
+		}
+		if data, ok := inline[strings.ToLower(ip.ContentID)]; ok && ip.ContentID != "" {
+			p.Body = data
+		}
+		root.Children = append(root.Children, p)
+	}
+	// Сервер без BODYSTRUCTURE: текст загружен целиком (imap.fetchWhole), частей нет
+	if len(e.Parts) == 0 && (e.Text != "" || e.HTML != "") {
+		if e.Text != "" {
+			root.Children = append(root.Children, &Part{Path: "1", MIMEType: "text/plain", Text: e.Text, Size: len(e.Text)})
+		}
+		if e.HTML != "" {
+			root.Children = append(root.Children, &Part{Path: "2", MIMEType: "text/html", Text: e.HTML, Size: len(e.HTML)})
+		}
+		for _, img := range e.Inline {
+			root.Children = append(root.Children, &Part{MIMEType: img.MIMEType, ContentID: img.ContentID, Body: img.Data, Size: len(img.Data)})
+		}
+	}
+	m.Root = root
+
+	subject, problems := DecodeHeader(e.Subject, bodyCharset(m))
+	m.Subject = subject
+	for _, p := range problems {
+		m.Problems = append(m.Problems, "subject: "+p)
+	}
+	return m
+}
+
+// bodyCharset возвращает объявленную кодировку текста письма: по ней перекодируются
+// заголовки с «сырыми» 8-битными байтами.
+func bodyCharset(m *Message) string {
+	text, html := m.Body()
+	for _, p := range []*Part{html, text} {
+		if p != nil && p.Charset != "" {
+			return p.Charset
+		}
+	}
+	return ""
+}
+
+// ParseMessage разбирает письмо в формате RFC 5322 (например, файл .eml). Разбор мягкий:
+// неверные строки заголовка, незакрытые multipart и ошибки кодировок попадают в Problems,
+// а ошибка возвращается, только если в данных нет ни заголовка, ни тела.
+func ParseMessage(raw []byte) (*Message, error) {
+	if len(bytes.TrimSpace(raw)) == 0 {
+		return nil, fmt.Errorf("email: empty message")
+	}
+	m := &Message{Size: len(raw)}
+	p := &parser{msg: m}
+	header, body := p.splitHeader(raw, "header")
+	if len(header) == 0 {
+		return nil, fmt.Errorf("email: no header found")
+	}
+	m.Header = header
+	m.Root = p.parsePart(header, body, "", 0)
+
+	hint := bodyCharset(m)
+	decode := func(field, value string) string {
+		s, problems := DecodeHeader(value, hint)
+		for _, pr := range problems {
+			m.Problems = append(m.Problems, strings.ToLower(field)+": "+pr)
+		}
+		return s
+	}
+	m.Subject = decode("Subject", header.Get("Subject"))
+	m.MessageID = strings.TrimSpace(header.Get("Message-Id"))
+	if v := header.Get("Date"); v != "" {
+		if t, err := parseDate(v); err == nil {
+			m.Date = t
+		} else {
+			m.Problems = append(m.Problems, "date: unparsable value "+fmt.Sprintf("%q", v))
+		}
+	}
+	list := func(field string) []Address {
+		var out []Address
+		for _, v := range header.Values(field) {
+			out = append(out, ParseAddressList(v)...)
+		}
+		return out
+	}
+	m.Addresses = Addresses{
+		From:    list("From"),
+		Sender:  list("Sender"),
+		ReplyTo: list("Reply-To"),
+		To:      list("To"),
+		Cc:      list("Cc"),
+	}
+	if len(m.Addresses.Sender) > 0 && len(m.Addresses.From) > 0 && m.Addresses.Sender[0].Is(m.Addresses.From[0].Addr) {
+		m.Addresses.Sender = nil
+	}
+	return m, nil
+}
+
+// dateLayouts — форматы Date, которые встречаются в письмах старых программ вместо RFC 5322
+var dateLayouts = []string{
+	"Mon, 2 Jan 2006 15:04:05 -0700 (MST)",
+	"Mon, 2 Jan 2006 15:04:05 MST",
+	"2 Jan 2006 15:04:05 -0700",
+	"Mon, 2 Jan 06 15:04:05 -0700",
+	"Mon Jan 2 15:04:05 2006",
+	"Mon, 2 Jan 2006 15:04 -0700",
+	time.RFC3339,
+}
+
+func parseDate(v string) (time.Time, error) {
+	v = strings.Join(strings.Fields(v), " ")
+	if t, err := mail.ParseDate(v); err == nil {
+		return t, nil
+	}
+	for _, layout := range dateLayouts {
+		if t, err := time.Parse(layout, v); err == nil {
+			return t, nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("email: unparsable date %q", v)
+}
+
+type parser struct {
+	msg   *Message
+	count int
+}
+
+func (p *parser) problemf(format string, args ...any) {
+	p.msg.Problems = append(p.msg.Problems, fmt.Sprintf(format, args...))
+}
+
+// splitHeader отделяет заголовок от тела по первой пустой строке и разбирает поля.
+// Строки без двоеточия пропускаются; where — где заголовок, для сообщений о проблемах.
+func (p *parser) splitHeader(raw []byte, where string) (Header, []byte) {
+	var h Header
+	rest := raw
+	for len(rest) > 0 {
+		line := rest
+		next := []byte(nil)
+		if i := bytes.IndexByte(rest, '\n'); i >= 0 {
+			line, next = rest[:i], rest[i+1:]
+		}
+		line = bytes.TrimSuffix(line, []byte("\r"))
+		if len(line) == 0 {
+			return h, next
+		}
+		if (line[0] == ' ' || line[0] == '\t') && len(h) > 0 {
+			// Продолжение свёрнутого поля
+			h[len(h)-1].Value += " " + strings.TrimSpace(string(line))
+		} else if k, v, ok := strings.Cut(string(line), ":"); ok && isFieldName(strings.TrimRight(k, " \t")) {
+			// Пробелы перед двоеточием допускает устаревший синтаксис (RFC 5322 4.5)
+			h = append(h, HeaderField{Key: strings.TrimRight(k, " \t"), Value: strings.TrimSpace(v)})
+		} else if len(h) == 0 && bytes.HasPrefix(line, []byte("From ")) {
+			// Строка-разделитель mbox перед письмом
+		} else {
+			p.problemf("%s: skipped malformed line %q", where, truncateString(string(line), 60))
+		}
+		rest = next
+	}
+	return h, nil
+}
+
+// isFieldName проверяет имя поля заголовка: печатные ASCII-символы без пробелов (RFC 5322 2.2).
+func isFieldName(k string) bool {
+	if k == "" {
+		return false
+	}
+	for i := 0; i < len(k); i++ {
+		if k[i] <= ' ' || k[i] > '~' {
+			return false
+		}
+	}
+	return true
+}
+
+// parsePart разбирает часть с заголовком h и телом body; path — номер части для IMAP-нумерации.
+func (p *parser) parsePart(h Header, body []byte, path string, depth int) *Part {
+	p.count++
+	part := &Part{Header: h, Path: path}
+	mediaType, params := p.contentType(h.Get("Content-Type"), path)
+	part.MIMEType = mediaType
+	part.Charset = params["charset"]
+	part.Encoding = strings.ToLower(strings.TrimSpace(h.Get("Content-Transfer-Encoding")))
+	part.ContentID = strings.Trim(strings.TrimSpace(h.Get("Content-Id")), "<>")
+	if disp := h.Get("Content-Disposition"); disp != "" {
+		d, dparams, err := mime.ParseMediaType(disp)
+		if err != nil {
+			d, _, _ = strings.Cut(disp, ";")
+			d = strings.ToLower(strings.TrimSpace(d))
+			dparams = lenientParams(disp)
+		}
+		part.Disposition = d
+		part.Filename = dparams["filename"]
+	}
+	if part.Filename == "" {
+		part.Filename = params["name"]
+	}
+	if part.Filename != "" {
+		// Outlook и др. кодируют имя файла словами RFC 2047 вместо RFC 2231
+		part.Filename, _ = DecodeHeader(part.Filename, part.Charset)
+	}
+
+	if strings.HasPrefix(mediaType, "multipart/") && params["boundary"] != "" {
+		if depth >= maxPartDepth || p.count >= maxPartCount {
+			p.problemf("part %s: nesting too deep, contents skipped", orRoot(path))
+			return part
+		}
+		for i, chunk := range p.splitMultipart(body, params["boundary"], part.Path) {
+			ch, cb := p.splitHeader(chunk, "part "+childPath(path, i+1))
+			part.Children = append(part.Children, p.parsePart(ch, cb, childPath(path, i+1), depth+1))
+		}
+		if len(part.Children) == 0 {
+			p.problemf("part %s: %s without parts", orRoot(path), mediaType)
+		}
+		return part
+	}
+	if strings.HasPrefix(mediaType, "multipart/") {
+		p.problemf("part %s: %s without boundary, shown as text", orRoot(path), mediaType)
+		part.MIMEType = "text/plain"
+	}
+	// Письмо из одной части нумеруется в IMAP как BODY[1]
+	if part.Path == "" {
+		part.Path = "1"
+	}
+
+	data, problems := DecodeTransfer(body, part.Encoding)
+	for _, pr := range problems {
+		p.problemf("part %s (%s): %s", part.Path, part.MIMEType, pr)
+	}
+	part.Body = data
+	part.Size = len(data)
+	if !part.IsAttachment() {
+		text, problems := DecodeCharset(data, part.Charset)
+		for _, pr := range problems {
+			p.problemf("part %s (%s): %s", part.Path, part.MIMEType, pr)
+		}
+		part.Text = text
+	}
+	return part
+}
+
+// contentType разбирает Content-Type; без него (или с неразборчивым значением) часть — text/plain (RFC 2045 5.2).
+func (p *parser) contentType(v, path string) (string, map[string]string) {
+	if strings.TrimSpace(v) == "" {
+		return "text/plain", map[string]string{}
+	}
+	mediaType, params, err := mime.ParseMediaType(v)
+	if err == nil {
+		return mediaType, params
+	}
+	t, _, _ := strings.Cut(v, ";")
+	t = strings.ToLower(strings.TrimSpace(t))
+	if !strings.Contains(t, "/") {
+		p.problemf("part %s: invalid Content-Type %q, treated as text/plain", orRoot(path), truncateString(v, 60))
+		t = "text/plain"
+	}
+	return t, lenientParams(v)
+}
+
+// lenientParams достаёт параметры key=value из значения, которое не принял mime.ParseMediaType
+// (пробелы вокруг "=", лишние ";", незакрытые кавычки).
+func lenientParams(v string) map[string]string {
+	out := map[string]string{}
+	_, rest, _ := strings.Cut(v, ";")
+	for _, item := range strings.Split(rest, ";") {
+		k, val, ok := strings.Cut(item, "=")
+		if !ok {
+			continue
+		}
+		k = strings.ToLower(strings.TrimSpace(k))
+		val = strings.Trim(strings.TrimSpace(val), `"`)
+		if k != "" {
+			if _, dup := out[k]; !dup {
+				out[k] = val
+			}
+		}
+	}
+	return out
+}
+
+// splitMultipart делит тело multipart на части по границе boundary; преамбула и эпилог
+// отбрасываются. Незакрытая последняя часть сохраняется (письмо могло быть обрезано).
+func (p *parser) splitMultipart(body []byte, boundary, path string) [][]byte {
+	delim := []byte("--" + boundary)
+	var parts [][]byte
+	var cur []byte
+	in, closed := false, false
+	rest := body
+	for len(rest) > 0 && !closed {
+		line := rest
+		next := []byte(nil)
+		if i := bytes.IndexByte(rest, '\n'); i >= 0 {
+			line, next = rest[:i+1], rest[i+1:]
+		}
+		trimmed := bytes.TrimRight(line, " \t\r\n")
+		switch {
+		case bytes.Equal(trimmed, append(append([]byte(nil), delim...), '-', '-')):
+			if in {
+				parts = append(parts, trimLineBreak(cur))
+			}
+			closed = true
+		case bytes.Equal(trimmed, delim):
+			if in {
+				parts = append(parts, trimLineBreak(cur))
+			}
+			in, cur = true, nil
+		case in:
+			cur = append(cur, line...)
+		}
+		rest = next
+	}
+	if !closed {
+		if in {
+			parts = append(parts, trimLineBreak(cur))
+		}
+		p.problemf("part %s: multipart is not closed (--%s--), message may be truncated", orRoot(path), truncateString(boundary, 40))
+	}
+	return parts
+}
+
+// trimLineBreak убирает перевод строки перед границей: по RFC 2046 он относится к разделителю.
+func trimLineBreak(b []byte) []byte {
+	b = bytes.TrimSuffix(b, []byte("\n"))
+	return bytes.TrimSuffix(b, []byte("\r"))
+}
+
+func childPath(parent string, n int) string {
+	if parent == "" {
+		return fmt.Sprint(n)
+	}
+	return parent + "." + fmt.Sprint(n)
+}
+
+func orRoot(path string) string {
+	if path == "" {
+		return "root"
+	}
+	return path
+}
+
+func truncateString(s string, n int) string {
+	r := []rune(strings.ToValidUTF8(s, "�"))
+	if len(r) <= n {
+		return string(r)
+	}
+	return string(r[:n]) + "…"
+}
+
+// outlinePart — часть письма в Outline: без содержимого, только структура.
+type outlinePart struct {
+	Path        string        `json:"path,omitempty"`
+	Type        string        `json:"type"`
+	Charset     string        `json:"charset,omitempty"`
+	Encoding    string        `json:"encoding,omitempty"`
+	Disposition string        `json:"disposition,omitempty"`
+	Filename    string        `json:"filename,omitempty"`
+	ContentID   string        `json:"content_id,omitempty"`
+	Size        int           `json:"size,omitempty"`
+	Children    []outlinePart `json:"children,omitempty"`
+}
+
+// Outline описывает разобранное письмо в JSON: декодированные заголовки и адреса, MIME-дерево,
+// текст, вложения и проблемы. Так печатает письма `mailpuff ingest -dry-run`; в этом виде
+// хранятся эталоны разбора testdata/*.golden.
+func Outline(m *Message) ([]byte, error) {
+	addrs := func(list []Address) []string {
+		var out []string
+		for _, a := range list {
+			s := a.String()
+			if a.Group != "" {
+				s = a.Group + ": " + s
+			}
+			out = append(out, s)
+		}
+		return out
+	}
+	var tree func(p *Part) outlinePart
+	tree = func(p *Part) outlinePart {
+		o := outlinePart{
+			Path:        p.Path,
+			Type:        p.MIMEType,
+			Charset:     p.Charset,
+			Encoding:    p.Encoding,
+			Disposition: p.Disposition,
+			Filename:    p.Filename,
+			ContentID:   p.ContentID,
+			Size:        p.Size,
+		}
+		for _, c := range p.Children {
+			o.Children = append(o.Children, tree(c))
+		}
+		return o
+	}
+	out := struct {
+		MessageID   string       `json:"message_id,omitempty"`
+		Subject     string       `json:"subject"`
+		Date        string       `json:"date,omitempty"`
+		From        []string     `json:"from,omitempty"`
+		Sender      []string     `json:"sender,omitempty"`
+		ReplyTo     []string     `json:"reply_to,omitempty"`
+		To          []string     `json:"to,omitempty"`
+		Cc          []string     `json:"cc,omitempty"`
+		Structure   *outlinePart `json:"structure,omitempty"`
+		Text        string       `json:"text,omitempty"`
+		HTML        string       `json:"html,omitempty"`
+		Attachments []string     `json:"attachments,omitempty"`
+		Inline      []string     `json:"inline,omitempty"`
+		Problems    []string     `json:"problems,omitempty"`
+	}{
+		MessageID: m.MessageID,
+		Subject:   m.Subject,
+		From:      addrs(m.Addresses.From),
+		Sender:    addrs(m.Addresses.Sender),
+		ReplyTo:   addrs(m.Addresses.ReplyTo),
+		To:        addrs(m.Addresses.To),
+		Cc:        addrs(m.Addresses.Cc),
+		Problems:  m.Problems,
+	}
+	if !m.Date.IsZero() {
+		out.Date = m.Date.Format(time.RFC3339)
+	}
+	if m.Root != nil {
+		root := tree(m.Root)
+		out.Structure = &root
+	}
+	text, html := m.Body()
+	if text != nil {
+		out.Text = text.Text
+	}
+	if html != nil {
+		out.HTML = html.Text
+	}
+	for _, a := range m.Attachments() {
+		name := a.Filename
+		if name == "" {
+			name = "unnamed"
+		}
+		out.Attachments = append(out.Attachments, fmt.Sprintf("%s (%s, %s)", name, a.MIMEType, FormatSize(a.Size)))
+	}
+	for _, p := range m.InlineImages() {
+		out.Inline = append(out.Inline, p.ContentID)
+	}
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	enc.SetEscapeHTML(false)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(out); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
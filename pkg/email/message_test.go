@@ -0,0 +1,82 @@
+package email
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// update перезаписывает эталоны testdata/*.golden текущим разбором: go test ./pkg/email -update.
+// Изменения эталонов нужно просмотреть в diff перед коммитом.
+var update = flag.Bool("update", false, "rewrite testdata/*.golden with the current parser output")
+
+func TestParseMessageGolden(t *testing.T) {
+	files, err := filepath.Glob(filepath.Join("testdata", "*.eml"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) == 0 {
+		t.Fatal("no testdata/*.eml files")
+	}
+	for _, file := range files {
+		name := strings.TrimSuffix(filepath.Base(file), ".eml")
+		t.Run(name, func(t *testing.T) {
+			raw, err := os.ReadFile(file)
+			if err != nil {
+				t.Fatal(err)
+			}
+			m, err := ParseMessage(raw)
+			if err != nil {
+				t.Fatalf("ParseMessage: %v", err)
+			}
+			got, err := Outline(m)
+			if err != nil {
+				t.Fatalf("Outline: %v", err)
+			}
+			golden := strings.TrimSuffix(file, ".eml") + ".golden"
+			if *update {
+				if err := os.WriteFile(golden, got, 0o644); err != nil {
+					t.Fatal(err)
+				}
+				return
+			}
+			want, err := os.ReadFile(golden)
+			if err != nil {
+				t.Fatalf("%v (run with -update to create it)", err)
+			}
+			if !bytes.Equal(got, want) {
+				t.Errorf("parsed %s differs from %s:\n%s", file, golden, lineDiff(string(want), string(got)))
+			}
+		})
+	}
+}
+
+// lineDiff показывает первые расходящиеся строки эталона (-) и разбора (+).
+func lineDiff(want, got string) string {
+	w, g := strings.Split(want, "\n"), strings.Split(got, "\n")
+	var b strings.Builder
+	shown := 0
+	for i := 0; i < len(w) || i < len(g); i++ {
+		var wl, gl string
+		if i < len(w) {
+			wl = w[i]
+		}
+		if i < len(g) {
+			gl = g[i]
+		}
+		if wl == gl {
+			continue
+		}
+		if shown == 10 {
+			b.WriteString("...\n")
+			break
+		}
+		shown++
+		fmt.Fprintf(&b, "line %d:\n- %s\n+ %s\n", i+1, wl, gl)
+	}
+	return b.String()
+}
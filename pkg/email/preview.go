@@ -0,0 +1,245 @@
+package email
+
+import (
+	"regexp"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"golang.org/x/net/html"
+	"golang.org/x/net/html/atom"
+)
+
+// HTMLToText переводит HTML письма в обычный текст: блоки и <br> становятся переводами строк,
+// пункты списков — строками «• », текст внутри <blockquote> — цитатой «> », подпись Gmail
+// и Thunderbird отделяется строкой "-- ". Скрипты, стили и <head> отбрасываются, сущности декодируются.
+func HTMLToText(s string) string {
+	z := html.NewTokenizer(strings.NewReader(s))
+	var b strings.Builder
+	skip, pre, quote := 0, 0, 0
+	// ends — закрывающие теги, после которых нужно вернуть счётчики skip, pre и quote
+	var ends []atom.Atom
+	newline := func(n int) {
+		text := b.String()
+		have := len(text) - len(strings.TrimRight(text, "\n"))
+		if len(text) == 0 {
+			return
+		}
+		for ; have < n; have++ {
+			b.WriteByte('\n')
+		}
+	}
+	write := func(text string) {
+		for i, line := range strings.Split(text, "\n") {
+			if i > 0 {
+				b.WriteByte('\n')
+			}
+			if line == "" {
+				continue
+			}
+			if s := b.String(); quote > 0 && (s == "" || strings.HasSuffix(s, "\n")) {
+				b.WriteString(strings.Repeat("> ", quote))
+			}
+			b.WriteString(line)
+		}
+	}
+	for {
+		tt := z.Next()
+		switch tt {
+		case html.ErrorToken:
+			return cleanText(b.String())
+		case html.TextToken:
+			if skip > 0 {
+				continue
+			}
+			text := string(z.Text())
+			if pre == 0 {
+				// Пробел между словами соседних строчных элементов сохраняется; &nbsp; — тоже пробел
+				decoded := text
+				text = strings.Join(strings.Fields(decoded), " ")
+				out := b.String()
+				space := out != "" && !strings.HasSuffix(out, "\n") && !strings.HasSuffix(out, " ")
+				if text == "" {
+					if space && decoded != "" {
+						b.WriteByte(' ')
+					}
+					continue
+				}
+				if space && strings.TrimLeftFunc(decoded, unicode.IsSpace) != decoded {
+					text = " " + text
+				}
+				if strings.TrimRightFunc(decoded, unicode.IsSpace) != decoded {
+					text += " "
+				}
+			}
+			write(text)
+		case html.StartTagToken, html.SelfClosingTagToken:
+			name, hasAttr := z.TagName()
+			a := atom.Lookup(name)
+			var class, id string
+			for hasAttr {
+				var k, v []byte
+				k, v, hasAttr = z.TagAttr()
+				switch string(k) {
+				case "class":
+					class = string(v)
+				case "id":
+					id = string(v)
+				}
+			}
+			switch a {
+			case atom.Script, atom.Style, atom.Head, atom.Title, atom.Noscript, atom.Template:
+				if tt == html.StartTagToken {
+					skip++
+					ends = append(ends, a)
+				}
+				continue
+			case atom.Br:
+				b.WriteByte('\n')
+			case atom.Hr:
+				newline(1)
+			case atom.Li:
+				newline(1)
+				write("• ")
+			case atom.Td, atom.Th:
+				if s := b.String(); s != "" && !strings.HasSuffix(s, "\n") && !strings.HasSuffix(s, " ") {
+					b.WriteByte(' ')
+				}
+			case atom.Pre:
+				newline(2)
+				pre++
+				ends = append(ends, a)
+			case atom.Blockquote:
+				newline(1)
+				quote++
+				ends = append(ends, a)
+			case atom.P, atom.H1, atom.H2, atom.H3, atom.H4, atom.H5, atom.H6, atom.Table, atom.Ul, atom.Ol:
+				newline(2)
+			case atom.Div, atom.Tr, atom.Section, atom.Article, atom.Header, atom.Footer, atom.Dd, atom.Dt:
+				newline(1)
+			}
+			if strings.Contains(class, "gmail_signature") || strings.Contains(class, "moz-signature") || id == "Signature" {
+				newline(1)
+				b.WriteString("-- \n")
+			}
+		case html.EndTagToken:
+			name, _ := z.TagName()
+			a := atom.Lookup(name)
+			if n := len(ends); n > 0 && ends[n-1] == a {
+				ends = ends[:n-1]
+				switch a {
+				case atom.Pre:
+					pre--
+				case atom.Blockquote:
+					quote--
+				default:
+					skip--
+				}
+			}
+			switch a {
+			case atom.P, atom.H1, atom.H2, atom.H3, atom.H4, atom.H5, atom.H6, atom.Table, atom.Ul, atom.Ol, atom.Pre:
+				newline(2)
+			case atom.Div, atom.Tr, atom.Li, atom.Blockquote, atom.Section, atom.Article, atom.Header, atom.Footer:
+				newline(1)
+			}
+		}
+	}
+}
+
+var blankLinesRe = regexp.MustCompile(`\n{3,}`)
+
+// cleanText убирает пробелы в конце строк, кроме разделителя подписи "-- ", и лишние пустые строки.
+func cleanText(s string) string {
+	lines := strings.Split(s, "\n")
+	for i, line := range lines {
+		if line != "-- " {
+			lines[i] = strings.TrimRight(line, " \t")
+		}
+	}
+	s = blankLinesRe.ReplaceAllString(strings.Join(lines, "\n"), "\n\n")
+	return strings.Trim(s, "\n ")
+}
+
+var (
+	// signatureRe — разделитель подписи (RFC 3676 "-- ", часто без пробела) и подписи мобильных клиентов
+	signatureRe = regexp.MustCompile(`^(--|__+|Sent from my .+|Get Outlook for .+|Отправлено с .+|Отправлено из .+)$`)
+	// attributionRe — строка перед цитатой ответа: "On Mon, 1 Jan 2024, Alice <a@x> wrote:", «1 янв. 2024 г., Алиса пишет:»
+	attributionRe = regexp.MustCompile(`(?i)^(on .+ wrote|.+ (пишет|написал|написала|написал\(а\))|.+ schrieb .*|le .+ a écrit)\s*:$`)
+	// originalRe — начало цитаты Outlook и Apple Mail
+	originalRe = regexp.MustCompile(`(?i)^-{2,}\s*(original message|исходное сообщение)\s*-{2,}$`)
+	// fromLineRe, sentLineRe — первые строки заголовков цитаты Outlook ("From: …", "Sent: …")
+	fromLineRe = regexp.MustCompile(`(?i)^\*?(from|от|de|von):\*?\s`)
+	sentLineRe = regexp.MustCompile(`(?i)^\*?(sent|date|отправлено|дата|envoyé|gesendet):\*?\s`)
+	// invisibleRep убирает невидимые символы, которыми рассылки добивают скрытый анонс письма
+	invisibleRep = strings.NewReplacer("\u200b", "", "\u200c", "", "\u200d", "", "\u2060", "", "\ufeff", "", "\u00ad", "", "\u034f", "")
+)
+
+// PreviewText делает из текста письма краткий анонс для уведомления: отбрасывает цитаты
+// предыдущих писем (строки «> », «On … wrote:», блок заголовков Outlook) и подпись, схлопывает
+// пробелы и переводы строк и обрезает результат до limit символов по границе слова с «…».
+// Если после удаления цитат текста не осталось (например, пересылка), анонс строится по всему тексту.
+// limit <= 0 — анонс не нужен.
+func PreviewText(text string, limit int) string {
+	if limit <= 0 {
+		return ""
+	}
+	text = invisibleRep.Replace(strings.ReplaceAll(text, "\r\n", "\n"))
+	lines := strings.Split(text, "\n")
+	var kept []string
+body:
+	for i, line := range lines {
+		t := strings.TrimSpace(line)
+		switch {
+		case strings.HasPrefix(t, ">"):
+			continue
+		case signatureRe.MatchString(t) || originalRe.MatchString(t):
+			break body
+		case attributionRe.MatchString(t):
+			break body
+		// Строка автора цитаты, перенесённая почтовой программой: "On …" + "… wrote:"
+		case i+1 < len(lines) && strings.HasPrefix(strings.ToLower(t), "on ") && attributionRe.MatchString(t+" "+strings.TrimSpace(lines[i+1])):
+			break body
+		case fromLineRe.MatchString(t) && isQuoteHeader(lines[i+1:]):
+			break body
+		}
+		kept = append(kept, t)
+	}
+	preview := strings.Join(strings.Fields(strings.Join(kept, " ")), " ")
+	if preview == "" {
+		for i, line := range lines {
+			lines[i] = strings.TrimLeft(strings.TrimSpace(line), "> ")
+		}
+		preview = strings.Join(strings.Fields(strings.Join(lines, " ")), " ")
+	}
+	return truncateText(preview, limit)
+}
+
+// isQuoteHeader сообщает, что за строкой "From:" идёт строка "Sent:" или "Date:" — это заголовок цитаты Outlook.
+func isQuoteHeader(next []string) bool {
+	for i, line := range next {
+		if i == 3 {
+			break
+		}
+		if sentLineRe.MatchString(strings.TrimSpace(line)) {
+			return true
+		}
+	}
+	return false
+}
+
+// truncateText обрезает текст до limit символов вместе с «…», по возможности по границе слова.
+func truncateText(s string, limit int) string {
+	if utf8.RuneCountInString(s) <= limit {
+		return s
+	}
+	if limit <= 1 {
+		return ""
+	}
+	runes := []rune(s)
+	cut := string(runes[:limit-1])
+	// Слово, которое влезло целиком, не обрезается
+	if i := strings.LastIndexByte(cut, ' '); i > len(cut)/2 && runes[limit-1] != ' ' {
+		cut = cut[:i]
+	}
+	return strings.TrimRight(cut, " ,.;:-") + "…"
+}
@@ -0,0 +1,153 @@
+package email
+
+import (
+	"strings"
+	"testing"
+	"unicode/utf8"
+)
+
+func TestHTMLToText(t *testing.T) {
+	tests := []struct {
+		name, in, want string
+	}{
+		{
+			name: "paragraphs and breaks",
+			in:   "<p>Hello,<br>world</p><p>Second   paragraph</p>",
+			want: "Hello,\nworld\n\nSecond paragraph",
+		},
+		{
+			name: "inline elements keep spaces",
+			in:   "<div>Total: <b>42</b> <i>EUR</i>&nbsp;due</div>",
+			want: "Total: 42 EUR due",
+		},
+		{
+			name: "entities, head, scripts and styles",
+			in:   "<html><head><title>T</title><style>p{}</style></head><body>a &amp; b &lt;c&gt;<script>alert(1)</script></body></html>",
+			want: "a & b <c>",
+		},
+		{
+			name: "lists",
+			in:   "<p>Agenda:</p><ul><li>one</li><li>two</li></ul>",
+			want: "Agenda:\n\n• one\n• two",
+		},
+		{
+			name: "blockquote",
+			in:   "<div>Sure</div><blockquote><div>Can you come?</div><blockquote>Nested</blockquote></blockquote>",
+			want: "Sure\n> Can you come?\n> > Nested",
+		},
+		{
+			name: "pre keeps layout",
+			in:   "<pre>a  b\n  c</pre>",
+			want: "a  b\n  c",
+		},
+		{
+			name: "table cells",
+			in:   "<table><tr><td>Name</td><td>Qty</td></tr><tr><td>Tea</td><td>2</td></tr></table>",
+			want: "Name Qty\nTea 2",
+		},
+		{
+			name: "gmail signature",
+			in:   `<div>Thanks</div><div class="gmail_signature">Alice</div>`,
+			want: "Thanks\n-- \nAlice",
+		},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := HTMLToText(tc.in); got != tc.want {
+				t.Errorf("HTMLToText(%q)\n got %q\nwant %q", tc.in, got, tc.want)
+			}
+		})
+	}
+}
+
+func TestPreviewText(t *testing.T) {
+	tests := []struct {
+		name  string
+		text  string
+		limit int
+		want  string
+	}{
+		{
+			name:  "collapses whitespace",
+			text:  "Hi team,\r\n\r\n  the build   is green.\n",
+			limit: 100,
+			want:  "Hi team, the build is green.",
+		},
+		{
+			name:  "drops quoted reply",
+			text:  "Sounds good.\n\nOn Mon, 4 Mar 2024 at 10:00, Alice <alice@example.org> wrote:\n> Lunch at noon?\n",
+			limit: 100,
+			want:  "Sounds good.",
+		},
+		{
+			name:  "wrapped attribution",
+			text:  "Yes\nOn Mon, 4 Mar 2024 at 10:00, Alice Example\n<alice@example.org> wrote:\n> Q\n",
+			limit: 100,
+			want:  "Yes",
+		},
+		{
+			name:  "russian attribution",
+			text:  "Да, подходит.\n4 марта 2024 г., Алиса пишет:\n> Обед в полдень?\n",
+			limit: 100,
+			want:  "Да, подходит.",
+		},
+		{
+			name:  "outlook header",
+			text:  "See below\n\nFrom: Bob <bob@example.org>\nSent: Monday, March 4, 2024\nSubject: Report\n\nOld text",
+			limit: 100,
+			want:  "See below",
+		},
+		{
+			name:  "signature",
+			text:  "Done.\n-- \nAlice\nCEO",
+			limit: 100,
+			want:  "Done.",
+		},
+		{
+			name:  "mobile signature",
+			text:  "Ok\n\nSent from my iPhone",
+			limit: 100,
+			want:  "Ok",
+		},
+		{
+			name:  "only a quote",
+			text:  "> forwarded text\n> second line",
+			limit: 100,
+			want:  "forwarded text second line",
+		},
+		{
+			name:  "invisible padding",
+			text:  "Sale\u200b\u200c\u00ad starts\ufeff today",
+			limit: 100,
+			want:  "Sale starts today",
+		},
+		{
+			name:  "truncates at a word",
+			text:  "The quick brown fox jumps over the lazy dog",
+			limit: 20,
+			want:  "The quick brown fox…",
+		},
+		{
+			name:  "disabled",
+			text:  "anything",
+			limit: 0,
+			want:  "",
+		},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			got := PreviewText(tc.text, tc.limit)
+			if got != tc.want {
+				t.Errorf("PreviewText(%q, %d)\n got %q\nwant %q", tc.text, tc.limit, got, tc.want)
+			}
+			if n := utf8.RuneCountInString(got); n > tc.limit && tc.limit > 0 {
+				t.Errorf("preview has %d characters, limit %d", n, tc.limit)
+			}
+		})
+	}
+	// Длинное слово без пробелов режется по символам, не по байтам
+	long := strings.Repeat("я", 50)
+	if got := PreviewText(long, 10); got != strings.Repeat("я", 9)+"…" {
+		t.Errorf("PreviewText(long word) = %q", got)
+	}
+}
@@ -0,0 +1,154 @@
+package email
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/emersion/go-message/mail"
+
+	"mailpuff/pkg/imap"
+)
+
+// ReplyOptions — исходные данные ответа на письмо.
+type ReplyOptions struct {
+	// From — отправитель ответа
+	From *mail.Address
+	// Original — письмо, на которое отвечаем; для цитаты нужен загруженный Text
+	Original *imap.Email
+	// References — цепочка Message-ID исходного письма (imap.FetchReferences)
+	References []string
+	// Text — текст ответа
+	Text string
+	// Quote — добавить под ответом цитату исходного письма
+	Quote bool
+	// Date — время отправки; нулевое — текущее
+	Date time.Time
+}
+
+// Outgoing — готовое к отправке письмо.
+type Outgoing struct {
+	// Raw — письмо целиком (RFC 5322) для SMTP и копии в «Отправленных»
+	Raw []byte
+	// MessageID — Message-ID ответа в угловых скобках
+	MessageID string
+	// To — адреса получателей для RCPT TO
+	To []string
+}
+
+// BuildReply собирает ответ: получатель — Reply-To исходного письма (иначе From), тема с «Re: »,
+// In-Reply-To и References по RFC 5322 3.6.4, чтобы почтовые клиенты собрали переписку в цепочку.
+func BuildReply(opts ReplyOptions) (Outgoing, error) {
+	orig := opts.Original
+	if opts.From == nil || orig == nil {
+		return Outgoing{}, errors.New("email: reply needs a sender and the original message")
+	}
+	recipients := EnvelopeAddresses(orig).ReplyTargets()
+	if len(recipients) == 0 {
+		return Outgoing{}, errors.New("email: original message has no sender address")
+	}
+	to := make([]*mail.Address, len(recipients))
+	for i, a := range recipients {
+		to[i] = a.Mail()
+	}
+	h, out, err := newHeader(opts.From, to, replySubject(orig.Subject), opts.Date)
+	if err != nil {
+		return Outgoing{}, err
+	}
+	if id := trimMsgID(orig.MessageID); id != "" {
+		h.SetMsgIDList("In-Reply-To", []string{id})
+		var refs []string
+		for _, r := range opts.References {
+			if r = trimMsgID(r); r != "" && r != id {
+				refs = append(refs, r)
+			}
+		}
+		h.SetMsgIDList("References", append(refs, id))
+	}
+	h.Set("Content-Type", "text/plain; charset=utf-8")
+
+	body := strings.TrimRight(opts.Text, "\r\n ") + "\n"
+	if opts.Quote && orig.Text != "" {
+		body += "\n" + quoteText(orig) + "\n"
+	}
+	var buf bytes.Buffer
+	w, err := mail.CreateSingleInlineWriter(&buf, h)
+	if err != nil {
+		return Outgoing{}, err
+	}
+	if _, err := w.Write([]byte(body)); err != nil {
+		return Outgoing{}, err
+	}
+	if err := w.Close(); err != nil {
+		return Outgoing{}, err
+	}
+	out.Raw = buf.Bytes()
+	return out, nil
+}
+
+// newHeader заполняет общие заголовки исходящего письма и создаёт для него Message-ID
+// в домене отправителя; out получает Message-ID и адреса получателей.
+func newHeader(from *mail.Address, to []*mail.Address, subject string, date time.Time) (mail.Header, Outgoing, error) {
+	var out Outgoing
+	if date.IsZero() {
+		date = time.Now()
+	}
+	var h mail.Header
+	h.SetDate(date)
+	h.SetAddressList("From", []*mail.Address{from})
+	h.SetAddressList("To", to)
+	h.SetSubject(subject)
+	_, domain, _ := strings.Cut(from.Address, "@")
+	if domain == "" {
+		domain = "localhost"
+	}
+	if err := h.GenerateMessageIDWithHostname(domain); err != nil {
+		return h, out, err
+	}
+	out.MessageID = h.Get("Message-Id")
+	for _, a := range to {
+		out.To = append(out.To, a.Address)
+	}
+	return h, out, nil
+}
+
+// replySubject добавляет «Re: », если тема ещё не начинается с него.
+func replySubject(subject string) string {
+	s := strings.TrimSpace(subject)
+	if len(s) >= 3 && strings.EqualFold(s[:3], "re:") {
+		return s
+	}
+	return "Re: " + s
+}
+
+// quoteText цитирует текст исходного письма строками «> » под строкой с автором и датой.
+func quoteText(e *imap.Email) string {
+	author := "unknown sender"
+	if len(e.From) > 0 {
+		author = e.From[0].String()
+	}
+	var b strings.Builder
+	if e.Sent.IsZero() {
+		fmt.Fprintf(&b, "%s wrote:\n", author)
+	} else {
+		fmt.Fprintf(&b, "On %s, %s wrote:\n", e.Sent.Format("Mon, 02 Jan 2006 15:04"), author)
+	}
+	text := strings.ReplaceAll(strings.TrimRight(e.Text, "\r\n "), "\r\n", "\n")
+	for _, line := range strings.Split(text, "\n") {
+		if line == "" || strings.HasPrefix(line, ">") {
+			b.WriteString(">" + line + "\n")
+		} else {
+			b.WriteString("> " + line + "\n")
+		}
+	}
+	if e.Truncated {
+		b.WriteString("> [...]\n")
+	}
+	return b.String()
+}
+
+func trimMsgID(id string) string {
+	return strings.Trim(strings.TrimSpace(id), "<>")
+}
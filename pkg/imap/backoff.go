@@ -0,0 +1,50 @@
+package imap
+
+import (
+	"math/rand/v2"
+	"time"
+)
+
+// Backoff — экспоненциальная задержка между попытками подключения с джиттером,
+// чтобы соединения нескольких папок и аккаунтов не ломились на сервер одновременно.
+// Нулевое значение использует Min = 1s и Max = 5m. Не безопасен для одновременного использования.
+type Backoff struct {
+	Min time.Duration
+	Max time.Duration
+
+	attempt int
+}
+
+// Next возвращает задержку перед следующей попыткой: Min·2^n, но не больше Max,
+// случайно уменьшенную не более чем вдвое.
+func (b *Backoff) Next() time.Duration {
+	lo, hi := b.Min, b.Max
+	if lo <= 0 {
+		lo = time.Second
+	}
+	if hi < lo {
+		hi = 5 * time.Minute
+		if hi < lo {
+			hi = lo
+		}
+	}
+	d := lo
+	for i := 0; i < b.attempt && d < hi; i++ {
+		d *= 2
+	}
+	if d > hi {
+		d = hi
+	}
+	b.attempt++
+	return d/2 + rand.N(d/2+1)
+}
+
+// Reset возвращает задержку к Min после успешного подключения.
+func (b *Backoff) Reset() {
+	b.attempt = 0
+}
+
+// Attempts — число неудачных попыток подряд с последнего Reset.
+func (b *Backoff) Attempts() int {
+	return b.attempt
+}
@@ -0,0 +1,278 @@
+package imap
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/emersion/go-imap"
+	"github.com/emersion/go-imap/commands"
+	"github.com/emersion/go-imap/responses"
+)
+
+// Системные флаги писем, которые отслеживает MailPuff.
+const (
+	FlagSeen    = imap.SeenFlag
+	FlagFlagged = imap.FlaggedFlag
+)
+
+// Changes — изменения отслеживаемых писем папки с прошлой проверки.
+type Changes struct {
+	// Flags — текущие флаги писем (UID -> флаги). С CONDSTORE — только изменившихся,
+	// без него — всех запрошенных; сравнивать с известным состоянием должен вызывающий.
+	Flags map[int][]string
+	// Vanished — UID писем, которых больше нет в папке: удалены или перенесены в другую папку
+	Vanished []int
+	// ModSeq — точка, с которой запрашивать изменения в следующий раз; 0 — сервер без CONDSTORE
+	ModSeq uint64
+}
+
+// SupportsCondStore сообщает, что сервер ведёт MODSEQ писем (CONDSTORE, RFC 7162).
+func SupportsCondStore(m *Conn) bool {
+	ok, err := m.c.Support("CONDSTORE")
+	return err == nil && ok
+}
+
+// EnableQResync включает QRESYNC (RFC 7162), если сервер его поддерживает: об удалённых
+// письмах сервер сообщает их UID (VANISHED), а не порядковыми номерами (EXPUNGE).
+// Вызывается до SELECT; без поддержки возвращает false, соединение остаётся пригодным.
+func EnableQResync(m *Conn) bool {
+	caps, err := Capabilities(m)
+	if err != nil || !caps["QRESYNC"] || !caps["ENABLE"] {
+		return false
+	}
+	enabled, err := m.c.Enable([]string{"QRESYNC"})
+	if err != nil {
+		return false
+	}
+	for _, c := range enabled {
+		if strings.EqualFold(c, "QRESYNC") {
+			m.qresync = true
+		}
+	}
+	return m.qresync
+}
+
+// selectCondStore выполняет SELECT <папка> (CONDSTORE), чтобы получить HIGHESTMODSEQ.
+// Обычный Client.Select этот код ответа не разбирает.
+func selectCondStore(m *Conn, mailbox string) (*imap.MailboxStatus, uint64, error) {
+	cmd := (&commands.Select{Mailbox: mailbox}).Command()
+	cmd.Arguments = append(cmd.Arguments, []interface{}{imap.RawString("CONDSTORE")})
+	mbox := &imap.MailboxStatus{Name: mailbox, Items: make(map[imap.StatusItem]interface{})}
+	res := &condStoreSelect{Select: responses.Select{Mailbox: mbox}}
+	// Как и Client.Select: EXISTS во время SELECT клиент записывает в выбранную папку
+	m.c.SetState(m.c.State(), mbox)
+	status, err := m.c.Execute(rawCommand{cmd}, res)
+	if err == nil {
+		err = status.Err()
+	}
+	if err != nil {
+		m.c.SetState(imap.AuthenticatedState, nil)
+		return nil, 0, err
+	}
+	mbox.ReadOnly = status.Code == imap.CodeReadOnly
+	m.c.SetState(imap.SelectedState, mbox)
+	return mbox, res.highestModSeq, nil
+}
+
+// TrackChanges сообщает об изменениях писем uids с момента since (MODSEQ из прошлого
+// вызова или из SELECT). С CONDSTORE сервер возвращает только изменившиеся письма
+// (UID FETCH ... (CHANGEDSINCE)), с QRESYNC — и удалённые; без них запрашиваются
+// флаги всех uids, а удалёнными считаются не вернувшиеся.
+// since = 0 — полная сверка, например после переподключения.
+func TrackChanges(m *Conn, uids []int, since uint64) (Changes, error) {
+	out := Changes{Flags: make(map[int][]string), ModSeq: since}
+	if len(uids) == 0 {
+		return out, nil
+	}
+	seq := new(imap.SeqSet)
+	for _, u := range uids {
+		seq.AddNum(uint32(u))
+	}
+	if since == 0 || !SupportsCondStore(m) {
+		return trackAll(m, uids, seq, out)
+	}
+
+	modifiers := []interface{}{imap.RawString("CHANGEDSINCE"), imap.RawString(strconv.FormatUint(since, 10))}
+	if m.qresync {
+		modifiers = append(modifiers, imap.RawString("VANISHED"))
+	}
+	cmd := &imap.Command{
+		Name:      "UID",
+		Arguments: []interface{}{imap.RawString("FETCH"), seq, []interface{}{imap.RawString("FLAGS")}, modifiers},
+	}
+	res := &changesResp{changes: &out}
+	status, err := m.c.Execute(rawCommand{cmd}, res)
+	if err == nil {
+		err = status.Err()
+	}
+	if err != nil {
+		return out, err
+	}
+	if m.qresync {
+		return out, nil
+	}
+	// CONDSTORE без QRESYNC не сообщает об удалении — сверяем, какие письма остались
+	criteria := imap.NewSearchCriteria()
+	criteria.Uid = seq
+	found, err := m.c.UidSearch(criteria)
+	if err != nil {
+		return out, err
+	}
+	out.Vanished = missingUIDs(uids, found)
+	return out, nil
+}
+
+// trackAll — сверка без CONDSTORE: флаги всех uids одной командой.
+func trackAll(m *Conn, uids []int, seq *imap.SeqSet, out Changes) (Changes, error) {
+	ch := make(chan *imap.Message, 16)
+	done := make(chan error, 1)
+	go func() { done <- m.c.UidFetch(seq, []imap.FetchItem{imap.FetchUid, imap.FetchFlags}, ch) }()
+	var found []uint32
+	for msg := range ch {
+		if msg.Uid == 0 {
+			continue
+		}
+		found = append(found, msg.Uid)
+		out.Flags[int(msg.Uid)] = msg.Flags
+	}
+	if err := <-done; err != nil {
+		return out, err
+	}
+	out.Vanished = missingUIDs(uids, found)
+	return out, nil
+}
+
+func missingUIDs(uids []int, found []uint32) []int {
+	set := make(map[int]bool, len(found))
+	for _, u := range found {
+		set[int(u)] = true
+	}
+	var out []int
+	for _, u := range uids {
+		if !set[u] {
+			out = append(out, u)
+		}
+	}
+	return out
+}
+
+// HasFlag сообщает, есть ли флаг среди flags (без учёта регистра).
+func HasFlag(flags []string, flag string) bool {
+	return hasAttr(flags, flag)
+}
+
+// rawCommand позволяет выполнить через Client.Execute команду, для которой в go-imap нет типа.
+type rawCommand struct {
+	cmd *imap.Command
+}
+
+func (r rawCommand) Command() *imap.Command {
+	return r.cmd
+}
+
+// condStoreSelect дополняет разбор ответа SELECT кодами HIGHESTMODSEQ и NOMODSEQ.
+type condStoreSelect struct {
+	responses.Select
+	highestModSeq uint64
+}
+
+func (r *condStoreSelect) Handle(resp imap.Resp) error {
+	if st, ok := resp.(*imap.StatusResp); ok {
+		switch st.Code {
+		case "HIGHESTMODSEQ":
+			if len(st.Arguments) > 0 {
+				r.highestModSeq, _ = parseModSeq(st.Arguments[0])
+			}
+			return nil
+		case "NOMODSEQ":
+			// Папка не хранит MODSEQ — остаётся полная сверка
+			return nil
+		}
+	}
+	return r.Select.Handle(resp)
+}
+
+// changesResp разбирает ответы UID FETCH (CHANGEDSINCE): FETCH с FLAGS и MODSEQ и VANISHED (EARLIER).
+type changesResp struct {
+	changes *Changes
+}
+
+func (r *changesResp) Handle(resp imap.Resp) error {
+	name, fields, ok := imap.ParseNamedResp(resp)
+	if !ok {
+		return responses.ErrUnhandled
+	}
+	switch name {
+	case "FETCH":
+		if len(fields) < 2 {
+			return responses.ErrUnhandled
+		}
+		list, ok := fields[1].([]interface{})
+		if !ok {
+			return responses.ErrUnhandled
+		}
+		msg := &imap.Message{}
+		if err := msg.Parse(list); err != nil {
+			return err
+		}
+		if msg.Uid == 0 {
+			// Непрошеный FETCH без UID — пусть его обработает клиент
+			return responses.ErrUnhandled
+		}
+		if _, ok := msg.Items[imap.FetchFlags]; ok {
+			r.changes.Flags[int(msg.Uid)] = msg.Flags
+		}
+		if v, ok := msg.Items["MODSEQ"].([]interface{}); ok && len(v) > 0 {
+			if ms, err := parseModSeq(v[0]); err == nil && ms > r.changes.ModSeq {
+				r.changes.ModSeq = ms
+			}
+		}
+		return nil
+	case "VANISHED":
+		uids, err := parseVanished(fields)
+		if err != nil {
+			return err
+		}
+		r.changes.Vanished = append(r.changes.Vanished, uids...)
+		return nil
+	}
+	return responses.ErrUnhandled
+}
+
+// parseVanished разбирает поля ответа VANISHED [(EARLIER)] <uid-set>.
+func parseVanished(fields []interface{}) ([]int, error) {
+	if len(fields) > 0 {
+		if _, ok := fields[0].([]interface{}); ok {
+			fields = fields[1:]
+		}
+	}
+	if len(fields) < 1 {
+		return nil, fmt.Errorf("imap: VANISHED without UID set")
+	}
+	s, err := imap.ParseString(fields[0])
+	if err != nil {
+		return nil, err
+	}
+	set, err := imap.ParseSeqSet(s)
+	if err != nil {
+		return nil, err
+	}
+	var out []int
+	for _, r := range set.Set {
+		// '*' в VANISHED не встречается: сервер перечисляет конкретные UID
+		for u := r.Start; u <= r.Stop && r.Stop != 0; u++ {
+			out = append(out, int(u))
+		}
+	}
+	return out, nil
+}
+
+// parseModSeq разбирает mod-sequence: в отличие от прочих чисел IMAP он 63-битный.
+func parseModSeq(f interface{}) (uint64, error) {
+	s, err := imap.ParseString(f)
+	if err != nil {
+		return 0, err
+	}
+	return strconv.ParseUint(s, 10, 63)
+}
@@ -0,0 +1,559 @@
+package imap
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"mime/quotedprintable"
+	"strconv"
+	"strings"
+
+	"github.com/emersion/go-imap"
+	"github.com/emersion/go-message"
+	"github.com/emersion/go-message/charset"
+	"github.com/emersion/go-message/mail"
+	"github.com/emersion/go-message/textproto"
+	"github.com/jhillyerd/enmime"
+)
+
+// DefaultMaxBodySize — лимит загрузки текстовой части письма по умолчанию.
+const DefaultMaxBodySize = 2 << 20
+
+// Part — листовая часть письма из BODYSTRUCTURE. Содержимое не загружено: его получают
+// FetchBodies (текст для просмотра) или FetchPart (вложения — по запросу).
+type Part struct {
+	// Path — номер части для BODY[<path>]: "1", "2.1"
+	Path string
+	// MIMEType — тип в нижнем регистре, например "text/html"
+	MIMEType    string
+	Charset     string
+	Encoding    string
+	Size        int
+	Filename    string
+	Disposition string
+	// ContentID — Content-ID без угловых скобок (для ссылок cid:)
+	ContentID string
+}
+
+// IsAttachment сообщает, что часть — вложение, а не текст письма.
+func (p Part) IsAttachment() bool {
+	if p.Disposition == "attachment" {
+		return true
+	}
+	if p.MIMEType != "text/plain" && p.MIMEType != "text/html" {
+		return true
+	}
+	return p.Filename != "" && p.Disposition != "inline"
+}
+
+// DecodedSize оценивает размер части после декодирования: BODYSTRUCTURE даёт размер в base64.
+func (p Part) DecodedSize() int {
+	if p.Encoding == "base64" {
+		return p.Size * 3 / 4
+	}
+	return p.Size
+}
+
+// Attachments возвращает части письма, не являющиеся его текстом. Картинки, на которые
+// ссылается HTML письма (cid:), — часть оформления, а не вложения.
+func (e *Email) Attachments() []Part {
+	var out []Part
+	for _, p := range e.Parts {
+		if p.IsAttachment() && !e.references(p.ContentID) {
+			out = append(out, p)
+		}
+	}
+	return out
+}
+
+// references сообщает, что HTML письма ссылается на часть с Content-ID id.
+func (e *Email) references(id string) bool {
+	if id == "" || e.HTML == "" {
+		return false
+	}
+	return strings.Contains(strings.ToLower(e.HTML), "cid:"+strings.ToLower(id))
+}
+
+// inlineImageTypes — форматы картинок, которые viewer показывает как data: URI
+var inlineImageTypes = map[string]bool{
+	"image/gif":     true,
+	"image/jpeg":    true,
+	"image/png":     true,
+	"image/webp":    true,
+	"image/svg+xml": true,
+}
+
+// FetchOptions — ограничения загрузки тел писем.
+type FetchOptions struct {
+	// MaxBodySize — сколько байт текстовой части загружать; остаток отбрасывается (Email.Truncated)
+	MaxBodySize int
+	// MaxInlineSize — общий размер картинок cid: на письмо (после декодирования); картинки сверх
+	// него не загружаются. 0 — картинки не загружаются
+	MaxInlineSize int
+	// Decoder переводит текстовые части в UTF-8; nil — только объявленная кодировка, без проверок
+	Decoder TextDecoder
+}
+
+// TextDecoder снимает Content-Transfer-Encoding с загруженной текстовой части p и переводит её
+// в UTF-8. problems — что пришлось исправить или угадать; они попадают в Email.Problems.
+type TextDecoder func(raw []byte, p Part) (text string, problems []string)
+
+// FetchHeaders загружает ENVELOPE, BODYSTRUCTURE, флаги и размер писем — без тел.
+// Тела загружаются отдельно (FetchBodies) и только для тех писем, которые нужно показать.
+func FetchHeaders(m *Conn, uids []int) (map[int]*Email, error) {
+	out := make(map[int]*Email, len(uids))
+	if len(uids) == 0 {
+		return out, nil
+	}
+	seq := new(imap.SeqSet)
+	for _, u := range uids {
+		seq.AddNum(uint32(u))
+	}
+	items := []imap.FetchItem{imap.FetchUid, imap.FetchEnvelope, imap.FetchBodyStructure, imap.FetchRFC822Size, imap.FetchFlags}
+	ch := make(chan *imap.Message, 16)
+	done := make(chan error, 1)
+	go func() { done <- m.c.UidFetch(seq, items, ch) }()
+	for msg := range ch {
+		if msg.Uid == 0 {
+			continue
+		}
+		e := &Email{UID: int(msg.Uid), Size: int(msg.Size), Flagged: HasFlag(msg.Flags, FlagFlagged)}
+		if env := msg.Envelope; env != nil {
+			e.MessageID = env.MessageId
+			e.Subject = env.Subject
+			e.Sent = env.Date
+			e.From = envelopeAddresses(env.From)
+			e.To = envelopeAddresses(env.To)
+			e.Cc = envelopeAddresses(env.Cc)
+			// Сервер подставляет в ReplyTo адрес From, если заголовка нет (RFC 3501)
+			if !sameAddresses(env.ReplyTo, env.From) {
+				e.ReplyTo = envelopeAddresses(env.ReplyTo)
+			}
+			if !sameAddresses(env.Sender, env.From) {
+				e.Sender = envelopeAddresses(env.Sender)
+			}
+		}
+		if msg.BodyStructure != nil {
+			e.Parts = flattenStructure(msg.BodyStructure)
+		}
+		out[e.UID] = e
+	}
+	return out, <-done
+}
+
+func sameAddresses(a, b []*imap.Address) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] == nil || b[i] == nil || a[i].Address() != b[i].Address() {
+			return false
+		}
+	}
+	return true
+}
+
+// FetchReferences возвращает цепочку Message-ID, на которые отвечает письмо: заголовок
+// References, а без него — In-Reply-To. Идентификаторы — в угловых скобках, как в ENVELOPE.
+func FetchReferences(m *Conn, uid int) ([]string, error) {
+	section := &imap.BodySectionName{Peek: true, BodyPartName: imap.BodyPartName{
+		Specifier: imap.HeaderSpecifier,
+		Fields:    []string{"References", "In-Reply-To"},
+	}}
+	msg, err := fetchOne(m, uid, []imap.FetchItem{imap.FetchUid, section.FetchItem()})
+	if err != nil {
+		return nil, err
+	}
+	body := msg.GetBody(section)
+	if body == nil {
+		return nil, nil
+	}
+	hdr, err := textproto.ReadHeader(bufio.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	h := mail.Header{Header: message.Header{Header: hdr}}
+	ids, err := h.MsgIDList("References")
+	if err != nil || len(ids) == 0 {
+		ids, err = h.MsgIDList("In-Reply-To")
+	}
+	if err != nil {
+		// Нестандартный заголовок не мешает ответить, цепочка просто начнётся заново
+		return nil, nil
+	}
+	out := make([]string, len(ids))
+	for i, id := range ids {
+		out[i] = "<" + id + ">"
+	}
+	return out, nil
+}
+
+// flattenStructure собирает листовые части в порядке следования. Вложенные письма
+// (message/rfc822) не раскрываются — это одно вложение.
+func flattenStructure(bs *imap.BodyStructure) []Part {
+	var out []Part
+	bs.Walk(func(path []int, p *imap.BodyStructure) bool {
+		if len(p.Parts) > 0 {
+			return true
+		}
+		nums := make([]string, len(path))
+		for i, n := range path {
+			nums[i] = strconv.Itoa(n)
+		}
+		filename, _ := p.Filename()
+		out = append(out, Part{
+			Path:        strings.Join(nums, "."),
+			MIMEType:    strings.ToLower(p.MIMEType + "/" + p.MIMESubType),
+			Charset:     p.Params["charset"],
+			Encoding:    strings.ToLower(p.Encoding),
+			Size:        int(p.Size),
+			Filename:    filename,
+			Disposition: strings.ToLower(p.Disposition),
+			ContentID:   strings.Trim(p.Id, "<>"),
+		})
+		return false
+	})
+	return out
+}
+
+// BodyParts выбирает части для просмотра: первую text/plain и первую text/html, не являющиеся вложениями.
+func BodyParts(parts []Part) (text, html *Part) {
+	for i := range parts {
+		p := &parts[i]
+		if p.IsAttachment() {
+			continue
+		}
+		switch p.MIMEType {
+		case "text/plain":
+			if text == nil {
+				text = p
+			}
+		case "text/html":
+			if html == nil {
+				html = p
+			}
+		}
+	}
+	return text, html
+}
+
+// FetchBodies загружает для писем только текстовые части (text/plain и text/html) не длиннее
+// opts.MaxBodySize; вложения не загружаются. Письма без BODYSTRUCTURE загружаются целиком с тем же лимитом.
+func FetchBodies(m *Conn, emails []*Email, opts FetchOptions) error {
+	if opts.MaxBodySize <= 0 {
+		opts.MaxBodySize = DefaultMaxBodySize
+	}
+	for _, e := range emails {
+		var err error
+		if e.Parts == nil {
+			err = fetchWhole(m, e, opts)
+		} else {
+			err = fetchTextParts(m, e, opts)
+		}
+		if err != nil {
+			return fmt.Errorf("imap: uid %d: %w", e.UID, err)
+		}
+	}
+	return nil
+}
+
+func fetchTextParts(m *Conn, e *Email, opts FetchOptions) error {
+	text, html := BodyParts(e.Parts)
+	var wanted []*Part
+	for _, p := range []*Part{text, html} {
+		if p != nil {
+			wanted = append(wanted, p)
+		}
+	}
+	if len(wanted) == 0 {
+		return nil
+	}
+	sections := make([]*imap.BodySectionName, len(wanted))
+	items := []imap.FetchItem{imap.FetchUid}
+	for i, p := range wanted {
+		sections[i] = partSection(p.Path, p.Size, opts.MaxBodySize)
+		if p.Size > opts.MaxBodySize {
+			e.Truncated = true
+		}
+		items = append(items, sections[i].FetchItem())
+	}
+	msg, err := fetchOne(m, e.UID, items)
+	if err != nil {
+		return err
+	}
+	for i, p := range wanted {
+		body := msg.GetBody(sections[i])
+		if body == nil {
+			continue
+		}
+		raw, err := io.ReadAll(body)
+		if err != nil {
+			return err
+		}
+		var s string
+		if opts.Decoder != nil {
+			var problems []string
+			s, problems = opts.Decoder(raw, *p)
+			e.Problems = append(e.Problems, problems...)
+		} else {
+			s = decodePart(raw, p.Encoding, p.Charset)
+		}
+		if p == text {
+			e.Text = s
+		} else {
+			e.HTML = s
+		}
+	}
+	return fetchInlineImages(m, e, opts.MaxInlineSize)
+}
+
+// fetchInlineImages загружает картинки, на которые ссылается HTML письма, пока их общий
+// размер укладывается в limit; не поместившиеся остаются битыми ссылками cid:.
+func fetchInlineImages(m *Conn, e *Email, limit int) error {
+	var wanted []Part
+	total := 0
+	for _, p := range e.Parts {
+		if !inlineImageTypes[p.MIMEType] || !e.references(p.ContentID) {
+			continue
+		}
+		if total+p.DecodedSize() > limit {
+			continue
+		}
+		total += p.DecodedSize()
+		wanted = append(wanted, p)
+	}
+	if len(wanted) == 0 {
+		return nil
+	}
+	sections := make([]*imap.BodySectionName, len(wanted))
+	items := []imap.FetchItem{imap.FetchUid}
+	for i, p := range wanted {
+		sections[i] = partSection(p.Path, 0, 0)
+		items = append(items, sections[i].FetchItem())
+	}
+	msg, err := fetchOne(m, e.UID, items)
+	if err != nil {
+		return err
+	}
+	total = 0
+	for i, p := range wanted {
+		body := msg.GetBody(sections[i])
+		if body == nil {
+			continue
+		}
+		raw, err := io.ReadAll(body)
+		if err != nil {
+			return err
+		}
+		data := decodeTransfer(raw, p.Encoding)
+		if total+len(data) > limit {
+			continue
+		}
+		total += len(data)
+		e.Inline = append(e.Inline, InlineImage{ContentID: p.ContentID, MIMEType: p.MIMEType, Data: data})
+	}
+	return nil
+}
+
+// fetchWhole — запасной путь для серверов без BODYSTRUCTURE: письмо целиком (в пределах лимита) через enmime.
+func fetchWhole(m *Conn, e *Email, opts FetchOptions) error {
+	section := &imap.BodySectionName{Peek: true, Partial: []int{0, opts.MaxBodySize}}
+	msg, err := fetchOne(m, e.UID, []imap.FetchItem{imap.FetchUid, section.FetchItem()})
+	if err != nil {
+		return err
+	}
+	body := msg.GetBody(section)
+	if body == nil {
+		return nil
+	}
+	raw, err := io.ReadAll(body)
+	if err != nil {
+		return err
+	}
+	e.Truncated = e.Size > opts.MaxBodySize
+	env, err := enmime.ReadEnvelope(bytes.NewReader(raw))
+	if err != nil {
+		// Неразборчивое письмо остаётся без текста и будет пропущено, соединение при этом исправно
+		e.Problems = append(e.Problems, "mime: "+err.Error())
+		return nil
+	}
+	for _, perr := range env.Errors {
+		e.Problems = append(e.Problems, perr.String())
+	}
+	if s := env.GetHeader("Subject"); s != "" {
+		e.Subject = s
+	}
+	e.Text = env.Text
+	e.HTML = env.HTML
+	total := 0
+	for _, p := range append(env.Inlines, env.OtherParts...) {
+		ct := strings.ToLower(p.ContentType)
+		if !inlineImageTypes[ct] || !e.references(p.ContentID) || total+len(p.Content) > opts.MaxInlineSize {
+			continue
+		}
+		total += len(p.Content)
+		e.Inline = append(e.Inline, InlineImage{ContentID: p.ContentID, MIMEType: ct, Data: p.Content})
+	}
+	return nil
+}
+
+// FetchPart загружает и декодирует одну часть письма (например, вложение) по её Path.
+func FetchPart(m *Conn, uid int, p Part) ([]byte, error) {
+	section := partSection(p.Path, 0, 0)
+	msg, err := fetchOne(m, uid, []imap.FetchItem{imap.FetchUid, section.FetchItem()})
+	if err != nil {
+		return nil, err
+	}
+	body := msg.GetBody(section)
+	if body == nil {
+		return nil, fmt.Errorf("imap: uid %d: part %s not returned", uid, p.Path)
+	}
+	raw, err := io.ReadAll(body)
+	if err != nil {
+		return nil, err
+	}
+	return decodeTransfer(raw, p.Encoding), nil
+}
+
+// OpenPart загружает часть письма по её Path и возвращает reader, который снимает
+// Content-Transfer-Encoding по мере чтения: декодированная часть целиком в памяти не собирается.
+// Клиент получает часть от сервера до возврата из OpenPart, поэтому reader можно читать
+// и после того, как сессия вернулась в пул.
+func OpenPart(m *Conn, uid int, p Part) (io.Reader, error) {
+	section := partSection(p.Path, 0, 0)
+	msg, err := fetchOne(m, uid, []imap.FetchItem{imap.FetchUid, section.FetchItem()})
+	if err != nil {
+		return nil, err
+	}
+	body := msg.GetBody(section)
+	if body == nil {
+		return nil, fmt.Errorf("imap: uid %d: part %s not returned", uid, p.Path)
+	}
+	return transferDecoder(body, p.Encoding), nil
+}
+
+// FetchRaw загружает письмо целиком (BODY.PEEK[]) — например, чтобы переслать его вложением.
+func FetchRaw(m *Conn, uid int) ([]byte, error) {
+	section := &imap.BodySectionName{Peek: true}
+	msg, err := fetchOne(m, uid, []imap.FetchItem{imap.FetchUid, section.FetchItem()})
+	if err != nil {
+		return nil, err
+	}
+	body := msg.GetBody(section)
+	if body == nil {
+		return nil, fmt.Errorf("imap: uid %d: message body not returned", uid)
+	}
+	return io.ReadAll(body)
+}
+
+// partSection — BODY.PEEK[<path>], при size > limit — только первые limit байт.
+func partSection(path string, size, limit int) *imap.BodySectionName {
+	var nums []int
+	for _, s := range strings.Split(path, ".") {
+		n, _ := strconv.Atoi(s)
+		nums = append(nums, n)
+	}
+	section := &imap.BodySectionName{Peek: true, BodyPartName: imap.BodyPartName{Path: nums}}
+	if limit > 0 && size > limit {
+		section.Partial = []int{0, limit}
+	}
+	return section
+}
+
+func fetchOne(m *Conn, uid int, items []imap.FetchItem) (*imap.Message, error) {
+	seq := new(imap.SeqSet)
+	seq.AddNum(uint32(uid))
+	ch := make(chan *imap.Message, 1)
+	done := make(chan error, 1)
+	go func() { done <- m.c.UidFetch(seq, items, ch) }()
+	var msg *imap.Message
+	for mm := range ch {
+		if msg == nil {
+			msg = mm
+		}
+	}
+	if err := <-done; err != nil {
+		return nil, err
+	}
+	if msg == nil {
+		return nil, fmt.Errorf("imap: uid %d not found", uid)
+	}
+	return msg, nil
+}
+
+// decodePart снимает Content-Transfer-Encoding и переводит текст в UTF-8.
+func decodePart(raw []byte, encoding, cs string) string {
+	data := decodeTransfer(raw, encoding)
+	if cs == "" || strings.EqualFold(cs, "utf-8") || strings.EqualFold(cs, "us-ascii") {
+		return string(data)
+	}
+	r, err := charset.Reader(cs, bytes.NewReader(data))
+	if err != nil {
+		return string(data)
+	}
+	out, err := io.ReadAll(r)
+	if err != nil {
+		return string(data)
+	}
+	return string(out)
+}
+
+// decodeTransfer декодирует base64/quoted-printable. Обрезанное по лимиту тело
+// декодируется до последнего целого фрагмента.
+func decodeTransfer(raw []byte, encoding string) []byte {
+	switch encoding {
+	case "base64":
+		clean := bytes.Map(func(r rune) rune {
+			if r == '\r' || r == '\n' || r == ' ' || r == '\t' {
+				return -1
+			}
+			return r
+		}, raw)
+		clean = clean[:len(clean)/4*4]
+		out := make([]byte, base64.StdEncoding.DecodedLen(len(clean)))
+		n, err := base64.StdEncoding.Decode(out, clean)
+		if err != nil && n == 0 {
+			return raw
+		}
+		return out[:n]
+	case "quoted-printable":
+		out, err := io.ReadAll(quotedprintable.NewReader(bytes.NewReader(raw)))
+		if err != nil && len(out) == 0 {
+			return raw
+		}
+		return out
+	}
+	return raw
+}
+
+// transferDecoder — потоковый вариант decodeTransfer. Пробелы и переводы строк в base64 пропускаются.
+func transferDecoder(r io.Reader, encoding string) io.Reader {
+	switch encoding {
+	case "base64":
+		return base64.NewDecoder(base64.StdEncoding, spaceSkipper{r})
+	case "quoted-printable":
+		return quotedprintable.NewReader(r)
+	}
+	return r
+}
+
+// spaceSkipper читает r без пробельных символов.
+type spaceSkipper struct{ r io.Reader }
+
+func (s spaceSkipper) Read(p []byte) (int, error) {
+	for {
+		n, err := s.r.Read(p)
+		j := 0
+		for _, c := range p[:n] {
+			if c != '\r' && c != '\n' && c != ' ' && c != '\t' {
+				p[j] = c
+				j++
+			}
+		}
+		if j > 0 || err != nil {
+			return j, err
+		}
+	}
+}
@@ -0,0 +1,118 @@
+package imap
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"time"
+
+	"github.com/emersion/go-imap"
+	"github.com/emersion/go-imap/commands"
+	"github.com/emersion/go-imap/responses"
+)
+
+// idleStopTimeout — сколько ждать ответа на DONE, прежде чем считать соединение потерянным.
+const idleStopTimeout = 30 * time.Second
+
+// ErrIdleDisconnected возвращается, если соединение разорвано во время IDLE.
+var ErrIdleDisconnected = errors.New("imap connection lost during IDLE")
+
+// Capabilities возвращает набор возможностей сервера (ответ CAPABILITY) в верхнем регистре.
+func Capabilities(m *Conn) (map[string]bool, error) {
+	caps, err := m.c.Capability()
+	if err != nil {
+		return nil, err
+	}
+	out := make(map[string]bool, len(caps))
+	for c, ok := range caps {
+		if ok {
+			out[strings.ToUpper(c)] = true
+		}
+	}
+	return out, nil
+}
+
+// SupportsIdle сообщает, поддерживает ли сервер команду IDLE (RFC 2177).
+// Ошибку запроса CAPABILITY трактуем как отсутствие поддержки — остаётся режим опроса.
+func SupportsIdle(m *Conn) bool {
+	caps, err := Capabilities(m)
+	if err != nil {
+		return false
+	}
+	return caps["IDLE"]
+}
+
+// WaitForChange переводит соединение в IDLE и ждёт первого уведомления сервера
+// (EXISTS/EXPUNGE/FETCH/VANISHED) либо истечения timeout (или отмены ctx), после чего завершает IDLE командой DONE.
+// Уведомление, пришедшее ещё до входа в IDLE, тоже считается изменением.
+// changed=true означает, что в папке что-то изменилось и её стоит перечитать.
+// При ошибке соединение следует закрыть и установить заново.
+func WaitForChange(ctx context.Context, m *Conn, timeout time.Duration) (changed bool, err error) {
+	select {
+	case <-m.changes:
+		return true, nil
+	default:
+	}
+
+	// Таймаут команд ограничил бы и сам IDLE
+	prevTimeout := m.c.Timeout
+	m.c.Timeout = 0
+	defer func() { m.c.Timeout = prevTimeout }()
+
+	stop := make(chan struct{})
+	done := make(chan error, 1)
+	go func() { done <- m.idle(stop) }()
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case <-m.changes:
+		changed = true
+	case <-timer.C:
+	case <-ctx.Done():
+	case err := <-done:
+		// IDLE завершился без DONE — сервер закрыл соединение
+		if err == nil {
+			err = ErrIdleDisconnected
+		}
+		return false, err
+	}
+	close(stop)
+	select {
+	case err := <-done:
+		return changed, err
+	case <-time.After(idleStopTimeout):
+		_ = m.c.Terminate()
+		return changed, ErrIdleDisconnected
+	}
+}
+
+// idle выполняет IDLE до закрытия stop. Вместо Client.Idle — свой обработчик ответов:
+// клиент не знает VANISHED, которым при включённом QRESYNC сервер сообщает об удалении писем.
+func (m *Conn) idle(stop <-chan struct{}) error {
+	res := &idleResp{
+		Idle:    &responses.Idle{Stop: stop, RepliesCh: make(chan []byte, 10)},
+		changes: m.changes,
+	}
+	status, err := m.c.Execute(&commands.Idle{}, res)
+	if err != nil {
+		return err
+	}
+	return status.Err()
+}
+
+type idleResp struct {
+	*responses.Idle
+	changes chan struct{}
+}
+
+func (r *idleResp) Handle(resp imap.Resp) error {
+	if name, _, ok := imap.ParseNamedResp(resp); ok && name == "VANISHED" {
+		select {
+		case r.changes <- struct{}{}:
+		default:
+		}
+		return nil
+	}
+	return r.Idle.Handle(resp)
+}
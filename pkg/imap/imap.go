@@ -1,58 +1,496 @@
 package imap
 
 import (
-	imap "github.com/BrianLeishman/go-imap"
+	"errors"
+	"fmt"
+	"net"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/emersion/go-imap"
+	"github.com/emersion/go-imap/client"
+	"github.com/emersion/go-message/charset"
+)
+
+func init() {
+	// Заголовки ENVELOPE бывают в koi8-r, windows-1251 и т.п.
+	imap.CharsetReader = charset.Reader
+}
+
+// Способы аутентификации (Config.Auth).
+const (
+	AuthLogin       = "login"
+	AuthXOAuth2     = "xoauth2"
+	AuthOAuthBearer = "oauthbearer"
+)
+
+const (
+	dialTimeout = 30 * time.Second
+	// commandTimeout ограничивает каждую команду, кроме IDLE
+	commandTimeout = 2 * time.Minute
+	logoutTimeout  = 5 * time.Second
 )
 
+// TokenSource выдаёт access token для SASL-механизмов OAuth2.
+type TokenSource interface {
+	Token() (string, error)
+	// Invalidate сбрасывает закэшированный токен, если сервер его отверг.
+	Invalidate()
+}
+
 type Config struct {
 	Host     string
 	Port     int
 	Username string
 	Password string
-	UseTLS   bool
-	Mailbox  string
+	// Security — SecurityTLS (по умолчанию), SecurityStartTLS или SecurityPlain
+	Security string
+	// TLS — проверка сертификата; у каждого соединения своя конфигурация TLS
+	TLS     TLSOptions
+	Mailbox string
+	// Auth — AuthLogin (по умолчанию), AuthXOAuth2 или AuthOAuthBearer
+	Auth string
+	// Tokens — источник access token для Auth = xoauth2/oauthbearer
+	Tokens TokenSource
 }
 
-// ConnectAndSelect устанавливает соединение и выбирает папку (по умолчанию INBOX)
-func ConnectAndSelect(cfg Config) (*imap.Dialer, error) {
-	// Библиотека всегда использует TLS; валидация сертификата управляется глобально TLSSkipVerify.
-	imap.TLSSkipVerify = false
-	if !cfg.UseTLS {
-		// Если ранее пользователь явно отключал TLS, ближайшая семантика — не проверять сертификат.
-		// Полностью нешифрованные подключения библиотекой не поддерживаются.
-		imap.TLSSkipVerify = true
+// MailboxStatus — сведения о папке из ответа SELECT.
+type MailboxStatus struct {
+	Name string
+	// UIDVALIDITY: при его смене все ранее полученные UID папки недействительны
+	UIDValidity uint32
+	UIDNext     int
+	Exists      int
+	// HighestModSeq — HIGHESTMODSEQ папки (CONDSTORE); 0, если сервер или папка MODSEQ не ведут
+	HighestModSeq uint64
+}
+
+// ErrUIDValidityChanged — UIDVALIDITY папки изменился, сохранённый UID указывает неизвестно на что.
+var ErrUIDValidityChanged = errors.New("imap: mailbox UIDVALIDITY changed, stored UID is stale")
+
+// ErrAuth — сервер отверг учётные данные.
+var ErrAuth = errors.New("imap: authentication failed")
+
+// Conn — соединение с IMAP-сервером.
+type Conn struct {
+	c *client.Client
+	// changes получает сигнал о непрошеных обновлениях папки (EXISTS/EXPUNGE/FETCH)
+	changes chan struct{}
+	// qresync — включён QRESYNC: удаления приходят как VANISHED
+	qresync bool
+}
+
+// Close завершает сессию (LOGOUT), а если сервер не отвечает — просто рвёт соединение.
+func (m *Conn) Close() error {
+	done := make(chan error, 1)
+	go func() { done <- m.c.Logout() }()
+	select {
+	case err := <-done:
+		return err
+	case <-time.After(logoutTimeout):
+		return m.c.Terminate()
 	}
+}
 
-	m, err := imap.New(cfg.Username, cfg.Password, cfg.Host, cfg.Port)
+// Connect устанавливает соединение и проходит аутентификацию, не выбирая папку.
+func Connect(cfg Config) (*Conn, error) {
+	addr := net.JoinHostPort(cfg.Host, strconv.Itoa(cfg.Port))
+	c, err := dial(cfg, addr)
 	if err != nil {
 		return nil, err
 	}
+	m := &Conn{c: c, changes: make(chan struct{}, 1)}
+	m.watchUpdates()
+	if err := authenticate(c, cfg); err != nil {
+		_ = c.Terminate()
+		return nil, err
+	}
+	return m, nil
+}
+
+// dial открывает соединение в режиме cfg.Security. При STARTTLS аутентификация
+// начинается только после успешного перехода на TLS — откат на открытый канал не выполняется.
+func dial(cfg Config, addr string) (*client.Client, error) {
+	dialer := &net.Dialer{Timeout: dialTimeout}
+	switch cfg.Security {
+	case "", SecurityTLS:
+		tc, err := tlsConfig(cfg)
+		if err != nil {
+			return nil, err
+		}
+		c, err := client.DialWithDialerTLS(dialer, addr, tc)
+		if err != nil {
+			return nil, err
+		}
+		c.Timeout = commandTimeout
+		return c, nil
+	case SecurityStartTLS:
+		tc, err := tlsConfig(cfg)
+		if err != nil {
+			return nil, err
+		}
+		c, err := client.DialWithDialer(dialer, addr)
+		if err != nil {
+			return nil, err
+		}
+		c.Timeout = commandTimeout
+		ok, err := c.SupportStartTLS()
+		if err == nil && !ok {
+			err = ErrStartTLSUnsupported
+		}
+		if err == nil {
+			err = c.StartTLS(tc)
+		}
+		if err != nil {
+			_ = c.Terminate()
+			return nil, err
+		}
+		return c, nil
+	case SecurityPlain:
+		c, err := client.DialWithDialer(dialer, addr)
+		if err != nil {
+			return nil, err
+		}
+		c.Timeout = commandTimeout
+		return c, nil
+	}
+	return nil, fmt.Errorf("imap: unknown security mode %q", cfg.Security)
+}
+
+// watchUpdates вычитывает непрошеные ответы сервера. Клиент блокируется, пока канал
+// Updates не прочитан, поэтому читаем его постоянно, а наружу отдаём только факт изменения.
+func (m *Conn) watchUpdates() {
+	updates := make(chan client.Update, 16)
+	m.c.Updates = updates
+	go func() {
+		for {
+			select {
+			case u := <-updates:
+				switch u.(type) {
+				case *client.MailboxUpdate, *client.ExpungeUpdate, *client.MessageUpdate:
+					select {
+					case m.changes <- struct{}{}:
+					default:
+					}
+				}
+			case <-m.c.LoggedOut():
+				return
+			}
+		}
+	}()
+}
+
+// authenticate выполняет LOGIN или SASL-аутентификацию OAuth2.
+func authenticate(c *client.Client, cfg Config) error {
+	switch cfg.Auth {
+	case "", AuthLogin:
+		if err := c.Login(cfg.Username, cfg.Password); err != nil {
+			return fmt.Errorf("%w: %v", ErrAuth, err)
+		}
+		return nil
+	case AuthXOAuth2, AuthOAuthBearer:
+		if cfg.Tokens == nil {
+			return fmt.Errorf("imap: %s requires a token source", cfg.Auth)
+		}
+		token, err := cfg.Tokens.Token()
+		if err != nil {
+			return fmt.Errorf("imap: obtain access token: %w", err)
+		}
+		if err := c.Authenticate(newSASLClient(cfg, token)); err != nil {
+			// токен мог быть отозван до истечения срока — в следующий раз запросим новый
+			cfg.Tokens.Invalidate()
+			return fmt.Errorf("%w: %s: %v", ErrAuth, strings.ToUpper(cfg.Auth), err)
+		}
+		return nil
+	}
+	return fmt.Errorf("imap: unknown auth method %q", cfg.Auth)
+}
+
+// ConnectAndSelect устанавливает соединение и выбирает папку (по умолчанию INBOX)
+func ConnectAndSelect(cfg Config) (*Conn, MailboxStatus, error) {
+	m, err := Connect(cfg)
+	if err != nil {
+		return nil, MailboxStatus{}, err
+	}
 	// Выбираем папку для работы
 	mailbox := cfg.Mailbox
 	if mailbox == "" {
 		mailbox = "INBOX"
 	}
-	if err := m.SelectFolder(mailbox); err != nil {
+	status, err := SelectMailbox(m, mailbox)
+	if err != nil {
 		_ = m.Close()
-		return nil, err
+		return nil, MailboxStatus{}, err
+	}
+	return m, status, nil
+}
+
+// SelectMailbox выполняет SELECT и возвращает UIDVALIDITY, UIDNEXT и EXISTS папки,
+// а при поддержке CONDSTORE — и HIGHESTMODSEQ.
+func SelectMailbox(m *Conn, mailbox string) (MailboxStatus, error) {
+	var mb *imap.MailboxStatus
+	var modSeq uint64
+	var err error
+	if SupportsCondStore(m) {
+		mb, modSeq, err = selectCondStore(m, mailbox)
+	} else {
+		mb, err = m.c.Select(mailbox, false)
+	}
+	if err != nil {
+		return MailboxStatus{}, err
+	}
+	status := MailboxStatus{
+		Name:          mailbox,
+		UIDValidity:   mb.UidValidity,
+		UIDNext:       int(mb.UidNext),
+		Exists:        int(mb.Messages),
+		HighestModSeq: modSeq,
+	}
+	if status.UIDValidity == 0 {
+		return status, fmt.Errorf("imap: no UIDVALIDITY in SELECT response for %q", mailbox)
+	}
+	return status, nil
+}
+
+// selectedStatus возвращает сведения об уже выбранной папке без повторного SELECT;
+// клиент обновляет их по непрошеным ответам сервера.
+func selectedStatus(m *Conn) MailboxStatus {
+	mb := m.c.Mailbox()
+	if mb == nil {
+		return MailboxStatus{}
+	}
+	return MailboxStatus{
+		Name:        mb.Name,
+		UIDValidity: mb.UidValidity,
+		UIDNext:     int(mb.UidNext),
+		Exists:      int(mb.Messages),
 	}
-	return m, nil
+}
+
+// Noop проверяет, что соединение живо (NOOP), заодно получая накопившиеся уведомления.
+func Noop(m *Conn) error {
+	return m.c.Noop()
+}
+
+// ListMailboxes возвращает имена всех папок аккаунта (LIST "" "*").
+func ListMailboxes(m *Conn) ([]string, error) {
+	ch := make(chan *imap.MailboxInfo, 32)
+	done := make(chan error, 1)
+	go func() { done <- m.c.List("", "*", ch) }()
+	var names []string
+	for info := range ch {
+		if hasAttr(info.Attributes, imap.NoSelectAttr) {
+			continue
+		}
+		names = append(names, info.Name)
+	}
+	return names, <-done
+}
+
+func hasAttr(attrs []string, attr string) bool {
+	for _, a := range attrs {
+		if strings.EqualFold(a, attr) {
+			return true
+		}
+	}
+	return false
+}
+
+// MatchMailbox проверяет имя папки по шаблону в духе IMAP LIST:
+// '*' — любые символы, '%' — любые символы, кроме разделителей иерархии '/' и '.'.
+// Имя INBOX сравнивается без учёта регистра (RFC 3501).
+func MatchMailbox(pattern, name string) bool {
+	if strings.EqualFold(name, "INBOX") {
+		name = "INBOX"
+	}
+	if strings.EqualFold(pattern, "INBOX") {
+		pattern = "INBOX"
+	}
+	var re strings.Builder
+	re.WriteString("^")
+	for _, r := range pattern {
+		switch r {
+		case '*':
+			re.WriteString(".*")
+		case '%':
+			re.WriteString(`[^/.]*`)
+		default:
+			re.WriteString(regexp.QuoteMeta(string(r)))
+		}
+	}
+	re.WriteString("$")
+	ok, _ := regexp.MatchString(re.String(), name)
+	return ok
 }
 
 // SearchUnseen возвращает UIDs непрочитанных писем
-func SearchUnseen(m *imap.Dialer) ([]int, error) {
-	return m.GetUIDs("UNSEEN")
+func SearchUnseen(m *Conn) ([]int, error) {
+	return SearchUnseenFrom(m, 0)
+}
+
+// SearchUnseenFrom возвращает UIDs непрочитанных писем не меньше minUID — новые письма
+// получают UID не меньше UIDNEXT из SELECT, так что весь UNSEEN папки перечитывать не нужно.
+func SearchUnseenFrom(m *Conn, minUID int) ([]int, error) {
+	criteria := imap.NewSearchCriteria()
+	criteria.WithoutFlags = []string{imap.SeenFlag}
+	if minUID > 1 {
+		criteria.Uid = new(imap.SeqSet)
+		criteria.Uid.AddRange(uint32(minUID), 0)
+	}
+	uids, err := m.c.UidSearch(criteria)
+	if err != nil {
+		return nil, err
+	}
+	out := make([]int, 0, len(uids))
+	for _, u := range uids {
+		// Диапазон n:* всегда включает последнее письмо, даже если его UID меньше n
+		if int(u) >= minUID {
+			out = append(out, int(u))
+		}
+	}
+	return out, nil
+}
+
+// SearchMessageID возвращает UIDs писем выбранной папки с заголовком Message-ID (вместе с угловыми скобками, как в ENVELOPE).
+// Письма с \Deleted пропускаются: без UIDPLUS они остаются в папке после переноса (см. MoveMessage).
+func SearchMessageID(m *Conn, messageID string) ([]int, error) {
+	criteria := imap.NewSearchCriteria()
+	criteria.Header.Add("Message-Id", messageID)
+	criteria.WithoutFlags = []string{imap.DeletedFlag}
+	uids, err := m.c.UidSearch(criteria)
+	if err != nil {
+		return nil, err
+	}
+	out := make([]int, 0, len(uids))
+	for _, u := range uids {
+		out = append(out, int(u))
+	}
+	return out, nil
+}
+
+// Address — адрес из ENVELOPE письма.
+type Address struct {
+	Name string
+	Addr string
+	// Group — имя группы RFC 5322 ("Team: a@x, b@y;"), в которую входит адрес
+	Group string
+}
+
+func (a Address) String() string {
+	if a.Name == "" {
+		return a.Addr
+	}
+	return a.Name + " <" + a.Addr + ">"
+}
+
+// Email — письмо с сервера: заголовки из ENVELOPE и структура, тела — по мере надобности.
+type Email struct {
+	UID int
+	// MessageID — значение Message-ID из ENVELOPE (вместе с угловыми скобками)
+	MessageID string
+	Subject   string
+	Sent      time.Time
+	From      []Address
+	To        []Address
+	Cc        []Address
+	// ReplyTo — адреса из Reply-To; пусто, если заголовка нет
+	ReplyTo []Address
+	// Sender — адрес из Sender; пусто, если он совпадает с From
+	Sender []Address
+	// Size — размер письма целиком (RFC822.SIZE)
+	Size int
+	// Flagged — письмо помечено флагом \Flagged на момент загрузки
+	Flagged bool
+	// Parts — листовые части из BODYSTRUCTURE; вложения загружаются только по запросу (FetchPart)
+	Parts []Part
+	// Text, HTML — текстовые части, загруженные FetchBodies
+	Text string
+	HTML string
+	// Truncated — текстовая часть длиннее лимита загружена не полностью
+	Truncated bool
+	// Inline — картинки, на которые HTML ссылается по cid: (multipart/related), загруженные FetchBodies
+	Inline []InlineImage
+	// Problems — проблемы декодирования текстовых частей (FetchOptions.Decoder, разбор MIME)
+	Problems []string
+}
+
+// InlineImage — картинка письма с Content-ID для ссылок cid: (RFC 2392).
+type InlineImage struct {
+	// ContentID — без угловых скобок
+	ContentID string
+	MIMEType  string
+	Data      []byte
 }
 
-// FetchEmails загружает полные письма по UID'ам
-func FetchEmails(m *imap.Dialer, uids []int) (map[int]*imap.Email, error) {
-	if len(uids) == 0 {
-		return map[int]*imap.Email{}, nil
+// envelopeAddresses переводит адреса ENVELOPE в Address. Группы RFC 5322 ENVELOPE передаёт
+// маркерами (RFC 3501 7.4.2): начало — адрес без хоста с именем группы в mailbox, конец —
+// адрес без mailbox и хоста; адреса между ними получают Group.
+func envelopeAddresses(list []*imap.Address) []Address {
+	out := make([]Address, 0, len(list))
+	group := ""
+	for _, a := range list {
+		if a == nil {
+			continue
+		}
+		if a.HostName == "" {
+			group = a.MailboxName
+			continue
+		}
+		if a.MailboxName == "" {
+			continue
+		}
+		addr := a.MailboxName + "@" + a.HostName
+		out = append(out, Address{Name: a.PersonalName, Addr: strings.ToLower(addr), Group: group})
 	}
-	return m.GetEmails(uids...)
+	return out
 }
 
 // MarkSeen помечает письмо прочитанным
-func MarkSeen(m *imap.Dialer, uid int) error {
-	return m.MarkSeen(uid)
-}
\ No newline at end of file
+func MarkSeen(m *Conn, uid int) error {
+	seq := new(imap.SeqSet)
+	seq.AddNum(uint32(uid))
+	item := imap.FormatFlagsOp(imap.AddFlags, true)
+	return m.c.UidStore(seq, item, []interface{}{imap.SeenFlag}, nil)
+}
+
+// MarkUnseen снимает с письма флаг \Seen
+func MarkUnseen(m *Conn, uid int) error {
+	seq := new(imap.SeqSet)
+	seq.AddNum(uint32(uid))
+	item := imap.FormatFlagsOp(imap.RemoveFlags, true)
+	return m.c.UidStore(seq, item, []interface{}{imap.SeenFlag}, nil)
+}
+
+// MarkAnswered помечает письмо флагом \Answered (на него отправлен ответ)
+func MarkAnswered(m *Conn, uid int) error {
+	seq := new(imap.SeqSet)
+	seq.AddNum(uint32(uid))
+	item := imap.FormatFlagsOp(imap.AddFlags, true)
+	return m.c.UidStore(seq, item, []interface{}{imap.AnsweredFlag}, nil)
+}
+
+// FlagForwarded — ключевое слово $Forwarded (RFC 5788): письмо переслано
+const FlagForwarded = "$Forwarded"
+
+// MarkForwarded помечает письмо ключевым словом $Forwarded. Сервер может не принимать
+// ключевые слова (PERMANENTFLAGS без \*) — тогда вернётся ошибка.
+func MarkForwarded(m *Conn, uid int) error {
+	seq := new(imap.SeqSet)
+	seq.AddNum(uint32(uid))
+	item := imap.FormatFlagsOp(imap.AddFlags, true)
+	return m.c.UidStore(seq, item, []interface{}{FlagForwarded}, nil)
+}
+
+// SetFlagged ставит или снимает флаг \Flagged (в Gmail — звёздочка «Помеченные»)
+func SetFlagged(m *Conn, uid int, flagged bool) error {
+	seq := new(imap.SeqSet)
+	seq.AddNum(uint32(uid))
+	op := imap.FlagsOp(imap.AddFlags)
+	if !flagged {
+		op = imap.RemoveFlags
+	}
+	item := imap.FormatFlagsOp(op, true)
+	return m.c.UidStore(seq, item, []interface{}{imap.FlaggedFlag}, nil)
+}
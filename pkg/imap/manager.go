@@ -0,0 +1,345 @@
+package imap
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/emersion/go-imap"
+)
+
+// Состояния подключения аккаунта (Health.State).
+const (
+	// HealthConnecting — подключений ещё не было
+	HealthConnecting = "connecting"
+	HealthOK         = "ok"
+	// HealthDown — последние попытки подключения неудачны, следующая — в NextRetry
+	HealthDown = "down"
+)
+
+// Health — состояние подключения к серверу аккаунта.
+type Health struct {
+	State string `json:"state"`
+	// Failures — неудачных подключений подряд
+	Failures    int       `json:"failures"`
+	LastError   string    `json:"last_error,omitempty"`
+	LastErrorAt time.Time `json:"last_error_at"`
+	// LastOK — время последнего успешного подключения
+	LastOK    time.Time `json:"last_ok"`
+	NextRetry time.Time `json:"next_retry"`
+	// Sessions — сессий пула, свободных и занятых (без соединений наблюдателей папок)
+	Sessions int `json:"sessions"`
+}
+
+// ManagerOptions — параметры Manager; нулевые поля заменяются значениями по умолчанию.
+type ManagerOptions struct {
+	// Name — имя аккаунта для логов
+	Name string
+	// PoolSize — максимум одновременных сессий для разовых команд (по умолчанию 2)
+	PoolSize int
+	// BackoffMin, BackoffMax — пределы задержки между неудачными подключениями
+	BackoffMin time.Duration
+	BackoffMax time.Duration
+	// CheckAfter — после такого простоя сессия перед выдачей проверяется командой NOOP (по умолчанию 30s)
+	CheckAfter time.Duration
+	// IdleTimeout — простаивающие дольше сессии пула закрываются (по умолчанию 5m)
+	IdleTimeout time.Duration
+}
+
+// ErrUnavailable — сервер недоступен, повторное подключение запланировано позже.
+var ErrUnavailable = errors.New("imap: server unavailable")
+
+// ErrManagerClosed — Manager закрыт.
+var ErrManagerClosed = errors.New("imap: connection manager closed")
+
+// Manager владеет соединениями одного аккаунта: держит небольшой пул аутентифицированных
+// сессий для разовых команд (Do) и открывает долгоживущие соединения наблюдателям (Open).
+// Все подключения идут через общий backoff, так что при недоступном сервере аккаунт
+// не переподключается чаще, чем позволяет задержка, а Health отражает его состояние.
+type Manager struct {
+	cfg  Config
+	opts ManagerOptions
+	// slots ограничивает число сессий, одновременно выданных Do
+	slots chan struct{}
+	stop  chan struct{}
+
+	mu          sync.Mutex
+	idle        []*session
+	backoff     Backoff
+	health      Health
+	lastFailure time.Time
+	closed      bool
+}
+
+// session — сессия пула и выбранная в ней папка.
+type session struct {
+	conn     *Conn
+	mailbox  string
+	lastUsed time.Time
+}
+
+// NewManager создаёт менеджер соединений; cfg.Mailbox не используется.
+func NewManager(cfg Config, opts ManagerOptions) *Manager {
+	if opts.PoolSize <= 0 {
+		opts.PoolSize = 2
+	}
+	if opts.CheckAfter <= 0 {
+		opts.CheckAfter = 30 * time.Second
+	}
+	if opts.IdleTimeout <= 0 {
+		opts.IdleTimeout = 5 * time.Minute
+	}
+	mg := &Manager{
+		cfg:     cfg,
+		opts:    opts,
+		slots:   make(chan struct{}, opts.PoolSize),
+		stop:    make(chan struct{}),
+		backoff: Backoff{Min: opts.BackoffMin, Max: opts.BackoffMax},
+		health:  Health{State: HealthConnecting},
+	}
+	go mg.janitor()
+	return mg
+}
+
+// Health возвращает снимок состояния подключения.
+func (mg *Manager) Health() Health {
+	mg.mu.Lock()
+	defer mg.mu.Unlock()
+	h := mg.health
+	h.Sessions = len(mg.idle) + len(mg.slots)
+	return h
+}
+
+// Do выполняет fn на сессии пула с выбранной папкой mailbox (пустое имя — без SELECT).
+// Сессия принадлежит fn до возврата, команды разных вызовов не перемешиваются.
+// status — состояние папки на момент выдачи сессии; по нему сверяют UIDVALIDITY.
+// Если сервер недоступен и подключение отложено backoff'ом, возвращается ErrUnavailable без ожидания.
+func (mg *Manager) Do(ctx context.Context, mailbox string, fn func(c *Conn, status MailboxStatus) error) error {
+	select {
+	case mg.slots <- struct{}{}:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	defer func() { <-mg.slots }()
+
+	s, err := mg.checkout(ctx)
+	if err != nil {
+		return err
+	}
+	var status MailboxStatus
+	if mailbox != "" {
+		if s.mailbox == mailbox {
+			status = selectedStatus(s.conn)
+		} else {
+			s.mailbox = ""
+			status, err = SelectMailbox(s.conn, mailbox)
+			if err != nil {
+				mg.checkin(s, err)
+				return err
+			}
+			s.mailbox = mailbox
+		}
+	}
+	err = fn(s.conn, status)
+	mg.checkin(s, err)
+	return err
+}
+
+// Open открывает отдельное долгоживущее соединение с выбранной папкой (для IDLE и опроса).
+// На нём включается QRESYNC, если сервер его поддерживает (см. TrackChanges).
+// Если аккаунт в backoff, ждёт назначенного времени попытки или отмены ctx.
+// Соединение принадлежит вызывающему и закрывается им самим.
+func (mg *Manager) Open(ctx context.Context, mailbox string) (*Conn, MailboxStatus, error) {
+	c, err := mg.dial(ctx, true)
+	if err != nil {
+		return nil, MailboxStatus{}, err
+	}
+	if mailbox == "" {
+		mailbox = "INBOX"
+	}
+	EnableQResync(c)
+	status, err := SelectMailbox(c, mailbox)
+	if err != nil {
+		_ = c.Close()
+		return nil, MailboxStatus{}, err
+	}
+	return c, status, nil
+}
+
+// Close закрывает сессии пула; открытые через Open соединения не затрагиваются.
+func (mg *Manager) Close() {
+	mg.mu.Lock()
+	if mg.closed {
+		mg.mu.Unlock()
+		return
+	}
+	mg.closed = true
+	idle := mg.idle
+	mg.idle = nil
+	mg.mu.Unlock()
+	close(mg.stop)
+	for _, s := range idle {
+		_ = s.conn.Close()
+	}
+}
+
+// checkout выдаёт свободную сессию, проверив NOOP'ом давно простаивавшую, либо подключается заново.
+func (mg *Manager) checkout(ctx context.Context) (*session, error) {
+	for {
+		mg.mu.Lock()
+		if mg.closed {
+			mg.mu.Unlock()
+			return nil, ErrManagerClosed
+		}
+		n := len(mg.idle)
+		if n == 0 {
+			mg.mu.Unlock()
+			break
+		}
+		s := mg.idle[n-1]
+		mg.idle = mg.idle[:n-1]
+		mg.mu.Unlock()
+		if time.Since(s.lastUsed) < mg.opts.CheckAfter {
+			return s, nil
+		}
+		err := Noop(s.conn)
+		if err == nil {
+			return s, nil
+		}
+		log.Printf("imap session check failed account=%s: %v", mg.opts.Name, err)
+		_ = s.conn.Close()
+	}
+	c, err := mg.dial(ctx, false)
+	if err != nil {
+		return nil, err
+	}
+	return &session{conn: c}, nil
+}
+
+// checkin возвращает сессию в пул; сессию с оборванным соединением закрывает.
+func (mg *Manager) checkin(s *session, err error) {
+	if err != nil && isConnError(s.conn, err) {
+		log.Printf("imap session dropped account=%s: %v", mg.opts.Name, err)
+		_ = s.conn.Close()
+		return
+	}
+	s.lastUsed = time.Now()
+	mg.mu.Lock()
+	if mg.closed {
+		mg.mu.Unlock()
+		_ = s.conn.Close()
+		return
+	}
+	mg.idle = append(mg.idle, s)
+	mg.mu.Unlock()
+}
+
+// dial подключается с учётом backoff: wait=false — не ждать назначенной попытки, а вернуть ErrUnavailable.
+func (mg *Manager) dial(ctx context.Context, wait bool) (*Conn, error) {
+	mg.mu.Lock()
+	next, lastErr := mg.health.NextRetry, mg.health.LastError
+	mg.mu.Unlock()
+	if d := time.Until(next); d > 0 {
+		if !wait {
+			return nil, fmt.Errorf("%w, retry in %s: %s", ErrUnavailable, d.Round(10*time.Millisecond), lastErr)
+		}
+		t := time.NewTimer(d)
+		select {
+		case <-t.C:
+		case <-ctx.Done():
+			t.Stop()
+			return nil, ctx.Err()
+		case <-mg.stop:
+			t.Stop()
+			return nil, ErrManagerClosed
+		}
+	}
+	started := time.Now()
+	c, err := Connect(mg.cfg)
+	mg.mu.Lock()
+	defer mg.mu.Unlock()
+	if err != nil {
+		mg.failure(started, err)
+		return nil, err
+	}
+	mg.success()
+	return c, nil
+}
+
+// failure учитывает неудачное подключение. Попытки, начатые до уже учтённой ошибки
+// (несколько наблюдателей упали одновременно), задержку не увеличивают.
+func (mg *Manager) failure(started time.Time, err error) {
+	now := time.Now()
+	mg.health.LastError = err.Error()
+	mg.health.LastErrorAt = now
+	if started.Before(mg.lastFailure) {
+		return
+	}
+	mg.lastFailure = now
+	delay := mg.backoff.Next()
+	mg.health.State = HealthDown
+	mg.health.Failures = mg.backoff.Attempts()
+	mg.health.NextRetry = now.Add(delay)
+	log.Printf("imap health account=%s state=%s failures=%d retry_in=%s: %v", mg.opts.Name, HealthDown, mg.health.Failures, delay.Round(10*time.Millisecond), err)
+}
+
+func (mg *Manager) success() {
+	switch mg.health.State {
+	case HealthConnecting:
+		log.Printf("imap health account=%s state=%s", mg.opts.Name, HealthOK)
+	case HealthDown:
+		log.Printf("imap health account=%s state=%s after_failures=%d", mg.opts.Name, HealthOK, mg.health.Failures)
+	}
+	mg.backoff.Reset()
+	mg.health.State = HealthOK
+	mg.health.Failures = 0
+	mg.health.LastOK = time.Now()
+	mg.health.NextRetry = time.Time{}
+}
+
+// janitor закрывает сессии пула, простаивающие дольше IdleTimeout, чтобы их не оборвал сервер.
+func (mg *Manager) janitor() {
+	t := time.NewTicker(mg.opts.IdleTimeout / 2)
+	defer t.Stop()
+	for {
+		select {
+		case <-mg.stop:
+			return
+		case <-t.C:
+		}
+		var stale []*session
+		mg.mu.Lock()
+		kept := mg.idle[:0]
+		for _, s := range mg.idle {
+			if time.Since(s.lastUsed) > mg.opts.IdleTimeout {
+				stale = append(stale, s)
+			} else {
+				kept = append(kept, s)
+			}
+		}
+		mg.idle = kept
+		mg.mu.Unlock()
+		for _, s := range stale {
+			_ = s.conn.Close()
+		}
+	}
+}
+
+// isConnError отличает обрыв соединения от ответа сервера NO/BAD, после которого сессия пригодна.
+func isConnError(m *Conn, err error) bool {
+	select {
+	case <-m.c.LoggedOut():
+		return true
+	default:
+	}
+	if m.c.State() == imap.LogoutState {
+		return true
+	}
+	// После таймаута неизвестно, в каком месте протокола осталось соединение
+	var ne net.Error
+	return errors.As(err, &ne)
+}
@@ -0,0 +1,92 @@
+package imap
+
+import (
+	"bytes"
+	"errors"
+	"time"
+
+	"github.com/emersion/go-imap"
+)
+
+// Роли папок из LIST (SPECIAL-USE, RFC 6154).
+const (
+	SpecialArchive = imap.ArchiveAttr
+	// SpecialAll — «Вся почта» Gmail: перенос туда из INBOX и есть архивирование
+	SpecialAll   = imap.AllAttr
+	SpecialJunk  = imap.JunkAttr
+	SpecialSent  = imap.SentAttr
+	SpecialTrash = imap.TrashAttr
+)
+
+// SpecialUseMailboxes возвращает папки с ролями RFC 6154: роль (например, SpecialTrash) -> имя папки.
+// Серверы без SPECIAL-USE ролей не сообщают — карта будет пустой.
+func SpecialUseMailboxes(m *Conn) (map[string]string, error) {
+	ch := make(chan *imap.MailboxInfo, 32)
+	done := make(chan error, 1)
+	go func() { done <- m.c.List("", "*", ch) }()
+	out := make(map[string]string)
+	for info := range ch {
+		for _, role := range []string{SpecialArchive, SpecialAll, SpecialJunk, SpecialSent, SpecialTrash} {
+			if _, taken := out[role]; !taken && hasAttr(info.Attributes, role) {
+				out[role] = info.Name
+			}
+		}
+	}
+	return out, <-done
+}
+
+// ErrNotExpunged — письмо помечено \Deleted, но осталось в папке: без UIDPLUS (RFC 4315) сервер
+// не может удалить одно письмо, а обычный EXPUNGE удалил бы и чужие письма с \Deleted.
+// Помеченное письмо удалит почтовый клиент при следующей очистке папки.
+var ErrNotExpunged = errors.New("imap: marked \\Deleted but not expunged, server has no UIDPLUS")
+
+// MoveMessage переносит письмо из выбранной папки в dest: командой MOVE (RFC 6851), а без
+// неё — COPY, пометкой \Deleted и удалением только этого письма (UID EXPUNGE, RFC 4315).
+// ErrNotExpunged означает, что копия в dest создана, а исходное письмо осталось с \Deleted.
+func MoveMessage(m *Conn, uid int, dest string) error {
+	seq := new(imap.SeqSet)
+	seq.AddNum(uint32(uid))
+	if ok, err := m.c.Support("MOVE"); err != nil {
+		return err
+	} else if ok {
+		return m.c.UidMove(seq, dest)
+	}
+	if err := m.c.UidCopy(seq, dest); err != nil {
+		return err
+	}
+	return expungeUID(m, seq)
+}
+
+// DeleteMessage безвозвратно удаляет письмо из выбранной папки (\Deleted и UID EXPUNGE);
+// ErrNotExpunged — письмо только помечено \Deleted.
+func DeleteMessage(m *Conn, uid int) error {
+	seq := new(imap.SeqSet)
+	seq.AddNum(uint32(uid))
+	return expungeUID(m, seq)
+}
+
+// expungeUID помечает письма seq \Deleted и удаляет только их командой UID EXPUNGE;
+// без UIDPLUS письма остаются помеченными и возвращается ErrNotExpunged.
+func expungeUID(m *Conn, seq *imap.SeqSet) error {
+	item := imap.FormatFlagsOp(imap.AddFlags, true)
+	if err := m.c.UidStore(seq, item, []interface{}{imap.DeletedFlag}, nil); err != nil {
+		return err
+	}
+	if ok, err := m.c.Support("UIDPLUS"); err != nil {
+		return err
+	} else if !ok {
+		return ErrNotExpunged
+	}
+	cmd := &imap.Command{Name: "UID", Arguments: []interface{}{imap.RawString("EXPUNGE"), seq}}
+	status, err := m.c.Execute(rawCommand{cmd}, nil)
+	if err != nil {
+		return err
+	}
+	return status.Err()
+}
+
+// AppendMessage сохраняет готовое письмо msg в папку mailbox (APPEND) с флагом \Seen —
+// например, копию отправленного ответа в «Отправленные».
+func AppendMessage(m *Conn, mailbox string, msg []byte) error {
+	return m.c.Append(mailbox, []string{imap.SeenFlag}, time.Now(), bytes.NewBuffer(msg))
+}
@@ -0,0 +1,41 @@
+package imap
+
+import (
+	"github.com/emersion/go-sasl"
+)
+
+// newSASLClient возвращает SASL-клиент для OAuth2-механизма из cfg.Auth.
+func newSASLClient(cfg Config, token string) sasl.Client {
+	return NewOAuthSASLClient(cfg.Auth, cfg.Username, token, cfg.Host, cfg.Port)
+}
+
+// NewOAuthSASLClient возвращает SASL-клиент OAUTHBEARER (auth = AuthOAuthBearer) или XOAUTH2.
+// Механизмы одинаковы для IMAP и SMTP.
+func NewOAuthSASLClient(auth, username, token, host string, port int) sasl.Client {
+	if auth == AuthOAuthBearer {
+		return sasl.NewOAuthBearerClient(&sasl.OAuthBearerOptions{
+			Username: username,
+			Token:    token,
+			Host:     host,
+			Port:     port,
+		})
+	}
+	return &xoauth2Client{username: username, token: token}
+}
+
+// xoauth2Client реализует механизм XOAUTH2 (Google, Microsoft), которого нет в go-sasl.
+// https://developers.google.com/gmail/imap/xoauth2-protocol
+type xoauth2Client struct {
+	username string
+	token    string
+}
+
+func (c *xoauth2Client) Start() (mech string, ir []byte, err error) {
+	return "XOAUTH2", []byte("user=" + c.username + "\x01auth=Bearer " + c.token + "\x01\x01"), nil
+}
+
+// Next отвечает на challenge с JSON-описанием ошибки пустой строкой —
+// после этого сервер завершает AUTHENTICATE ответом NO.
+func (c *xoauth2Client) Next(challenge []byte) ([]byte, error) {
+	return []byte{}, nil
+}
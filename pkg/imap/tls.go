@@ -0,0 +1,114 @@
+package imap
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// Режимы защиты соединения (Config.Security).
+const (
+	// SecurityTLS — TLS с первого байта (implicit TLS, обычно порт 993)
+	SecurityTLS = "tls"
+	// SecurityStartTLS — открытое соединение, переводимое в TLS командой STARTTLS (обычно порт 143)
+	SecurityStartTLS = "starttls"
+	// SecurityPlain — без шифрования; только для локальных мостов (ProtonMail Bridge, Dovecot на localhost)
+	SecurityPlain = "plain"
+)
+
+// TLSOptions — параметры проверки сертификата сервера для SecurityTLS и SecurityStartTLS.
+type TLSOptions struct {
+	// CAFile — PEM-файл с корневыми сертификатами, которым доверять вместо системных
+	CAFile string
+	// Fingerprint — SHA-256 сертификата сервера в hex (допускаются ':').
+	// Если задан, проверяется только совпадение отпечатка — подходит для самоподписанных сертификатов.
+	Fingerprint string
+	// SkipVerify отключает проверку сертификата (небезопасно)
+	SkipVerify bool
+}
+
+// ErrFingerprintMismatch — отпечаток сертификата сервера не совпал с закреплённым.
+var ErrFingerprintMismatch = errors.New("imap: server certificate fingerprint mismatch")
+
+// ErrStartTLSUnsupported — сервер не объявил STARTTLS; продолжать без шифрования нельзя.
+var ErrStartTLSUnsupported = errors.New("imap: server does not support STARTTLS")
+
+// tlsConfig собирает отдельную конфигурацию TLS для соединения с cfg.Host.
+func tlsConfig(cfg Config) (*tls.Config, error) {
+	return NewTLSConfig(cfg.Host, cfg.TLS)
+}
+
+// NewTLSConfig собирает конфигурацию TLS для соединения с host по правилам opts.
+// Используется и для других протоколов того же аккаунта (SMTP).
+func NewTLSConfig(host string, opts TLSOptions) (*tls.Config, error) {
+	tc := &tls.Config{ServerName: host, MinVersion: tls.VersionTLS12}
+	if opts.CAFile != "" {
+		pool, err := LoadCAFile(opts.CAFile)
+		if err != nil {
+			return nil, err
+		}
+		tc.RootCAs = pool
+	}
+	if opts.Fingerprint != "" {
+		want, err := ParseFingerprint(opts.Fingerprint)
+		if err != nil {
+			return nil, err
+		}
+		// Цепочку не проверяем: доверие задаётся самим отпечатком
+		tc.InsecureSkipVerify = true
+		tc.VerifyConnection = func(cs tls.ConnectionState) error {
+			if len(cs.PeerCertificates) == 0 {
+				return ErrFingerprintMismatch
+			}
+			got := sha256.Sum256(cs.PeerCertificates[0].Raw)
+			if !bytes.Equal(got[:], want) {
+				return fmt.Errorf("%w: got %s", ErrFingerprintMismatch, FormatFingerprint(got[:]))
+			}
+			return nil
+		}
+		return tc, nil
+	}
+	tc.InsecureSkipVerify = opts.SkipVerify
+	return tc, nil
+}
+
+// LoadCAFile читает PEM-файл с сертификатами удостоверяющих центров.
+func LoadCAFile(path string) (*x509.CertPool, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("imap: read CA file: %w", err)
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(data) {
+		return nil, fmt.Errorf("imap: no PEM certificates in CA file %s", path)
+	}
+	return pool, nil
+}
+
+// ParseFingerprint разбирает SHA-256 отпечаток сертификата: 64 hex-символа,
+// допускаются разделители ':' и пробелы, регистр не важен, необязательный префикс "sha256:".
+func ParseFingerprint(s string) ([]byte, error) {
+	h := strings.ToLower(strings.TrimSpace(s))
+	h = strings.TrimPrefix(h, "sha256:")
+	h = strings.NewReplacer(":", "", " ", "").Replace(h)
+	b, err := hex.DecodeString(h)
+	if err != nil || len(b) != sha256.Size {
+		return nil, fmt.Errorf("imap: invalid SHA-256 fingerprint %q", s)
+	}
+	return b, nil
+}
+
+// FormatFingerprint записывает отпечаток в виде AB:CD:..., как его показывает openssl.
+func FormatFingerprint(b []byte) string {
+	parts := make([]string, len(b))
+	for i, c := range b {
+		parts[i] = fmt.Sprintf("%02X", c)
+	}
+	return strings.Join(parts, ":")
+}
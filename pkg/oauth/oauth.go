@@ -0,0 +1,134 @@
+package oauth
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+
+	"golang.org/x/oauth2"
+
+	"mailpuff/pkg/state"
+)
+
+const (
+	// earlyExpiry — за сколько до истечения access token запрашивается новый,
+	// чтобы токен не истёк между выдачей и AUTHENTICATE
+	earlyExpiry = 2 * time.Minute
+	// defaultLifetime — срок жизни токена, если провайдер не прислал expires_in
+	defaultLifetime = 50 * time.Minute
+	requestTimeout  = 30 * time.Second
+)
+
+// Config — параметры refresh-token flow (RFC 6749, раздел 6).
+type Config struct {
+	TokenURL     string
+	ClientID     string
+	ClientSecret string
+	RefreshToken string
+	Scopes       []string
+}
+
+// TokenSource выдаёт access token аккаунта, обновляя его по refresh token до истечения.
+// Новый refresh token, если провайдер его ротировал, сохраняется в state.Store.
+// Безопасен для одновременного использования всеми соединениями аккаунта.
+type TokenSource struct {
+	cfg     oauth2.Config
+	account string
+	seed    string
+	st      *state.Store
+	client  *http.Client
+
+	mu      sync.Mutex
+	refresh string
+	tok     *oauth2.Token
+}
+
+// NewTokenSource создаёт источник токенов для аккаунта account (ключ в state.Store).
+// Сохранённый ранее refresh token используется, если он получен от того же токена из конфигурации.
+// client может быть nil — тогда используется http.DefaultClient.
+func NewTokenSource(cfg Config, account string, st *state.Store, client *http.Client) (*TokenSource, error) {
+	if client == nil {
+		client = http.DefaultClient
+	}
+	s := &TokenSource{
+		cfg: oauth2.Config{
+			ClientID:     cfg.ClientID,
+			ClientSecret: cfg.ClientSecret,
+			Endpoint:     oauth2.Endpoint{TokenURL: cfg.TokenURL},
+			Scopes:       cfg.Scopes,
+		},
+		account: account,
+		seed:    fingerprint(cfg.RefreshToken),
+		st:      st,
+		client:  client,
+		refresh: cfg.RefreshToken,
+	}
+	if st != nil {
+		rec, found, err := st.OAuthToken(account)
+		if err != nil {
+			return nil, fmt.Errorf("oauth: load refresh token: %w", err)
+		}
+		if found && rec.Seed == s.seed && rec.RefreshToken != "" {
+			s.refresh = rec.RefreshToken
+		}
+	}
+	return s, nil
+}
+
+func fingerprint(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:8])
+}
+
+// Token возвращает действующий access token, при необходимости обновляя его.
+func (s *TokenSource) Token() (string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.tok != nil && time.Until(s.tok.Expiry) > earlyExpiry {
+		return s.tok.AccessToken, nil
+	}
+	ctx, cancel := context.WithTimeout(context.WithValue(context.Background(), oauth2.HTTPClient, s.client), requestTimeout)
+	defer cancel()
+	tok, err := s.cfg.TokenSource(ctx, &oauth2.Token{RefreshToken: s.refresh}).Token()
+	if err != nil {
+		return "", fmt.Errorf("oauth: refresh access token: %w", err)
+	}
+	if tok.Expiry.IsZero() {
+		tok.Expiry = time.Now().Add(defaultLifetime)
+	}
+	rotated := tok.RefreshToken != "" && tok.RefreshToken != s.refresh
+	if rotated {
+		s.refresh = tok.RefreshToken
+		if s.st != nil {
+			if err := s.st.SaveOAuthToken(s.account, state.OAuthRecord{RefreshToken: s.refresh, Seed: s.seed}); err != nil {
+				// токен уже действует; без сохранения после рестарта придётся заново выдать доступ
+				log.Printf("oauth save refresh_token error account=%s: %v", s.account, err)
+			}
+		}
+	}
+	s.tok = tok
+	log.Printf("oauth token refreshed account=%s expires_in=%s rotated=%t", s.account, time.Until(tok.Expiry).Round(time.Second), rotated)
+	return tok.AccessToken, nil
+}
+
+// Expiry возвращает срок действия текущего access token (нулевое время, если токена нет).
+func (s *TokenSource) Expiry() time.Time {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.tok == nil {
+		return time.Time{}
+	}
+	return s.tok.Expiry
+}
+
+// Invalidate сбрасывает текущий access token: следующий Token() обратится к провайдеру.
+func (s *TokenSource) Invalidate() {
+	s.mu.Lock()
+	s.tok = nil
+	s.mu.Unlock()
+}
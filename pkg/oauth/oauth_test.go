@@ -0,0 +1,155 @@
+package oauth
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+
+	"mailpuff/pkg/state"
+)
+
+// fakeProvider — token endpoint, выдающий access token по refresh token.
+type fakeProvider struct {
+	mu sync.Mutex
+	// valid — refresh token, который провайдер сейчас принимает
+	valid string
+	// rotateTo — новый refresh token в ответе; пустой — без ротации
+	rotateTo  string
+	expiresIn int
+	calls     int
+}
+
+func (p *fakeProvider) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if err := r.ParseForm(); err != nil || r.PostForm.Get("grant_type") != "refresh_token" {
+		http.Error(w, `{"error":"invalid_request"}`, http.StatusBadRequest)
+		return
+	}
+	if r.PostForm.Get("refresh_token") != p.valid {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusBadRequest)
+		_, _ = w.Write([]byte(`{"error":"invalid_grant"}`))
+		return
+	}
+	p.calls++
+	resp := map[string]any{
+		"access_token": fmt.Sprintf("access-%d", p.calls),
+		"token_type":   "Bearer",
+		"expires_in":   p.expiresIn,
+	}
+	if p.rotateTo != "" {
+		resp["refresh_token"] = p.rotateTo
+		p.valid = p.rotateTo
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(resp)
+}
+
+func (p *fakeProvider) callCount() int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.calls
+}
+
+func newSource(t *testing.T, p *fakeProvider, refresh string, st *state.Store) *TokenSource {
+	t.Helper()
+	srv := httptest.NewServer(p)
+	t.Cleanup(srv.Close)
+	ts, err := NewTokenSource(Config{TokenURL: srv.URL, ClientID: "id", ClientSecret: "secret", RefreshToken: refresh}, "user@imap.example.com", st, srv.Client())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return ts
+}
+
+func openState(t *testing.T) *state.Store {
+	t.Helper()
+	st, err := state.Open(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = st.Close() })
+	return st
+}
+
+func TestTokenRefreshAndCache(t *testing.T) {
+	p := &fakeProvider{valid: "r1", expiresIn: 3600}
+	ts := newSource(t, p, "r1", nil)
+
+	tok, err := ts.Token()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tok != "access-1" {
+		t.Fatalf("token = %q, want access-1", tok)
+	}
+	if tok, err = ts.Token(); err != nil || tok != "access-1" {
+		t.Fatalf("second Token() = %q, %v; want cached access-1", tok, err)
+	}
+	if n := p.callCount(); n != 1 {
+		t.Fatalf("provider called %d times, want 1", n)
+	}
+
+	// Отвергнутый сервером токен запрашивается заново
+	ts.Invalidate()
+	if tok, err = ts.Token(); err != nil || tok != "access-2" {
+		t.Fatalf("Token() after Invalidate = %q, %v; want access-2", tok, err)
+	}
+}
+
+func TestTokenEarlyRefresh(t *testing.T) {
+	// Токен живёт меньше earlyExpiry: каждый запрос должен обновлять его заранее
+	p := &fakeProvider{valid: "r1", expiresIn: int(earlyExpiry.Seconds()) / 2}
+	ts := newSource(t, p, "r1", nil)
+
+	for i := 0; i < 2; i++ {
+		if _, err := ts.Token(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if n := p.callCount(); n != 2 {
+		t.Fatalf("provider called %d times, want 2 (token within earlyExpiry must be refreshed)", n)
+	}
+}
+
+func TestTokenRotationIsSaved(t *testing.T) {
+	st := openState(t)
+	p := &fakeProvider{valid: "r1", rotateTo: "r2", expiresIn: 3600}
+	ts := newSource(t, p, "r1", st)
+	if _, err := ts.Token(); err != nil {
+		t.Fatal(err)
+	}
+	rec, found, err := st.OAuthToken("user@imap.example.com")
+	if err != nil || !found {
+		t.Fatalf("rotated token not saved: found=%t err=%v", found, err)
+	}
+	if rec.RefreshToken != "r2" {
+		t.Fatalf("saved refresh token = %q, want r2", rec.RefreshToken)
+	}
+
+	// После рестарта используется сохранённый токен: r1 провайдер уже не принимает
+	p.rotateTo = ""
+	restarted := newSource(t, p, "r1", st)
+	if _, err := restarted.Token(); err != nil {
+		t.Fatalf("refresh with saved token: %v", err)
+	}
+
+	// Новый токен в конфигурации (доступ выдан заново) важнее сохранённого
+	p.valid = "fresh"
+	reissued := newSource(t, p, "fresh", st)
+	if _, err := reissued.Token(); err != nil {
+		t.Fatalf("refresh with new configured token: %v", err)
+	}
+}
+
+func TestTokenRefreshError(t *testing.T) {
+	p := &fakeProvider{valid: "r1", expiresIn: 3600}
+	ts := newSource(t, p, "revoked", nil)
+	if _, err := ts.Token(); err == nil {
+		t.Fatal("Token() with a revoked refresh token succeeded")
+	}
+}
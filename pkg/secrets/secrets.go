@@ -0,0 +1,176 @@
+package secrets
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+
+	"golang.org/x/crypto/scrypt"
+)
+
+// Переменные окружения с ключом (паролем) зашифрованного файла секретов.
+const (
+	EnvKey     = "SECRETS_KEY"
+	EnvKeyFile = "SECRETS_KEY_FILE"
+)
+
+// magic открывает зашифрованный файл: по нему отличаем наш формат и его версию.
+const magic = "MPSECRETS1"
+
+const (
+	saltSize = 16
+	keySize  = 32
+	// параметры scrypt: ~100 мс на современном CPU, файл расшифровывается один раз при старте
+	scryptN = 1 << 15
+	scryptR = 8
+	scryptP = 1
+)
+
+// ErrDecrypt возвращается при неверном ключе или повреждённом файле.
+var ErrDecrypt = errors.New("secrets: wrong key or corrupted file")
+
+// Encrypt шифрует plaintext паролем passphrase.
+// Формат: magic | salt(16) | nonce(12) | AES-256-GCM(plaintext); ключ выводится через scrypt.
+func Encrypt(plaintext []byte, passphrase string) ([]byte, error) {
+	if passphrase == "" {
+		return nil, errors.New("secrets: empty key")
+	}
+	salt := make([]byte, saltSize)
+	if _, err := rand.Read(salt); err != nil {
+		return nil, err
+	}
+	aead, err := newAEAD(passphrase, salt)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	out := make([]byte, 0, len(magic)+len(salt)+len(nonce)+len(plaintext)+aead.Overhead())
+	out = append(out, magic...)
+	out = append(out, salt...)
+	out = append(out, nonce...)
+	// magic входит в additional data, чтобы его нельзя было подменить
+	return aead.Seal(out, nonce, plaintext, []byte(magic)), nil
+}
+
+// Decrypt расшифровывает данные, созданные Encrypt.
+func Decrypt(data []byte, passphrase string) ([]byte, error) {
+	if !bytes.HasPrefix(data, []byte(magic)) {
+		return nil, errors.New("secrets: not an encrypted secrets file")
+	}
+	data = data[len(magic):]
+	if len(data) < saltSize {
+		return nil, ErrDecrypt
+	}
+	salt, data := data[:saltSize], data[saltSize:]
+	aead, err := newAEAD(passphrase, salt)
+	if err != nil {
+		return nil, err
+	}
+	if len(data) < aead.NonceSize() {
+		return nil, ErrDecrypt
+	}
+	nonce, data := data[:aead.NonceSize()], data[aead.NonceSize():]
+	plain, err := aead.Open(nil, nonce, data, []byte(magic))
+	if err != nil {
+		return nil, ErrDecrypt
+	}
+	return plain, nil
+}
+
+func newAEAD(passphrase string, salt []byte) (cipher.AEAD, error) {
+	key, err := scrypt.Key([]byte(passphrase), salt, scryptN, scryptR, scryptP, keySize)
+	if err != nil {
+		return nil, err
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// ParseEnv разбирает содержимое в формате .env: строки KEY=VALUE, пустые строки
+// и комментарии '#' пропускаются, значение можно взять в одинарные или двойные кавычки.
+func ParseEnv(data []byte) (map[string]string, error) {
+	out := make(map[string]string)
+	sc := bufio.NewScanner(bytes.NewReader(data))
+	for n := 1; sc.Scan(); n++ {
+		line := strings.TrimSpace(sc.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		line = strings.TrimPrefix(line, "export ")
+		key, val, ok := strings.Cut(line, "=")
+		key = strings.TrimSpace(key)
+		if !ok || key == "" {
+			return nil, fmt.Errorf("line %d: expected KEY=VALUE", n)
+		}
+		val = strings.TrimSpace(val)
+		if len(val) >= 2 && val[0] == '"' && val[len(val)-1] == '"' {
+			uq, err := strconv.Unquote(val)
+			if err != nil {
+				return nil, fmt.Errorf("line %d: %v", n, err)
+			}
+			val = uq
+		} else if len(val) >= 2 && val[0] == '\'' && val[len(val)-1] == '\'' {
+			val = val[1 : len(val)-1]
+		}
+		out[key] = val
+	}
+	if err := sc.Err(); err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// Load читает и расшифровывает файл секретов path, возвращая пары KEY=VALUE.
+func Load(path, passphrase string) (map[string]string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	plain, err := Decrypt(data, passphrase)
+	if err != nil {
+		return nil, err
+	}
+	return ParseEnv(plain)
+}
+
+// ReadFile читает секрет из файла (Docker/Kubernetes secrets): завершающий перевод строки
+// отбрасывается, остальное содержимое сохраняется как есть.
+func ReadFile(path string) (string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimRight(string(data), "\r\n"), nil
+}
+
+// KeyFromEnv возвращает ключ файла секретов из SECRETS_KEY или файла SECRETS_KEY_FILE.
+func KeyFromEnv() (string, error) {
+	key := os.Getenv(EnvKey)
+	path := os.Getenv(EnvKeyFile)
+	switch {
+	case key != "" && path != "":
+		return "", fmt.Errorf("%s and %s are mutually exclusive", EnvKey, EnvKeyFile)
+	case path != "":
+		k, err := ReadFile(path)
+		if err != nil {
+			return "", fmt.Errorf("%s: %w", EnvKeyFile, err)
+		}
+		return k, nil
+	case key != "":
+		return key, nil
+	}
+	return "", fmt.Errorf("%s or %s is required to decrypt the secrets file", EnvKey, EnvKeyFile)
+}
@@ -0,0 +1,147 @@
+package secrets
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestEncryptDecrypt(t *testing.T) {
+	plain := []byte("IMAP_PASSWORD=secret\nTELEGRAM_TOKEN=\"123:abc\"\n")
+	data, err := Encrypt(plain, "passphrase")
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := Decrypt(data, "passphrase")
+	if err != nil {
+		t.Fatalf("Decrypt: %v", err)
+	}
+	if string(got) != string(plain) {
+		t.Fatalf("Decrypt = %q, want %q", got, plain)
+	}
+
+	tampered := append([]byte(nil), data...)
+	tampered[len(tampered)-1] ^= 1
+	tests := []struct {
+		name string
+		data []byte
+		key  string
+		want error
+	}{
+		{"wrong key", data, "other", ErrDecrypt},
+		{"tampered", tampered, "passphrase", ErrDecrypt},
+		{"truncated", data[:len(magic)+4], "passphrase", ErrDecrypt},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			if _, err := Decrypt(tc.data, tc.key); !errors.Is(err, tc.want) {
+				t.Fatalf("Decrypt: err = %v, want %v", err, tc.want)
+			}
+		})
+	}
+	if _, err := Decrypt(plain, "passphrase"); err == nil || errors.Is(err, ErrDecrypt) {
+		t.Errorf("Decrypt of a plain .env: err = %v, want a format error", err)
+	}
+	if _, err := Encrypt(plain, ""); err == nil {
+		t.Error("Encrypt accepted an empty key")
+	}
+}
+
+func TestParseEnv(t *testing.T) {
+	tests := []struct {
+		name    string
+		in      string
+		want    map[string]string
+		wantErr bool
+	}{
+		{
+			name: "comments and blanks",
+			in:   "# secrets\n\nA=1\n  B = two  \n",
+			want: map[string]string{"A": "1", "B": "two"},
+		},
+		{
+			name: "quotes",
+			in:   "A=\"x y\\n\"\nB='#not a comment'\nC=\"\"\n",
+			want: map[string]string{"A": "x y\n", "B": "#not a comment", "C": ""},
+		},
+		{
+			name: "export and equals in value",
+			in:   "export TOKEN=a=b\n",
+			want: map[string]string{"TOKEN": "a=b"},
+		},
+		{name: "missing equals", in: "A=1\nBROKEN\n", wantErr: true},
+		{name: "bad quoting", in: "A=\"\\q\"\n", wantErr: true},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			got, err := ParseEnv([]byte(tc.in))
+			if tc.wantErr {
+				if err == nil {
+					t.Fatalf("ParseEnv = %v, want an error", got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(got) != len(tc.want) {
+				t.Errorf("ParseEnv = %q, want %q", got, tc.want)
+			}
+			for k, v := range tc.want {
+				if got[k] != v {
+					t.Errorf("%s = %q, want %q", k, got[k], v)
+				}
+			}
+		})
+	}
+}
+
+func TestLoadAndKeyFromEnv(t *testing.T) {
+	dir := t.TempDir()
+	data, err := Encrypt([]byte("IMAP_PASSWORD=from-file\n"), "k3y")
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(dir, "secrets.enc")
+	if err := os.WriteFile(path, data, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	keyFile := filepath.Join(dir, "key")
+	if err := os.WriteFile(keyFile, []byte("k3y\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name, key, keyFile string
+		wantErr            bool
+	}{
+		{name: "key", key: "k3y"},
+		{name: "key file", keyFile: keyFile},
+		{name: "both", key: "k3y", keyFile: keyFile, wantErr: true},
+		{name: "none", wantErr: true},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			t.Setenv(EnvKey, tc.key)
+			t.Setenv(EnvKeyFile, tc.keyFile)
+			key, err := KeyFromEnv()
+			if tc.wantErr {
+				if err == nil {
+					t.Fatal("KeyFromEnv: want an error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			m, err := Load(path, key)
+			if err != nil {
+				t.Fatalf("Load: %v", err)
+			}
+			if m["IMAP_PASSWORD"] != "from-file" {
+				t.Fatalf("IMAP_PASSWORD = %q", m["IMAP_PASSWORD"])
+			}
+		})
+	}
+}
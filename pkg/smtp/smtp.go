@@ -0,0 +1,151 @@
+// Package smtp отправляет письма (ответы из Telegram) через SMTP-сервер аккаунта.
+package smtp
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/emersion/go-sasl"
+	gosmtp "github.com/emersion/go-smtp"
+
+	"mailpuff/pkg/imap"
+)
+
+const (
+	dialTimeout = 30 * time.Second
+	// sendTimeout ограничивает весь сеанс отправки одного письма
+	sendTimeout = 2 * time.Minute
+)
+
+// ErrAuth — сервер отверг учётные данные.
+var ErrAuth = errors.New("smtp: authentication failed")
+
+// ErrStartTLSUnsupported — сервер не объявил STARTTLS; продолжать без шифрования нельзя.
+var ErrStartTLSUnsupported = errors.New("smtp: server does not support STARTTLS")
+
+// Config — параметры SMTP-сервера. Режимы защиты, проверка сертификата и способы
+// аутентификации те же, что у IMAP (imap.SecurityTLS, imap.AuthXOAuth2, ...).
+type Config struct {
+	Host     string
+	Port     int
+	Username string
+	Password string
+	// Security — imap.SecurityTLS (по умолчанию, обычно порт 465), SecurityStartTLS (587) или SecurityPlain
+	Security string
+	TLS      imap.TLSOptions
+	// Auth — imap.AuthLogin (AUTH PLAIN, по умолчанию), AuthXOAuth2 или AuthOAuthBearer
+	Auth string
+	// Tokens — источник access token для Auth = xoauth2/oauthbearer
+	Tokens imap.TokenSource
+}
+
+// Send отправляет готовое письмо msg (RFC 5322, строки через CRLF) от from получателям to.
+func Send(cfg Config, from string, to []string, msg []byte) error {
+	if len(to) == 0 {
+		return errors.New("smtp: no recipients")
+	}
+	c, err := dial(cfg)
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+	if err := authenticate(c, cfg); err != nil {
+		return err
+	}
+	if err := c.Mail(from, nil); err != nil {
+		return fmt.Errorf("smtp: MAIL FROM %s: %w", from, err)
+	}
+	for _, rcpt := range to {
+		if err := c.Rcpt(rcpt); err != nil {
+			return fmt.Errorf("smtp: RCPT TO %s: %w", rcpt, err)
+		}
+	}
+	w, err := c.Data()
+	if err != nil {
+		return fmt.Errorf("smtp: DATA: %w", err)
+	}
+	if _, err := w.Write(msg); err != nil {
+		_ = w.Close()
+		return fmt.Errorf("smtp: DATA: %w", err)
+	}
+	if err := w.Close(); err != nil {
+		return fmt.Errorf("smtp: DATA: %w", err)
+	}
+	return c.Quit()
+}
+
+// dial открывает соединение в режиме cfg.Security. При STARTTLS аутентификация
+// начинается только после успешного перехода на TLS — откат на открытый канал не выполняется.
+func dial(cfg Config) (*gosmtp.Client, error) {
+	addr := net.JoinHostPort(cfg.Host, strconv.Itoa(cfg.Port))
+	dialer := &net.Dialer{Timeout: dialTimeout}
+	var conn net.Conn
+	var err error
+	switch cfg.Security {
+	case "", imap.SecurityTLS:
+		tc, terr := imap.NewTLSConfig(cfg.Host, cfg.TLS)
+		if terr != nil {
+			return nil, terr
+		}
+		conn, err = tls.DialWithDialer(dialer, "tcp", addr, tc)
+	case imap.SecurityStartTLS, imap.SecurityPlain:
+		conn, err = dialer.Dial("tcp", addr)
+	default:
+		return nil, fmt.Errorf("smtp: unknown security mode %q", cfg.Security)
+	}
+	if err != nil {
+		return nil, err
+	}
+	_ = conn.SetDeadline(time.Now().Add(sendTimeout))
+	c, err := gosmtp.NewClient(conn, cfg.Host)
+	if err != nil {
+		_ = conn.Close()
+		return nil, err
+	}
+	if cfg.Security == imap.SecurityStartTLS {
+		if ok, _ := c.Extension("STARTTLS"); !ok {
+			_ = c.Close()
+			return nil, ErrStartTLSUnsupported
+		}
+		tc, err := imap.NewTLSConfig(cfg.Host, cfg.TLS)
+		if err == nil {
+			err = c.StartTLS(tc)
+		}
+		if err != nil {
+			_ = c.Close()
+			return nil, err
+		}
+	}
+	return c, nil
+}
+
+// authenticate выполняет AUTH PLAIN или SASL-аутентификацию OAuth2.
+func authenticate(c *gosmtp.Client, cfg Config) error {
+	switch cfg.Auth {
+	case "", imap.AuthLogin:
+		if err := c.Auth(sasl.NewPlainClient("", cfg.Username, cfg.Password)); err != nil {
+			return fmt.Errorf("%w: %v", ErrAuth, err)
+		}
+		return nil
+	case imap.AuthXOAuth2, imap.AuthOAuthBearer:
+		if cfg.Tokens == nil {
+			return fmt.Errorf("smtp: %s requires a token source", cfg.Auth)
+		}
+		token, err := cfg.Tokens.Token()
+		if err != nil {
+			return fmt.Errorf("smtp: obtain access token: %w", err)
+		}
+		if err := c.Auth(imap.NewOAuthSASLClient(cfg.Auth, cfg.Username, token, cfg.Host, cfg.Port)); err != nil {
+			// токен мог быть отозван до истечения срока — в следующий раз запросим новый
+			cfg.Tokens.Invalidate()
+			return fmt.Errorf("%w: %s: %v", ErrAuth, strings.ToUpper(cfg.Auth), err)
+		}
+		return nil
+	}
+	return fmt.Errorf("smtp: unknown auth method %q", cfg.Auth)
+}
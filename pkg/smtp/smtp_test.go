@@ -0,0 +1,207 @@
+package smtp
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"net"
+	netmail "net/mail"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/emersion/go-message/mail"
+	gosmtp "github.com/emersion/go-smtp"
+
+	"mailpuff/pkg/email"
+	"mailpuff/pkg/imap"
+)
+
+// delivery — письмо, принятое тестовым сервером.
+type delivery struct {
+	username string
+	from     string
+	rcpts    []string
+	data     []byte
+}
+
+// fakeBackend — SMTP-сервер в памяти: принимает вход username/password и запоминает письма.
+type fakeBackend struct {
+	username, password string
+
+	mu   sync.Mutex
+	mail []delivery
+}
+
+func (b *fakeBackend) Login(_ *gosmtp.ConnectionState, username, password string) (gosmtp.Session, error) {
+	if username != b.username || password != b.password {
+		return nil, errors.New("invalid credentials")
+	}
+	return &fakeSession{b: b, d: delivery{username: username}}, nil
+}
+
+func (b *fakeBackend) AnonymousLogin(*gosmtp.ConnectionState) (gosmtp.Session, error) {
+	return nil, gosmtp.ErrAuthRequired
+}
+
+func (b *fakeBackend) delivered() []delivery {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return append([]delivery(nil), b.mail...)
+}
+
+type fakeSession struct {
+	b *fakeBackend
+	d delivery
+}
+
+func (s *fakeSession) Mail(from string, _ gosmtp.MailOptions) error {
+	s.d.from = from
+	return nil
+}
+
+func (s *fakeSession) Rcpt(to string) error {
+	s.d.rcpts = append(s.d.rcpts, to)
+	return nil
+}
+
+func (s *fakeSession) Data(r io.Reader) error {
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return err
+	}
+	s.d.data = data
+	s.b.mu.Lock()
+	s.b.mail = append(s.b.mail, s.d)
+	s.b.mu.Unlock()
+	return nil
+}
+
+func (s *fakeSession) Reset() {
+	s.d = delivery{username: s.d.username}
+}
+
+func (s *fakeSession) Logout() error { return nil }
+
+// startServer запускает сервер на свободном локальном порту и возвращает Config для него.
+func startServer(t *testing.T, b *fakeBackend) Config {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := gosmtp.NewServer(b)
+	srv.Domain = "localhost"
+	srv.AllowInsecureAuth = true
+	srv.ReadTimeout = 10 * time.Second
+	srv.WriteTimeout = 10 * time.Second
+	go func() { _ = srv.Serve(l) }()
+	t.Cleanup(func() { _ = srv.Close() })
+	addr := l.Addr().(*net.TCPAddr)
+	return Config{
+		Host:     "127.0.0.1",
+		Port:     addr.Port,
+		Username: b.username,
+		Password: b.password,
+		Security: imap.SecurityPlain,
+	}
+}
+
+func TestSendReply(t *testing.T) {
+	b := &fakeBackend{username: "bot@example.com", password: "secret"}
+	cfg := startServer(t, b)
+
+	orig := &imap.Email{
+		MessageID: "<orig@mail.example.org>",
+		Subject:   "Quarterly report",
+		Sent:      time.Date(2024, 3, 1, 9, 30, 0, 0, time.UTC),
+		From:      []imap.Address{{Name: "Alice", Addr: "alice@example.org"}},
+		ReplyTo:   []imap.Address{{Addr: "team@example.org"}, {Name: "Bob", Addr: "bob@example.org"}},
+		Text:      "Numbers are attached.\n\n> earlier quote\nThanks",
+	}
+	reply, err := email.BuildReply(email.ReplyOptions{
+		From:       &mail.Address{Name: "Mail Bot", Address: "bot@example.com"},
+		Original:   orig,
+		References: []string{"<root@mail.example.org>", "<orig@mail.example.org>"},
+		Text:       "Got it, thanks!",
+		Quote:      true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := Send(cfg, "bot@example.com", reply.To, reply.Raw); err != nil {
+		t.Fatalf("Send: %v", err)
+	}
+
+	got := b.delivered()
+	if len(got) != 1 {
+		t.Fatalf("server received %d messages, want 1", len(got))
+	}
+	d := got[0]
+	if d.username != "bot@example.com" {
+		t.Errorf("AUTH username = %q", d.username)
+	}
+	if d.from != "bot@example.com" {
+		t.Errorf("MAIL FROM = %q, want bot@example.com", d.from)
+	}
+	if want := []string{"team@example.org", "bob@example.org"}; strings.Join(d.rcpts, ",") != strings.Join(want, ",") {
+		t.Errorf("RCPT TO = %v, want Reply-To addresses %v", d.rcpts, want)
+	}
+
+	msg, err := netmail.ReadMessage(bytes.NewReader(d.data))
+	if err != nil {
+		t.Fatalf("received message does not parse: %v", err)
+	}
+	for _, h := range []struct{ name, want string }{
+		{"Subject", "Re: Quarterly report"},
+		{"In-Reply-To", "<orig@mail.example.org>"},
+		{"References", "<root@mail.example.org> <orig@mail.example.org>"},
+		{"Message-Id", reply.MessageID},
+	} {
+		if v := msg.Header.Get(h.name); v != h.want {
+			t.Errorf("%s = %q, want %q", h.name, v, h.want)
+		}
+	}
+	body, err := io.ReadAll(msg.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	text := strings.ReplaceAll(string(body), "\r\n", "\n")
+	wantBody := "Got it, thanks!\n" +
+		"\n" +
+		"On Fri, 01 Mar 2024 09:30, Alice <alice@example.org> wrote:\n" +
+		"> Numbers are attached.\n" +
+		">\n" +
+		">> earlier quote\n" +
+		"> Thanks\n"
+	if !strings.HasPrefix(text, wantBody) {
+		t.Errorf("body:\n%s\nwant it to start with:\n%s", text, wantBody)
+	}
+}
+
+func TestSendAuthFailure(t *testing.T) {
+	b := &fakeBackend{username: "bot@example.com", password: "secret"}
+	cfg := startServer(t, b)
+	cfg.Password = "wrong"
+
+	err := Send(cfg, "bot@example.com", []string{"alice@example.org"}, []byte("Subject: x\r\n\r\nx\r\n"))
+	if !errors.Is(err, ErrAuth) {
+		t.Fatalf("Send with a wrong password: err = %v, want ErrAuth", err)
+	}
+	if n := len(b.delivered()); n != 0 {
+		t.Fatalf("server received %d messages after failed AUTH", n)
+	}
+}
+
+func TestSendStartTLSRequired(t *testing.T) {
+	// Сервер без STARTTLS: письмо не должно уйти по открытому каналу
+	b := &fakeBackend{username: "bot@example.com", password: "secret"}
+	cfg := startServer(t, b)
+	cfg.Security = imap.SecurityStartTLS
+
+	err := Send(cfg, "bot@example.com", []string{"alice@example.org"}, []byte("Subject: x\r\n\r\nx\r\n"))
+	if !errors.Is(err, ErrStartTLSUnsupported) {
+		t.Fatalf("err = %v, want ErrStartTLSUnsupported", err)
+	}
+}
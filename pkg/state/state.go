@@ -0,0 +1,459 @@
+package state
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// FileName — имя файла базы внутри каталога данных.
+const FileName = "mailpuff.db"
+
+// ErrLocked — базу держит другой процесс (bbolt открывает файл монопольно), обычно запущенный mailpuff.
+var ErrLocked = errors.New("state: database is locked by another process")
+
+var (
+	bucketProcessed = []byte("processed")
+	// bucketMailboxes хранит последний известный UIDVALIDITY каждой папки
+	bucketMailboxes = []byte("mailboxes")
+	// bucketResync хранит записи прежнего поколения UID, проиндексированные по Message-ID,
+	// до тех пор пока письмо не будет найдено под новым UID
+	bucketResync = []byte("resync")
+	// bucketOAuth хранит актуальные refresh token аккаунтов: провайдеры ротируют их при обновлении
+	bucketOAuth = []byte("oauth")
+	// bucketSnooze хранит отложенные письма до времени их возвращения
+	bucketSnooze = []byte("snooze")
+	// bucketNotifications — индекс уведомлений: chat_id\0message_id -> ключ записи в bucketProcessed
+	bucketNotifications = []byte("notifications")
+)
+
+// Key однозначно идентифицирует письмо на сервере: UID имеет смысл только
+// в паре с UIDVALIDITY конкретной папки конкретного аккаунта.
+type Key struct {
+	Account     string
+	Mailbox     string
+	UIDValidity uint32
+	UID         int
+}
+
+func mailboxPrefix(account, mailbox string) []byte {
+	return []byte(account + "\x00" + mailbox + "\x00")
+}
+
+func notificationKey(chatID int64, messageID int) []byte {
+	return []byte(fmt.Sprintf("%d\x00%d", chatID, messageID))
+}
+
+func (k Key) bytes() []byte {
+	// Фиксированная ширина чисел сохраняет сортировку UID внутри папки.
+	return []byte(fmt.Sprintf("%s\x00%s\x00%010d\x00%010d", k.Account, k.Mailbox, k.UIDValidity, k.UID))
+}
+
+// parseKey разбирает ключ, сохранённый Key.bytes.
+func parseKey(b []byte) (Key, bool) {
+	f := strings.Split(string(b), "\x00")
+	if len(f) != 4 {
+		return Key{}, false
+	}
+	uidValidity, err1 := strconv.ParseUint(f[2], 10, 32)
+	uid, err2 := strconv.Atoi(f[3])
+	if err1 != nil || err2 != nil {
+		return Key{}, false
+	}
+	return Key{Account: f[0], Mailbox: f[1], UIDValidity: uint32(uidValidity), UID: uid}, true
+}
+
+// Record — сведения об уже обработанном письме.
+// ChatID/MessageID равны нулю, если письмо было пропущено без уведомления.
+type Record struct {
+	ChatID    int64 `json:"chat_id,omitempty"`
+	MessageID int   `json:"message_id,omitempty"`
+	// EmailMessageID — заголовок Message-ID письма; по нему записи переносятся при смене UIDVALIDITY
+	EmailMessageID string    `json:"email_message_id,omitempty"`
+	ProcessedAt    time.Time `json:"processed_at"`
+}
+
+type mailboxRecord struct {
+	UIDValidity uint32 `json:"uid_validity"`
+}
+
+// Store — файловое хранилище состояния, переживающее рестарты процесса.
+type Store struct {
+	db *bolt.DB
+}
+
+// Open открывает (или создаёт) базу состояния в каталоге dir.
+func Open(dir string) (*Store, error) {
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return nil, fmt.Errorf("state: create data dir: %w", err)
+	}
+	db, err := bolt.Open(filepath.Join(dir, FileName), 0o600, &bolt.Options{Timeout: 5 * time.Second})
+	if errors.Is(err, bolt.ErrTimeout) {
+		return nil, fmt.Errorf("%w: %s", ErrLocked, filepath.Join(dir, FileName))
+	}
+	if err != nil {
+		return nil, fmt.Errorf("state: open db: %w", err)
+	}
+	err = db.Update(func(tx *bolt.Tx) error {
+		for _, b := range [][]byte{bucketProcessed, bucketMailboxes, bucketResync, bucketOAuth, bucketSnooze} {
+			if _, err := tx.CreateBucketIfNotExists(b); err != nil {
+				return err
+			}
+		}
+		if tx.Bucket(bucketNotifications) != nil {
+			return nil
+		}
+		// База прежней версии: индекс уведомлений строится по уже сохранённым записям
+		index, err := tx.CreateBucket(bucketNotifications)
+		if err != nil {
+			return err
+		}
+		return tx.Bucket(bucketProcessed).ForEach(func(k, v []byte) error {
+			var rec Record
+			if json.Unmarshal(v, &rec) != nil {
+				return nil
+			}
+			return putNotification(index, k, rec)
+		})
+	})
+	if err != nil {
+		_ = db.Close()
+		return nil, fmt.Errorf("state: init buckets: %w", err)
+	}
+	return &Store{db: db}, nil
+}
+
+// Close закрывает файл базы.
+func (s *Store) Close() error {
+	return s.db.Close()
+}
+
+// Processed возвращает запись об обработанном письме, если она есть.
+func (s *Store) Processed(k Key) (Record, bool, error) {
+	var rec Record
+	var found bool
+	err := s.db.View(func(tx *bolt.Tx) error {
+		v := tx.Bucket(bucketProcessed).Get(k.bytes())
+		if v == nil {
+			return nil
+		}
+		found = true
+		return json.Unmarshal(v, &rec)
+	})
+	return rec, found, err
+}
+
+// MarkProcessed сохраняет отметку об обработке письма.
+func (s *Store) MarkProcessed(k Key, rec Record) error {
+	if rec.ProcessedAt.IsZero() {
+		rec.ProcessedAt = time.Now()
+	}
+	v, err := json.Marshal(rec)
+	if err != nil {
+		return err
+	}
+	return s.db.Update(func(tx *bolt.Tx) error {
+		if err := tx.Bucket(bucketProcessed).Put(k.bytes(), v); err != nil {
+			return err
+		}
+		return putNotification(tx.Bucket(bucketNotifications), k.bytes(), rec)
+	})
+}
+
+// putNotification добавляет уведомление записи rec в индекс; записи без уведомления не индексируются.
+func putNotification(index *bolt.Bucket, key []byte, rec Record) error {
+	if rec.ChatID == 0 || rec.MessageID == 0 {
+		return nil
+	}
+	return index.Put(notificationKey(rec.ChatID, rec.MessageID), key)
+}
+
+// FindNotification ищет письмо, о котором отправлено уведомление messageID в чат chatID.
+// Запись ищется по индексу уведомлений; если с тех пор запись удалена или о письме
+// отправлено другое уведомление, письмо не находится.
+func (s *Store) FindNotification(chatID int64, messageID int) (Key, Record, bool, error) {
+	var key Key
+	var rec Record
+	var found bool
+	err := s.db.View(func(tx *bolt.Tx) error {
+		k := tx.Bucket(bucketNotifications).Get(notificationKey(chatID, messageID))
+		if k == nil {
+			return nil
+		}
+		v := tx.Bucket(bucketProcessed).Get(k)
+		if v == nil {
+			return nil
+		}
+		if err := json.Unmarshal(v, &rec); err != nil {
+			return err
+		}
+		if rec.ChatID != chatID || rec.MessageID != messageID {
+			return nil
+		}
+		key, found = parseKey(k)
+		return nil
+	})
+	return key, rec, found, err
+}
+
+// CheckUIDValidity сверяет UIDVALIDITY папки с сохранённым значением.
+// При первом обращении значение просто запоминается. При смене все записи папки,
+// привязанные к прежним UID, удаляются; те из них, у которых известен Message-ID,
+// перекладываются в индекс пересинхронизации (см. TakeResync).
+func (s *Store) CheckUIDValidity(account, mailbox string, uidValidity uint32) (prev uint32, changed bool, err error) {
+	prefix := mailboxPrefix(account, mailbox)
+	mbKey := []byte(account + "\x00" + mailbox)
+	err = s.db.Update(func(tx *bolt.Tx) error {
+		mailboxes := tx.Bucket(bucketMailboxes)
+		if v := mailboxes.Get(mbKey); v != nil {
+			var rec mailboxRecord
+			if err := json.Unmarshal(v, &rec); err != nil {
+				return err
+			}
+			prev = rec.UIDValidity
+		}
+		if prev == uidValidity {
+			return nil
+		}
+		v, err := json.Marshal(mailboxRecord{UIDValidity: uidValidity})
+		if err != nil {
+			return err
+		}
+		if err := mailboxes.Put(mbKey, v); err != nil {
+			return err
+		}
+		if prev == 0 {
+			return nil
+		}
+		changed = true
+
+		resync := tx.Bucket(bucketResync)
+		if err := deletePrefix(resync, prefix); err != nil {
+			return err
+		}
+		processed, index := tx.Bucket(bucketProcessed), tx.Bucket(bucketNotifications)
+		c := processed.Cursor()
+		for k, v := c.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix); k, v = c.Seek(prefix) {
+			var rec Record
+			if err := json.Unmarshal(v, &rec); err == nil {
+				if rec.EmailMessageID != "" {
+					if err := resync.Put(append(append([]byte{}, prefix...), rec.EmailMessageID...), v); err != nil {
+						return err
+					}
+				}
+				// Запись вернётся в индекс под новым UID, когда её заберёт TakeResync и сохранит MarkProcessed
+				if rec.ChatID != 0 && rec.MessageID != 0 {
+					if err := index.Delete(notificationKey(rec.ChatID, rec.MessageID)); err != nil {
+						return err
+					}
+				}
+			}
+			if err := processed.Delete(k); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	return prev, changed, err
+}
+
+// TakeResync извлекает (и удаляет) запись прежнего поколения UID по Message-ID письма.
+func (s *Store) TakeResync(account, mailbox, emailMessageID string) (Record, bool, error) {
+	var rec Record
+	var found bool
+	if emailMessageID == "" {
+		return rec, false, nil
+	}
+	key := append(mailboxPrefix(account, mailbox), emailMessageID...)
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(bucketResync)
+		v := b.Get(key)
+		if v == nil {
+			return nil
+		}
+		if err := json.Unmarshal(v, &rec); err != nil {
+			return err
+		}
+		found = true
+		return b.Delete(key)
+	})
+	return rec, found, err
+}
+
+// PruneProcessed удаляет записи папки account/mailbox, обработанные раньше before, вместе с их
+// уведомлениями в индексе, а также записи пересинхронизации старше before — письма, так и не
+// найденные под новым UID. Записи писем с UID из keep остаются: это непрочитанные письма папки,
+// без записи они пришли бы повторно. Возвращает число удалённых записей.
+func (s *Store) PruneProcessed(account, mailbox string, before time.Time, keep []int) (int, error) {
+	prefix := mailboxPrefix(account, mailbox)
+	kept := make(map[int]bool, len(keep))
+	for _, uid := range keep {
+		kept[uid] = true
+	}
+	pruned := 0
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		processed, index := tx.Bucket(bucketProcessed), tx.Bucket(bucketNotifications)
+		var stale [][]byte
+		c := processed.Cursor()
+		for k, v := c.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix); k, v = c.Next() {
+			key, ok := parseKey(k)
+			if ok && kept[key.UID] {
+				continue
+			}
+			var rec Record
+			if err := json.Unmarshal(v, &rec); err == nil {
+				if !rec.ProcessedAt.Before(before) {
+					continue
+				}
+				if rec.ChatID != 0 && rec.MessageID != 0 {
+					// Индекс мог перейти к более новой записи того же уведомления — её не трогаем
+					nk := notificationKey(rec.ChatID, rec.MessageID)
+					if bytes.Equal(index.Get(nk), k) {
+						if err := index.Delete(nk); err != nil {
+							return err
+						}
+					}
+				}
+			}
+			stale = append(stale, append([]byte(nil), k...))
+		}
+		resync := tx.Bucket(bucketResync)
+		var staleResync [][]byte
+		c = resync.Cursor()
+		for k, v := c.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix); k, v = c.Next() {
+			var rec Record
+			if err := json.Unmarshal(v, &rec); err == nil && !rec.ProcessedAt.Before(before) {
+				continue
+			}
+			staleResync = append(staleResync, append([]byte(nil), k...))
+		}
+		// Ключи удаляются после обхода: удаление под курсором сбивает его позицию
+		for _, k := range stale {
+			if err := processed.Delete(k); err != nil {
+				return err
+			}
+		}
+		for _, k := range staleResync {
+			if err := resync.Delete(k); err != nil {
+				return err
+			}
+		}
+		pruned = len(stale) + len(staleResync)
+		return nil
+	})
+	return pruned, err
+}
+
+// deletePrefix удаляет из бакета все ключи с заданным префиксом.
+func deletePrefix(b *bolt.Bucket, prefix []byte) error {
+	c := b.Cursor()
+	for k, _ := c.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix); k, _ = c.Seek(prefix) {
+		if err := b.Delete(k); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// OAuthRecord — последний выданный провайдером refresh token аккаунта.
+type OAuthRecord struct {
+	RefreshToken string `json:"refresh_token"`
+	// Seed — отпечаток refresh token из конфигурации, от которого получен RefreshToken.
+	// Если в конфигурации указан другой токен (пользователь заново выдал доступ), запись устарела.
+	Seed      string    `json:"seed"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+// OAuthToken возвращает сохранённый refresh token аккаунта.
+func (s *Store) OAuthToken(account string) (OAuthRecord, bool, error) {
+	var rec OAuthRecord
+	var found bool
+	err := s.db.View(func(tx *bolt.Tx) error {
+		v := tx.Bucket(bucketOAuth).Get([]byte(account))
+		if v == nil {
+			return nil
+		}
+		found = true
+		return json.Unmarshal(v, &rec)
+	})
+	return rec, found, err
+}
+
+// SaveOAuthToken сохраняет refresh token аккаунта.
+func (s *Store) SaveOAuthToken(account string, rec OAuthRecord) error {
+	if rec.UpdatedAt.IsZero() {
+		rec.UpdatedAt = time.Now()
+	}
+	v, err := json.Marshal(rec)
+	if err != nil {
+		return err
+	}
+	return s.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(bucketOAuth).Put([]byte(account), v)
+	})
+}
+
+// Snooze — письмо, отложенное до Until: к этому времени оно снова становится непрочитанным
+// и о нём отправляется новое уведомление.
+type Snooze struct {
+	// Account — StateID аккаунта (в записях прежних версий — имя аккаунта из конфигурации)
+	Account string `json:"account"`
+	// Mailbox, UIDValidity, UID — письмо в исходной папке; UID = 0 — искать по EmailMessageID
+	Mailbox     string `json:"mailbox"`
+	UIDValidity uint32 `json:"uid_validity"`
+	UID         int    `json:"uid"`
+	// Parked — папка, куда письмо перенесено на время откладывания; пусто — письмо
+	// осталось в Mailbox и помечено прочитанным
+	Parked         string    `json:"parked,omitempty"`
+	EmailMessageID string    `json:"email_message_id,omitempty"`
+	Until          time.Time `json:"until"`
+	// ID — ключ записи; назначается SaveSnooze и сохраняется при обновлении записи
+	ID string `json:"-"`
+}
+
+// SaveSnooze сохраняет (или обновляет, если задан ID) отложенное письмо и возвращает ключ записи.
+func (s *Store) SaveSnooze(sn Snooze) (string, error) {
+	if sn.ID == "" {
+		sn.ID = string(Key{Account: sn.Account, Mailbox: sn.Mailbox, UIDValidity: sn.UIDValidity, UID: sn.UID}.bytes())
+	}
+	v, err := json.Marshal(sn)
+	if err != nil {
+		return "", err
+	}
+	err = s.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(bucketSnooze).Put([]byte(sn.ID), v)
+	})
+	return sn.ID, err
+}
+
+// Snoozes возвращает все отложенные письма.
+func (s *Store) Snoozes() ([]Snooze, error) {
+	var out []Snooze
+	err := s.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(bucketSnooze).ForEach(func(k, v []byte) error {
+			var sn Snooze
+			if err := json.Unmarshal(v, &sn); err != nil {
+				return err
+			}
+			sn.ID = string(k)
+			out = append(out, sn)
+			return nil
+		})
+	})
+	return out, err
+}
+
+// DeleteSnooze удаляет запись об отложенном письме.
+func (s *Store) DeleteSnooze(id string) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(bucketSnooze).Delete([]byte(id))
+	})
+}
@@ -0,0 +1,215 @@
+package state
+
+import (
+	"encoding/json"
+	"path/filepath"
+	"testing"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+func openStore(t *testing.T, dir string) *Store {
+	t.Helper()
+	st, err := Open(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = st.Close() })
+	return st
+}
+
+func TestFindNotification(t *testing.T) {
+	st := openStore(t, t.TempDir())
+	k := Key{Account: "user@imap.example.com", Mailbox: "INBOX", UIDValidity: 7, UID: 42}
+	if err := st.MarkProcessed(k, Record{ChatID: -100, MessageID: 5, EmailMessageID: "<a@example.com>"}); err != nil {
+		t.Fatal(err)
+	}
+	// Письмо без уведомления в индекс не попадает
+	if err := st.MarkProcessed(Key{Account: k.Account, Mailbox: "INBOX", UIDValidity: 7, UID: 43}, Record{}); err != nil {
+		t.Fatal(err)
+	}
+
+	got, rec, found, err := st.FindNotification(-100, 5)
+	if err != nil || !found {
+		t.Fatalf("FindNotification = found %t, err %v", found, err)
+	}
+	if got != k || rec.EmailMessageID != "<a@example.com>" {
+		t.Fatalf("FindNotification = %+v %+v, want %+v", got, rec, k)
+	}
+	if _, _, found, _ := st.FindNotification(-100, 6); found {
+		t.Fatal("found a notification that was never sent")
+	}
+	if _, _, found, _ := st.FindNotification(0, 0); found {
+		t.Fatal("found the record of an email skipped without a notification")
+	}
+
+	// О письме отправлено новое уведомление: старое больше не ведёт к письму
+	if err := st.MarkProcessed(k, Record{ChatID: -100, MessageID: 9}); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, found, _ := st.FindNotification(-100, 5); found {
+		t.Fatal("stale notification still resolves")
+	}
+	if got, _, found, _ := st.FindNotification(-100, 9); !found || got != k {
+		t.Fatalf("new notification: found %t key %+v", found, got)
+	}
+}
+
+func TestFindNotificationAfterUIDValidityChange(t *testing.T) {
+	st := openStore(t, t.TempDir())
+	k := Key{Account: "acc", Mailbox: "INBOX", UIDValidity: 1, UID: 10}
+	if _, _, err := st.CheckUIDValidity(k.Account, k.Mailbox, 1); err != nil {
+		t.Fatal(err)
+	}
+	if err := st.MarkProcessed(k, Record{ChatID: 1, MessageID: 2, EmailMessageID: "<m@example.com>"}); err != nil {
+		t.Fatal(err)
+	}
+	if _, changed, err := st.CheckUIDValidity(k.Account, k.Mailbox, 2); err != nil || !changed {
+		t.Fatalf("CheckUIDValidity: changed %t, err %v", changed, err)
+	}
+	if _, _, found, _ := st.FindNotification(1, 2); found {
+		t.Fatal("notification resolves to a record of the old UID generation")
+	}
+
+	// Письмо найдено под новым UID: уведомление снова ведёт к нему
+	rec, ok, err := st.TakeResync(k.Account, k.Mailbox, "<m@example.com>")
+	if err != nil || !ok {
+		t.Fatalf("TakeResync: ok %t, err %v", ok, err)
+	}
+	moved := Key{Account: "acc", Mailbox: "INBOX", UIDValidity: 2, UID: 3}
+	if err := st.MarkProcessed(moved, rec); err != nil {
+		t.Fatal(err)
+	}
+	if got, _, found, _ := st.FindNotification(1, 2); !found || got != moved {
+		t.Fatalf("after resync: found %t key %+v, want %+v", found, got, moved)
+	}
+}
+
+func TestNotificationIndexMigration(t *testing.T) {
+	// База прежней версии: записи есть, индекса уведомлений нет
+	dir := t.TempDir()
+	db, err := bolt.Open(filepath.Join(dir, FileName), 0o600, &bolt.Options{Timeout: time.Second})
+	if err != nil {
+		t.Fatal(err)
+	}
+	k := Key{Account: "acc", Mailbox: "Work", UIDValidity: 5, UID: 77}
+	err = db.Update(func(tx *bolt.Tx) error {
+		b, err := tx.CreateBucket(bucketProcessed)
+		if err != nil {
+			return err
+		}
+		v, err := json.Marshal(Record{ChatID: 123, MessageID: 456, ProcessedAt: time.Now()})
+		if err != nil {
+			return err
+		}
+		return b.Put(k.bytes(), v)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	st := openStore(t, dir)
+	if got, _, found, err := st.FindNotification(123, 456); err != nil || !found || got != k {
+		t.Fatalf("after migration: found %t key %+v err %v, want %+v", found, got, err, k)
+	}
+}
+
+func TestPruneProcessed(t *testing.T) {
+	st := openStore(t, t.TempDir())
+	now := time.Now()
+	old, fresh := now.Add(-40*24*time.Hour), now.Add(-time.Hour)
+	key := func(mailbox string, uid int) Key {
+		return Key{Account: "acc", Mailbox: mailbox, UIDValidity: 1, UID: uid}
+	}
+	records := []struct {
+		key Key
+		rec Record
+	}{
+		{key("INBOX", 1), Record{ChatID: 1, MessageID: 11, ProcessedAt: old}},
+		{key("INBOX", 2), Record{ChatID: 1, MessageID: 12, ProcessedAt: old}},
+		{key("INBOX", 3), Record{ChatID: 1, MessageID: 13, ProcessedAt: fresh}},
+		{key("INBOX", 4), Record{ProcessedAt: old}},
+		{key("Archive", 1), Record{ChatID: 1, MessageID: 21, ProcessedAt: old}},
+	}
+	for _, r := range records {
+		if _, _, err := st.CheckUIDValidity(r.key.Account, r.key.Mailbox, 1); err != nil {
+			t.Fatal(err)
+		}
+		if err := st.MarkProcessed(r.key, r.rec); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Старая запись прежнего поколения UID, письмо под новым UID так и не нашлось
+	if err := st.MarkProcessed(key("Sent", 5), Record{EmailMessageID: "<gone@example.com>", ProcessedAt: old}); err != nil {
+		t.Fatal(err)
+	}
+	if err := st.MarkProcessed(key("Sent", 6), Record{EmailMessageID: "<recent@example.com>", ProcessedAt: fresh}); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := st.CheckUIDValidity("acc", "Sent", 1); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := st.CheckUIDValidity("acc", "Sent", 2); err != nil {
+		t.Fatal(err)
+	}
+
+	before := now.Add(-30 * 24 * time.Hour)
+	// UID 2 ещё не прочитан: его запись остаётся, иначе письмо пришло бы повторно
+	n, err := st.PruneProcessed("acc", "INBOX", before, []int{2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 2 {
+		t.Errorf("pruned %d INBOX records, want 2", n)
+	}
+	for _, tc := range []struct {
+		key  Key
+		kept bool
+	}{
+		{key("INBOX", 1), false},
+		{key("INBOX", 2), true},
+		{key("INBOX", 3), true},
+		{key("INBOX", 4), false},
+		{key("Archive", 1), true},
+	} {
+		if _, found, err := st.Processed(tc.key); err != nil || found != tc.kept {
+			t.Errorf("Processed(%s uid %d) = found %t, err %v; want %t", tc.key.Mailbox, tc.key.UID, found, err, tc.kept)
+		}
+	}
+	for _, tc := range []struct {
+		msgID int
+		found bool
+	}{
+		{11, false},
+		{12, true},
+		{13, true},
+		{21, true},
+	} {
+		if _, _, found, err := st.FindNotification(1, tc.msgID); err != nil || found != tc.found {
+			t.Errorf("FindNotification(1, %d) = found %t, err %v; want %t", tc.msgID, found, err, tc.found)
+		}
+	}
+	err = st.db.View(func(tx *bolt.Tx) error {
+		if v := tx.Bucket(bucketNotifications).Get(notificationKey(1, 11)); v != nil {
+			t.Errorf("index still holds the pruned notification -> %q", v)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if n, err := st.PruneProcessed("acc", "Sent", before, nil); err != nil || n != 1 {
+		t.Fatalf("PruneProcessed(Sent) = %d, %v; want 1 resync record", n, err)
+	}
+	if _, ok, _ := st.TakeResync("acc", "Sent", "<gone@example.com>"); ok {
+		t.Error("stale resync record survived pruning")
+	}
+	if _, ok, _ := st.TakeResync("acc", "Sent", "<recent@example.com>"); !ok {
+		t.Error("recent resync record was pruned")
+	}
+}
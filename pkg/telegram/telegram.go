@@ -1,31 +1,108 @@
 package telegram
 
 import (
+    "errors"
     "fmt"
     "html"
+    "io"
+    "net/http"
+    "time"
 
     telegram "github.com/go-telegram-bot-api/telegram-bot-api/v5"
 )
 
-func SendMessage(bot *telegram.BotAPI, chatID int64, subject, fromName, fromAddress, viewURL string, markCallbackData string) (int, error) {
-    if fromName == "" {
-        fromName = "Unknown sender"
-    }
-    if fromAddress == "" {
-        fromAddress = "unknown@unknown"
-    }
-    // Формирование текста сообщения на основе реальных полей письма
-    subjectEsc := html.EscapeString(subject)
-    fromNameEsc := html.EscapeString(fromName)
-    fromAddressEsc := html.EscapeString(fromAddress)
-    text := fmt.Sprintf("%s\n%s\n\nA new email has arrived from this address: %s\n\n🌐 A secret HTML page has been created for it, where you can preview the message by following the link below 👇", subjectEsc, fromNameEsc, fromAddressEsc)
-    btnView := telegram.NewInlineKeyboardButtonURL("Open html", viewURL)
-    btnMark := telegram.NewInlineKeyboardButtonData("Mark as read", markCallbackData)
-    markup := telegram.NewInlineKeyboardMarkup(
-        telegram.NewInlineKeyboardRow(btnView, btnMark),
-    )
+// MessageText формирует текст уведомления о письме (HTML) по шаблону t; nil — DefaultTemplate.
+// Текст укладывается в предел Telegram с запасом под строки о состоянии письма: сначала
+// сокращается анонс, затем тема и остальные поля.
+func MessageText(t *Template, n Notification) string {
+    if t == nil {
+        t = defaultTemplate
+    }
+    if n.FromName == "" {
+        n.FromName = "Unknown sender"
+    }
+    if n.FromAddress == "" {
+        n.FromAddress = "unknown@unknown"
+    }
+    limit := MaxMessageLength - messageReserve
+    fields := []*string{&n.Preview, &n.Subject, &n.FromName, &n.Recipients, &n.Folder, &n.FromAddress}
+    for {
+        text, err := t.render(n)
+        if err != nil {
+            // Шаблон проверен при загрузке конфигурации; на случай ошибки — шаблон по умолчанию
+            if t == defaultTemplate {
+                return html.EscapeString(n.Subject)
+            }
+            t = defaultTemplate
+            continue
+        }
+        over := textLength(text) - limit
+        if over <= 0 {
+            return text
+        }
+        shortened := false
+        for _, f := range fields {
+            if *f != "" {
+                *f = shorten(*f, over)
+                shortened = true
+                break
+            }
+        }
+        if !shortened {
+            return text
+        }
+    }
+}
+
+// Button — кнопка с callback data.
+type Button struct {
+    Text string
+    Data string
+}
+
+// Keyboard — кнопки уведомления: ссылка на страницу viewer, "Mark as read", флаг и ряды действий.
+type Keyboard struct {
+    ViewURL string
+    // MarkData — callback data кнопки "Mark as read"; пустая — кнопки нет
+    MarkData string
+    // FlagData — callback data кнопки флага; пустая — кнопки нет.
+    // Flagged — письмо помечено: кнопка предлагает снять флаг, иначе — поставить
+    FlagData string
+    Flagged  bool
+    // Rows — ряды кнопок под основной строкой (действия, подменю выбора папки)
+    Rows [][]Button
+}
+
+func (k Keyboard) markup() telegram.InlineKeyboardMarkup {
+    row := telegram.NewInlineKeyboardRow(telegram.NewInlineKeyboardButtonURL("Open html", k.ViewURL))
+    if k.MarkData != "" {
+        row = append(row, telegram.NewInlineKeyboardButtonData("Mark as read", k.MarkData))
+    }
+    if k.FlagData != "" {
+        label := "☆ Flag"
+        if k.Flagged {
+            label = "★ Unflag"
+        }
+        row = append(row, telegram.NewInlineKeyboardButtonData(label, k.FlagData))
+    }
+    rows := [][]telegram.InlineKeyboardButton{row}
+    for _, r := range k.Rows {
+        if len(r) == 0 {
+            continue
+        }
+        var buttons []telegram.InlineKeyboardButton
+        for _, b := range r {
+            buttons = append(buttons, telegram.NewInlineKeyboardButtonData(b.Text, b.Data))
+        }
+        rows = append(rows, buttons)
+    }
+    return telegram.NewInlineKeyboardMarkup(rows...)
+}
+
+// SendMessage отправляет уведомление о письме: text — MessageText, при необходимости со строками о состоянии письма.
+func SendMessage(bot *telegram.BotAPI, chatID int64, text string, kb Keyboard) (int, error) {
 	msg := telegram.NewMessage(chatID, text)
-	msg.ReplyMarkup = markup
+	msg.ReplyMarkup = kb.markup()
 	msg.DisableWebPagePreview = true
 	msg.ParseMode = "HTML"
 	sent, err := bot.Send(msg)
@@ -35,6 +112,159 @@ func SendMessage(bot *telegram.BotAPI, chatID int64, subject, fromName, fromAddr
 	return sent.MessageID, nil
 }
 
+// EditMessage заменяет текст (HTML) и кнопки отправленного уведомления.
+func EditMessage(bot *telegram.BotAPI, chatID int64, messageID int, text string, kb Keyboard) error {
+    edit := telegram.NewEditMessageTextAndMarkup(chatID, messageID, text, kb.markup())
+    edit.ParseMode = "HTML"
+    edit.DisableWebPagePreview = true
+    _, err := bot.Request(edit)
+    return err
+}
+
+// EditKeyboard заменяет только кнопки отправленного уведомления.
+func EditKeyboard(bot *telegram.BotAPI, chatID int64, messageID int, kb Keyboard) error {
+    edit := telegram.NewEditMessageReplyMarkup(chatID, messageID, kb.markup())
+    _, err := bot.Request(edit)
+    return err
+}
+
+// SendReply отправляет короткий служебный ответ (обычный текст) на сообщение replyTo в чате.
+func SendReply(bot *telegram.BotAPI, chatID int64, replyTo int, text string) error {
+    msg := telegram.NewMessage(chatID, text)
+    msg.ReplyToMessageID = replyTo
+    msg.DisableWebPagePreview = true
+    _, err := bot.Send(msg)
+    return err
+}
+
+// SendPrompt отправляет вопрос с принудительным ответом (ForceReply): клиент Telegram сразу
+// открывает ответ на это сообщение. placeholder — подсказка в поле ввода.
+func SendPrompt(bot *telegram.BotAPI, chatID int64, replyTo int, text, placeholder string) (int, error) {
+    msg := telegram.NewMessage(chatID, text)
+    msg.ReplyToMessageID = replyTo
+    msg.ReplyMarkup = telegram.ForceReply{ForceReply: true, Selective: true, InputFieldPlaceholder: placeholder}
+    sent, err := bot.Send(msg)
+    if err != nil {
+        return 0, err
+    }
+    return sent.MessageID, nil
+}
+
+// SendButtons отправляет служебное сообщение (HTML) с рядами кнопок, без ссылки на страницу viewer.
+func SendButtons(bot *telegram.BotAPI, chatID int64, text string, rows [][]Button) (int, error) {
+    msg := telegram.NewMessage(chatID, text)
+    msg.ParseMode = "HTML"
+    msg.DisableWebPagePreview = true
+    var kb [][]telegram.InlineKeyboardButton
+    for _, r := range rows {
+        var buttons []telegram.InlineKeyboardButton
+        for _, b := range r {
+            buttons = append(buttons, telegram.NewInlineKeyboardButtonData(b.Text, b.Data))
+        }
+        kb = append(kb, buttons)
+    }
+    if len(kb) > 0 {
+        msg.ReplyMarkup = telegram.NewInlineKeyboardMarkup(kb...)
+    }
+    sent, err := bot.Send(msg)
+    if err != nil {
+        return 0, err
+    }
+    return sent.MessageID, nil
+}
+
+// EditText заменяет текст (HTML) сообщения и убирает его кнопки.
+func EditText(bot *telegram.BotAPI, chatID int64, messageID int, text string) error {
+    edit := telegram.NewEditMessageText(chatID, messageID, text)
+    edit.ParseMode = "HTML"
+    edit.DisableWebPagePreview = true
+    _, err := bot.Request(edit)
+    return err
+}
+
+// Document — файл для отправки в чат.
+type Document struct {
+    Name string
+    Data []byte
+}
+
+// MaxAlbumSize — сколько файлов Telegram принимает в одном альбоме (sendMediaGroup).
+const MaxAlbumSize = 10
+
+// SendDocuments отправляет файлы ответом на сообщение replyTo: один — документом,
+// от двух до MaxAlbumSize — альбомом документов.
+func SendDocuments(bot *telegram.BotAPI, chatID int64, replyTo int, docs []Document) error {
+    switch {
+    case len(docs) == 0:
+        return nil
+    case len(docs) > MaxAlbumSize:
+        return fmt.Errorf("telegram: at most %d documents per album, got %d", MaxAlbumSize, len(docs))
+    case len(docs) == 1:
+        msg := telegram.NewDocument(chatID, telegram.FileBytes{Name: docs[0].Name, Bytes: docs[0].Data})
+        msg.ReplyToMessageID = replyTo
+        msg.DisableNotification = true
+        _, err := bot.Send(msg)
+        return err
+    }
+    media := make([]interface{}, len(docs))
+    for i, d := range docs {
+        media[i] = telegram.NewInputMediaDocument(telegram.FileBytes{Name: d.Name, Bytes: d.Data})
+    }
+    group := telegram.NewMediaGroup(chatID, media)
+    group.ReplyToMessageID = replyTo
+    group.DisableNotification = true
+    _, err := bot.SendMediaGroup(group)
+    return err
+}
+
+// SendLink отправляет ответом на сообщение replyTo текст (HTML) с одной кнопкой-ссылкой.
+func SendLink(bot *telegram.BotAPI, chatID int64, replyTo int, text, label, url string) error {
+    msg := telegram.NewMessage(chatID, text)
+    msg.ReplyToMessageID = replyTo
+    msg.ParseMode = "HTML"
+    msg.DisableWebPagePreview = true
+    msg.DisableNotification = true
+    msg.ReplyMarkup = telegram.NewInlineKeyboardMarkup(telegram.NewInlineKeyboardRow(telegram.NewInlineKeyboardButtonURL(label, url)))
+    _, err := bot.Send(msg)
+    return err
+}
+
+// ErrFileTooLarge — файл больше допустимого размера.
+var ErrFileTooLarge = errors.New("telegram: file is too large")
+
+// downloadTimeout ограничивает загрузку одного файла с серверов Telegram
+const downloadTimeout = 2 * time.Minute
+
+// DownloadFile загружает файл, присланный боту, не больше limit байт.
+// Bot API отдаёт ботам файлы размером до 20 МБ.
+func DownloadFile(bot *telegram.BotAPI, fileID string, limit int64) ([]byte, error) {
+    // URL содержит токен бота: в ошибки и лог он не попадает
+    url, err := bot.GetFileDirectURL(fileID)
+    if err != nil {
+        return nil, err
+    }
+    client := &http.Client{Timeout: downloadTimeout}
+    resp, err := client.Get(url)
+    if err != nil {
+        return nil, errors.New("telegram: file download failed")
+    }
+    defer resp.Body.Close()
+    if resp.StatusCode != http.StatusOK {
+        return nil, fmt.Errorf("telegram: file download failed: status %d", resp.StatusCode)
+    }
+    if resp.ContentLength > limit {
+        return nil, ErrFileTooLarge
+    }
+    data, err := io.ReadAll(io.LimitReader(resp.Body, limit+1))
+    if err != nil {
+        return nil, errors.New("telegram: file download failed")
+    }
+    if int64(len(data)) > limit {
+        return nil, ErrFileTooLarge
+    }
+    return data, nil
+}
+
 func DeleteMessage(bot *telegram.BotAPI, chatID int64, messageID int) error {
 	cfg := telegram.DeleteMessageConfig{ChatID: chatID, MessageID: messageID}
 	_, err := bot.Request(cfg)
@@ -0,0 +1,102 @@
+package telegram
+
+import (
+	"fmt"
+	"html"
+	"html/template"
+	"regexp"
+	"strings"
+	"time"
+	"unicode/utf16"
+)
+
+// MaxMessageLength — предел Telegram для текста сообщения (в UTF-16 символах после разбора HTML).
+const MaxMessageLength = 4096
+
+// messageReserve — место под строки, которые добавляются к уведомлению позже:
+// пометка об отложенном письме, «⭐ Flagged», результат действия с письмом.
+const messageReserve = 256
+
+// DefaultTemplate — шаблон уведомления о письме по умолчанию.
+const DefaultTemplate = `{{if .Folder}}📁 <b>{{.Folder}}</b>
+{{end}}<b>{{.Subject}}</b>
+{{.FromName}} &lt;{{.FromAddress}}&gt;
+{{- if .Recipients}}
+👥 To: {{.Recipients}}{{end}}
+{{- if .Preview}}
+
+{{.Preview}}{{end}}`
+
+// Notification — данные уведомления о письме для шаблона. Строки — обычный текст:
+// шаблон (html/template) сам экранирует их для HTML Telegram.
+type Notification struct {
+	// Folder — подпись папки-источника; пустая, когда отслеживается единственная папка
+	Folder      string
+	Subject     string
+	FromName    string
+	FromAddress string
+	// Recipients — краткий список получателей ("you + 4 others"); пустой — письмо только вам
+	Recipients string
+	// Preview — анонс текста письма (email.PreviewText); пустой — анонс выключен или текста нет
+	Preview string
+	Date    time.Time
+}
+
+// Template — шаблон уведомления о письме.
+type Template struct {
+	t *template.Template
+}
+
+// ParseTemplate разбирает шаблон уведомления (синтаксис Go html/template, поля — Notification)
+// и проверяет его на примере письма: неизвестные поля и слишком длинный текст — ошибки.
+func ParseTemplate(text string) (*Template, error) {
+	t, err := template.New("message").Parse(text)
+	if err != nil {
+		return nil, err
+	}
+	tmpl := &Template{t: t}
+	out, err := tmpl.render(Notification{Folder: "INBOX", Subject: "Subject", FromName: "Sender", FromAddress: "sender@example.com", Recipients: "you + 1 other", Date: time.Now()})
+	if err != nil {
+		return nil, err
+	}
+	if strings.TrimSpace(out) == "" {
+		return nil, fmt.Errorf("template renders an empty message")
+	}
+	if n := textLength(out); n > MaxMessageLength-messageReserve {
+		return nil, fmt.Errorf("template renders %d characters without the preview, Telegram allows %d", n, MaxMessageLength-messageReserve)
+	}
+	return tmpl, nil
+}
+
+var defaultTemplate = func() *Template {
+	t, err := ParseTemplate(DefaultTemplate)
+	if err != nil {
+		panic(err)
+	}
+	return t
+}()
+
+func (t *Template) render(n Notification) (string, error) {
+	var b strings.Builder
+	if err := t.t.Execute(&b, n); err != nil {
+		return "", err
+	}
+	return b.String(), nil
+}
+
+// tagRe — теги HTML Telegram, не входящие в длину сообщения
+var tagRe = regexp.MustCompile(`<[^>]*>`)
+
+// textLength — длина сообщения так, как её считает Telegram: без тегов, с раскрытыми сущностями, в UTF-16.
+func textLength(s string) int {
+	return len(utf16.Encode([]rune(html.UnescapeString(tagRe.ReplaceAllString(s, "")))))
+}
+
+// shorten обрезает s на n символов с конца, заменяя хвост на «…».
+func shorten(s string, n int) string {
+	r := []rune(s)
+	if n >= len(r) {
+		return ""
+	}
+	return strings.TrimRight(string(r[:len(r)-n-1]), " ") + "…"
+}
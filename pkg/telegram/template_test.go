@@ -0,0 +1,134 @@
+package telegram
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseTemplate(t *testing.T) {
+	tests := []struct {
+		name, text string
+		wantErr    string
+	}{
+		{name: "default", text: DefaultTemplate},
+		{name: "custom", text: `✉️ {{.Subject}} — {{.FromAddress}} {{.Date.Format "15:04"}}`},
+		{name: "syntax", text: `{{.Subject`, wantErr: "unclosed action"},
+		{name: "unknown field", text: `{{.Sender}}`, wantErr: "can't evaluate field Sender"},
+		{name: "empty output", text: `{{if .Preview}}{{.Preview}}{{end}}`, wantErr: "template renders an empty message"},
+		{name: "too long", text: strings.Repeat("x", MaxMessageLength), wantErr: "Telegram allows"},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			_, err := ParseTemplate(tc.text)
+			if tc.wantErr == "" {
+				if err != nil {
+					t.Fatalf("ParseTemplate: %v", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tc.wantErr) {
+				t.Fatalf("ParseTemplate: err = %v, want it to mention %q", err, tc.wantErr)
+			}
+		})
+	}
+}
+
+func TestMessageText(t *testing.T) {
+	custom, err := ParseTemplate(`{{.FromName}}: {{.Subject}} ({{.Date.Format "2006-01-02"}})`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	date := time.Date(2024, 3, 4, 10, 0, 0, 0, time.UTC)
+	tests := []struct {
+		name string
+		tmpl *Template
+		n    Notification
+		want string
+	}{
+		{
+			name: "default",
+			n:    Notification{Subject: "Report", FromName: "Alice", FromAddress: "alice@example.org", Date: date},
+			want: "<b>Report</b>\nAlice &lt;alice@example.org&gt;",
+		},
+		{
+			name: "all fields",
+			n: Notification{
+				Folder:      "Lists",
+				Subject:     "Weekly",
+				FromName:    "Bob",
+				FromAddress: "bob@example.org",
+				Recipients:  "you + 2 others",
+				Preview:     "Hi all",
+				Date:        date,
+			},
+			// html/template пишет «+» числовой сущностью — Telegram их поддерживает
+			want: "📁 <b>Lists</b>\n<b>Weekly</b>\nBob &lt;bob@example.org&gt;\n👥 To: you &#43; 2 others\n\nHi all",
+		},
+		{
+			name: "escaping and unknown sender",
+			n:    Notification{Subject: "<script>&", Preview: "a < b"},
+			want: "<b>&lt;script&gt;&amp;</b>\nUnknown sender &lt;unknown@unknown&gt;\n\na &lt; b",
+		},
+		{
+			name: "custom template",
+			tmpl: custom,
+			n:    Notification{Subject: "Hi", FromName: "Carol", Date: date},
+			want: "Carol: Hi (2024-03-04)",
+		},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := MessageText(tc.tmpl, tc.n); got != tc.want {
+				t.Errorf("MessageText\n got %q\nwant %q", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestMessageTextLimit(t *testing.T) {
+	limit := MaxMessageLength - messageReserve
+	tests := []struct {
+		name string
+		n    Notification
+		// keep — поле, которое должно остаться целым: сокращается сначала анонс, потом тема
+		keep string
+	}{
+		{
+			name: "long preview",
+			n:    Notification{Subject: "Short subject", FromName: "A", FromAddress: "a@example.org", Preview: strings.Repeat("слово ", 2000)},
+			keep: "Short subject",
+		},
+		{
+			name: "long subject",
+			n:    Notification{Subject: strings.Repeat("S", 5000), FromName: "A", FromAddress: "a@example.org"},
+			keep: "a@example.org",
+		},
+		{
+			// Длина считается в UTF-16, как в Telegram: эмодзи — два символа
+			name: "utf-16",
+			n:    Notification{Subject: "Emoji", FromName: "A", FromAddress: "a@example.org", Preview: strings.Repeat("😀", 3000)},
+			keep: "Emoji",
+		},
+		{
+			// Сущности HTML считаются одним символом
+			name: "entities",
+			n:    Notification{Subject: "Amp", FromName: "A", FromAddress: "a@example.org", Preview: strings.Repeat("&", 5000)},
+			keep: "Amp",
+		},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			got := MessageText(nil, tc.n)
+			if n := textLength(got); n > limit {
+				t.Errorf("message is %d characters long, limit %d", n, limit)
+			}
+			if !strings.Contains(got, tc.keep) {
+				t.Errorf("message lost %q", tc.keep)
+			}
+			if !strings.Contains(got, "…") {
+				t.Error("shortened field does not end with …")
+			}
+		})
+	}
+}
@@ -3,15 +3,23 @@ package viewer
 import (
     "crypto/rand"
     "encoding/base64"
+    "encoding/json"
     "errors"
+    "fmt"
+    "html"
+    "io"
     "strings"
     "log"
+    "mime"
     "net/http"
+    "net/url"
     "sync"
     "time"
 
     "github.com/google/uuid"
     "github.com/microcosm-cc/bluemonday"
+
+    "mailpuff/pkg/email"
 )
 
 // Page представляет опубликованную HTML-страницу с контролем срока жизни и просмотров.
@@ -26,6 +34,33 @@ type Page struct {
 	ChatID     int64
 	MessageID  int
 	IMAPUID    int
+	// Account — имя аккаунта (config.Account.Name), к которому относится письмо
+	Account    string
+	// Mailbox — папка, к которой относится IMAPUID
+	Mailbox    string
+	// UIDValidity папки на момент привязки IMAPUID; UID без совпадающего UIDVALIDITY недействителен
+	UIDValidity uint32
+	// Attachments — вложения письма, которые можно скачать по /attachment
+	Attachments []Attachment
+}
+
+// snapshot возвращает копию страницы. Страницы хранилища меняются под Store.mu (SetIMAPRef,
+// SetAttachments), поэтому наружу отдаются только копии, которые можно читать без блокировки.
+func (p *Page) snapshot() *Page {
+    cp := *p
+    cp.Attachments = append([]Attachment(nil), p.Attachments...)
+    return &cp
+}
+
+// Attachment — вложение письма страницы. Содержимое не хранится: его загружает из IMAP
+// функция fetchAttachment, переданная в StartHTTPServer.
+type Attachment struct {
+    // Part — номер части письма (BODY[<part>])
+    Part        string
+    Filename    string
+    ContentType string
+    // Size — примерный размер после декодирования
+    Size int
 }
 
 // OnDeleteCallback вызывается при удалении страницы (по TTL или из-за превышения просмотров).
@@ -158,18 +193,34 @@ func (s *Store) CreatePage(html string, ttl time.Duration, maxViews int) (id, to
 	return uid, tok, nil
 }
 
-// SetIMAPUID привязывает к странице UID письма из IMAP для последующих действий.
-func (s *Store) SetIMAPUID(id string, uid int) bool {
+// SetIMAPRef привязывает к странице письмо из IMAP (аккаунт, папка, UIDVALIDITY папки и UID)
+// для последующих действий.
+func (s *Store) SetIMAPRef(id, account, mailbox string, uidValidity uint32, uid int) bool {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 	p, ok := s.pages[id]
 	if !ok {
 		return false
 	}
+	p.Account = account
+	p.Mailbox = mailbox
+	p.UIDValidity = uidValidity
 	p.IMAPUID = uid
 	return true
 }
 
+// SetAttachments задаёт список вложений, доступных для скачивания со страницы.
+func (s *Store) SetAttachments(id string, atts []Attachment) bool {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    p, ok := s.pages[id]
+    if !ok {
+        return false
+    }
+    p.Attachments = atts
+    return true
+}
+
 // SetMessageRef привязывает к странице информацию о Telegram-сообщении для последующего удаления.
 func (s *Store) SetMessageRef(id string, chatID int64, messageID int) bool {
 	s.mu.Lock()
@@ -213,7 +264,7 @@ func (s *Store) ViewWithReason(id, token string) (html string, ok bool, reason s
     content := p.HTML
     // Колбэк самого первого просмотра
     if firstView && s.onFirstView != nil {
-        go s.onFirstView(p)
+        go s.onFirstView(p.snapshot())
     }
     // Если задан лимит и он превышен — удаляем после этого просмотра
     if p.MaxViews > 0 && p.Views > p.MaxViews {
@@ -233,7 +284,7 @@ func (s *Store) View(id, token string) (html string, ok bool) {
 }
 
 // Authorize проверяет корректность id/token и срок действия без инкремента просмотров.
-// Возвращает страницу при успехе. Возможные reason: "", "not_found", "invalid_token", "expired".
+// Возвращает копию страницы при успехе. Возможные reason: "", "not_found", "invalid_token", "expired".
 func (s *Store) Authorize(id, token string) (p *Page, ok bool, reason string) {
     s.mu.Lock()
     defer s.mu.Unlock()
@@ -253,7 +304,7 @@ func (s *Store) Authorize(id, token string) (p *Page, ok bool, reason string) {
         }
         return nil, false, "expired"
     }
-    return page, true, ""
+    return page.snapshot(), true, ""
 }
 
 // Delete удаляет страницу вручную и вызывает onDelete.
@@ -285,7 +336,12 @@ func (s *Store) getOnDelete() OnDeleteCallback {
 }
 
 // StartHTTPServer запускает простой HTTP-сервер с эндпоинтом /view?id=UUID&token=TOKEN
-func StartHTTPServer(addr string, store *Store, markSeen func(uid int) error) error {
+// markSeen получает страницу целиком, чтобы сверить UIDVALIDITY перед действием над письмом.
+// fetchAttachment (может быть nil) открывает вложение для /attachment; оно копируется в ответ
+// по мере чтения, не собираясь в памяти целиком.
+// health (может быть nil) отдаётся на /healthz в JSON: 200, если всё в порядке, иначе 503.
+// /healthz не требует токена, поэтому отчёт не должен раскрывать имена, адреса и ошибки.
+func StartHTTPServer(addr string, store *Store, markSeen func(p *Page) error, fetchAttachment func(p *Page, a Attachment) (io.Reader, error), health func() (healthy bool, report any)) error {
 	mux := http.NewServeMux()
 	mux.HandleFunc("/view", func(w http.ResponseWriter, r *http.Request) {
 		id := r.URL.Query().Get("id")
@@ -332,7 +388,7 @@ func StartHTTPServer(addr string, store *Store, markSeen func(uid int) error) er
             http.Error(w, "mark action is not configured", http.StatusInternalServerError)
             return
         }
-        if err := markSeen(page.IMAPUID); err != nil {
+        if err := markSeen(page); err != nil {
             log.Printf("mark_read 500 reason=imap_error uid=%d id=%s err=%v", page.IMAPUID, redactID(id), err)
             http.Error(w, "failed to mark as read", http.StatusInternalServerError)
             return
@@ -342,11 +398,106 @@ func StartHTTPServer(addr string, store *Store, markSeen func(uid int) error) er
         _, _ = w.Write([]byte("OK"))
     })
 
+    // /attachments?id=UUID&token=TOKEN — список вложений страницы со ссылками на скачивание
+    mux.HandleFunc("/attachments", func(w http.ResponseWriter, r *http.Request) {
+        id := r.URL.Query().Get("id")
+        tok := r.URL.Query().Get("token")
+        page, ok, reason := store.Authorize(id, tok)
+        if !ok || len(page.Attachments) == 0 {
+            if ok {
+                reason = "no_attachments"
+            }
+            log.Printf("attachments 404 reason=%s ip=%s id=%s", reason, r.RemoteAddr, redactID(id))
+            http.NotFound(w, r)
+            return
+        }
+        w.Header().Set("Content-Type", "text/html; charset=utf-8")
+        _, _ = w.Write([]byte(attachmentsHTML(page)))
+    })
+
+    // /attachment?id=UUID&token=TOKEN&part=N — скачивание вложения; просмотры страницы не расходуются.
+    // Вложение всегда отдаётся файлом (Content-Disposition: attachment), чтобы HTML или SVG
+    // из письма не открывались в браузере на домене viewer.
+    mux.HandleFunc("/attachment", func(w http.ResponseWriter, r *http.Request) {
+        id := r.URL.Query().Get("id")
+        tok := r.URL.Query().Get("token")
+        part := r.URL.Query().Get("part")
+        page, ok, reason := store.Authorize(id, tok)
+        if !ok {
+            log.Printf("attachment 404 reason=%s ip=%s id=%s", reason, r.RemoteAddr, redactID(id))
+            http.NotFound(w, r)
+            return
+        }
+        var att Attachment
+        found := false
+        for _, a := range page.Attachments {
+            if a.Part == part {
+                att, found = a, true
+                break
+            }
+        }
+        if !found {
+            log.Printf("attachment 404 reason=unknown_part ip=%s id=%s part=%q", r.RemoteAddr, redactID(id), part)
+            http.NotFound(w, r)
+            return
+        }
+        if fetchAttachment == nil {
+            log.Printf("attachment 500 reason=handler_not_configured id=%s", redactID(id))
+            http.Error(w, "attachments are not configured", http.StatusInternalServerError)
+            return
+        }
+        body, err := fetchAttachment(page, att)
+        if err != nil {
+            log.Printf("attachment 500 reason=imap_error uid=%d part=%s id=%s err=%v", page.IMAPUID, part, redactID(id), err)
+            http.Error(w, "failed to load attachment", http.StatusInternalServerError)
+            return
+        }
+        ct := att.ContentType
+        if ct == "" {
+            ct = "application/octet-stream"
+        }
+        w.Header().Set("Content-Type", ct)
+        w.Header().Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": att.Filename}))
+        w.Header().Set("X-Content-Type-Options", "nosniff")
+        w.Header().Set("Content-Security-Policy", "sandbox")
+        // Размер после декодирования заранее не известен точно: Content-Length не задаётся
+        n, err := io.Copy(w, body)
+        if err != nil {
+            // Заголовки уже отправлены: клиент получит оборванный файл
+            log.Printf("attachment 500 reason=copy_error uid=%d part=%s size=%d id=%s err=%v", page.IMAPUID, part, n, redactID(id), err)
+            return
+        }
+        log.Printf("attachment ok uid=%d part=%s size=%d id=%s", page.IMAPUID, part, n, redactID(id))
+    })
+
+    if health != nil {
+        mux.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
+            healthy, report := health()
+            w.Header().Set("Content-Type", "application/json")
+            if !healthy {
+                w.WriteHeader(http.StatusServiceUnavailable)
+            }
+            _ = json.NewEncoder(w).Encode(report)
+        })
+    }
+
     server := &http.Server{Addr: addr, Handler: logRequest(mux)}
 	log.Printf("http server listening on %s", addr)
 	return server.ListenAndServe()
 }
 
+// attachmentsHTML — страница со ссылками на вложения; ссылки относительные, с теми же id и token.
+func attachmentsHTML(p *Page) string {
+    var b strings.Builder
+    b.WriteString(`<!DOCTYPE html><html><head><meta charset="utf-8"><meta name="viewport" content="width=device-width, initial-scale=1"><title>Attachments</title></head><body><h3>📎 Attachments</h3><ul>`)
+    for _, a := range p.Attachments {
+        q := url.Values{"id": {p.ID}, "token": {p.Token}, "part": {a.Part}}
+        fmt.Fprintf(&b, `<li><a href="attachment?%s">%s</a> (%s)</li>`, html.EscapeString(q.Encode()), html.EscapeString(a.Filename), email.FormatSize(a.Size))
+    }
+    b.WriteString("</ul></body></html>")
+    return b.String()
+}
+
 // statusRecorder фиксирует HTTP-статус и размер ответа.
 type statusRecorder struct {
     http.ResponseWriter